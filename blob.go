@@ -0,0 +1,388 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// blobPointerSize is the size of the element value pointing to a blob: the id
+// of its first page and the size of the value, in 8 big-endian bytes each.
+// It follows the expiry time of expiring values.
+const blobPointerSize = 16
+
+// pendingBlobFlag is set, along with common.BlobValueFlag, on the leaf inodes
+// whose value is to be written to a blob when the bucket is spilled. Their
+// value is the value itself rather than a pointer. It is never written to a
+// page.
+const pendingBlobFlag = 0x80
+
+// blobPointer locates the value of a blob.
+type blobPointer struct {
+	pgid common.Pgid
+	size uint64
+}
+
+// appendBlobPointer appends the encoding of ptr to dst.
+func appendBlobPointer(dst []byte, ptr blobPointer) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, uint64(ptr.pgid))
+	return binary.BigEndian.AppendUint64(dst, ptr.size)
+}
+
+// readBlobPointer returns the blob pointer of an element value with the given
+// flags, which must have common.BlobValueFlag set and pendingBlobFlag unset.
+func readBlobPointer(v []byte, flags uint32) blobPointer {
+	if (flags & common.ExpiringValueFlag) != 0 {
+		v = v[expirySize:]
+	}
+	if len(v) != blobPointerSize {
+		panic(fmt.Sprintf("corrupted blob pointer: %x", v))
+	}
+	return blobPointer{
+		pgid: common.Pgid(binary.BigEndian.Uint64(v)),
+		size: binary.BigEndian.Uint64(v[8:]),
+	}
+}
+
+// isStoredBlob reports whether an element with the given flags points to a
+// blob written to pages.
+func isStoredBlob(flags uint32) bool {
+	return (flags&common.BlobValueFlag) != 0 && (flags&pendingBlobFlag) == 0
+}
+
+// storesBlob reports whether Bucket.Put stores a value of the given size in a
+// blob.
+func (db *DB) storesBlob(size int) bool {
+	return db.blobThreshold > 0 && size > db.blobThreshold
+}
+
+// blobPageCount returns the number of pages of a blob of the given size.
+func (db *DB) blobPageCount(size uint64) int {
+	n := uint64(common.PageHeaderSize) + size + uint64(db.pageOverhead())
+	return int((n + uint64(db.pageSize) - 1) / uint64(db.pageSize))
+}
+
+// blobRun returns a page header standing for the run of pages of a blob.
+func (db *DB) blobRun(ptr blobPointer) *common.Page {
+	return common.NewPage(ptr.pgid, common.BlobPageFlag, 0, uint32(db.blobPageCount(ptr.size)-1))
+}
+
+// allocateBlob allocates the pages of a blob of the given size. It returns
+// them along with the slice to write the value to.
+func (tx *Tx) allocateBlob(size int) (*common.Page, []byte, error) {
+	p, err := tx.allocate(tx.db.blobPageCount(uint64(size)))
+	if err != nil {
+		return nil, nil, err
+	}
+	p.SetFlags(common.BlobPageFlag)
+	return p, common.UnsafeByteSlice(unsafe.Pointer(p), common.PageHeaderSize, 0, size), nil
+}
+
+// discardBlob releases the pages of a blob allocated by the transaction that
+// is not referenced.
+func (tx *Tx) discardBlob(p *common.Page) {
+	delete(tx.pages, p.Id())
+	tx.freePage(p)
+}
+
+// blob returns the value of the blob ptr points to.
+func (b *Bucket) blob(ptr blobPointer) []byte {
+	p, err := b.checkedPage(ptr.pgid)
+	if err != nil {
+		b.tx.setErr(err)
+		return nil
+	}
+	if !p.IsBlobPage() || b.tx.db.blobPageCount(ptr.size) != int(p.Overflow())+1 {
+		panic(fmt.Sprintf("corrupted blob pointer: page %d of type %s and %d overflow pages holds no value of %d bytes",
+			ptr.pgid, p.Typ(), p.Overflow(), ptr.size))
+	}
+	return common.UnsafeByteSlice(unsafe.Pointer(p), common.PageHeaderSize, 0, int(ptr.size))
+}
+
+// freeBlob releases the pages of the blob an element value points to, if any.
+func (b *Bucket) freeBlob(v []byte, flags uint32) {
+	if !isStoredBlob(flags) {
+		return
+	}
+	b.tx.freePage(b.tx.db.blobRun(readBlobPointer(v, flags)))
+}
+
+// forEachBlob calls fn with the key and the pointer of each value of the
+// bucket stored in a blob, in storage order. Nested buckets are not visited.
+func (b *Bucket) forEachBlob(fn func(key []byte, ptr blobPointer)) {
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if isStoredBlob(flags) {
+			fn(k, readBlobPointer(v, flags))
+		}
+	}
+}
+
+// writeBlobs writes the values of the bucket pending to be stored in blobs to
+// newly allocated pages, and points their elements to them. Nested buckets
+// are not visited.
+func (b *Bucket) writeBlobs() error {
+	nodes := make([]*node, 0, len(b.nodes)+1)
+	if b.rootNode != nil {
+		nodes = append(nodes, b.rootNode)
+	}
+	for _, n := range b.nodes {
+		nodes = append(nodes, n)
+	}
+	for _, n := range nodes {
+		if !n.isLeaf {
+			continue
+		}
+		for i := range n.inodes {
+			inode := &n.inodes[i]
+			if (inode.Flags() & pendingBlobFlag) == 0 {
+				continue
+			}
+			var expiry []byte
+			v := inode.Value()
+			if (inode.Flags() & common.ExpiringValueFlag) != 0 {
+				expiry, v = v[:expirySize], v[expirySize:]
+			}
+			p, data, err := b.tx.allocateBlob(len(v))
+			if err != nil {
+				return err
+			}
+			copy(data, v)
+			stored := append(make([]byte, 0, len(expiry)+blobPointerSize), expiry...)
+			inode.SetValue(appendBlobPointer(stored, blobPointer{pgid: p.Id(), size: uint64(len(v))}))
+			inode.SetFlags(inode.Flags() &^ pendingBlobFlag)
+		}
+	}
+	return nil
+}
+
+// relocateBlob rewrites the blob of a key to new pages on commit, if it is
+// still stored at the given page.
+func (b *Bucket) relocateBlob(key []byte, id common.Pgid) {
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	if !bytes.Equal(key, k) || !isStoredBlob(flags) || readBlobPointer(v, flags).pgid != id {
+		return
+	}
+	stored := append(cloneBytes(v[:len(v)-blobPointerSize]), c.value(v, flags)...)
+	b.freeBlob(v, flags)
+	c.node().put(key, key, stored, 0, flags|pendingBlobFlag)
+}
+
+// GetReader returns a reader of the value of a key, or nil if the key does
+// not exist or is a nested bucket, like Get. The reader is only valid for the
+// life of the transaction, after which it returns ErrTxClosed.
+//
+// A value stored in a blob is read from the pages of the blob as needed, from
+// the memory map, so that it is never held in memory as a whole. The pages
+// of a blob of an encrypted database are decrypted as a whole on first read,
+// and other values are read like Get does.
+func (b *Bucket) GetReader(key []byte) *io.SectionReader {
+	b.tx.opt.read(b, key)
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	if (flags&common.BucketLeafFlag) != 0 || !bytes.Equal(key, k) || b.hidden(k, v, flags) {
+		return nil
+	}
+	if isStoredBlob(flags) {
+		ptr := readBlobPointer(v, flags)
+		return io.NewSectionReader(&blobReader{b: b, ptr: ptr}, 0, int64(ptr.size))
+	}
+	v = c.value(v, flags)
+	return io.NewSectionReader(bytes.NewReader(v), 0, int64(len(v)))
+}
+
+// blobReader reads the value of a blob from its pages.
+type blobReader struct {
+	b   *Bucket
+	ptr blobPointer
+}
+
+// ReadAt implements io.ReaderAt. The pages are looked up on every call, as
+// the memory map may move while the transaction writes.
+func (r *blobReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.b.tx.db == nil {
+		return 0, errors.ErrTxClosed
+	}
+	value := r.b.blob(r.ptr)
+	if value == nil && r.ptr.size > 0 {
+		return 0, r.b.tx.Err()
+	}
+	if off >= int64(len(value)) {
+		return 0, io.EOF
+	}
+	n := copy(p, value[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// PutStream sets the value of a key to the size bytes read from r, stored in
+// a blob whatever Options.BlobThreshold.
+//
+// The value is written to the pages of the blob in the database file as it is
+// read, through a buffer of blobStreamBufferSize bytes, so that it is never
+// held in memory as a whole. This is safe because the pages are only
+// referenced once the transaction is committed. The value is read into memory
+// instead, like Put does, if the database is encrypted or in WAL mode, if it
+// has followers or subscribers, which are sent the value, if the bucket has
+// secondary indexes, or in the transactions of DB.OptimisticUpdate and
+// DB.UpdateBuckets, which do not hold the writer lock.
+//
+// Returns ErrBlobSizeMismatch if r ends before size bytes are read, the
+// error of r if it fails, and the errors of Put otherwise.
+func (b *Bucket) PutStream(key []byte, r io.Reader, size int64) error {
+	if b.tx.db == nil {
+		return errors.ErrTxClosed
+	} else if !b.Writable() {
+		return errors.ErrTxNotWritable
+	} else if len(key) == 0 {
+		return errors.ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return errors.ErrKeyTooLarge
+	} else if size < 0 {
+		return fmt.Errorf("invalid blob size: %d", size)
+	} else if size > MaxValueSize {
+		return errors.ErrValueTooLarge
+	}
+
+	// Transactions which do not hold the writer lock cannot allocate pages,
+	// so the blob is written when their changes are committed.
+	if b.tx.opt != nil || b.tx.scope != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return blobReadError(err)
+		}
+		return b.putValue(key, value, 0, true, nil)
+	}
+
+	stream, err := b.streamsBlob()
+	if err != nil {
+		return err
+	}
+	ptr := blobPointer{size: uint64(size)}
+	if stream {
+		if ptr.pgid, err = b.tx.writeBlob(r, size); err != nil {
+			return err
+		}
+		if err = b.putValue(key, nil, 0, true, &ptr); err != nil {
+			b.tx.freePage(b.tx.db.blobRun(ptr))
+		}
+		return err
+	}
+
+	// Otherwise the value is read into the dirty pages of the blob.
+	p, value, err := b.tx.allocateBlob(int(size))
+	if err != nil {
+		return err
+	}
+	ptr.pgid = p.Id()
+	if _, err = io.ReadFull(r, value); err != nil {
+		err = blobReadError(err)
+	} else {
+		err = b.putValue(key, value, 0, true, &ptr)
+	}
+	if err != nil {
+		b.tx.discardBlob(p)
+	}
+	return err
+}
+
+// blobStreamBufferSize is the size of the buffer PutStream writes the pages
+// of a blob through.
+const blobStreamBufferSize = 256 << 10
+
+// streamsBlob reports whether PutStream writes a blob to the database file as
+// it is read, rather than reading it into memory.
+func (b *Bucket) streamsBlob() (bool, error) {
+	tx := b.tx
+	if tx.db.cipher != nil || tx.db.wal != nil || tx.replica != nil || tx.changes != nil {
+		return false, nil
+	}
+	idxs, err := b.loadIndexes()
+	return len(idxs) == 0, err
+}
+
+// writeBlob allocates the pages of a blob of the given size, and writes the
+// value read from r to them in the database file, along with their header and
+// checksum. The pages are released if r fails. It returns the id of the
+// first page.
+func (tx *Tx) writeBlob(r io.Reader, size int64) (common.Pgid, error) {
+	db := tx.db
+	count := db.blobPageCount(uint64(size))
+	id, err := db.allocateRun(tx.meta.Txid(), count)
+	if err != nil {
+		return 0, err
+	}
+	p := db.blobRun(blobPointer{pgid: id, size: uint64(size)})
+	if err := tx.writeBlobPages(p, r, size); err != nil {
+		tx.freePage(p)
+		return 0, err
+	}
+
+	// Drop the state kept about the previous content of the pages, and
+	// track them like the dirty pages written on commit.
+	db.uncheckPage(id)
+	db.pageTxids.mark(id, count, tx.meta.Txid())
+	tx.stats.IncPageCount(int64(count))
+	tx.stats.IncPageAlloc(int64(count * db.pageSize))
+	return id, nil
+}
+
+// writeBlobPages writes the run of pages of a blob, whose header is p, to the
+// database file, with the value read from r followed by zeros, and the
+// checksum of the run if page checksums are enabled.
+func (tx *Tx) writeBlobPages(p *common.Page, r io.Reader, size int64) error {
+	db := tx.db
+	offset := int64(p.Id()) * int64(db.pageSize)
+	end := (int64(p.Overflow())+1)*int64(db.pageSize) - int64(db.pageOverhead())
+	header := common.UnsafeByteSlice(unsafe.Pointer(p), 0, 0, int(common.PageHeaderSize))
+	valueEnd := int64(common.PageHeaderSize) + size
+
+	buf := make([]byte, min(int64(blobStreamBufferSize), end))
+	var crc uint32
+	for pos := int64(0); pos < end; {
+		chunk := buf[:min(int64(len(buf)), end-pos)]
+		n := 0
+		if pos == 0 {
+			n = copy(chunk, header)
+		}
+		if m := min(int64(len(chunk)), valueEnd-pos); int64(n) < m {
+			if _, err := io.ReadFull(r, chunk[n:m]); err != nil {
+				return blobReadError(err)
+			}
+			n = int(m)
+		}
+		clear(chunk[n:])
+
+		if db.pageChecksums {
+			crc = common.UpdatePageChecksum(crc, chunk)
+		}
+		if _, err := db.ops.writeAt(chunk, offset+pos); err != nil {
+			return err
+		}
+		tx.stats.IncWrite(1)
+		pos += int64(len(chunk))
+	}
+	if db.pageChecksums {
+		sum := binary.LittleEndian.AppendUint32(nil, crc)
+		if _, err := db.ops.writeAt(sum, offset+end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobReadError returns the error of PutStream for an error of io.ReadFull.
+func blobReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.ErrBlobSizeMismatch
+	}
+	return err
+}
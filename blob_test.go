@@ -0,0 +1,544 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// blobValue returns a value of n bytes that differs for each seed.
+func blobValue(seed, n int) []byte {
+	v := make([]byte, n)
+	for i := range v {
+		v[i] = byte(seed + i*7)
+	}
+	return v
+}
+
+// requireBlobStats checks the number of values of a bucket stored in blobs.
+func requireBlobStats(t testing.TB, db *bolt.DB, name string, n int) {
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, n, tx.Bucket([]byte(name)).Stats().BlobValueN)
+		return nil
+	}))
+}
+
+// Ensure that values above the threshold are stored in blobs, and that the
+// pages of the blobs overwritten or deleted are reused.
+func TestBucket_Put_Blob(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 1000})
+	write := func(seed int) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 20; i++ {
+				if err := b.Put([]byte(fmt.Sprint("blob", i)), blobValue(seed+i, 10000)); err != nil {
+					return err
+				}
+				if err := b.Put([]byte(fmt.Sprint("small", i)), blobValue(seed+i, 1000)); err != nil {
+					return err
+				}
+			}
+
+			// The values are read back before the commit.
+			require.Equal(t, blobValue(seed+3, 10000), b.Get([]byte("blob3")))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	write(0)
+	requireBlobStats(t, db.DB, "widgets", 20)
+	db.MustCheck()
+
+	var size int64
+	for seed := 1; seed < 10; seed++ {
+		write(seed)
+		db.MustCheck()
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 20; i++ {
+				require.Equal(t, blobValue(seed+i, 10000), b.Get([]byte(fmt.Sprint("blob", i))))
+				require.Equal(t, blobValue(seed+i, 1000), b.Get([]byte(fmt.Sprint("small", i))))
+			}
+			if seed == 2 {
+				size = tx.Size()
+			} else if seed > 2 {
+				require.Equal(t, size, tx.Size())
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Overwrite with a small value, then delete.
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Put([]byte("blob0"), []byte("small")))
+		require.NoError(t, b.Delete([]byte("blob1")))
+		c := b.Cursor()
+		c.Seek([]byte("blob2"))
+		return c.Delete()
+	})
+	require.NoError(t, err)
+	requireBlobStats(t, db.DB, "widgets", 17)
+	db.MustCheck()
+
+	db.MustClose()
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("small"), b.Get([]byte("blob0")))
+		require.Nil(t, b.Get([]byte("blob1")))
+		require.Nil(t, b.Get([]byte("blob2")))
+		require.Equal(t, blobValue(9+3, 10000), b.Get([]byte("blob3")))
+
+		s := b.Stats()
+		require.Equal(t, 17*3*4096, s.BlobAlloc)
+		require.Equal(t, 0, s.LeafOverflowN)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// errReader fails after returning some bytes.
+type errReader struct{ n int }
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("read failure")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+// Ensure that a value can be put from a reader and read with a ReaderAt.
+func TestBucket_PutStream(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	const size = 5 << 20
+	value := blobValue(0, size)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
+			return err
+		}
+		require.NoError(t, b.PutStream([]byte("big"), bytes.NewReader(value), size))
+		require.NoError(t, b.PutStream([]byte("empty"), bytes.NewReader(nil), 0))
+		require.NoError(t, b.Put([]byte("small"), []byte("value")))
+
+		require.ErrorIs(t, b.PutStream([]byte("short"), bytes.NewReader(value[:100]), 101), berrors.ErrBlobSizeMismatch)
+		require.ErrorContains(t, b.PutStream([]byte("failing"), &errReader{n: 5000}, 10000), "read failure")
+		require.ErrorIs(t, b.PutStream([]byte("child"), bytes.NewReader(value[:10]), 10), berrors.ErrIncompatibleValue)
+		require.ErrorIs(t, b.PutStream(nil, bytes.NewReader(nil), 0), berrors.ErrKeyRequired)
+		require.ErrorIs(t, b.PutStream([]byte("huge"), bytes.NewReader(nil), bolt.MaxValueSize+1), berrors.ErrValueTooLarge)
+		require.Nil(t, b.Get([]byte("short")))
+		return nil
+	})
+	require.NoError(t, err)
+	requireBlobStats(t, db.DB, "widgets", 2)
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		r := b.GetReader([]byte("big"))
+		require.EqualValues(t, size, r.Size())
+		buf := make([]byte, 1000)
+		n, err := r.ReadAt(buf, 3<<20)
+		require.NoError(t, err)
+		require.Equal(t, 1000, n)
+		require.Equal(t, value[3<<20:3<<20+1000], buf)
+		n, err = r.ReadAt(buf, size-10)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, value[size-10:], buf[:n])
+
+		require.EqualValues(t, 0, b.GetReader([]byte("empty")).Size())
+		require.Nil(t, b.GetReader([]byte("missing")))
+		require.Nil(t, b.GetReader([]byte("child")))
+
+		// Values stored in leaf pages can be read too.
+		small, err := io.ReadAll(b.GetReader([]byte("small")))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), small)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).PutStream([]byte("x"), bytes.NewReader(nil), 0)
+	})
+	require.ErrorIs(t, err, berrors.ErrTxNotWritable)
+}
+
+// patternReader reads the n bytes of blobValue(seed, n) starting at off,
+// without holding them in memory.
+type patternReader struct{ seed, off, n int }
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.off >= r.n {
+		return 0, io.EOF
+	}
+	p = p[:min(len(p), r.n-r.off)]
+	for i := range p {
+		p[i] = byte(r.seed + (r.off+i)*7)
+	}
+	r.off += len(p)
+	return len(p), nil
+}
+
+// totalAlloc returns the number of bytes allocated so far.
+func totalAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.TotalAlloc
+}
+
+// Ensure that PutStream writes a blob to the database file as it is read, and
+// that GetReader reads it from its pages, without holding it in memory.
+func TestBucket_PutStream_Memory(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts *bolt.Options
+	}{
+		{name: "default", opts: &bolt.Options{PageSize: 4096}},
+		{name: "page checksums", opts: &bolt.Options{PageSize: 4096, PageChecksums: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, tc.opts)
+			const size = 32 << 20
+			before := totalAlloc()
+			err := db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				if err := b.PutStream([]byte("big"), &patternReader{seed: 1, n: size}, size); err != nil {
+					return err
+				}
+
+				// The blob can be read back before it is committed.
+				buf, exp := make([]byte, 10), make([]byte, 10)
+				_, err = b.GetReader([]byte("big")).ReadAt(buf, size-10)
+				require.NoError(t, err)
+				_, _ = (&patternReader{seed: 1, off: size - 10, n: size}).Read(exp)
+				require.Equal(t, exp, buf)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Less(t, totalAlloc()-before, uint64(size/8))
+
+			// The pages of a blob written by a transaction rolled back are
+			// released.
+			err = db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				require.NoError(t, b.PutStream([]byte("rolled back"), &patternReader{seed: 2, n: 1 << 20}, 1<<20))
+				return errors.New("rollback")
+			})
+			require.EqualError(t, err, "rollback")
+			db.MustCheck()
+			db.MustClose()
+			db.MustReopen()
+
+			var r *io.SectionReader
+			before = totalAlloc()
+			err = db.View(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				require.Nil(t, b.Get([]byte("rolled back")))
+				r = b.GetReader([]byte("big"))
+				require.EqualValues(t, size, r.Size())
+				buf, exp := make([]byte, 1<<20), make([]byte, 1<<20)
+				for off := 0; off < size; off += len(buf) {
+					n, err := r.ReadAt(buf, int64(off))
+					require.NoError(t, err)
+					require.Equal(t, len(buf), n)
+					_, _ = (&patternReader{seed: 1, off: off, n: size}).Read(exp)
+					require.True(t, bytes.Equal(exp, buf), "offset %d", off)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			require.Less(t, totalAlloc()-before, uint64(size/8))
+
+			_, err = r.ReadAt(make([]byte, 1), 0)
+			require.ErrorIs(t, err, berrors.ErrTxClosed)
+		})
+	}
+}
+
+// Ensure that the blobs of inline buckets and deleted buckets are accounted
+// for.
+func TestBucket_Blob_Buckets(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 100})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		inline, err := b.CreateBucket([]byte("inline"))
+		if err != nil {
+			return err
+		}
+		if err := inline.Put([]byte("k"), blobValue(0, 20000)); err != nil {
+			return err
+		}
+		nested, err := b.CreateBucket([]byte("deleted"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := nested.Put([]byte(fmt.Sprint(i)), blobValue(i, 5000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		s := tx.Bucket([]byte("widgets")).Stats()
+		require.Equal(t, 2, s.InlineBucketN)
+		require.Equal(t, 11, s.BlobValueN)
+		require.Equal(t, blobValue(0, 20000), tx.Bucket([]byte("widgets")).Bucket([]byte("inline")).Get([]byte("k")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.DeleteBucket([]byte("deleted")); err != nil {
+			return err
+		}
+		return b.Bucket([]byte("inline")).Put([]byte("k"), blobValue(1, 20000))
+	})
+	require.NoError(t, err)
+	requireBlobStats(t, db.DB, "widgets", 1)
+	db.MustCheck()
+}
+
+// Ensure that values in blobs can expire.
+func TestBucket_Blob_TTL(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 100})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.PutWithTTL([]byte("soon"), blobValue(0, 10000), 10*time.Millisecond); err != nil {
+			return err
+		}
+		return b.PutWithTTL([]byte("later"), blobValue(1, 10000), time.Hour)
+	})
+	require.NoError(t, err)
+	requireBlobStats(t, db.DB, "widgets", 2)
+
+	time.Sleep(20 * time.Millisecond)
+	n, err := db.ReapExpired()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Nil(t, b.Get([]byte("soon")))
+		require.Equal(t, blobValue(1, 10000), b.Get([]byte("later")))
+		return nil
+	})
+	require.NoError(t, err)
+	requireBlobStats(t, db.DB, "widgets", 1)
+	db.MustCheck()
+}
+
+// Ensure that the blobs of encrypted databases and databases with page
+// checksums are encrypted and checksummed.
+func TestBucket_Blob_Cipher(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		PageSize:      4096,
+		BlobThreshold: 100,
+		Cipher:        mustCipher(t, "0123456789abcdef0123456789abcdef"),
+		PageChecksums: true,
+	})
+	value := bytes.Repeat([]byte("secret blob "), 1000)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("put"), value); err != nil {
+			return err
+		}
+		return b.PutStream([]byte("stream"), bytes.NewReader(value), int64(len(value)))
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	db.MustClose()
+	data, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(data, []byte("secret blob")))
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, value, b.Get([]byte("put")))
+		require.Equal(t, value, b.Get([]byte("stream")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that the transactions which do not hold the writer lock write their
+// blobs on commit.
+func TestBucket_Blob_ConcurrentWriters(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 100})
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"a", "b"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("old"), blobValue(0, 10000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	write := func(tx *bolt.Tx, name string) error {
+		b := tx.Bucket([]byte(name))
+		if err := b.Put([]byte("put"), blobValue(1, 10000)); err != nil {
+			return err
+		}
+		if err := b.PutStream([]byte("stream"), bytes.NewReader(blobValue(2, 50)), 50); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("old"), blobValue(3, 10000)); err != nil {
+			return err
+		}
+		require.Equal(t, blobValue(1, 10000), b.Get([]byte("put")))
+		require.Equal(t, blobValue(2, 50), b.Get([]byte("stream")))
+		return nil
+	}
+	require.NoError(t, db.OptimisticUpdate(func(tx *bolt.Tx) error { return write(tx, "a") }))
+	require.NoError(t, db.UpdateBuckets([][]byte{[]byte("b")}, func(tx *bolt.Tx) error { return write(tx, "b") }))
+	db.MustCheck()
+
+	for _, name := range []string{"a", "b"} {
+		requireBlobStats(t, db.DB, name, 3)
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(name))
+			require.Equal(t, blobValue(1, 10000), b.Get([]byte("put")))
+			require.Equal(t, blobValue(2, 50), b.Get([]byte("stream")))
+			require.Equal(t, blobValue(3, 10000), b.Get([]byte("old")))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// fillBlobs writes n values in blobs to the widgets bucket and to an inline
+// bucket, then deletes most of the former.
+func fillBlobs(t *testing.T, db *btesting.DB, n int) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), blobValue(i, 10000)); err != nil {
+				return err
+			}
+		}
+		inline, err := b.CreateBucketIfNotExists([]byte("inline"))
+		if err != nil {
+			return err
+		}
+		return inline.Put([]byte("k"), blobValue(n, 20000))
+	})
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < n; i++ {
+			if i%10 != 0 {
+				if err := b.Delete([]byte(fmt.Sprintf("%04d", i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// verifyBlobs checks the values left by fillBlobs.
+func verifyBlobs(t *testing.T, db *bolt.DB, n int) {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < n; i += 10 {
+			require.Equal(t, blobValue(i, 10000), b.Get([]byte(fmt.Sprintf("%04d", i))))
+		}
+		require.Equal(t, blobValue(n, 20000), b.Bucket([]byte("inline")).Get([]byte("k")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that compacting a database, in place or not, keeps its blobs.
+func TestCompact_Blob(t *testing.T) {
+	const n = 200
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 1000})
+	fillBlobs(t, db, n)
+
+	dst := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 1000})
+	require.NoError(t, bolt.Compact(dst.DB, db.DB, 0))
+	verifyBlobs(t, dst.DB, n)
+	requireBlobStats(t, dst.DB, "widgets", n/10+1)
+	dst.MustCheck()
+
+	fi, err := os.Stat(db.Path())
+	require.NoError(t, err)
+	shrunk, err := db.CompactInPlace(nil)
+	require.NoError(t, err)
+	require.Greater(t, shrunk, fi.Size()/2)
+	verifyBlobs(t, db.DB, n)
+	db.MustCheck()
+}
+
+// Ensure that a named snapshot keeps the blobs overwritten after it.
+func TestDB_CreateSnapshot_Blob(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 1000})
+	put := func(seed int) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("k"), blobValue(seed, 10000))
+		})
+		require.NoError(t, err)
+	}
+	put(0)
+	require.NoError(t, db.CreateSnapshot("v1"))
+	for i := 1; i < 5; i++ {
+		put(i)
+	}
+	db.MustCheck()
+
+	tx, err := db.OpenSnapshot("v1")
+	require.NoError(t, err)
+	require.Equal(t, blobValue(0, 10000), tx.Bucket([]byte("widgets")).Get([]byte("k")))
+	require.NoError(t, tx.Rollback())
+}
@@ -2,6 +2,7 @@ package bbolt
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"unsafe"
 
@@ -27,6 +28,12 @@ const (
 const DefaultFillPercent = 0.5
 
 // Bucket represents a collection of key/value pairs inside the database.
+//
+// The names of nested and top-level buckets starting with "\x00bbolt-" are
+// reserved for the buckets the library keeps for itself, such as the expiry
+// and secondary indexes or the history of a bucket. They are hidden from the
+// cursors, and creating or moving a bucket with such a name returns
+// ErrBucketNameReserved.
 type Bucket struct {
 	*common.InBucket
 	tx       *Tx                   // the associated transaction
@@ -34,6 +41,19 @@ type Bucket struct {
 	page     *common.Page          // inline page reference
 	rootNode *node                 // materialized node for the root page.
 	nodes    map[common.Pgid]*node // node cache
+	opts     common.BucketOptions  // persisted bucket options
+	compare  Comparator            // key order; nil means byte-wise order
+
+	compressor Compressor // value compressor; nil if values are not compressed
+
+	parent *Bucket // bucket this bucket was opened from, if opened by name
+	name   []byte  // name of the bucket in its parent
+
+	indexes       []*bucketIndex // secondary indexes, once loaded
+	indexesLoaded bool
+
+	values  map[string]*Bucket  // chunk trees of chunked values, in read-write transactions
+	written map[string]struct{} // keys written to, if the bucket is versioned
 
 	// Sets the threshold for filling nodes when they split. By default,
 	// the bucket will fill to 50% but it can be useful to increase this
@@ -71,6 +91,11 @@ func (b *Bucket) Writable() bool {
 // Cursor creates a cursor associated with the bucket.
 // The cursor is only valid as long as the transaction is open.
 // Do not use a cursor after the transaction is closed.
+//
+// The keys of a page failing its checksum or decryption are skipped by the
+// cursor. DB.View and DB.Update return the error, as does Tx.Rollback for
+// a transaction started with DB.Begin(false), but callers iterating in a
+// transaction they manage must check Tx.Err before trusting the result.
 func (b *Bucket) Cursor() *Cursor {
 	// Update transaction statistics.
 	b.tx.stats.IncCursorCount(1)
@@ -83,12 +108,31 @@ func (b *Bucket) Cursor() *Cursor {
 }
 
 // Bucket retrieves a nested bucket by name.
-// Returns nil if the bucket does not exist.
+// Returns nil if the bucket does not exist or if it cannot be opened; use
+// OpenBucket to know why.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) Bucket(name []byte) *Bucket {
+	child, _ := b.OpenBucket(name)
+	return child
+}
+
+// OpenBucket retrieves a nested bucket by name, like Bucket.
+// Returns ErrBucketNotFound if the bucket does not exist, ErrIncompatibleValue
+// if the key is not a bucket, and ErrComparatorNotRegistered or
+// ErrCompressorNotRegistered if its key comparator or its value compressor is
+// not registered.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) OpenBucket(name []byte) (*Bucket, error) {
+	if b.tx.db == nil {
+		return nil, errors.ErrTxClosed
+	}
+	b.tx.opt.read(b, name)
+	if internalBucketName(name) {
+		return nil, errors.ErrBucketNotFound
+	}
 	if b.buckets != nil {
 		if child := b.buckets[string(name)]; child != nil {
-			return child
+			return child, nil
 		}
 	}
 
@@ -96,18 +140,25 @@ func (b *Bucket) Bucket(name []byte) *Bucket {
 	c := b.Cursor()
 	k, v, flags := c.seek(name)
 
-	// Return nil if the key doesn't exist or it is not a bucket.
-	if !bytes.Equal(name, k) || (flags&common.BucketLeafFlag) == 0 {
-		return nil
+	// Return an error if the key doesn't exist or it is not a bucket.
+	if !bytes.Equal(name, k) {
+		return nil, errors.ErrBucketNotFound
+	} else if (flags & common.BucketLeafFlag) == 0 {
+		return nil, errors.ErrIncompatibleValue
 	}
 
 	// Otherwise create a bucket and cache it.
 	var child = b.openBucket(v)
+	child.parent, child.name = b, k
+	if err := child.optionsError(); err != nil {
+		b.tx.db.Logger().Errorf("Opening bucket %q failed: %v", name, err)
+		return nil, err
+	}
 	if b.buckets != nil {
 		b.buckets[string(name)] = child
 	}
 
-	return child
+	return child, nil
 }
 
 // Helper method that re-interprets a sub-bucket value
@@ -134,18 +185,41 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 		child.InBucket = (*common.InBucket)(unsafe.Pointer(&value[0]))
 	}
 
+	// Load the persisted options and resolve the key comparator.
+	opts, err := common.ReadBucketOptions(value)
+	if err != nil {
+		panic(fmt.Sprintf("corrupted bucket header: %v", err))
+	}
+	child.opts = opts
+	if opts.Comparator != "" {
+		child.compare = b.tx.db.comparators[opts.Comparator]
+	}
+	if opts.Compression != "" {
+		child.compressor = b.tx.db.compressors[opts.Compression]
+	}
+
 	// Save a reference to the inline page if the bucket is inline.
 	if child.RootPage() == 0 {
-		child.page = (*common.Page)(unsafe.Pointer(&value[common.BucketHeaderSize]))
+		child.page = child.InlinePage(value)
 	}
 
 	return &child
 }
 
 // CreateBucket creates a new bucket at the given key and returns the new bucket.
-// Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
+// Returns an error if the key already exists, if the bucket name is blank, if the
+// bucket name is reserved, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) CreateBucket(key []byte) (rb *Bucket, err error) {
+	return b.CreateBucketWithOptions(key, BucketOptions{})
+}
+
+// CreateBucketWithOptions creates a new bucket at the given key with the given
+// options and returns the new bucket. The options are persisted with the bucket.
+// Returns an error if the key already exists, if the bucket name is blank or
+// reserved, if the bucket name is too long, or if the comparator is not registered.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) CreateBucketWithOptions(key []byte, opts BucketOptions) (rb *Bucket, err error) {
 	if lg := b.tx.db.Logger(); lg != discardLogger {
 		lg.Debugf("Creating bucket %q", key)
 		defer func() {
@@ -162,6 +236,12 @@ func (b *Bucket) CreateBucket(key []byte) (rb *Bucket, err error) {
 		return nil, errors.ErrTxNotWritable
 	} else if len(key) == 0 {
 		return nil, errors.ErrBucketNameRequired
+	} else if reservedBucketName(key) {
+		return nil, errors.ErrBucketNameReserved
+	} else if opts.Comparator != "" && b.tx.db.comparators[opts.Comparator] == nil {
+		return nil, errors.ErrComparatorNotRegistered
+	} else if opts.Compression != "" && b.tx.db.compressors[opts.Compression] == nil {
+		return nil, errors.ErrCompressorNotRegistered
 	}
 
 	// Insert into node.
@@ -183,13 +263,17 @@ func (b *Bucket) CreateBucket(key []byte) (rb *Bucket, err error) {
 
 	// Create empty, inline bucket.
 	var bucket = Bucket{
+		tx:          b.tx,
 		InBucket:    &common.InBucket{},
 		rootNode:    &node{isLeaf: true},
+		opts:        opts.persisted(),
 		FillPercent: DefaultFillPercent,
 	}
 	var value = bucket.write()
 
 	c.node().put(newKey, newKey, value, 0, common.BucketLeafFlag)
+	b.tx.opt.write(b, optimisticWrite{op: opCreateBucket, key: newKey, opts: opts})
+	b.tx.changes.add(b, Change{Op: ChangeCreateBucket, Key: newKey})
 
 	// Since subbuckets are not allowed on inline buckets, we need to
 	// dereference the inline page, if it exists. This will cause the bucket
@@ -200,7 +284,7 @@ func (b *Bucket) CreateBucket(key []byte) (rb *Bucket, err error) {
 }
 
 // CreateBucketIfNotExists creates a new bucket if it doesn't already exist and returns a reference to it.
-// Returns an error if the bucket name is blank, or if the bucket name is too long.
+// Returns an error if the bucket name is blank, if the bucket name is reserved, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) CreateBucketIfNotExists(key []byte) (rb *Bucket, err error) {
 	if lg := b.tx.db.Logger(); lg != discardLogger {
@@ -220,12 +304,15 @@ func (b *Bucket) CreateBucketIfNotExists(key []byte) (rb *Bucket, err error) {
 		return nil, errors.ErrTxNotWritable
 	} else if len(key) == 0 {
 		return nil, errors.ErrBucketNameRequired
+	} else if reservedBucketName(key) {
+		return nil, errors.ErrBucketNameReserved
 	}
 
 	// Insert into node.
 	// Tip: Use a new variable `newKey` instead of reusing the existing `key` to prevent
 	// it from being marked as leaking, and accordingly cannot be allocated on stack.
 	newKey := cloneBytes(key)
+	b.tx.opt.read(b, newKey)
 
 	if b.buckets != nil {
 		if child := b.buckets[string(newKey)]; child != nil {
@@ -241,6 +328,10 @@ func (b *Bucket) CreateBucketIfNotExists(key []byte) (rb *Bucket, err error) {
 	if bytes.Equal(newKey, k) {
 		if (flags & common.BucketLeafFlag) != 0 {
 			var child = b.openBucket(v)
+			child.parent, child.name = b, k
+			if err := child.optionsError(); err != nil {
+				return nil, err
+			}
 			if b.buckets != nil {
 				b.buckets[string(newKey)] = child
 			}
@@ -259,6 +350,8 @@ func (b *Bucket) CreateBucketIfNotExists(key []byte) (rb *Bucket, err error) {
 	var value = bucket.write()
 
 	c.node().put(newKey, newKey, value, 0, common.BucketLeafFlag)
+	b.tx.opt.write(b, optimisticWrite{op: opCreateBucket, key: newKey})
+	b.tx.changes.add(b, Change{Op: ChangeCreateBucket, Key: newKey})
 
 	// Since subbuckets are not allowed on inline buckets, we need to
 	// dereference the inline page, if it exists. This will cause the bucket
@@ -302,7 +395,10 @@ func (b *Bucket) DeleteBucket(key []byte) (err error) {
 	}
 
 	// Recursively delete all child buckets.
-	child := b.Bucket(newKey)
+	child, err := b.OpenBucket(newKey)
+	if err != nil {
+		return err
+	}
 	err = child.ForEachBucket(func(k []byte) error {
 		if err := child.DeleteBucket(k); err != nil {
 			return fmt.Errorf("delete bucket: %s", err)
@@ -313,16 +409,27 @@ func (b *Bucket) DeleteBucket(key []byte) (err error) {
 		return err
 	}
 
+	if idx := child.expiryIndex(false); idx != nil {
+		idx.free()
+	}
+	child.freeIndexes()
+	if history := child.internalBucket(historyKey, false, common.BucketOptions{}); history != nil {
+		history.free()
+	}
+
 	// Remove cached copy.
 	delete(b.buckets, string(newKey))
 
 	// Release all bucket pages to freelist.
+	child.freeValues()
 	child.nodes = nil
 	child.rootNode = nil
 	child.free()
 
 	// Delete the node if we have a matching key.
 	c.node().del(newKey)
+	b.tx.opt.write(b, optimisticWrite{op: opDeleteBucket, key: newKey})
+	b.tx.changes.add(b, Change{Op: ChangeDeleteBucket, Key: newKey})
 
 	return nil
 }
@@ -332,7 +439,8 @@ func (b *Bucket) DeleteBucket(key []byte) (err error) {
 //  1. the sub-bucket cannot be found in the source bucket;
 //  2. or the key already exists in the destination bucket;
 //  3. or the key represents a non-bucket value;
-//  4. the source and destination buckets are the same.
+//  4. the source and destination buckets are the same;
+//  5. or the key is a reserved bucket name.
 func (b *Bucket) MoveBucket(key []byte, dstBucket *Bucket) (err error) {
 	lg := b.tx.db.Logger()
 	if lg != discardLogger {
@@ -350,6 +458,8 @@ func (b *Bucket) MoveBucket(key []byte, dstBucket *Bucket) (err error) {
 		return errors.ErrTxClosed
 	} else if !b.Writable() || !dstBucket.Writable() {
 		return errors.ErrTxNotWritable
+	} else if reservedBucketName(key) {
+		return errors.ErrBucketNameReserved
 	}
 
 	if b.tx.db.Path() != dstBucket.tx.db.Path() || b.tx != dstBucket.tx {
@@ -399,6 +509,13 @@ func (b *Bucket) MoveBucket(key []byte, dstBucket *Bucket) (err error) {
 	newValue := cloneBytes(v)
 	curDst.node().put(newKey, newKey, newValue, 0, common.BucketLeafFlag)
 
+	// Let the reaper find the expiring keys of the bucket at its new place.
+	if b.openBucket(newValue).expiryIndex(false) != nil {
+		dstBucket.markExpiry(newKey)
+	}
+	b.tx.opt.write(b, optimisticWrite{op: opMoveBucket, key: newKey, dst: dstBucket.path()})
+	b.tx.changes.add(b, Change{Op: ChangeMoveBucket, Key: newKey, Dst: bytesPath(dstBucket.path())})
+
 	return nil
 }
 
@@ -415,6 +532,12 @@ func (b *Bucket) recursivelyInspect(name []byte) BucketStructure {
 	for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
 		if flags&common.BucketLeafFlag != 0 {
 			childBucket := b.Bucket(k)
+			if childBucket == nil {
+				// The comparator is not registered; the structure can
+				// still be walked in storage order.
+				_, v, _ := c.keyValue()
+				childBucket = b.openBucket(v)
+			}
 			childBS := childBucket.recursivelyInspect(k)
 			bs.Children = append(bs.Children, childBS)
 		} else {
@@ -430,8 +553,15 @@ func (b *Bucket) recursivelyInspect(name []byte) BucketStructure {
 // Returns a nil value if the key does not exist or if the key is a nested bucket.
 // The returned value is only valid for the life of the transaction.
 // The returned memory is owned by bbolt and must never be modified; writing to this memory might corrupt the database.
+//
+// A key stored on a page failing its checksum or decryption is reported as
+// not existing. DB.View and DB.Update return the error, as does Tx.Rollback
+// for a transaction started with DB.Begin(false), but callers must check
+// Tx.Err before trusting a nil value in a transaction they manage.
 func (b *Bucket) Get(key []byte) []byte {
-	k, v, flags := b.Cursor().seek(key)
+	b.tx.opt.read(b, key)
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
 
 	// Return nil if this is a bucket.
 	if (flags & common.BucketLeafFlag) != 0 {
@@ -439,10 +569,23 @@ func (b *Bucket) Get(key []byte) []byte {
 	}
 
 	// If our target node isn't the same key as what's passed in then return nil.
-	if !bytes.Equal(key, k) {
+	if !bytes.Equal(key, k) || b.hidden(k, v, flags) {
 		return nil
 	}
-	return v
+	return c.value(v, flags)
+}
+
+// GetE retrieves the value for a key in the bucket, like Get, but also returns
+// the error of the transaction, see Tx.Err. Once a page failing its checksum
+// or decryption is read, it returns that error instead of a value, as the
+// page is read as if it held no key: a nil value with a nil error is a key
+// that does not exist, and not a key of a corrupted page.
+func (b *Bucket) GetE(key []byte) ([]byte, error) {
+	v := b.Get(key)
+	if err := b.tx.Err(); err != nil {
+		return nil, err
+	}
+	return v, nil
 }
 
 // Put sets the value for a key in the bucket.
@@ -450,6 +593,21 @@ func (b *Bucket) Get(key []byte) []byte {
 // Supplied value must remain valid for the life of the transaction.
 // Returns an error if the bucket was created from a read-only transaction, if the key is blank, if the key is too large, or if the value is too large.
 func (b *Bucket) Put(key []byte, value []byte) (err error) {
+	return b.put(key, value, 0)
+}
+
+// put sets the value for a key in the bucket, expiring at the given time in
+// Unix nanoseconds, or never if zero.
+func (b *Bucket) put(key []byte, value []byte, expires int64) error {
+	return b.putValue(key, value, expires, false, nil)
+}
+
+// putValue is put, storing the value in a blob if it is larger than
+// Options.BlobThreshold or if forceBlob is set. The blob is written on
+// commit, unless blob points to the pages it is already written to, in which
+// case value is only needed by the indexes, the subscribers and the
+// optimistic log of the transaction, if any.
+func (b *Bucket) putValue(key []byte, value []byte, expires int64, forceBlob bool, blob *blobPointer) (err error) {
 	if lg := b.tx.db.Logger(); lg != discardLogger {
 		lg.Debugf("Putting key %q", key)
 		defer func() {
@@ -466,7 +624,7 @@ func (b *Bucket) Put(key []byte, value []byte) (err error) {
 		return errors.ErrTxNotWritable
 	} else if len(key) == 0 {
 		return errors.ErrKeyRequired
-	} else if len(key) > MaxKeySize {
+	} else if len(key) > MaxKeySize || (b.versioned() && len(key) > MaxKeySize-versionKeyOverhead) {
 		return errors.ErrKeyTooLarge
 	} else if int64(len(value)) > MaxValueSize {
 		return errors.ErrValueTooLarge
@@ -477,18 +635,80 @@ func (b *Bucket) Put(key []byte, value []byte) (err error) {
 	// it from being marked as leaking, and accordingly cannot be allocated on stack.
 	newKey := cloneBytes(key)
 
+	// Create the expiry index first, as it moves the cursors of the bucket.
+	if expires != 0 && b.expiryIndex(true) == nil {
+		return errors.ErrIncompatibleValue
+	}
+
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(newKey)
+	k, v, flags := c.seek(newKey)
 
 	// Return an error if there is an existing key with a bucket value.
-	if bytes.Equal(newKey, k) && (flags&common.BucketLeafFlag) != 0 {
+	exists := bytes.Equal(newKey, k)
+	if exists && (flags&common.BucketLeafFlag) != 0 {
 		return errors.ErrIncompatibleValue
 	}
 
+	// Keep the previous value for the subscribers.
+	var old []byte
+	if b.tx.changes != nil && exists {
+		old = append([]byte{}, c.value(v, flags)...)
+	}
+	var oldExpires int64
+	if exists && (flags&common.ExpiringValueFlag) != 0 {
+		oldExpires = valueExpiry(v)
+	}
+
+	// Work out the changes to the secondary indexes before changing anything.
+	indexes, err := b.indexUpdates()
+	if err != nil {
+		return err
+	}
+	if indexes != nil {
+		if exists {
+			indexes.remove(newKey, c.value(v, flags))
+		}
+		if err := indexes.add(newKey, value); err != nil {
+			return err
+		}
+	}
+
+	// Compress the value if the bucket is configured to, unless it goes to a
+	// blob.
+	var stored []byte
+	var newFlags uint32
+	switch {
+	case blob != nil:
+		stored = appendBlobPointer(nil, *blob)
+		newFlags = common.BlobValueFlag
+	case forceBlob || b.tx.db.storesBlob(len(value)):
+		stored = value
+		newFlags = common.BlobValueFlag | pendingBlobFlag
+	default:
+		if stored, newFlags, err = b.compress(value); err != nil {
+			return err
+		}
+	}
+	if expires != 0 {
+		stored = append(binary.BigEndian.AppendUint64(make([]byte, 0, expirySize+len(stored)), uint64(expires)), stored...)
+		newFlags |= common.ExpiringValueFlag
+	}
+
 	// gofail: var beforeBucketPut struct{}
 
-	c.node().put(newKey, newKey, value, 0, 0)
+	if exists {
+		b.freeValue(newKey, v, flags)
+	}
+	c.node().put(newKey, newKey, stored, 0, newFlags)
+	if oldExpires != expires {
+		b.unindexExpiry(newKey, oldExpires)
+		b.indexExpiry(newKey, expires)
+	}
+	indexes.apply()
+	b.touchVersion(newKey)
+	b.tx.opt.write(b, optimisticWrite{op: opPut, key: newKey, value: value, expires: expires, blob: forceBlob})
+	b.tx.changes.add(b, Change{Op: ChangePut, Key: newKey, OldValue: old, NewValue: value})
 
 	return nil
 }
@@ -516,10 +736,11 @@ func (b *Bucket) Delete(key []byte) (err error) {
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, v, flags := c.seek(key)
 
 	// Return nil if the key doesn't exist.
 	if !bytes.Equal(key, k) {
+		b.tx.opt.write(b, optimisticWrite{op: opDelete, key: key})
 		return nil
 	}
 
@@ -528,14 +749,35 @@ func (b *Bucket) Delete(key []byte) (err error) {
 		return errors.ErrIncompatibleValue
 	}
 
+	indexes, err := b.indexUpdates()
+	if err != nil {
+		return err
+	}
+	indexes.remove(key, c.value(v, flags))
+
+	// Keep the previous value for the subscribers.
+	if b.tx.changes != nil {
+		b.tx.changes.add(b, Change{Op: ChangeDelete, Key: key, OldValue: append([]byte{}, c.value(v, flags)...)})
+	}
+	var expires int64
+	if (flags & common.ExpiringValueFlag) != 0 {
+		expires = valueExpiry(v)
+	}
+
 	// Delete the node if we have a matching key.
+	b.freeValue(key, v, flags)
 	c.node().del(key)
+	b.unindexExpiry(key, expires)
+	indexes.apply()
+	b.touchVersion(key)
+	b.tx.opt.write(b, optimisticWrite{op: opDelete, key: key})
 
 	return nil
 }
 
 // Sequence returns the current integer for the bucket without incrementing it.
 func (b *Bucket) Sequence() uint64 {
+	b.tx.opt.readSequence(b)
 	return b.InSequence()
 }
 
@@ -555,6 +797,7 @@ func (b *Bucket) SetSequence(v uint64) error {
 
 	// Set the sequence.
 	b.SetInSequence(v)
+	b.tx.opt.write(b, optimisticWrite{op: opSetSequence, seq: v})
 	return nil
 }
 
@@ -573,8 +816,10 @@ func (b *Bucket) NextSequence() (uint64, error) {
 	}
 
 	// Increment and return the sequence.
+	b.tx.opt.readSequence(b)
 	b.IncSequence()
-	return b.Sequence(), nil
+	b.tx.opt.write(b, optimisticWrite{op: opSetSequence, seq: b.InSequence()})
+	return b.InSequence(), nil
 }
 
 // ForEach executes a function for each key/value pair in a bucket.
@@ -599,9 +844,10 @@ func (b *Bucket) ForEachBucket(fn func(k []byte) error) error {
 	if b.tx.db == nil {
 		return errors.ErrTxClosed
 	}
+	b.tx.opt.scan(b)
 	c := b.Cursor()
 	for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
-		if flags&common.BucketLeafFlag != 0 {
+		if flags&common.BucketLeafFlag != 0 && !internalBucketName(k) {
 			if err := fn(k); err != nil {
 				return err
 			}
@@ -622,6 +868,43 @@ func (b *Bucket) Stats() BucketStats {
 		if p.IsLeafPage() {
 			s.KeyN += int(p.Count())
 
+			// Collect value sizes before and after compression.
+			for i := uint16(0); i < p.Count(); i++ {
+				e := p.LeafPageElement(i)
+				if (e.Flags() & common.BucketLeafFlag) != 0 {
+					continue
+				}
+				s.ValueStoredBytes += int(e.Vsize())
+				v := e.Value()
+				if (e.Flags() & common.BlobValueFlag) != 0 {
+					ptr := readBlobPointer(v, e.Flags())
+					s.BlobValueN++
+					s.BlobAlloc += b.tx.db.blobPageCount(ptr.size) * pageSize
+					s.ValueRawBytes += int(ptr.size)
+					continue
+				}
+				if (e.Flags() & common.ChunkedValueFlag) != 0 {
+					tree := b.openBucket(v)
+					s.ChunkedValueN++
+					s.ValueRawBytes += int(tree.InSequence())
+					if tree.RootPage() != 0 {
+						tree.forEachPage(func(p *common.Page, _ int, _ []common.Pgid) {
+							s.ChunkedAlloc += (int(p.Overflow()) + 1) * pageSize
+						})
+					}
+					continue
+				}
+				if (e.Flags() & common.ExpiringValueFlag) != 0 {
+					v = v[expirySize:]
+				}
+				if (e.Flags() & common.CompressedValueFlag) != 0 {
+					s.CompressedValueN++
+					s.ValueRawBytes += rawValueSize(v)
+				} else {
+					s.ValueRawBytes += len(v)
+				}
+			}
+
 			// used totals the used bytes for the page
 			used := common.PageHeaderSize
 
@@ -740,24 +1023,18 @@ func (b *Bucket) _forEachPageNode(pgId common.Pgid, depth int, fn func(*common.P
 
 // spill writes all the nodes for this bucket to dirty pages.
 func (b *Bucket) spill() error {
+	if err := b.writeBlobs(); err != nil {
+		return err
+	}
+	if err := b.spillValues(); err != nil {
+		return err
+	}
+
 	// Spill all child buckets first.
 	for name, child := range b.buckets {
-		// If the child bucket is small enough and it has no child buckets then
-		// write it inline into the parent bucket's page. Otherwise spill it
-		// like a normal bucket and make the parent value a pointer to the page.
-		var value []byte
-		if child.inlineable() {
-			child.free()
-			value = child.write()
-		} else {
-			if err := child.spill(); err != nil {
-				return err
-			}
-
-			// Update the child bucket header in this bucket.
-			value = make([]byte, unsafe.Sizeof(common.InBucket{}))
-			var bucket = (*common.InBucket)(unsafe.Pointer(&value[0]))
-			*bucket = *child.InBucket
+		value, err := child.spillTree()
+		if err != nil {
+			return err
 		}
 
 		// Skip writing the bucket if there are no materialized nodes.
@@ -797,6 +1074,35 @@ func (b *Bucket) spill() error {
 	return nil
 }
 
+// spillTree spills a nested bucket, or the chunk tree of a chunked value, and
+// returns its new value in its parent bucket.
+func (b *Bucket) spillTree() ([]byte, error) {
+	// Write the blobs and the chunked values first, for the size of the
+	// bucket without them.
+	if err := b.writeBlobs(); err != nil {
+		return nil, err
+	}
+	if err := b.spillValues(); err != nil {
+		return nil, err
+	}
+
+	// If the bucket is small enough and it has no child buckets then write
+	// it inline into the parent bucket's page. Otherwise spill it like a
+	// normal bucket and make the parent value a pointer to the page.
+	if b.inlineable() {
+		b.free()
+		return b.write(), nil
+	}
+	if err := b.spill(); err != nil {
+		return nil, err
+	}
+
+	// Update the bucket header in the parent bucket.
+	value := make([]byte, b.headerSize())
+	b.writeHeader(value)
+	return value, nil
+}
+
 // inlineable returns true if a bucket is small enough to be written inline
 // and if it contains no subbuckets. Otherwise, returns false.
 func (b *Bucket) inlineable() bool {
@@ -832,19 +1138,33 @@ func (b *Bucket) maxInlineBucketSize() uintptr {
 func (b *Bucket) write() []byte {
 	// Allocate the appropriate size.
 	var n = b.rootNode
-	var value = make([]byte, common.BucketHeaderSize+n.size())
+	var value = make([]byte, b.headerSize()+n.size())
 
 	// Write a bucket header.
-	var bucket = (*common.InBucket)(unsafe.Pointer(&value[0]))
-	*bucket = *b.InBucket
+	b.writeHeader(value)
 
 	// Convert byte slice to a fake page and write the root node.
-	var p = (*common.Page)(unsafe.Pointer(&value[common.BucketHeaderSize]))
+	var p = (*common.Page)(unsafe.Pointer(&value[b.headerSize()]))
 	n.write(p)
 
 	return value
 }
 
+// headerSize returns the size of the bucket header including the options record.
+func (b *Bucket) headerSize() int {
+	return common.BucketHeaderSize + b.opts.Size()
+}
+
+// writeHeader writes the bucket header and the options record to value.
+func (b *Bucket) writeHeader(value []byte) {
+	var bucket = (*common.InBucket)(unsafe.Pointer(&value[0]))
+	*bucket = *b.InBucket
+	if !b.opts.IsZero() {
+		b.opts.Write(value[common.BucketHeaderSize:])
+		b.tx.meta.SetFeatureFlags(common.MetaBucketOptionsFlag)
+	}
+}
+
 // rebalance attempts to balance all nodes.
 func (b *Bucket) rebalance() {
 	for _, n := range b.nodes {
@@ -853,6 +1173,9 @@ func (b *Bucket) rebalance() {
 	for _, child := range b.buckets {
 		child.rebalance()
 	}
+	for _, tree := range b.values {
+		tree.rebalance()
+	}
 }
 
 // node creates a node from a page and associates it with a given parent.
@@ -875,7 +1198,7 @@ func (b *Bucket) node(pgId common.Pgid, parent *node) *node {
 	// Use the inline page if this is an inline bucket.
 	var p = b.page
 	if p == nil {
-		p = b.tx.page(pgId)
+		p = b.readPage(pgId)
 	} else {
 		// if p isn't nil, then it's an inline bucket.
 		// The pgId must be 0 in this case.
@@ -903,7 +1226,7 @@ func (b *Bucket) free() {
 	var tx = b.tx
 	b.forEachPageNode(func(p *common.Page, n *node, _ int) {
 		if p != nil {
-			tx.db.freelist.free(tx.meta.Txid(), p)
+			tx.freePage(p)
 		} else {
 			n.free()
 		}
@@ -920,6 +1243,9 @@ func (b *Bucket) dereference() {
 	for _, child := range b.buckets {
 		child.dereference()
 	}
+	for _, tree := range b.values {
+		tree.dereference()
+	}
 }
 
 // pageNode returns the in-memory node, if it exists.
@@ -945,7 +1271,7 @@ func (b *Bucket) pageNode(id common.Pgid) (*common.Page, *node) {
 	}
 
 	// Finally lookup the page from the transaction if no node is materialized.
-	return b.tx.page(id), nil
+	return b.readPage(id), nil
 }
 
 // BucketStats records statistics about resources used by a bucket.
@@ -970,6 +1296,19 @@ type BucketStats struct {
 	BucketN           int // total number of buckets including the top bucket
 	InlineBucketN     int // total number on inlined buckets
 	InlineBucketInuse int // bytes used for inlined buckets (also accounted for in LeafInuse)
+
+	// Value statistics
+	CompressedValueN int // number of values stored compressed
+	ValueRawBytes    int // total size of values before compression
+	ValueStoredBytes int // total size of values as stored in leaf pages
+
+	// Blob statistics
+	BlobValueN int // number of values stored in blobs
+	BlobAlloc  int // bytes allocated for blob pages
+
+	// Chunked value statistics
+	ChunkedValueN int // number of values stored in chunks
+	ChunkedAlloc  int // bytes allocated for the pages of chunked values
 }
 
 func (s *BucketStats) Add(other BucketStats) {
@@ -989,6 +1328,16 @@ func (s *BucketStats) Add(other BucketStats) {
 	s.BucketN += other.BucketN
 	s.InlineBucketN += other.InlineBucketN
 	s.InlineBucketInuse += other.InlineBucketInuse
+
+	s.CompressedValueN += other.CompressedValueN
+	s.ValueRawBytes += other.ValueRawBytes
+	s.ValueStoredBytes += other.ValueStoredBytes
+
+	s.BlobValueN += other.BlobValueN
+	s.BlobAlloc += other.BlobAlloc
+
+	s.ChunkedValueN += other.ChunkedValueN
+	s.ChunkedAlloc += other.ChunkedAlloc
 }
 
 // cloneBytes returns a copy of a given slice.
@@ -0,0 +1,133 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+
+	"go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// Comparator defines the order of the keys in a bucket. It returns a negative
+// number if a sorts before b, zero if a == b, and a positive number if a sorts
+// after b.
+//
+// A comparator must define a total order and must return zero only for keys
+// that are byte-wise equal. It must never change its order once a bucket has
+// been created with it, or the bucket becomes unreadable.
+//
+// A comparator is only called with the keys put by the user. The hidden
+// nested buckets holding the expiry index, the secondary indexes or the
+// versions of the keys of a bucket are not passed to it: they sort before
+// all the other keys, so a comparator may reject the keys it does not expect,
+// such as the keys of the wrong length.
+type Comparator func(a, b []byte) int
+
+// BucketOptions represents the options that can be set when creating a bucket.
+// They are persisted in the bucket header and cannot be changed afterwards.
+type BucketOptions struct {
+	// Comparator is the name of the key comparator used by the bucket. The
+	// comparator must be registered in Options.Comparators every time the
+	// database is opened. An empty name keeps the default byte-wise order.
+	Comparator string
+
+	// Compression is the name of the compressor used for the values of the
+	// bucket. FlateCompression is always available; other compressors must be
+	// registered in Options.Compressors every time the database is opened.
+	// An empty name stores values uncompressed.
+	Compression string
+
+	// CompressionThreshold is the minimum size of a value, in bytes, to be
+	// compressed. Smaller values are stored as is. If zero, the
+	// DefaultCompressionThreshold is used.
+	CompressionThreshold int
+
+	// MaxVersions makes the bucket versioned, retaining up to that many
+	// previous versions of each key besides the current one. See
+	// Bucket.History.
+	MaxVersions int
+
+	// VersionRetention makes the bucket versioned, retaining the previous
+	// versions of each key which were current within that duration. If
+	// MaxVersions is also set, the versions retained must satisfy both.
+	VersionRetention time.Duration
+}
+
+// persisted converts the options to their on-disk representation.
+func (o BucketOptions) persisted() common.BucketOptions {
+	opts := common.BucketOptions{Comparator: o.Comparator, Compression: o.Compression}
+	if o.Compression != "" {
+		opts.CompressionThreshold = DefaultCompressionThreshold
+		if o.CompressionThreshold > 0 {
+			opts.CompressionThreshold = uint32(min(o.CompressionThreshold, MaxValueSize))
+		}
+	}
+	if o.MaxVersions > 0 {
+		opts.MaxVersions = uint32(min(o.MaxVersions, math.MaxUint32))
+	}
+	if o.VersionRetention > 0 {
+		opts.VersionRetention = int64(o.VersionRetention)
+	}
+	return opts
+}
+
+// Options returns the options the bucket was created with.
+func (b *Bucket) Options() BucketOptions {
+	return BucketOptions{
+		Comparator:           b.opts.Comparator,
+		Compression:          b.opts.Compression,
+		CompressionThreshold: int(b.opts.CompressionThreshold),
+		MaxVersions:          int(b.opts.MaxVersions),
+		VersionRetention:     time.Duration(b.opts.VersionRetention),
+	}
+}
+
+// compareKeys compares two keys according to the key order of the bucket.
+// With a comparator, the names of all the internal buckets, such as the
+// expiry and secondary indexes or the history of the bucket, sort before all
+// the other keys, in byte-wise order, and are never passed to the comparator.
+func (b *Bucket) compareKeys(x, y []byte) int {
+	if b.compare == nil {
+		return bytes.Compare(x, y)
+	}
+	switch xi, yi := internalKey(x), internalKey(y); {
+	case xi && yi:
+		return bytes.Compare(x, y)
+	case xi:
+		return -1
+	case yi:
+		return 1
+	}
+	return b.compare(x, y)
+}
+
+// optionsError returns an error if the comparator or the compressor used by
+// the bucket is not registered with the database.
+func (b *Bucket) optionsError() error {
+	if b.missingComparator() {
+		return fmt.Errorf("%w: %q", errors.ErrComparatorNotRegistered, b.opts.Comparator)
+	}
+	if b.opts.Compression != "" && b.compressor == nil {
+		return fmt.Errorf("%w: %q", errors.ErrCompressorNotRegistered, b.opts.Compression)
+	}
+	return nil
+}
+
+// missingComparator returns true if the bucket uses a comparator that is not
+// registered with the database.
+func (b *Bucket) missingComparator() bool {
+	return b.opts.Comparator != "" && b.compare == nil
+}
+
+// CreateBucketWithOptions creates a new top-level bucket with the given options.
+// Returns an error if the bucket already exists, if the bucket name is blank or
+// reserved, if the bucket name is too long, or if the comparator is not registered.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) CreateBucketWithOptions(name []byte, opts BucketOptions) (*Bucket, error) {
+	if !tx.inScope(name) {
+		return nil, errors.ErrBucketNotDeclared
+	}
+	return tx.root.CreateBucketWithOptions(name, opts)
+}
@@ -0,0 +1,264 @@
+package bbolt_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// uint64Desc orders 8-byte big-endian keys from the largest to the smallest.
+// It panics on keys of another length.
+func uint64Desc(a, b []byte) int {
+	if len(a) != 8 || len(b) != 8 {
+		panic(fmt.Sprintf("bad key length %d %d", len(a), len(b)))
+	}
+	x, y := binary.BigEndian.Uint64(a), binary.BigEndian.Uint64(b)
+	switch {
+	case x > y:
+		return -1
+	case x < y:
+		return 1
+	}
+	return 0
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func comparatorOptions() *bolt.Options {
+	return &bolt.Options{
+		PageSize:    4096,
+		Comparators: map[string]bolt.Comparator{"uint64-desc": uint64Desc},
+	}
+}
+
+// assertDescending verifies that b holds the keys [0, n) in descending order.
+func assertDescending(t *testing.T, b *bolt.Bucket, n uint64) {
+	require.NotNil(t, b)
+	require.Equal(t, "uint64-desc", b.Options().Comparator)
+
+	want := n
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		want--
+		require.Equal(t, want, binary.BigEndian.Uint64(k))
+		require.Equal(t, fmt.Sprintf("v%d", want), string(v))
+	}
+	require.Zero(t, want)
+}
+
+// Ensure that a bucket created with a comparator keeps its keys in that order,
+// including across page splits, nested buckets and reopening the database.
+func TestBucket_CreateBucketWithOptions_Comparator(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, comparatorOptions())
+	const n = 2000
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Comparator: "uint64-desc"})
+		if err != nil {
+			return err
+		}
+		// Insert in an interleaved order so that the tree is built by
+		// inserts in the middle of pages rather than appends.
+		for i := uint64(0); i < n; i++ {
+			k := (i * 7919) % n
+			if err := b.Put(u64(k), []byte(fmt.Sprintf("v%d", k))); err != nil {
+				return err
+			}
+		}
+
+		// A small nested bucket is stored inline.
+		child, err := b.CreateBucketWithOptions(u64(n+1), bolt.BucketOptions{Comparator: "uint64-desc"})
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < 3; i++ {
+			if err := child.Put(u64(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	verify := func() {
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			require.Equal(t, "uint64-desc", b.Options().Comparator)
+
+			require.Equal(t, []byte("v42"), b.Get(u64(42)))
+			k, _ := b.Cursor().Seek(u64(n + 5))
+			require.Equal(t, u64(n+1), k)
+
+			k, _ = b.Cursor().SeekLE(u64(n))
+			require.Equal(t, u64(n+1), k, "SeekLE returns the closest key before the target in bucket order")
+
+			var got []uint64
+			it := b.Range(bolt.RangeOptions{Start: u64(10), End: u64(5)})
+			for k, _ := it.First(); k != nil; k, _ = it.Next() {
+				got = append(got, binary.BigEndian.Uint64(k))
+			}
+			require.Equal(t, []uint64{10, 9, 8, 7, 6}, got)
+
+			child := b.Bucket(u64(n + 1))
+			require.NotNil(t, child)
+			require.Equal(t, "uint64-desc", child.Options().Comparator)
+			k, _ = child.Cursor().First()
+			require.Equal(t, u64(2), k)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	verify()
+
+	// Delete half of the keys to force rebalancing.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.DeleteBucket(u64(n+1)))
+		for i := uint64(n / 2); i < n; i++ {
+			if err := b.Delete(u64(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	db.MustClose()
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		assertDescending(t, tx.Bucket([]byte("widgets")), n/2)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that the default byte order is kept for buckets without options.
+func TestBucket_CreateBucketWithOptions_Default(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, bolt.BucketOptions{}, b.Options())
+		for _, k := range []string{"c", "a", "b"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		k, _ := b.Cursor().First()
+		require.Equal(t, []byte("a"), k)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a bucket cannot be created or opened without its comparator.
+func TestBucket_Comparator_NotRegistered(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, comparatorOptions())
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketWithOptions([]byte("nope"), bolt.BucketOptions{Comparator: "unknown"})
+		require.ErrorIs(t, err, berrors.ErrComparatorNotRegistered)
+
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Comparator: "uint64-desc"})
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < 1000; i++ {
+			if err := b.Put(u64(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustClose()
+
+	db.SetOptions(&bolt.Options{PageSize: 4096})
+	db.MustReopen()
+	defer db.MustClose()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("widgets")))
+		_, err := tx.OpenBucket([]byte("widgets"))
+		require.ErrorIs(t, err, berrors.ErrComparatorNotRegistered)
+		_, err = tx.OpenBucket([]byte("nope"))
+		require.ErrorIs(t, err, berrors.ErrBucketNotFound)
+		err = tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			require.Fail(t, "unexpected bucket", "%q", name)
+			return nil
+		})
+		require.ErrorIs(t, err, berrors.ErrComparatorNotRegistered)
+
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		require.Len(t, errs, 1)
+		require.ErrorContains(t, errs[0], `comparator "uint64-desc" is not registered`)
+		return nil
+	})
+	require.NoError(t, err)
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+
+	_, err = tx.CreateBucketIfNotExists([]byte("widgets"))
+	require.ErrorIs(t, err, berrors.ErrComparatorNotRegistered)
+	require.ErrorIs(t, tx.DeleteBucket([]byte("widgets")), berrors.ErrComparatorNotRegistered)
+}
+
+// Ensure that Compact preserves the comparator of every bucket.
+func TestCompact_Comparator(t *testing.T) {
+	src := btesting.MustCreateDBWithOption(t, comparatorOptions())
+	const n = 1000
+
+	err := src.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket([]byte("root"))
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Comparator: "uint64-desc"})
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := b.Put(u64(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, comparatorOptions())
+	require.NoError(t, err)
+	defer dst.Close()
+
+	require.NoError(t, bolt.Compact(dst, src.DB, 0))
+
+	err = dst.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			require.NoError(t, err)
+		}
+		b := tx.Bucket([]byte("root"))
+		require.Equal(t, bolt.BucketOptions{}, b.Options())
+		assertDescending(t, b.Bucket([]byte("widgets")), n)
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -39,6 +40,24 @@ func TestBucket_Get_NonExistent(t *testing.T) {
 	}
 }
 
+// Ensure that GetE returns the value of a key, and nil for a missing key.
+func TestBucket_GetE(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("bar")))
+		v, err := b.GetE([]byte("foo"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("bar"), v)
+		v, err = b.GetE([]byte("baz"))
+		require.NoError(t, err)
+		require.Nil(t, v)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
 // Ensure that a bucket can read a value that is not flushed yet.
 func TestBucket_Get_FromNode(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -790,6 +809,63 @@ func TestBucket_CreateBucket_IncompatibleValue(t *testing.T) {
 	}
 }
 
+// Ensure that creating a bucket with a reserved name returns an error.
+func TestBucket_CreateBucket_ErrBucketNameReserved(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("\x00bbolt-snapshots"))
+		require.ErrorIs(t, err, berrors.ErrBucketNameReserved)
+
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for _, name := range []string{"\x00bbolt-ttl", "\x00bbolt-indexes", "\x00bbolt-history", "\x00bbolt-future"} {
+			_, err := widgets.CreateBucket([]byte(name))
+			require.ErrorIs(t, err, berrors.ErrBucketNameReserved)
+		}
+		// A name merely starting with 0x00 is not reserved.
+		_, err = widgets.CreateBucket([]byte("\x00bbolt"))
+		require.NoError(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that creating a bucket with options and a reserved name returns an
+// error.
+func TestBucket_CreateBucketWithOptions_ErrBucketNameReserved(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketWithOptions([]byte("\x00bbolt-tx-history"), bolt.BucketOptions{MaxVersions: 1})
+		require.ErrorIs(t, err, berrors.ErrBucketNameReserved)
+
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		_, err = widgets.CreateBucketWithOptions([]byte("\x00bbolt-history"), bolt.BucketOptions{MaxVersions: 1})
+		require.ErrorIs(t, err, berrors.ErrBucketNameReserved)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that creating a bucket with a reserved name if it does not exist
+// returns an error, even if the internal bucket exists.
+func TestBucket_CreateBucketIfNotExists_ErrBucketNameReserved(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("\x00bbolt-snapshots"))
+		require.ErrorIs(t, err, berrors.ErrBucketNameReserved)
+
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, widgets.PutWithTTL([]byte("foo"), []byte("bar"), time.Hour))
+		_, err = widgets.CreateBucketIfNotExists([]byte("\x00bbolt-ttl"))
+		require.ErrorIs(t, err, berrors.ErrBucketNameReserved)
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
 // Ensure that deleting a bucket on an existing non-bucket key returns an error.
 func TestBucket_DeleteBucket_IncompatibleValue(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1280,7 +1356,9 @@ func TestBucket_Stats(t *testing.T) {
 				1*10 + 2*90 + 3*400 + longKeyLength, // leaf values: 10 * 1digit, 90*2digits, ...
 			BucketN:           1,
 			InlineBucketN:     0,
-			InlineBucketInuse: 0},
+			InlineBucketInuse: 0,
+			ValueRawBytes:     1*10 + 2*90 + 3*400 + longKeyLength,
+			ValueStoredBytes:  1*10 + 2*90 + 3*400 + longKeyLength},
 		16384: {
 			BranchPageN:     1,
 			BranchOverflowN: 0,
@@ -1298,7 +1376,9 @@ func TestBucket_Stats(t *testing.T) {
 				1*10 + 2*90 + 3*400 + longKeyLength, // leaf values: 10 * 1digit, 90*2digits, ...
 			BucketN:           1,
 			InlineBucketN:     0,
-			InlineBucketInuse: 0},
+			InlineBucketInuse: 0,
+			ValueRawBytes:     1*10 + 2*90 + 3*400 + longKeyLength,
+			ValueStoredBytes:  1*10 + 2*90 + 3*400 + longKeyLength},
 		65536: {
 			BranchPageN:     1,
 			BranchOverflowN: 0,
@@ -1316,7 +1396,9 @@ func TestBucket_Stats(t *testing.T) {
 				1*10 + 2*90 + 3*400 + longKeyLength, // leaf values: 10 * 1digit, 90*2digits, ...
 			BucketN:           1,
 			InlineBucketN:     0,
-			InlineBucketInuse: 0},
+			InlineBucketInuse: 0,
+			ValueRawBytes:     1*10 + 2*90 + 3*400 + longKeyLength,
+			ValueStoredBytes:  1*10 + 2*90 + 3*400 + longKeyLength},
 	}
 
 	if err := db.View(func(tx *bolt.Tx) error {
@@ -1772,7 +1854,9 @@ func TestBucket_Stats_Large(t *testing.T) {
 			LeafInuse:         2596916,
 			BucketN:           1,
 			InlineBucketN:     0,
-			InlineBucketInuse: 0},
+			InlineBucketInuse: 0,
+			ValueRawBytes:     488890,
+			ValueStoredBytes:  488890},
 		16384: {
 			BranchPageN:       1,
 			BranchOverflowN:   0,
@@ -1786,7 +1870,9 @@ func TestBucket_Stats_Large(t *testing.T) {
 			LeafInuse:         2582452,
 			BucketN:           1,
 			InlineBucketN:     0,
-			InlineBucketInuse: 0},
+			InlineBucketInuse: 0,
+			ValueRawBytes:     488890,
+			ValueStoredBytes:  488890},
 		65536: {
 			BranchPageN:       1,
 			BranchOverflowN:   0,
@@ -1800,7 +1886,9 @@ func TestBucket_Stats_Large(t *testing.T) {
 			LeafInuse:         2578948,
 			BucketN:           1,
 			InlineBucketN:     0,
-			InlineBucketInuse: 0},
+			InlineBucketInuse: 0,
+			ValueRawBytes:     488890,
+			ValueStoredBytes:  488890},
 	}
 
 	if err := db.View(func(tx *bolt.Tx) error {
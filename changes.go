@@ -0,0 +1,383 @@
+package bbolt
+
+import (
+	"bytes"
+	"sync"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// DefaultSubscribeBufferSize is the number of change sets buffered for a
+// subscriber when SubscribeOptions.BufferSize is not set.
+const DefaultSubscribeBufferSize = 64
+
+// ChangeOp is the kind of a Change.
+type ChangeOp int
+
+const (
+	// ChangePut sets the value of a key.
+	ChangePut ChangeOp = iota + 1
+	// ChangeDelete deletes a key.
+	ChangeDelete
+	// ChangeCreateBucket creates a nested bucket.
+	ChangeCreateBucket
+	// ChangeDeleteBucket deletes a nested bucket along with its content.
+	ChangeDeleteBucket
+	// ChangeMoveBucket moves a nested bucket to another bucket.
+	ChangeMoveBucket
+	// ChangeWriteAt writes a range of the value of a key through a
+	// ValueHandle.
+	ChangeWriteAt
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangePut:
+		return "put"
+	case ChangeDelete:
+		return "delete"
+	case ChangeCreateBucket:
+		return "create-bucket"
+	case ChangeDeleteBucket:
+		return "delete-bucket"
+	case ChangeMoveBucket:
+		return "move-bucket"
+	case ChangeWriteAt:
+		return "write-at"
+	}
+	return "unknown"
+}
+
+// Change is a mutation made by a committed transaction.
+type Change struct {
+	Op ChangeOp
+
+	// Bucket is the path of the bucket holding Key, starting with a
+	// top-level bucket. It is empty when Key is a top-level bucket.
+	Bucket [][]byte
+
+	// Key is the changed key, or the name of the changed bucket.
+	Key []byte
+
+	// OldValue and NewValue are the values of the key before and after a
+	// ChangePut or a ChangeDelete. OldValue is nil if the key did not exist.
+	// For a ChangeWriteAt, NewValue holds the bytes written at Offset, the
+	// gap between the end of the value and Offset, if any, being filled with
+	// zeros, and OldValue is nil.
+	OldValue []byte
+	NewValue []byte
+
+	// Offset is the offset in the value a ChangeWriteAt writes at.
+	Offset int64
+
+	// Dst is the path of the bucket a ChangeMoveBucket moves the bucket to.
+	Dst [][]byte
+}
+
+// ChangeSet holds the changes of a committed transaction, in the order they
+// were made.
+type ChangeSet struct {
+	Txid    int
+	Changes []Change
+}
+
+// SubscribeOptions controls how the change sets are delivered to a
+// subscriber.
+type SubscribeOptions struct {
+	// BufferSize is the number of change sets buffered for the subscriber.
+	// If zero, DefaultSubscribeBufferSize is used.
+	BufferSize int
+
+	// Block makes commits wait for the subscriber when its buffer is full.
+	// By default the subscription is closed instead, and its Err method
+	// returns ErrSubscriberTooSlow.
+	Block bool
+}
+
+// Subscription delivers the change sets of the transactions committed after
+// it was created.
+type Subscription struct {
+	db       *DB
+	prefixes [][]byte
+	block    bool
+
+	ch     chan *ChangeSet
+	done   chan struct{}
+	once   sync.Once
+	closed bool // protected by DB.subsMu
+
+	// mu protects err, so that Err does not wait for a commit blocked on
+	// delivering to the subscriber.
+	mu  sync.Mutex
+	err error
+}
+
+// Subscribe returns a subscription to the changes of the transactions
+// committed after the transaction with the given id, in commit order. Each
+// change set is delivered once the transaction is durable, before its commit
+// returns.
+//
+// Only the changes within the top-level buckets whose names start with one
+// of the given prefixes are delivered, including the creation, deletion or
+// move of those buckets. All changes are delivered if no prefix is given.
+// Transactions without any matching change are skipped. Deleting a bucket
+// does not produce a change for each of its keys.
+//
+// A fromTxid of zero subscribes to the transactions committed from now on.
+// The id of a transaction that is already committed, usually the one of a
+// read-only transaction, can be given instead to catch up on the changes
+// committed since. Their change sets must still be held in memory, which is
+// up to Options.ChangeHistory; ErrChangesUnavailable is returned otherwise.
+//
+// Subscribe waits for the current read-write transaction to close, so it
+// must not be called from one. Change sets must not be modified.
+func (db *DB) Subscribe(prefixes [][]byte, fromTxid int, opts *SubscribeOptions) (*Subscription, error) {
+	if db.readOnly || db.follower {
+		return nil, berrors.ErrDatabaseReadOnly
+	}
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultSubscribeBufferSize
+	}
+
+	// Hold the writer lock so that all the transactions committed after
+	// subscribing record their changes.
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return nil, berrors.ErrDatabaseNotOpen
+	}
+
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+
+	s := &Subscription{
+		db:       db,
+		prefixes: make([][]byte, 0, len(prefixes)),
+		block:    opts.Block,
+		done:     make(chan struct{}),
+	}
+	for _, prefix := range prefixes {
+		s.prefixes = append(s.prefixes, cloneBytes(prefix))
+	}
+
+	var backlog []*ChangeSet
+	if fromTxid > 0 && common.Txid(fromTxid) < db.changesTxid {
+		if len(db.changeHistory) == 0 || db.changeHistory[0].Txid > fromTxid+1 {
+			return nil, berrors.ErrChangesUnavailable
+		}
+		for _, cs := range db.changeHistory {
+			if cs.Txid <= fromTxid {
+				continue
+			}
+			if cs = s.filter(cs); cs != nil {
+				backlog = append(backlog, cs)
+			}
+		}
+	}
+
+	s.ch = make(chan *ChangeSet, size+len(backlog))
+	for _, cs := range backlog {
+		s.ch <- cs
+	}
+	db.subs = append(db.subs, s)
+	db.captureChanges.Store(true)
+	return s, nil
+}
+
+// C returns the channel the change sets are delivered on. It is closed when
+// the subscription is closed.
+func (s *Subscription) C() <-chan *ChangeSet {
+	return s.ch
+}
+
+// Err returns the reason why the subscription was closed by the database:
+// ErrSubscriberTooSlow, or ErrDatabaseNotOpen if the database was closed. It
+// returns nil while the subscription is open or after Close is called.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// setErr records the reason why the subscription is closed by the database.
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// Close stops the delivery of the change sets and closes the channel.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		// Unblock a commit waiting to deliver a change set.
+		close(s.done)
+
+		db := s.db
+		db.subsMu.Lock()
+		defer db.subsMu.Unlock()
+		if !s.closed {
+			db.removeSubscription(s)
+		}
+	})
+}
+
+// filter returns the changes of cs matching the prefixes of the
+// subscription, or nil if there is none.
+func (s *Subscription) filter(cs *ChangeSet) *ChangeSet {
+	if len(s.prefixes) == 0 {
+		if len(cs.Changes) == 0 {
+			return nil
+		}
+		return cs
+	}
+
+	var changes []Change
+	for _, ch := range cs.Changes {
+		if s.match(ch.Bucket, ch.Key) || (ch.Op == ChangeMoveBucket && s.match(ch.Dst, ch.Key)) {
+			changes = append(changes, ch)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return &ChangeSet{Txid: cs.Txid, Changes: changes}
+}
+
+// match returns whether the top-level bucket of a key matches a prefix.
+func (s *Subscription) match(path [][]byte, key []byte) bool {
+	name := key
+	if len(path) > 0 {
+		name = path[0]
+	}
+	for _, prefix := range s.prefixes {
+		if bytes.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends a change set to the subscriber and returns whether the
+// subscription is still open. DB.subsMu must be held.
+func (s *Subscription) deliver(cs *ChangeSet) bool {
+	if cs = s.filter(cs); cs == nil {
+		return true
+	}
+	if s.block {
+		select {
+		case s.ch <- cs:
+		case <-s.done:
+		}
+		return true
+	}
+	select {
+	case s.ch <- cs:
+		return true
+	default:
+		s.setErr(berrors.ErrSubscriberTooSlow)
+		return false
+	}
+}
+
+// removeSubscription closes the channel of a subscription and stops
+// recording the changes if nothing needs them anymore. DB.subsMu must be
+// held.
+func (db *DB) removeSubscription(s *Subscription) {
+	for i, sub := range db.subs {
+		if sub == s {
+			db.subs = append(db.subs[:i], db.subs[i+1:]...)
+			break
+		}
+	}
+	s.closed = true
+	close(s.ch)
+	if len(db.subs) == 0 && db.changeHistorySize == 0 {
+		db.captureChanges.Store(false)
+	}
+}
+
+// publishChanges delivers the changes of a transaction that has just been
+// committed and adds them to the history.
+func (db *DB) publishChanges(tx *Tx) {
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+
+	db.changesTxid = tx.meta.Txid()
+	if tx.changes == nil {
+		return
+	}
+	cs := &ChangeSet{Txid: int(tx.meta.Txid()), Changes: tx.changes.changes}
+
+	if db.changeHistorySize > 0 {
+		if len(db.changeHistory) == db.changeHistorySize {
+			db.changeHistory[0] = nil
+			db.changeHistory = db.changeHistory[1:]
+		}
+		db.changeHistory = append(db.changeHistory, cs)
+	}
+
+	for _, s := range append([]*Subscription(nil), db.subs...) {
+		if !s.deliver(cs) {
+			db.removeSubscription(s)
+		}
+	}
+}
+
+// closeSubscriptions closes all the subscriptions when the database closes.
+func (db *DB) closeSubscriptions() {
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+	for len(db.subs) > 0 {
+		s := db.subs[0]
+		s.setErr(berrors.ErrDatabaseNotOpen)
+		db.removeSubscription(s)
+	}
+	db.changeHistory = nil
+}
+
+// changeLog records the changes of a read-write transaction while there is a
+// subscriber or a change history. Its methods do nothing on a nil log.
+type changeLog struct {
+	changes []Change
+}
+
+// newChangeLog returns a log if the changes of a transaction starting now
+// must be recorded.
+func (db *DB) newChangeLog() *changeLog {
+	if !db.captureChanges.Load() {
+		return nil
+	}
+	return &changeLog{}
+}
+
+// add records a change to a key or a nested bucket of b. The key and the new
+// value are copied; the old value must already be a non-nil copy if the key
+// existed.
+func (l *changeLog) add(b *Bucket, ch Change) {
+	if l == nil {
+		return
+	}
+	ch.Bucket = bytesPath(b.path())
+	ch.Key = cloneBytes(ch.Key)
+	if ch.Op == ChangePut || ch.Op == ChangeWriteAt {
+		ch.NewValue = append([]byte{}, ch.NewValue...)
+	}
+	l.changes = append(l.changes, ch)
+}
+
+// bytesPath converts a bucket path.
+func bytesPath(path []string) [][]byte {
+	if len(path) == 0 {
+		return nil
+	}
+	p := make([][]byte, len(path))
+	for i, name := range path {
+		p[i] = []byte(name)
+	}
+	return p
+}
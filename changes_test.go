@@ -0,0 +1,221 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// Ensure that the changes of a committed transaction are delivered in order,
+// with the old and new values of the keys.
+func TestDB_Subscribe(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("old"))
+	})
+	require.NoError(t, err)
+
+	s, err := db.Subscribe(nil, 0, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var txid int
+	err = db.Update(func(tx *bolt.Tx) error {
+		txid = tx.ID()
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("foo"), []byte("new")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("bar"), []byte("baz")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("bar")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("missing")); err != nil {
+			return err
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if err := child.Put([]byte("key"), []byte("value")); err != nil {
+			return err
+		}
+		if err := tx.MoveBucket([]byte("child"), b, nil); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte("child"))
+	})
+	require.NoError(t, err)
+
+	cs := <-s.C()
+	require.Equal(t, txid, cs.Txid)
+	widgets := [][]byte{[]byte("widgets")}
+	require.Equal(t, []bolt.Change{
+		{Op: bolt.ChangePut, Bucket: widgets, Key: []byte("foo"), OldValue: []byte("old"), NewValue: []byte("new")},
+		{Op: bolt.ChangePut, Bucket: widgets, Key: []byte("bar"), NewValue: []byte("baz")},
+		{Op: bolt.ChangeDelete, Bucket: widgets, Key: []byte("bar"), OldValue: []byte("baz")},
+		{Op: bolt.ChangeCreateBucket, Bucket: widgets, Key: []byte("child")},
+		{Op: bolt.ChangePut, Bucket: [][]byte{[]byte("widgets"), []byte("child")}, Key: []byte("key"), NewValue: []byte("value")},
+		{Op: bolt.ChangeMoveBucket, Bucket: widgets, Key: []byte("child")},
+		{Op: bolt.ChangeDeleteBucket, Key: []byte("child")},
+	}, cs.Changes)
+
+	// Transactions without changes are not delivered.
+	err = db.Update(func(tx *bolt.Tx) error { return nil })
+	require.NoError(t, err)
+	select {
+	case cs := <-s.C():
+		t.Fatalf("unexpected change set: %+v", cs)
+	default:
+	}
+
+	s.Close()
+	_, ok := <-s.C()
+	require.False(t, ok)
+	require.NoError(t, s.Err())
+}
+
+// Ensure that only the changes within the top-level buckets matching the
+// prefixes are delivered.
+func TestDB_Subscribe_Prefixes(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	s, err := db.Subscribe([][]byte{[]byte("user")}, 0, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, name := range []string{"widgets", "users"} {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte("bar"))
+		})
+		require.NoError(t, err)
+	}
+
+	cs := <-s.C()
+	require.Len(t, cs.Changes, 2)
+	require.Equal(t, []byte("users"), cs.Changes[0].Key)
+	require.Equal(t, [][]byte{[]byte("users")}, cs.Changes[1].Bucket)
+}
+
+// Ensure that a subscriber can catch up on the change sets held in the
+// history.
+func TestDB_Subscribe_History(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{ChangeHistory: 2})
+
+	var txids []int
+	for i := 0; i < 3; i++ {
+		err := db.Update(func(tx *bolt.Tx) error {
+			txids = append(txids, tx.ID())
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte(fmt.Sprint(i)))
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := db.Subscribe(nil, txids[0]-1, nil)
+	require.ErrorIs(t, err, berrors.ErrChangesUnavailable)
+
+	s, err := db.Subscribe(nil, txids[0], nil)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 1; i < 3; i++ {
+		cs := <-s.C()
+		require.Equal(t, txids[i], cs.Txid)
+		require.Equal(t, []byte(fmt.Sprint(i)), cs.Changes[len(cs.Changes)-1].NewValue)
+	}
+}
+
+// Ensure that a subscriber whose buffer is full is either closed or makes
+// the commits wait for it.
+func TestDB_Subscribe_BackPressure(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		t.Run(fmt.Sprintf("block=%t", block), func(t *testing.T) {
+			db := btesting.MustCreateDB(t)
+			s, err := db.Subscribe(nil, 0, &bolt.SubscribeOptions{BufferSize: 1, Block: block})
+			require.NoError(t, err)
+			defer s.Close()
+
+			const n = 5
+			done := make(chan error)
+			go func() {
+				for i := 0; i < n; i++ {
+					err := db.Update(func(tx *bolt.Tx) error {
+						_, err := tx.CreateBucket([]byte(fmt.Sprint(i)))
+						return err
+					})
+					if err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			if !block {
+				require.NoError(t, <-done)
+				var delivered int
+				for range s.C() {
+					delivered++
+				}
+				require.Equal(t, 1, delivered)
+				require.ErrorIs(t, s.Err(), berrors.ErrSubscriberTooSlow)
+				return
+			}
+
+			// Err does not wait for the commit blocked on the full buffer.
+			require.Eventually(t, func() bool { return len(s.C()) == 1 }, time.Second, time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+			require.NoError(t, s.Err())
+
+			for i := 0; i < n; i++ {
+				cs := <-s.C()
+				require.Equal(t, []byte(fmt.Sprint(i)), cs.Changes[0].Key)
+			}
+			require.NoError(t, <-done)
+		})
+	}
+}
+
+// Ensure that the changes merged by UpdateBuckets are delivered and that the
+// subscriptions are closed with the database.
+func TestDB_Subscribe_UpdateBuckets(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	s, err := db.Subscribe(nil, 0, nil)
+	require.NoError(t, err)
+
+	err = db.UpdateBuckets([][]byte{[]byte("widgets")}, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	})
+	require.NoError(t, err)
+
+	cs := <-s.C()
+	require.Len(t, cs.Changes, 2)
+	require.Equal(t, bolt.ChangePut, cs.Changes[1].Op)
+
+	db.MustClose()
+	_, ok := <-s.C()
+	require.False(t, ok)
+	require.ErrorIs(t, s.Err(), berrors.ErrDatabaseNotOpen)
+}
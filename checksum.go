@@ -0,0 +1,120 @@
+package bbolt
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// resetCheckedPages forgets which pages have had their checksum verified. It
+// is called whenever the database is remapped, as the mmap may have grown.
+func (db *DB) resetCheckedPages() {
+	if !db.pageChecksums || db.datasz == 0 {
+		db.checkedPages = nil
+		return
+	}
+	db.checkedPages = make([]atomic.Uint64, (db.datasz/db.pageSize+63)/64)
+}
+
+// uncheckPage marks a page as not verified. It must be called before the page
+// is overwritten on disk.
+func (db *DB) uncheckPage(id common.Pgid) {
+	if i := int(id / 64); i < len(db.checkedPages) {
+		w, bit := &db.checkedPages[i], uint64(1)<<(id%64)
+		for old := w.Load(); old&bit != 0 && !w.CompareAndSwap(old, old&^bit); old = w.Load() {
+		}
+	}
+}
+
+// setPageChecksum computes the checksum of a dirty page before it is written.
+func (db *DB) setPageChecksum(p *common.Page) {
+	n := (int(p.Overflow())+1)*db.pageSize - db.cipherOverhead()
+	common.SetPageChecksum(common.UnsafeByteSlice(unsafe.Pointer(p), 0, 0, n))
+}
+
+// verifyPage verifies the checksum of a page read from the database file the
+// first time it is touched. Dirty pages are not verified, as their checksum is
+// only computed when they are written.
+func (tx *Tx) verifyPage(p *common.Page) error {
+	db := tx.db
+	if !db.pageChecksums {
+		return nil
+	}
+	id := p.Id()
+	if _, ok := tx.pages[id]; ok {
+		return nil
+	}
+
+	i := int(id / 64)
+	if i >= len(db.checkedPages) {
+		return fmt.Errorf("%w: page %d: out of the mapped range", berrors.ErrPageChecksum, id)
+	}
+	w, bit := &db.checkedPages[i], uint64(1)<<(id%64)
+	if w.Load()&bit != 0 {
+		return nil
+	}
+
+	n := (int(p.Overflow()) + 1) * db.pageSize
+	if int(id)*db.pageSize+n > db.datasz {
+		return fmt.Errorf("%w: page %d: %d overflow pages exceed the mmap size", berrors.ErrPageChecksum, id, p.Overflow())
+	}
+	if !common.VerifyPageChecksum(common.UnsafeByteSlice(unsafe.Pointer(p), 0, 0, n-db.cipherOverhead())) {
+		return fmt.Errorf("%w: page %d", berrors.ErrPageChecksum, id)
+	}
+
+	for old := w.Load(); old&bit == 0 && !w.CompareAndSwap(old, old|bit); old = w.Load() {
+	}
+	return nil
+}
+
+// readPage returns a page of the bucket, verifying its checksum the first time
+// it is touched. A page failing its checksum is read as a leaf page without
+// elements, and the mismatch is recorded as the error of the transaction.
+func (b *Bucket) readPage(id common.Pgid) *common.Page {
+	p, err := b.checkedPage(id)
+	if err != nil {
+		b.tx.setErr(err)
+		return emptyPage(id)
+	}
+	return p
+}
+
+// checkedPage returns a page of the bucket, verifying its checksum the first
+// time it is touched. A checksum mismatch returns an error wrapping
+// ErrPageChecksum, which names the page and the bucket path.
+func (b *Bucket) checkedPage(id common.Pgid) (*common.Page, error) {
+	p := b.tx.page(id)
+	if err := b.tx.verifyPage(p); err != nil {
+		return nil, fmt.Errorf("%w (bucket path: %q)", err, b.path())
+	}
+	return p, nil
+}
+
+// emptyPage returns a leaf page without elements standing for the page of the
+// given id.
+func emptyPage(id common.Pgid) *common.Page {
+	buf := make([]byte, common.PageHeaderSize)
+	p := (*common.Page)(unsafe.Pointer(&buf[0]))
+	p.SetId(id)
+	p.SetFlags(common.LeafPageFlag)
+	return p
+}
+
+// setErr records the first page checksum mismatch or decryption failure met
+// by the transaction.
+func (tx *Tx) setErr(err error) {
+	tx.err.CompareAndSwap(nil, &err)
+}
+
+// path returns the names of the bucket and of its ancestors, starting with
+// the top-level bucket. It is empty for the root bucket.
+func (b *Bucket) path() []string {
+	var path []string
+	for ; b != nil && b.parent != nil; b = b.parent {
+		path = append([]string{string(b.name)}, path...)
+	}
+	return path
+}
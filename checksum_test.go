@@ -0,0 +1,150 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// Ensure that a database with page checksums, optionally encrypted, can be
+// written and read back.
+func TestDB_PageChecksums(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%t", encrypted), func(t *testing.T) {
+			opts := &bolt.Options{PageSize: 4096, PageChecksums: true}
+			if encrypted {
+				opts.Cipher = mustCipher(t, "0123456789abcdef")
+			}
+			db := btesting.MustCreateDBWithOption(t, opts)
+			fillEncrypted(t, db.DB)
+			verifyEncrypted(t, db.DB)
+
+			// The format is kept when the option is not set anymore.
+			db.MustClose()
+			db.SetOptions(&bolt.Options{PageSize: 4096, Cipher: opts.Cipher})
+			db.MustReopen()
+			verifyEncrypted(t, db.DB)
+		})
+	}
+}
+
+// Ensure that a corrupted page is reported with its id and bucket path.
+func TestDB_PageChecksums_Corruption(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, PageChecksums: true})
+
+	var pgid int
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := child.Put([]byte(fmt.Sprintf("%03d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	err = db.View(func(tx *bolt.Tx) error {
+		pgid = int(tx.Bucket([]byte("widgets")).Bucket([]byte("child")).RootPage())
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotZero(t, pgid)
+	path := db.Path()
+	db.MustClose()
+
+	// Flip a bit in the values of the child bucket.
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	buf := make([]byte, 1)
+	off := int64(pgid*4096 + 2048)
+	_, err = f.ReadAt(buf, off)
+	require.NoError(t, err)
+	buf[0] ^= 0x01
+	_, err = f.WriteAt(buf, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db.MustReopen()
+	db.ForceDisableStrictMode()
+	defer db.MustClose()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NotNil(t, b)
+		b.Bucket([]byte("child")).Get([]byte("042"))
+		return nil
+	})
+	require.ErrorIs(t, err, berrors.ErrPageChecksum)
+	require.ErrorContains(t, err, fmt.Sprintf("page %d", pgid))
+	require.ErrorContains(t, err, `["widgets" "child"]`)
+
+	// Transactions started with Begin read the page as empty and report
+	// the mismatch with Err, and cannot be committed.
+	for _, writable := range []bool{false, true} {
+		tx, err := db.Begin(writable)
+		require.NoError(t, err)
+		child := tx.Bucket([]byte("widgets")).Bucket([]byte("child"))
+		require.NoError(t, tx.Err())
+		require.Nil(t, child.Get([]byte("042")))
+		require.ErrorIs(t, tx.Err(), berrors.ErrPageChecksum)
+		v, err := child.GetE([]byte("042"))
+		require.Nil(t, v)
+		require.ErrorIs(t, err, berrors.ErrPageChecksum)
+		require.ErrorContains(t, tx.Err(), fmt.Sprintf("page %d", pgid))
+		if writable {
+			require.NoError(t, child.Put([]byte("042"), []byte("new")))
+			require.ErrorIs(t, tx.Commit(), berrors.ErrPageChecksum)
+		} else {
+			require.ErrorIs(t, tx.Rollback(), berrors.ErrPageChecksum)
+		}
+	}
+
+	// A read-only transaction iterating the page with a cursor skips its
+	// keys, and reports the mismatch with Cursor.Err and when rolled back.
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	var n int
+	c := tx.Bucket([]byte("widgets")).Bucket([]byte("child")).Cursor()
+	require.NoError(t, c.Err())
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	require.Less(t, n, 100)
+	require.ErrorIs(t, c.Err(), berrors.ErrPageChecksum)
+	err = tx.Rollback()
+	require.ErrorIs(t, err, berrors.ErrPageChecksum)
+	require.ErrorContains(t, err, fmt.Sprintf("page %d", pgid))
+	require.ErrorIs(t, tx.Rollback(), berrors.ErrTxClosed)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		// The flipped bit may also break the key order of the page.
+		require.NotEmpty(t, errs)
+		require.ErrorIs(t, errs[0], berrors.ErrPageChecksum)
+		return nil
+	})
+	require.ErrorIs(t, err, berrors.ErrPageChecksum)
+
+	// The other buckets are still readable.
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("other"))
+		return err
+	})
+	require.NoError(t, err)
+}
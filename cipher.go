@@ -0,0 +1,240 @@
+package bbolt
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// DefaultPageCacheSize is the number of decrypted pages kept in memory when
+// Options.PageCacheSize is not set.
+const DefaultPageCacheSize = 4096
+
+// Cipher encrypts the pages of a database at rest. Every page except the two
+// meta pages is encrypted when it is written, and decrypted into a page cache
+// when it is read.
+//
+// The same cipher, with the same key, must be used every time the database is
+// opened. To change the key, Compact the database into a new one opened with
+// the new cipher.
+type Cipher interface {
+	// Overhead returns the number of bytes Seal adds to a plaintext.
+	Overhead() int
+
+	// Seal encrypts and authenticates plaintext, authenticates
+	// additionalData and appends the result to dst. The additional data
+	// holds the id of the page and of the transaction writing it.
+	//
+	// Seal must use a fresh nonce every time it is called: the same page id
+	// is written again with the same transaction id when a transaction fails
+	// and the next one reuses its pages, so neither can make a nonce unique.
+	Seal(dst, plaintext, additionalData []byte) ([]byte, error)
+
+	// Open decrypts and authenticates ciphertext, authenticates
+	// additionalData and appends the resulting plaintext to dst.
+	Open(dst, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// aesGCMCipher implements Cipher using AES-GCM with a random 96-bit nonce,
+// which is stored before the ciphertext. The nonce does not depend on the page
+// and transaction ids, so that it does not repeat when a transaction fails and
+// its page ids are reused with the same transaction id.
+type aesGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCipher returns a Cipher using AES-GCM with the given key, which
+// must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+//
+// As the nonces are random, a key must not encrypt more than 2^32 pages, after
+// which a nonce is likely to repeat; rotate the key before, by compacting the
+// database into a new one.
+func NewAESGCMCipher(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMCipher{aead: aead}, nil
+}
+
+func (c *aesGCMCipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func (c *aesGCMCipher) Seal(dst, plaintext, additionalData []byte) ([]byte, error) {
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce[:]...)
+	return c.aead.Seal(dst, nonce[:], plaintext, additionalData), nil
+}
+
+func (c *aesGCMCipher) Open(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return c.aead.Open(dst, ciphertext[:n], ciphertext[n:], additionalData)
+}
+
+// pageCache is a bounded LRU cache of decrypted pages.
+//
+// Evicting a page does not invalidate references to it: transactions keep
+// using the buffer, which is reclaimed once it is no longer referenced.
+type pageCache struct {
+	mu    sync.Mutex
+	size  int
+	lru   *list.List
+	pages map[common.Pgid]*list.Element
+}
+
+type pageCacheEntry struct {
+	id  common.Pgid
+	buf []byte
+}
+
+func newPageCache(size int) *pageCache {
+	if size <= 0 {
+		size = DefaultPageCacheSize
+	}
+	return &pageCache{
+		size:  size,
+		lru:   list.New(),
+		pages: make(map[common.Pgid]*list.Element),
+	}
+}
+
+func (c *pageCache) get(id common.Pgid) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.pages[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*pageCacheEntry).buf, true
+}
+
+func (c *pageCache) put(id common.Pgid, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.pages[id]; ok {
+		e.Value.(*pageCacheEntry).buf = buf
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.pages[id] = c.lru.PushFront(&pageCacheEntry{id: id, buf: buf})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.pages, e.Value.(*pageCacheEntry).id)
+	}
+}
+
+// evict removes a page from the cache. It must be called before the page is
+// overwritten on disk.
+func (c *pageCache) evict(id common.Pgid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.pages[id]; ok {
+		c.lru.Remove(e)
+		delete(c.pages, id)
+	}
+}
+
+// reset removes all the pages from the cache, when the whole file is
+// replaced.
+func (c *pageCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.pages)
+}
+
+// pageOverhead returns the number of bytes at the end of every run of pages
+// that are reserved for the page checksum and the cipher.
+func (db *DB) pageOverhead() int {
+	n := db.cipherOverhead()
+	if db.pageChecksums {
+		n += common.PageChecksumSize
+	}
+	return n
+}
+
+// cipherOverhead returns the number of bytes at the end of every run of pages
+// that are reserved for the cipher and the id of the transaction which wrote
+// it.
+func (db *DB) cipherOverhead() int {
+	if db.cipher == nil {
+		return 0
+	}
+	return db.cipher.Overhead() + common.PageTxidSize
+}
+
+// checkCipher verifies that a cipher is set if and only if the database is
+// encrypted, and that the cipher can decrypt the root page.
+func (db *DB) checkCipher() error {
+	encrypted := db.meta().Flags()&common.MetaEncryptedFlag != 0
+	switch {
+	case encrypted && db.cipher == nil:
+		return berrors.ErrCipherRequired
+	case !encrypted && db.cipher != nil:
+		return berrors.ErrNotEncrypted
+	case encrypted:
+		_, err := db.decryptPage(db.meta().RootBucket().RootPage())
+		return err
+	}
+	return nil
+}
+
+// encryptPage returns the encrypted form of a run of pages written by the
+// transaction txid.
+func (db *DB) encryptPage(p *common.Page, txid common.Txid) ([]byte, error) {
+	buf := common.UnsafeByteSlice(unsafe.Pointer(p), 0, 0, (int(p.Overflow())+1)*db.pageSize)
+	return common.SealPage(buf, db.cipherOverhead(), txid, db.cipher.Seal)
+}
+
+// decryptPage decrypts the run of pages starting at the given page id.
+func (db *DB) decryptPage(id common.Pgid) ([]byte, error) {
+	p := db.rawPage(id)
+	n := (int(p.Overflow()) + 1) * db.pageSize
+	if int(id)*db.pageSize+n > db.datasz {
+		return nil, fmt.Errorf("%w: page %d: %d overflow pages exceed the mmap size", berrors.ErrDecrypt, id, p.Overflow())
+	}
+	buf, err := common.OpenPage(common.UnsafeByteSlice(unsafe.Pointer(p), 0, 0, n), db.cipher.Open)
+	if err != nil {
+		return nil, fmt.Errorf("%w: page %d: %v", berrors.ErrDecrypt, id, err)
+	}
+	return buf, nil
+}
+
+// openPage retrieves the page with the given id for a transaction reading
+// the state committed by txid, decrypting it into the page cache. As the
+// txid which wrote a page is authenticated along with it, a page written
+// after txid can only be the result of tampering and is rejected.
+func (db *DB) openPage(id common.Pgid, txid common.Txid) (*common.Page, error) {
+	buf, ok := db.pageCache.get(id)
+	if !ok {
+		var err error
+		if buf, err = db.decryptPage(id); err != nil {
+			return nil, err
+		}
+		db.pageCache.put(id, buf)
+	}
+	if written := common.SealedPageTxid(buf); written > txid {
+		return nil, fmt.Errorf("%w: page %d: written by txid %d after txid %d", berrors.ErrDecrypt, id, written, txid)
+	}
+	return (*common.Page)(unsafe.Pointer(&buf[0])), nil
+}
@@ -0,0 +1,229 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+var secret = []byte("top-secret-value")
+
+func mustCipher(t testing.TB, key string) bolt.Cipher {
+	c, err := bolt.NewAESGCMCipher([]byte(key))
+	require.NoError(t, err)
+	return c
+}
+
+// fillEncrypted writes small values, values spanning overflow pages and
+// nested buckets, then deletes some of them to recycle pages.
+func fillEncrypted(t testing.TB, db *bolt.DB) {
+	for round := 0; round < 3; round++ {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 500; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%d-%04d", round, i)), secret); err != nil {
+					return err
+				}
+			}
+			if err := b.Put([]byte(fmt.Sprintf("large-%d", round)), bytes.Repeat(secret, 1000)); err != nil {
+				return err
+			}
+			child, err := b.CreateBucketIfNotExists([]byte("child"))
+			if err != nil {
+				return err
+			}
+			return child.Put([]byte(fmt.Sprintf("%d", round)), secret)
+		})
+		require.NoError(t, err)
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 500; i += 2 {
+			if err := b.Delete([]byte(fmt.Sprintf("1-%04d", i))); err != nil {
+				return err
+			}
+		}
+		return b.Delete([]byte("large-1"))
+	})
+	require.NoError(t, err)
+}
+
+func verifyEncrypted(t testing.TB, db *bolt.DB) {
+	err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			require.NoError(t, err)
+		}
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, secret, b.Get([]byte("0-0000")))
+		require.Nil(t, b.Get([]byte("1-0000")))
+		require.Equal(t, secret, b.Get([]byte("1-0001")))
+		require.Equal(t, bytes.Repeat(secret, 1000), b.Get([]byte("large-2")))
+		require.Nil(t, b.Get([]byte("large-1")))
+		require.Equal(t, secret, b.Bucket([]byte("child")).Get([]byte("2")))
+		// Keys, large values, the child bucket and its keys.
+		require.Equal(t, 500*3-250+2+1+3, b.Stats().KeyN)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that the AES-GCM nonces are random and that sealed pages can be
+// opened.
+func TestAESGCMCipher_Nonce(t *testing.T) {
+	c := mustCipher(t, "0123456789abcdef")
+	nonces := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		sealed, err := c.Seal(nil, secret, nil)
+		require.NoError(t, err)
+		// No part of the nonce repeats either.
+		nonce := string(sealed[:8])
+		require.False(t, nonces[nonce])
+		nonces[nonce] = true
+		opened, err := c.Open(nil, sealed, nil)
+		require.NoError(t, err)
+		require.Equal(t, secret, opened)
+	}
+}
+
+// Ensure that an encrypted database is readable and never stores plaintext.
+func TestDB_Cipher(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		PageSize:      4096,
+		Cipher:        mustCipher(t, "0123456789abcdef0123456789abcdef"),
+		PageCacheSize: 8,
+	})
+	fillEncrypted(t, db.DB)
+	verifyEncrypted(t, db.DB)
+
+	data, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(data, secret), "database file contains plaintext")
+
+	var buf bytes.Buffer
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	})
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(buf.Bytes(), secret), "backup contains plaintext")
+
+	db.MustClose()
+	db.MustReopen()
+	verifyEncrypted(t, db.DB)
+}
+
+// Ensure that opening a database with the wrong cipher fails.
+func TestOpen_Cipher_Mismatch(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "encrypted.db")
+	db, err := bolt.Open(path, 0600, &bolt.Options{Cipher: mustCipher(t, "0123456789abcdef")})
+	require.NoError(t, err)
+	fillEncrypted(t, db)
+	require.NoError(t, db.Close())
+
+	_, err = bolt.Open(path, 0600, nil)
+	require.ErrorIs(t, err, berrors.ErrCipherRequired)
+
+	_, err = bolt.Open(path, 0600, &bolt.Options{Cipher: mustCipher(t, "fedcba9876543210")})
+	require.ErrorIs(t, err, berrors.ErrDecrypt)
+
+	plain := filepath.Join(dir, "plain.db")
+	db, err = bolt.Open(plain, 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = bolt.Open(plain, 0600, &bolt.Options{Cipher: mustCipher(t, "0123456789abcdef")})
+	require.ErrorIs(t, err, berrors.ErrNotEncrypted)
+}
+
+// Ensure that Compact can be used to rotate the encryption key.
+func TestCompact_Cipher(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := "0123456789abcdef", "fedcba9876543210"
+
+	src, err := bolt.Open(filepath.Join(dir, "src.db"), 0600, &bolt.Options{Cipher: mustCipher(t, oldKey)})
+	require.NoError(t, err)
+	defer src.Close()
+	fillEncrypted(t, src)
+
+	path := filepath.Join(dir, "dst.db")
+	dst, err := bolt.Open(path, 0600, &bolt.Options{Cipher: mustCipher(t, newKey)})
+	require.NoError(t, err)
+	require.NoError(t, bolt.Compact(dst, src, 4096))
+	verifyEncrypted(t, dst)
+	require.NoError(t, dst.Close())
+
+	_, err = bolt.Open(path, 0600, &bolt.Options{Cipher: mustCipher(t, oldKey)})
+	require.ErrorIs(t, err, berrors.ErrDecrypt)
+}
+
+// Ensure that a tampered page of an encrypted database, including the id of
+// the transaction which wrote it, fails the transaction reading it instead of
+// crashing the process.
+func TestDB_Cipher_TamperedPage(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		offset func(pageSize, n int) int
+	}{
+		{name: "ciphertext", offset: func(pageSize, n int) int { return 100 }},
+		{name: "txid", offset: func(pageSize, n int) int { return n*pageSize - 1 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "encrypted.db")
+			options := &bolt.Options{Cipher: mustCipher(t, "0123456789abcdef")}
+			db, err := bolt.Open(path, 0600, options)
+			require.NoError(t, err)
+			fillEncrypted(t, db)
+
+			var offset int64
+			err = db.View(func(tx *bolt.Tx) error {
+				id := tx.Bucket([]byte("widgets")).Root()
+				info, err := tx.Page(int(id))
+				require.NoError(t, err)
+				n := info.OverflowCount + 1
+				offset = int64(int(id)*db.Info().PageSize + tc.offset(db.Info().PageSize, n))
+				return nil
+			})
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0600)
+			require.NoError(t, err)
+			b := make([]byte, 1)
+			_, err = f.ReadAt(b, offset)
+			require.NoError(t, err)
+			b[0] ^= 0xff
+			_, err = f.WriteAt(b, offset)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			db, err = bolt.Open(path, 0600, options)
+			require.NoError(t, err)
+			defer db.Close()
+
+			err = db.View(func(tx *bolt.Tx) error {
+				require.Nil(t, tx.Bucket([]byte("widgets")).Get([]byte("0-0000")))
+				return nil
+			})
+			require.ErrorIs(t, err, berrors.ErrDecrypt)
+
+			err = db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte("key"), secret)
+			})
+			require.ErrorIs(t, err, berrors.ErrDecrypt)
+		})
+	}
+}
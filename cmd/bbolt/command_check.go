@@ -12,10 +12,12 @@ import (
 
 type checkOptions struct {
 	fromPageID uint64
+	keyFile    string
 }
 
 func (o *checkOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.Uint64VarP(&o.fromPageID, "from-page", "", o.fromPageID, "check db integrity starting from the given page ID")
+	fs.StringVarP(&o.keyFile, "key-file", "", o.keyFile, "path to a file holding the hex encoded key of an encrypted db")
 }
 
 func newCheckCommand() *cobra.Command {
@@ -38,10 +40,16 @@ func checkFunc(cmd *cobra.Command, dbPath string, cfg checkOptions) error {
 		return err
 	}
 
+	cipher, err := readKeyFile(cfg.keyFile)
+	if err != nil {
+		return err
+	}
+
 	// Open database.
 	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
 		ReadOnly:        true,
 		PreLoadFreelist: true,
+		Cipher:          cipher,
 	})
 	if err != nil {
 		return err
@@ -7,7 +7,9 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	bolt "go.etcd.io/bbolt"
 	main "go.etcd.io/bbolt/cmd/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
 	"go.etcd.io/bbolt/internal/btesting"
 	"go.etcd.io/bbolt/internal/guts_cli"
 )
@@ -64,3 +66,29 @@ func TestCheckCommand_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckCommand_Run_Encrypted(t *testing.T) {
+	keyFile, cipher := mustKeyFile(t, "0123456789abcdef")
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{Cipher: cipher})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	})
+	require.NoError(t, err)
+	db.Close()
+	defer requireDBNoChange(t, dbData(t, db.Path()), db.Path())
+
+	rootCmd := main.NewRootCommand()
+	outputBuf := bytes.NewBufferString("")
+	rootCmd.SetOut(outputBuf)
+	rootCmd.SetArgs([]string{"check", db.Path(), "--key-file", keyFile})
+	require.NoError(t, rootCmd.Execute())
+	require.Equal(t, "OK\n", outputBuf.String())
+
+	rootCmd = main.NewRootCommand()
+	rootCmd.SetArgs([]string{"check", db.Path()})
+	require.ErrorIs(t, rootCmd.Execute(), berrors.ErrCipherRequired)
+}
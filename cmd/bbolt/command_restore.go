@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+type restoreOptions struct {
+	outputDBFilePath string
+}
+
+func (o *restoreOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.outputDBFilePath, "output", o.outputDBFilePath, "path to the restored db file")
+	_ = cobra.MarkFlagRequired(fs, "output")
+}
+
+func (o *restoreOptions) Validate() error {
+	if o.outputDBFilePath == "" {
+		return errors.New("output database path wasn't given, specify output database file path with --output option")
+	}
+	return nil
+}
+
+func newRestoreCommand() *cobra.Command {
+	var o restoreOptions
+	restoreCmd := &cobra.Command{
+		Use:   "restore <full-backup> [incremental-backup...]",
+		Short: "restore a database from a full backup and the incremental backups taken since",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := o.Validate(); err != nil {
+				return err
+			}
+			return restoreFunc(cmd, args[0], args[1:], o)
+		},
+	}
+
+	o.AddFlags(restoreCmd.Flags())
+	return restoreCmd
+}
+
+func restoreFunc(cmd *cobra.Command, fullPath string, incrementalPaths []string, cfg restoreOptions) error {
+	if _, err := checkSourceDBPath(fullPath); err != nil {
+		return err
+	}
+
+	if err := common.CopyFile(fullPath, cfg.outputDBFilePath); err != nil {
+		return fmt.Errorf("[restore] copy file failed: %w", err)
+	}
+
+	// Each incremental backup must start from the transaction the previous
+	// one brought the database to.
+	for _, path := range incrementalPaths {
+		if err := bolt.ApplyIncremental(cfg.outputDBFilePath, path); err != nil {
+			return fmt.Errorf("[restore] applying %q failed: %w", path, err)
+		}
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Restored %q from %d backups.\n", cfg.outputDBFilePath, len(incrementalPaths)+1)
+	return nil
+}
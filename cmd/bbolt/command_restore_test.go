@@ -0,0 +1,84 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	main "go.etcd.io/bbolt/cmd/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+func TestRestoreCommand_Run(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{IncrementalBackup: true})
+	dir := t.TempDir()
+
+	put := func(key string) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), []byte("value"))
+		})
+		require.NoError(t, err)
+	}
+
+	// Take a full backup, then two incremental backups.
+	put("0")
+	paths := []string{filepath.Join(dir, "full")}
+	var since int
+	err := db.View(func(tx *bolt.Tx) error {
+		since = tx.ID()
+		return tx.CopyFile(paths[0], 0600)
+	})
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		put(fmt.Sprint(i))
+		path := filepath.Join(dir, fmt.Sprintf("inc%d", i))
+		err := db.View(func(tx *bolt.Tx) error {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = tx.WriteIncremental(f, since)
+			since = tx.ID()
+			return err
+		})
+		require.NoError(t, err)
+		paths = append(paths, path)
+	}
+	db.Close()
+	defer requireDBNoChange(t, dbData(t, paths[0]), paths[0])
+
+	t.Log("Running restore cmd")
+	output := filepath.Join(dir, "restored")
+	rootCmd := main.NewRootCommand()
+	outputBuf := bytes.NewBufferString("")
+	rootCmd.SetOut(outputBuf)
+	rootCmd.SetArgs(append([]string{"restore", "--output", output}, paths...))
+	require.NoError(t, rootCmd.Execute())
+	require.Contains(t, outputBuf.String(), "from 3 backups")
+
+	t.Log("Checking restored db")
+	rdb, err := bolt.Open(output, 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer rdb.Close()
+	err = rdb.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 3, tx.Bucket([]byte("widgets")).Stats().KeyN)
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Log("Running restore cmd with a missing link")
+	rootCmd = main.NewRootCommand()
+	rootCmd.SetArgs([]string{"restore", "--output", filepath.Join(dir, "broken"), paths[0], paths[2]})
+	require.ErrorIs(t, rootCmd.Execute(), berrors.ErrIncrementalMismatch)
+}
@@ -21,6 +21,8 @@ func NewRootCommand() *cobra.Command {
 		newSurgeryCommand(),
 		newInspectCommand(),
 		newCheckCommand(),
+		newRestoreCommand(),
+		newSnapshotsCommand(),
 	)
 
 	return rootCmd
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type snapshotsOptions struct {
+	keyFile string
+}
+
+func (o *snapshotsOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&o.keyFile, "key-file", "", o.keyFile, "path to a file holding the hex encoded key of an encrypted db")
+}
+
+func newSnapshotsCommand() *cobra.Command {
+	var o snapshotsOptions
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots <bbolt-file>",
+		Short: "list the named snapshots of bbolt database and the space they pin",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return snapshotsFunc(cmd, args[0], o)
+		},
+	}
+
+	o.AddFlags(snapshotsCmd.Flags())
+	return snapshotsCmd
+}
+
+func snapshotsFunc(cmd *cobra.Command, dbPath string, cfg snapshotsOptions) error {
+	if _, err := checkSourceDBPath(dbPath); err != nil {
+		return err
+	}
+
+	cipher, err := readKeyFile(cfg.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// Open database.
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
+		ReadOnly: true,
+		Cipher:   cipher,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	infos, err := db.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTXID\tPINNED SIZE")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", info.Name, info.Txid, info.PinnedSize)
+	}
+	return w.Flush()
+}
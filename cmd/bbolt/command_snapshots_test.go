@@ -0,0 +1,40 @@
+package main_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	main "go.etcd.io/bbolt/cmd/bbolt"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+func TestSnapshotsCommand_Run(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	put := func(value string) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte(value))
+		})
+		require.NoError(t, err)
+	}
+	put("bar")
+	require.NoError(t, db.CreateSnapshot("before-upgrade"))
+	put("baz")
+	db.Close()
+	defer requireDBNoChange(t, dbData(t, db.Path()), db.Path())
+
+	t.Log("Running snapshots cmd")
+	rootCmd := main.NewRootCommand()
+	outputBuf := bytes.NewBufferString("")
+	rootCmd.SetOut(outputBuf)
+	rootCmd.SetArgs([]string{"snapshots", db.Path()})
+	require.NoError(t, rootCmd.Execute())
+	require.Contains(t, outputBuf.String(), "NAME")
+	require.Regexp(t, `before-upgrade\s+\d+\s+[1-9]\d*\n`, outputBuf.String())
+}
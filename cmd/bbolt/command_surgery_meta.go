@@ -212,12 +212,14 @@ func updateMetaField(m *common.Meta, fields map[string]uint64) bool {
 		m.SetMagic(common.Magic)
 		changed = true
 	}
-	if m.Version() != common.Version {
+	if m.Version() != common.Version && m.Version() != common.FeatureVersion {
 		m.SetVersion(common.Version)
 		changed = true
 	}
-	if m.Flags() != common.MetaPageFlag {
-		m.SetFlags(common.MetaPageFlag)
+	// The flags of the meta tell the features the file uses, so only the
+	// unknown ones are cleared.
+	if m.Flags()&^common.MetaFlags != 0 {
+		m.SetFlags(m.Flags() & common.MetaFlags)
 		changed = true
 	}
 
@@ -251,6 +251,7 @@ func (cmd *dumpCommand) Run(args ...string) error {
 	// Parse flags.
 	fs := flag.NewFlagSet("", flag.ContinueOnError)
 	help := fs.Bool("h", false, "")
+	keyFile := fs.String("key-file", "", "")
 	if err := fs.Parse(args); err != nil {
 		return err
 	} else if *help {
@@ -274,6 +275,11 @@ func (cmd *dumpCommand) Run(args ...string) error {
 		return ErrPageIDRequired
 	}
 
+	cipher, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
 	// Open database to retrieve page size.
 	pageSize, _, err := guts_cli.ReadPageAndHWMSize(path)
 	if err != nil {
@@ -295,7 +301,12 @@ func (cmd *dumpCommand) Run(args ...string) error {
 		}
 
 		// Print page to stdout.
-		if err := cmd.PrintPage(cmd.Stdout, f, pageID, uint64(pageSize)); err != nil {
+		if cipher != nil {
+			err = cmd.PrintDecryptedPage(cmd.Stdout, path, pageID, pageSize, cipher)
+		} else {
+			err = cmd.PrintPage(cmd.Stdout, f, pageID, pageSize)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -305,8 +316,6 @@ func (cmd *dumpCommand) Run(args ...string) error {
 
 // PrintPage prints a given page as hexadecimal.
 func (cmd *dumpCommand) PrintPage(w io.Writer, r io.ReaderAt, pageID uint64, pageSize uint64) error {
-	const bytesPerLineN = 16
-
 	// Read page into buffer.
 	buf := make([]byte, pageSize)
 	addr := pageID * uint64(pageSize)
@@ -316,13 +325,39 @@ func (cmd *dumpCommand) PrintPage(w io.Writer, r io.ReaderAt, pageID uint64, pag
 		return io.ErrUnexpectedEOF
 	}
 
-	// Write out to writer in 16-byte lines.
+	printHexDump(w, buf, addr)
+	return nil
+}
+
+// PrintDecryptedPage prints a given page of an encrypted database, along with
+// its overflow pages, as hexadecimal. The meta pages are not encrypted and
+// are printed as is.
+func (cmd *dumpCommand) PrintDecryptedPage(w io.Writer, path string, pageID uint64, pageSize uint64, cipher bolt.Cipher) error {
+	_, buf, err := guts_cli.ReadPage(path, pageID)
+	if err != nil {
+		return err
+	}
+	if pageID > 1 {
+		if buf, err = common.OpenPage(buf, cipher.Open); err != nil {
+			return fmt.Errorf("page %d: %w", pageID, err)
+		}
+	}
+
+	printHexDump(w, buf, pageID*pageSize)
+	return nil
+}
+
+// printHexDump writes buf, located at addr in the database file, in 16-byte
+// lines of hexadecimal.
+func printHexDump(w io.Writer, buf []byte, addr uint64) {
+	const bytesPerLineN = 16
+
 	var prev []byte
 	var skipped bool
-	for offset := uint64(0); offset < pageSize; offset += bytesPerLineN {
+	for offset := uint64(0); offset < uint64(len(buf)); offset += bytesPerLineN {
 		// Retrieve current 16-byte line.
 		line := buf[offset : offset+bytesPerLineN]
-		isLastLine := (offset == (pageSize - bytesPerLineN))
+		isLastLine := (offset == (uint64(len(buf)) - bytesPerLineN))
 
 		// If it's the same as the previous line then print a skip.
 		if bytes.Equal(line, prev) && !isLastLine {
@@ -344,16 +379,21 @@ func (cmd *dumpCommand) PrintPage(w io.Writer, r io.ReaderAt, pageID uint64, pag
 		prev = line
 	}
 	fmt.Fprint(w, "\n")
-
-	return nil
 }
 
 // Usage returns the help message.
 func (cmd *dumpCommand) Usage() string {
 	return strings.TrimLeft(`
-usage: bolt dump PATH pageid [pageid...]
+usage: bolt dump [options] PATH pageid [pageid...]
 
 Dump prints a hexadecimal dump of one or more pages.
+
+Additional options include:
+
+	-key-file PATH
+		Decrypts the pages of an encrypted database with the hex encoded
+		key stored in the given file. Overflow pages are printed along
+		with the page they belong to.
 `, "\n")
 }
 
@@ -454,7 +494,7 @@ func (cmd *pageItemCommand) leafPageElement(pageBytes []byte, index uint16) ([]b
 	}
 
 	e := p.LeafPageElement(index)
-	return e.Key(), e.Value(), nil
+	return p.LeafPageKey(index), e.Value(), nil
 }
 
 const FORMAT_MODES = "auto|ascii-encoded|hex|bytes|redacted"
@@ -674,14 +714,18 @@ func (cmd *statsCommand) Run(args ...string) error {
 	return db.View(func(tx *bolt.Tx) error {
 		var s bolt.BucketStats
 		var count int
-		if err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-			if bytes.HasPrefix(name, []byte(prefix)) {
-				s.Add(b.Stats())
-				count += 1
+		// Only the buckets matching the prefix need to be opened.
+		c := tx.Cursor()
+		for name, v := c.First(); name != nil; name, v = c.Next() {
+			if v != nil || !bytes.HasPrefix(name, []byte(prefix)) {
+				continue
 			}
-			return nil
-		}); err != nil {
-			return err
+			b, err := tx.OpenBucket(name)
+			if err != nil {
+				return fmt.Errorf("bucket %q cannot be opened: %w", name, err)
+			}
+			s.Add(b.Stats())
+			count += 1
 		}
 
 		fmt.Fprintf(cmd.Stdout, "Aggregate statistics for %d buckets\n\n", count)
@@ -723,6 +767,19 @@ func (cmd *statsCommand) Run(args ...string) error {
 		}
 		fmt.Fprintf(cmd.Stdout, "\tBytes used for inlined buckets: %d (%d%%)\n", s.InlineBucketInuse, percentage)
 
+		fmt.Fprintln(cmd.Stdout, "Value statistics")
+		fmt.Fprintf(cmd.Stdout, "\tNumber of compressed values: %d\n", s.CompressedValueN)
+		fmt.Fprintf(cmd.Stdout, "\tBytes of values before compression: %d\n", s.ValueRawBytes)
+		percentage = 0
+		if s.ValueRawBytes != 0 {
+			percentage = int(float32(s.ValueStoredBytes) * 100.0 / float32(s.ValueRawBytes))
+		}
+		fmt.Fprintf(cmd.Stdout, "\tBytes of values as stored: %d (%d%%)\n", s.ValueStoredBytes, percentage)
+		fmt.Fprintf(cmd.Stdout, "\tNumber of values in blobs: %d\n", s.BlobValueN)
+		fmt.Fprintf(cmd.Stdout, "\tBytes allocated for blobs: %d\n", s.BlobAlloc)
+		fmt.Fprintf(cmd.Stdout, "\tNumber of chunked values: %d\n", s.ChunkedValueN)
+		fmt.Fprintf(cmd.Stdout, "\tBytes allocated for chunked values: %d\n", s.ChunkedAlloc)
+
 		return nil
 	})
 }
@@ -754,7 +811,7 @@ The following errors can be reported:
         A page is referenced by more than one other page.
 
     invalid type
-        The page type is not "meta", "leaf", "branch", or "freelist".
+        The page type is not "meta", "leaf", "branch", "freelist" or "blob".
 
 No errors should occur in your database. However, if for some reason you
 experience corruption, please submit a ticket to the etcd-io/bbolt project page:
@@ -1668,10 +1725,18 @@ func stringToPages(strs []string) ([]uint64, error) {
 type compactCommand struct {
 	baseCommand
 
-	SrcPath   string
-	DstPath   string
-	TxMaxSize int64
-	DstNoSync bool
+	SrcPath    string
+	DstPath    string
+	TxMaxSize  int64
+	DstNoSync  bool
+	InPlace    bool
+	Progress   bool
+	Workers    int
+	SrcKeyFile string
+	DstKeyFile string
+
+	KeyPrefixCompression bool
+	BlobThreshold        int
 }
 
 // newCompactCommand returns a CompactCommand.
@@ -1689,12 +1754,19 @@ func (cmd *compactCommand) Run(args ...string) (err error) {
 	fs.StringVar(&cmd.DstPath, "o", "", "")
 	fs.Int64Var(&cmd.TxMaxSize, "tx-max-size", 65536, "")
 	fs.BoolVar(&cmd.DstNoSync, "no-sync", false, "")
+	fs.StringVar(&cmd.SrcKeyFile, "key-file", "", "")
+	fs.StringVar(&cmd.DstKeyFile, "o-key-file", "", "")
+	fs.BoolVar(&cmd.InPlace, "in-place", false, "")
+	fs.BoolVar(&cmd.Progress, "progress", false, "")
+	fs.IntVar(&cmd.Workers, "workers", 1, "")
+	fs.BoolVar(&cmd.KeyPrefixCompression, "key-prefix-compression", false, "")
+	fs.IntVar(&cmd.BlobThreshold, "blob-threshold", 0, "")
 	if err := fs.Parse(args); err == flag.ErrHelp {
 		fmt.Fprintln(cmd.Stderr, cmd.Usage())
 		return ErrUsage
 	} else if err != nil {
 		return err
-	} else if cmd.DstPath == "" {
+	} else if cmd.DstPath == "" && !cmd.InPlace {
 		return errors.New("output file required")
 	}
 
@@ -1713,24 +1785,56 @@ func (cmd *compactCommand) Run(args ...string) (err error) {
 	}
 	initialSize := fi.Size()
 
+	srcCipher, err := readKeyFile(cmd.SrcKeyFile)
+	if err != nil {
+		return err
+	}
+	if cmd.InPlace {
+		return cmd.compactInPlace(initialSize, srcCipher)
+	}
+	dstCipher, err := readKeyFile(cmd.DstKeyFile)
+	if err != nil {
+		return err
+	}
+
 	// Open source database.
-	src, err := bolt.Open(cmd.SrcPath, 0400, &bolt.Options{ReadOnly: true})
+	src, err := bolt.Open(cmd.SrcPath, 0400, &bolt.Options{ReadOnly: true, Cipher: srcCipher})
 	if err != nil {
 		return err
 	}
 	defer src.Close()
 
 	// Open destination database.
-	dst, err := bolt.Open(cmd.DstPath, fi.Mode(), &bolt.Options{NoSync: cmd.DstNoSync})
+	dst, err := bolt.Open(cmd.DstPath, fi.Mode(), &bolt.Options{
+		NoSync:               cmd.DstNoSync,
+		Cipher:               dstCipher,
+		KeyPrefixCompression: cmd.KeyPrefixCompression,
+		BlobThreshold:        cmd.BlobThreshold,
+	})
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
 
 	// Run compaction.
-	if err := bolt.Compact(dst, src, cmd.TxMaxSize); err != nil {
+	opts := bolt.CompactOptions{TxMaxSize: cmd.TxMaxSize, Workers: cmd.Workers}
+	var progress bolt.CompactProgress
+	if cmd.Progress {
+		var last time.Time
+		opts.Progress = func(p bolt.CompactProgress) {
+			progress = p
+			if time.Since(last) >= 100*time.Millisecond {
+				last = time.Now()
+				fmt.Fprintf(cmd.Stderr, "\rcompacted %d keys, %d bytes", p.Keys, p.Bytes)
+			}
+		}
+	}
+	if err := bolt.CompactWithOptions(dst, src, opts); err != nil {
 		return err
 	}
+	if cmd.Progress {
+		fmt.Fprintf(cmd.Stderr, "\rcompacted %d keys, %d bytes\n", progress.Keys, progress.Bytes)
+	}
 
 	// Report stats on new size.
 	fi, err = os.Stat(cmd.DstPath)
@@ -1744,15 +1848,37 @@ func (cmd *compactCommand) Run(args ...string) (err error) {
 	return nil
 }
 
+// compactInPlace shrinks the source database file instead of copying it.
+func (cmd *compactCommand) compactInPlace(initialSize int64, cipher bolt.Cipher) error {
+	db, err := bolt.Open(cmd.SrcPath, 0600, &bolt.Options{
+		NoSync:               cmd.DstNoSync,
+		Cipher:               cipher,
+		KeyPrefixCompression: cmd.KeyPrefixCompression,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	shrunk, err := db.CompactInPlace(&bolt.CompactInPlaceOptions{TxMaxPages: int(cmd.TxMaxSize) / db.Info().PageSize})
+	if err != nil {
+		return err
+	}
+	size := initialSize - shrunk
+	fmt.Fprintf(cmd.Stdout, "%d -> %d bytes (gain=%.2fx)\n", initialSize, size, float64(initialSize)/float64(size))
+	return nil
+}
+
 // Usage returns the help message.
 func (cmd *compactCommand) Usage() string {
 	return strings.TrimLeft(`
 usage: bolt compact [options] -o DST SRC
+       bolt compact [options] -in-place SRC
 
 Compact opens a database at SRC path and walks it recursively, copying keys
 as they are found from all buckets, to a newly created database at DST path.
 
-The original database is left untouched.
+The original database is left untouched, unless -in-place is set.
 
 Additional options include:
 
@@ -1760,9 +1886,37 @@ Additional options include:
 		Specifies the maximum size of individual transactions.
 		Defaults to 64KB.
 
+	-in-place
+		Shrinks SRC by moving the pages at the end of the file into
+		free pages, then truncating it, instead of copying it to DST.
+
+	-progress
+		Reports the number of keys and bytes copied on stderr.
+
+	-workers NUM
+		Number of top-level buckets of SRC read concurrently, while
+		DST is written by a single writer.
+		Defaults to 1.
+
 	-no-sync BOOL
 		Skip fsync() calls after each commit (fast but unsafe)
 		Defaults to false
+
+	-key-prefix-compression
+		Writes the pages of DST, or the pages moved in SRC with
+		-in-place, with the prefix shared by their keys stored once.
+
+	-blob-threshold BYTES
+		Stores the values of DST larger than BYTES in blobs, outside
+		of the B+tree. Ignored with -in-place, which keeps the blobs.
+		Defaults to 0, storing every value in the leaf pages.
+
+	-key-file PATH
+		Path to a file holding the hex encoded key of an encrypted SRC.
+
+	-o-key-file PATH
+		Path to a file holding the hex encoded key used to encrypt DST.
+		Using a different key than -key-file rotates the encryption key.
 `, "\n")
 }
 
@@ -22,6 +22,7 @@ import (
 
 	bolt "go.etcd.io/bbolt"
 	main "go.etcd.io/bbolt/cmd/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
 )
 
 // Ensure the "info" command can print information about a database.
@@ -68,7 +69,15 @@ func TestStatsCommand_Run_EmptyDatabase(t *testing.T) {
 		"Bucket statistics\n" +
 		"\tTotal number of buckets: 0\n" +
 		"\tTotal number on inlined buckets: 0 (0%)\n" +
-		"\tBytes used for inlined buckets: 0 (0%)\n"
+		"\tBytes used for inlined buckets: 0 (0%)\n" +
+		"Value statistics\n" +
+		"\tNumber of compressed values: 0\n" +
+		"\tBytes of values before compression: 0\n" +
+		"\tBytes of values as stored: 0 (0%)\n" +
+		"\tNumber of values in blobs: 0\n" +
+		"\tBytes allocated for blobs: 0\n" +
+		"\tNumber of chunked values: 0\n" +
+		"\tBytes allocated for chunked values: 0\n"
 
 	// Run the command.
 	m := NewMain()
@@ -95,6 +104,32 @@ func TestDumpCommand_Run(t *testing.T) {
 	}
 }
 
+func TestDumpCommand_Run_Encrypted(t *testing.T) {
+	keyFile, cipher := mustKeyFile(t, "0123456789abcdef")
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, Cipher: cipher})
+	db.Close()
+
+	defer requireDBNoChange(t, dbData(t, db.Path()), db.Path())
+
+	// The empty root leaf page, including the bytes used by the cipher.
+	exp := "0003000 0300 0000 0000 0000 0200 0000 0000 0000\n" +
+		"0003010 0000 0000 0000 0000 0000 0000 0000 0000\n" +
+		"0003020 *\n" +
+		"0003ff0 0000 0000 0000 0000 0000 0000 0000 0000\n\n"
+
+	m := NewMain()
+	err := m.Run("dump", "-key-file", keyFile, db.Path(), "3")
+	require.NoError(t, err)
+	require.Equal(t, exp, m.Stdout.String())
+
+	// The meta page is not encrypted, and flags the encryption with format
+	// version 3.
+	m = NewMain()
+	err = m.Run("dump", "-key-file", keyFile, db.Path(), "0")
+	require.NoError(t, err)
+	require.Contains(t, m.Stdout.String(), "0000010 edda 0ced 0300 0000 0010 0000 0100 0000")
+}
+
 func TestPageCommand_Run(t *testing.T) {
 	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
 	db.Close()
@@ -122,6 +157,36 @@ func TestPageCommand_Run(t *testing.T) {
 	}
 }
 
+// Ensure that the page command prints the full keys of a prefix-compressed
+// page, and their prefix.
+func TestPageCommand_KeyPrefix(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, KeyPrefixCompression: true})
+	var pgid uint64
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("user/%03d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		pgid = uint64(tx.Bucket([]byte("widgets")).RootPage())
+		return nil
+	}))
+	db.Close()
+
+	m := NewMain()
+	require.NoError(t, m.Run("page", db.Path(), strconv.FormatUint(pgid, 10)))
+	require.Contains(t, m.Stdout.String(), "Item Count: 100\nKey Prefix: \"user/0\"\n")
+	require.Contains(t, m.Stdout.String(), "\"user/042\": value\n")
+}
+
 func TestPageItemCommand_Run(t *testing.T) {
 	testCases := []struct {
 		name          string
@@ -263,7 +328,15 @@ func TestStatsCommand_Run(t *testing.T) {
 		"Bucket statistics\n" +
 		"\tTotal number of buckets: 3\n" +
 		"\tTotal number on inlined buckets: 2 (66%)\n" +
-		"\tBytes used for inlined buckets: 236 (11%)\n"
+		"\tBytes used for inlined buckets: 236 (11%)\n" +
+		"Value statistics\n" +
+		"\tNumber of compressed values: 0\n" +
+		"\tBytes of values before compression: 205\n" +
+		"\tBytes of values as stored: 205 (100%)\n" +
+		"\tNumber of values in blobs: 0\n" +
+		"\tBytes allocated for blobs: 0\n" +
+		"\tNumber of chunked values: 0\n" +
+		"\tBytes allocated for chunked values: 0\n"
 
 	// Run the command.
 	m := NewMain()
@@ -631,6 +704,131 @@ func TestCompactCommand_Run(t *testing.T) {
 	}
 }
 
+func TestCompactCommand_Run_Encrypted(t *testing.T) {
+	srcKeyFile, srcCipher := mustKeyFile(t, "0123456789abcdef")
+	dstKeyFile, dstCipher := mustKeyFile(t, "fedcba9876543210")
+
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{Cipher: srcCipher})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return fillBucket(b, []byte("w."))
+	})
+	require.NoError(t, err)
+	db.Close()
+	dbChk, err := chkdbWithOptions(db.Path(), &bolt.Options{ReadOnly: true, Cipher: srcCipher})
+	require.NoError(t, err)
+
+	dstPath := db.Path() + ".compact"
+	m := NewMain()
+	err = m.Run("compact", "-key-file", srcKeyFile, "-o-key-file", dstKeyFile, "-o", dstPath, db.Path())
+	require.NoError(t, err)
+
+	dstChk, err := chkdbWithOptions(dstPath, &bolt.Options{ReadOnly: true, Cipher: dstCipher})
+	require.NoError(t, err)
+	require.Equal(t, dbChk, dstChk)
+
+	_, err = chkdbWithOptions(dstPath, &bolt.Options{ReadOnly: true, Cipher: srcCipher})
+	require.ErrorIs(t, err, berrors.ErrDecrypt)
+}
+
+func TestCompactCommand_Run_Progress(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("k%d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+
+	m := NewMain()
+	require.NoError(t, m.Run("compact", "-progress", "-o", db.Path()+".compact", db.Path()))
+	require.True(t, strings.HasSuffix(m.Stderr.String(), "\rcompacted 11 keys, 77 bytes\n"), m.Stderr.String())
+}
+
+func TestCompactCommand_Run_Workers(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 5; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket%d", i)))
+			if err != nil {
+				return err
+			}
+			if err := fillBucket(b, []byte(fmt.Sprintf("b%d.", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.Close()
+	dbChk, err := chkdb(db.Path())
+	require.NoError(t, err)
+
+	m := NewMain()
+	require.NoError(t, m.Run("compact", "-workers", "3", "-o", db.Path()+".compact", db.Path()))
+	dbChkAfterCompact, err := chkdb(db.Path() + ".compact")
+	require.NoError(t, err)
+	require.Equal(t, dbChk, dbChkAfterCompact)
+}
+
+func TestCompactCommand_Run_InPlace(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return fillBucket(b, []byte("w."))
+	})
+	require.NoError(t, err)
+
+	// make the db grow by adding large values, and delete them.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("large_vals"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("l%d", i)), make([]byte, 1000*1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("large_vals"))
+	})
+	require.NoError(t, err)
+	db.Close()
+	dbChk, err := chkdb(db.Path())
+	require.NoError(t, err)
+	fi, err := os.Stat(db.Path())
+	require.NoError(t, err)
+
+	m := NewMain()
+	require.NoError(t, m.Run("compact", "-in-place", db.Path()))
+
+	after, err := os.Stat(db.Path())
+	require.NoError(t, err)
+	require.Less(t, after.Size(), fi.Size()/2)
+	require.Contains(t, m.Stdout.String(), fmt.Sprintf("%d -> %d bytes", fi.Size(), after.Size()))
+	dbChkAfterCompact, err := chkdb(db.Path())
+	require.NoError(t, err)
+	require.Equal(t, dbChk, dbChkAfterCompact)
+}
+
 func TestCommands_Run_NoArgs(t *testing.T) {
 	testCases := []struct {
 		name   string
@@ -691,7 +889,11 @@ func fillBucket(b *bolt.Bucket, prefix []byte) error {
 }
 
 func chkdb(path string) ([]byte, error) {
-	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	return chkdbWithOptions(path, &bolt.Options{ReadOnly: true})
+}
+
+func chkdbWithOptions(path string, options *bolt.Options) ([]byte, error) {
+	db, err := bolt.Open(path, 0600, options)
 	if err != nil {
 		return nil, err
 	}
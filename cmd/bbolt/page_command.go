@@ -148,6 +148,7 @@ func (cmd *pageCommand) PrintLeaf(w io.Writer, buf []byte, formatValue string) e
 
 	// Print number of items.
 	fmt.Fprintf(w, "Item Count: %d\n", p.Count())
+	printKeyPrefix(w, p)
 	fmt.Fprintf(w, "\n")
 
 	// Print each key/value.
@@ -155,12 +156,7 @@ func (cmd *pageCommand) PrintLeaf(w io.Writer, buf []byte, formatValue string) e
 		e := p.LeafPageElement(i)
 
 		// Format key as string.
-		var k string
-		if isPrintable(string(e.Key())) {
-			k = fmt.Sprintf("%q", string(e.Key()))
-		} else {
-			k = fmt.Sprintf("%x", string(e.Key()))
-		}
+		k := formatKey(p.LeafPageKey(i))
 
 		// Format value as string.
 		var v string
@@ -187,6 +183,7 @@ func (cmd *pageCommand) PrintBranch(w io.Writer, buf []byte) error {
 
 	// Print number of items.
 	fmt.Fprintf(w, "Item Count: %d\n", p.Count())
+	printKeyPrefix(w, p)
 	fmt.Fprintf(w, "\n")
 
 	// Print each key/value.
@@ -194,12 +191,7 @@ func (cmd *pageCommand) PrintBranch(w io.Writer, buf []byte) error {
 		e := p.BranchPageElement(i)
 
 		// Format key as string.
-		var k string
-		if isPrintable(string(e.Key())) {
-			k = fmt.Sprintf("%q", string(e.Key()))
-		} else {
-			k = fmt.Sprintf("%x", string(e.Key()))
-		}
+		k := formatKey(p.BranchPageKey(i))
 
 		fmt.Fprintf(w, "%s: <pgid=%d>\n", k, e.Pgid())
 	}
@@ -207,6 +199,22 @@ func (cmd *pageCommand) PrintBranch(w io.Writer, buf []byte) error {
 	return nil
 }
 
+// printKeyPrefix prints the prefix elided from the keys of a
+// prefix-compressed page.
+func printKeyPrefix(w io.Writer, p *common.Page) {
+	if p.IsPrefixCompressed() {
+		fmt.Fprintf(w, "Key Prefix: %s\n", formatKey(p.KeyPrefix()))
+	}
+}
+
+// formatKey formats a key as a quoted string if it is printable, or in hex.
+func formatKey(key []byte) string {
+	if isPrintable(string(key)) {
+		return fmt.Sprintf("%q", string(key))
+	}
+	return fmt.Sprintf("%x", string(key))
+}
+
 // PrintFreelist prints the data for a freelist page.
 func (cmd *pageCommand) PrintFreelist(w io.Writer, buf []byte) error {
 	p := common.LoadPage(buf)
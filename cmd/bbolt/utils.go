@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"os"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 func checkSourceDBPath(srcPath string) (os.FileInfo, error) {
@@ -14,3 +18,24 @@ func checkSourceDBPath(srcPath string) (os.FileInfo, error) {
 	}
 	return fi, nil
 }
+
+// readKeyFile returns an AES-GCM cipher using the hex encoded key stored in
+// the file at keyPath. It returns a nil cipher if keyPath is empty.
+func readKeyFile(keyPath string) (bolt.Cipher, error) {
+	if keyPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %q: %v", keyPath, err)
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %q must contain a hex encoded key: %v", keyPath, err)
+	}
+	c, err := bolt.NewAESGCMCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %q: %v", keyPath, err)
+	}
+	return c, nil
+}
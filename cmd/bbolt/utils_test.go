@@ -1,15 +1,28 @@
 package main_test
 
 import (
+	"encoding/hex"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	bolt "go.etcd.io/bbolt"
 	"go.etcd.io/bbolt/internal/common"
 	"go.etcd.io/bbolt/internal/guts_cli"
 )
 
+// mustKeyFile writes a hex encoded key file and returns its path along with
+// the matching cipher.
+func mustKeyFile(t *testing.T, key string) (string, bolt.Cipher) {
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte(hex.EncodeToString([]byte(key))+"\n"), 0600))
+	cipher, err := bolt.NewAESGCMCipher([]byte(key))
+	require.NoError(t, err)
+	return path, cipher
+}
+
 func loadMetaPage(t *testing.T, dbPath string, pageID uint64) *common.Meta {
 	_, buf, err := guts_cli.ReadPage(dbPath, pageID)
 	require.NoError(t, err)
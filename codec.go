@@ -0,0 +1,311 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt/errors"
+)
+
+// KeyCodec encodes the keys of a TypedBucket. The encoded keys must sort
+// byte-wise in the order of the keys, so that cursors and ranges follow it,
+// and the encoding must be one-to-one. Decode returns ErrInvalidEncoding if
+// the data was not produced by Encode.
+//
+// Uint64Codec, Int64Codec, StringCodec, BytesCodec, TimeCodec, Tuple2Codec
+// and Tuple3Codec are order-preserving.
+type KeyCodec[K any] interface {
+	Encode(key K) ([]byte, error)
+	Decode(data []byte) (K, error)
+}
+
+// ValueCodec encodes the values of a TypedBucket. Any KeyCodec is also a
+// ValueCodec; JSONCodec and GobCodec encode any value but do not preserve its
+// order. Decode must not keep data, which is only valid for the life of the
+// transaction.
+type ValueCodec[V any] interface {
+	Encode(value V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// Uint64Codec encodes uint64 values as 8 big-endian bytes.
+type Uint64Codec struct{}
+
+// Encode encodes v.
+func (Uint64Codec) Encode(v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, v), nil
+}
+
+// Decode decodes a value encoded by Encode.
+func (Uint64Codec) Decode(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%w: uint64 of %d bytes", errors.ErrInvalidEncoding, len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// Int64Codec encodes int64 values as 8 big-endian bytes with the sign bit
+// flipped, so that the negative values sort first.
+type Int64Codec struct{}
+
+// Encode encodes v.
+func (Int64Codec) Encode(v int64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)), nil
+}
+
+// Decode decodes a value encoded by Encode.
+func (Int64Codec) Decode(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%w: int64 of %d bytes", errors.ErrInvalidEncoding, len(data))
+	}
+	return int64(binary.BigEndian.Uint64(data) ^ (1 << 63)), nil
+}
+
+// StringCodec encodes strings as their bytes.
+type StringCodec struct{}
+
+// Encode encodes s.
+func (StringCodec) Encode(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+// Decode decodes a string encoded by Encode.
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// BytesCodec stores byte slices as is. Decode returns a copy of the data, so
+// that it stays valid once the transaction is closed.
+type BytesCodec struct{}
+
+// Encode encodes b.
+func (BytesCodec) Encode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// Decode decodes a byte slice encoded by Encode.
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return cloneBytes(data), nil
+}
+
+// TimeCodec encodes times as the number of seconds since the Unix epoch, in
+// 8 big-endian bytes with the sign bit flipped, followed by the nanoseconds
+// in 4 big-endian bytes. The location and the monotonic clock reading are
+// not kept: Decode returns times in UTC.
+type TimeCodec struct{}
+
+// Encode encodes t.
+func (TimeCodec) Encode(t time.Time) ([]byte, error) {
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, 12), uint64(t.Unix())^(1<<63))
+	return binary.BigEndian.AppendUint32(data, uint32(t.Nanosecond())), nil
+}
+
+// Decode decodes a time encoded by Encode.
+func (TimeCodec) Decode(data []byte) (time.Time, error) {
+	if len(data) != 12 {
+		return time.Time{}, fmt.Errorf("%w: time of %d bytes", errors.ErrInvalidEncoding, len(data))
+	}
+	sec := int64(binary.BigEndian.Uint64(data) ^ (1 << 63))
+	nsec := binary.BigEndian.Uint32(data[8:])
+	if nsec >= 1e9 {
+		return time.Time{}, fmt.Errorf("%w: time with %d nanoseconds", errors.ErrInvalidEncoding, nsec)
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), nil
+}
+
+// Tuple2 is a key made of two values, ordered by A then by B.
+type Tuple2[A, B any] struct {
+	A A
+	B B
+}
+
+// Tuple2Codec encodes Tuple2 keys with the codecs of their values. Each value
+// is encoded with its 0x00 bytes escaped as 0x00 0xff, and followed by 0x00
+// 0x01, so that the tuples sort by their first value, then by their second.
+type Tuple2Codec[A, B any] struct {
+	A KeyCodec[A]
+	B KeyCodec[B]
+}
+
+// Encode encodes t.
+func (c Tuple2Codec[A, B]) Encode(t Tuple2[A, B]) ([]byte, error) {
+	var data []byte
+	if err := appendTupleValue(&data, c.A, t.A); err != nil {
+		return nil, err
+	}
+	if err := appendTupleValue(&data, c.B, t.B); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Decode decodes a tuple encoded by Encode.
+func (c Tuple2Codec[A, B]) Decode(data []byte) (Tuple2[A, B], error) {
+	var t Tuple2[A, B]
+	var err error
+	if t.A, data, err = cutTupleValue(data, c.A); err != nil {
+		return t, err
+	}
+	if t.B, data, err = cutTupleValue(data, c.B); err != nil {
+		return t, err
+	}
+	return t, tupleEnd(data)
+}
+
+// Tuple3 is a key made of three values, ordered by A, then by B, then by C.
+type Tuple3[A, B, C any] struct {
+	A A
+	B B
+	C C
+}
+
+// Tuple3Codec encodes Tuple3 keys with the codecs of their values, like
+// Tuple2Codec.
+type Tuple3Codec[A, B, C any] struct {
+	A KeyCodec[A]
+	B KeyCodec[B]
+	C KeyCodec[C]
+}
+
+// Encode encodes t.
+func (c Tuple3Codec[A, B, C]) Encode(t Tuple3[A, B, C]) ([]byte, error) {
+	var data []byte
+	if err := appendTupleValue(&data, c.A, t.A); err != nil {
+		return nil, err
+	}
+	if err := appendTupleValue(&data, c.B, t.B); err != nil {
+		return nil, err
+	}
+	if err := appendTupleValue(&data, c.C, t.C); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Decode decodes a tuple encoded by Encode.
+func (c Tuple3Codec[A, B, C]) Decode(data []byte) (Tuple3[A, B, C], error) {
+	var t Tuple3[A, B, C]
+	var err error
+	if t.A, data, err = cutTupleValue(data, c.A); err != nil {
+		return t, err
+	}
+	if t.B, data, err = cutTupleValue(data, c.B); err != nil {
+		return t, err
+	}
+	if t.C, data, err = cutTupleValue(data, c.C); err != nil {
+		return t, err
+	}
+	return t, tupleEnd(data)
+}
+
+// appendTupleValue appends the escaped encoding of a value of a tuple to data.
+func appendTupleValue[T any](data *[]byte, codec KeyCodec[T], v T) error {
+	enc, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	*data = append(appendEscaped(*data, enc), 0x00, 0x01)
+	return nil
+}
+
+// cutTupleValue decodes the first value of an encoded tuple, and returns the
+// rest of the tuple.
+func cutTupleValue[T any](data []byte, codec KeyCodec[T]) (T, []byte, error) {
+	enc, rest, ok := cutEscaped(data)
+	if !ok {
+		var zero T
+		return zero, nil, fmt.Errorf("%w: truncated tuple", errors.ErrInvalidEncoding)
+	}
+	v, err := codec.Decode(enc)
+	return v, rest, err
+}
+
+// tupleEnd checks that nothing follows the values of a tuple.
+func tupleEnd(rest []byte) error {
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: %d bytes after tuple", errors.ErrInvalidEncoding, len(rest))
+	}
+	return nil
+}
+
+// appendEscaped appends b to dst with its 0x00 bytes escaped as 0x00 0xff,
+// so that a 0x00 0x01 separator can follow it without changing its order.
+func appendEscaped(dst, b []byte) []byte {
+	for _, c := range b {
+		if c == 0x00 {
+			dst = append(dst, 0x00, 0xff)
+		} else {
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// cutEscaped returns the unescaped bytes of data up to the first 0x00 0x01
+// separator, and the bytes after it. It reports false if there is no
+// separator or if data is not escaped properly.
+func cutEscaped(data []byte) (b, rest []byte, ok bool) {
+	b = []byte{}
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0x00 {
+			b = append(b, data[i])
+			continue
+		}
+		if i+1 == len(data) {
+			return nil, nil, false
+		}
+		switch data[i+1] {
+		case 0xff:
+			b = append(b, 0x00)
+			i++
+		case 0x01:
+			return b, data[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
+
+// JSONCodec encodes values in JSON with encoding/json.
+type JSONCodec[V any] struct{}
+
+// Encode encodes v.
+func (JSONCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode decodes a value encoded by Encode.
+func (JSONCodec[V]) Decode(data []byte) (V, error) {
+	var v V
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("%w: %v", errors.ErrInvalidEncoding, err)
+	}
+	return v, nil
+}
+
+// GobCodec encodes values with encoding/gob. Each value is encoded on its
+// own, along with the description of its type.
+type GobCodec[V any] struct{}
+
+// Encode encodes v.
+func (GobCodec[V]) Encode(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes a value encoded by Encode.
+func (GobCodec[V]) Decode(data []byte) (V, error) {
+	var v V
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return v, fmt.Errorf("%w: %v", errors.ErrInvalidEncoding, err)
+	}
+	return v, nil
+}
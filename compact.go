@@ -1,104 +1,420 @@
 package bbolt
 
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
 // Compact will create a copy of the source DB and in the destination DB. This may
 // reclaim space that the source database no longer has use for. txMaxSize can be
 // used to limit the transactions size of this process and may trigger intermittent
-// commits. A value of zero will ignore transaction sizes.
+// commits. A value of zero will ignore transaction sizes. The named snapshots and
+// the transaction history of the source DB are not copied. The secondary indexes
+// are built again in the destination DB, whose Options.IndexExtractors must
+// register their extractors.
+// Only the current values of versioned buckets are copied.
 // TODO: merge with: https://github.com/etcd-io/etcd/blob/b7f0f52a16dbf83f18ca1d803f7892d750366a94/mvcc/backend/backend.go#L349
 func Compact(dst, src *DB, txMaxSize int64) error {
+	return CompactWithOptions(dst, src, CompactOptions{TxMaxSize: txMaxSize})
+}
+
+// CompactOptions represents the options of CompactWithOptions.
+type CompactOptions struct {
+	// TxMaxSize is the size of the keys and values written by a transaction
+	// of dst above which it is committed and a new one started. A value of
+	// zero will ignore transaction sizes.
+	TxMaxSize int64
+
+	// FillPercent is the fill percent of the buckets of dst. If zero, the
+	// pages are filled entirely for best compaction.
+	FillPercent float64
+
+	// Workers is the number of top-level buckets of src read concurrently,
+	// each by its own read-only transaction. The buckets are still written
+	// to dst one after the other, in order, by a single writer. If zero or
+	// one, src is read by the writer itself.
+	//
+	// As the top-level buckets are read by different transactions, they may
+	// be copied as of different commits if src is written meanwhile.
+	Workers int
+
+	// Filter, if set, is called for each bucket and key/value pair of src,
+	// with the names of the buckets holding it. v is nil for a bucket.
+	// Returning false leaves out the key/value pair, or the bucket and all
+	// it holds. It is called concurrently when Workers is over one.
+	Filter func(keys [][]byte, k, v []byte) bool
+
+	// Transform, if set, returns the value written to dst for each
+	// key/value pair of src kept by Filter. Returning a nil value leaves out
+	// the key/value pair. v is only valid until Transform returns. It is
+	// called concurrently when Workers is over one.
+	Transform func(keys [][]byte, k, v []byte) ([]byte, error)
+
+	// Progress, if set, is called after each bucket and key/value pair of
+	// src, whether it is copied or left out, in the order they are written.
+	Progress func(CompactProgress)
+}
+
+// CompactProgress reports the progress of CompactWithOptions.
+type CompactProgress struct {
+	// Keys is the number of buckets and key/value pairs of src processed.
+	Keys int64
+
+	// Bytes is the size of the keys and values of src processed.
+	Bytes int64
+}
+
+// CompactWithOptions is like Compact, but can leave out or rewrite the keys
+// and buckets copied, read the top-level buckets concurrently, and report the
+// progress.
+func CompactWithOptions(dst, src *DB, opts CompactOptions) error {
+	w := &compactWriter{dst: dst, opts: opts, fillPercent: opts.FillPercent}
+	if w.fillPercent == 0 {
+		w.fillPercent = 1.0
+	}
+
 	// commit regularly, or we'll run out of memory for large datasets if using one transaction.
-	var size int64
-	tx, err := dst.Begin(true)
+	var err error
+	w.tx, err = dst.Begin(true)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if tempErr := tx.Rollback(); tempErr != nil {
-			err = tempErr
-		}
-	}()
+	defer func() { _ = w.tx.Rollback() }()
 
-	if err := walk(src, func(keys [][]byte, k, v []byte, seq uint64) error {
-		// On each key/value, check if we have exceeded tx size.
-		sz := int64(len(k) + len(v))
-		if size+sz > txMaxSize && txMaxSize != 0 {
-			// Commit previous transaction.
-			if err := tx.Commit(); err != nil {
-				return err
+	if opts.Workers > 1 {
+		err = compactParallel(w, src)
+	} else {
+		filter := func(keys [][]byte, k, v []byte) (bool, error) {
+			if opts.Filter == nil || opts.Filter(keys, k, v) {
+				return true, nil
 			}
-
-			// Start new transaction.
-			tx, err = dst.Begin(true)
-			if err != nil {
+			w.report(int64(len(k) + len(v)))
+			return false, nil
+		}
+		err = walk(src, filter, func(keys [][]byte, k, v []byte, seq uint64, bopts BucketOptions, indexes []indexDef, expires int64) error {
+			defer w.report(int64(len(k) + len(v)))
+			v, skip, err := compactTransform(opts.Transform, keys, k, v)
+			if err != nil || skip {
 				return err
 			}
-			size = 0
+			return w.write(keys, k, v, seq, bopts, indexes, expires)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return w.tx.Commit()
+}
+
+// compactTransform returns the value to write for a key/value pair, or
+// whether to leave it out.
+func compactTransform(transform func(keys [][]byte, k, v []byte) ([]byte, error), keys [][]byte, k, v []byte) ([]byte, bool, error) {
+	if v == nil || transform == nil {
+		return v, false, nil
+	}
+	nv, err := transform(keys, k, v)
+	if err != nil {
+		return nil, false, err
+	}
+	return nv, nv == nil, nil
+}
+
+// compactWriter writes the buckets and key/value pairs of a compaction to
+// dst, committing its transaction every TxMaxSize bytes.
+type compactWriter struct {
+	dst         *DB
+	opts        CompactOptions
+	fillPercent float64
+
+	tx       *Tx
+	size     int64
+	progress CompactProgress
+}
+
+// report counts a bucket or key/value pair of src of size bytes as processed.
+func (w *compactWriter) report(size int64) {
+	w.progress.Keys++
+	w.progress.Bytes += size
+	if w.opts.Progress != nil {
+		w.opts.Progress(w.progress)
+	}
+}
+
+// write creates the bucket k with the given options and secondary indexes,
+// or puts the key/value pair k/v expiring at the given time, in the bucket at
+// keys.
+func (w *compactWriter) write(keys [][]byte, k, v []byte, seq uint64, bopts BucketOptions, indexes []indexDef, expires int64) error {
+	// On each key/value, check if we have exceeded tx size.
+	sz := int64(len(k) + len(v))
+	if w.size+sz > w.opts.TxMaxSize && w.opts.TxMaxSize != 0 {
+		// Commit previous transaction.
+		if err := w.tx.Commit(); err != nil {
+			return err
 		}
-		size += sz
 
-		// Create bucket on the root transaction if this is the first level.
-		nk := len(keys)
-		if nk == 0 {
-			bkt, err := tx.CreateBucket(k)
-			if err != nil {
-				return err
-			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
+		// Start new transaction.
+		tx, err := w.dst.Begin(true)
+		if err != nil {
+			return err
 		}
+		w.tx = tx
+		w.size = 0
+	}
+	w.size += sz
 
-		// Create buckets on subsequent levels, if necessary.
-		b := tx.Bucket(keys[0])
-		if nk > 1 {
-			for _, k := range keys[1:] {
-				b = b.Bucket(k)
+	// Create bucket on the root transaction if this is the first level.
+	nk := len(keys)
+	if nk == 0 {
+		bkt, err := w.tx.CreateBucketWithOptions(k, bopts)
+		if err != nil {
+			return err
+		}
+		return compactBucketSetup(bkt, seq, indexes)
+	}
+
+	// Create buckets on subsequent levels, if necessary.
+	b := w.tx.Bucket(keys[0])
+	if nk > 1 {
+		for _, k := range keys[1:] {
+			b = b.Bucket(k)
+		}
+	}
+
+	// Fill the entire page for best compaction.
+	b.FillPercent = w.fillPercent
+
+	// If there is no value then this is a bucket call.
+	if v == nil {
+		bkt, err := b.CreateBucketWithOptions(k, bopts)
+		if err != nil {
+			return err
+		}
+		return compactBucketSetup(bkt, seq, indexes)
+	}
+
+	// Otherwise treat it as a key/value pair.
+	return b.put(k, v, expires)
+}
+
+// compactBucketSetup sets the sequence of a bucket created by a compaction,
+// and creates its secondary indexes, which its keys are then added to.
+func compactBucketSetup(b *Bucket, seq uint64, indexes []indexDef) error {
+	if err := b.SetSequence(seq); err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := b.CreateIndex(idx.name, idx.extractor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// compactBatchSize is the size of the keys and values read by a worker
+	// of a parallel compaction before they are handed to the writer.
+	compactBatchSize = 256 * 1024
+
+	// compactBatchesAhead is the number of batches a worker of a parallel
+	// compaction reads ahead of the writer.
+	compactBatchesAhead = 4
+)
+
+// errCompactStopped is returned by a worker of a parallel compaction once the
+// writer stopped.
+var errCompactStopped = errors.New("compaction stopped")
+
+// compactItem is a bucket or key/value pair read by a worker of a parallel
+// compaction.
+type compactItem struct {
+	keys    [][]byte
+	k, v    []byte
+	seq     uint64
+	bopts   BucketOptions
+	indexes []indexDef
+	expires int64
+
+	// size is the size of the key/value pair in src, reported as progress.
+	size int64
+
+	// skip is set when the item is left out, and only reported.
+	skip bool
+}
+
+// compactBucket carries the items of a top-level bucket from the worker
+// reading it to the writer.
+type compactBucket struct {
+	batches chan []compactItem
+
+	// err is set by the worker before batches is closed.
+	err error
+}
+
+// compactParallel copies the top-level buckets of src, read by concurrent
+// workers, with w, in order.
+func compactParallel(w *compactWriter, src *DB) error {
+	var names [][]byte
+	err := src.View(func(tx *Tx) error {
+		return tx.ForEach(func(name []byte, b *Bucket) error {
+			names = append(names, cloneBytes(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	buckets := make([]*compactBucket, len(names))
+	for i := range buckets {
+		buckets[i] = &compactBucket{batches: make(chan []compactItem, compactBatchesAhead)}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	// The buckets are taken in order, so that the one being written is
+	// always being read, and the workers are never all waiting on the
+	// writer for buckets after it.
+	var next atomic.Int64
+	for i := 0; i < min(w.opts.Workers, len(names)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(names) {
+					return
+				}
+				bucket := buckets[i]
+				bucket.err = compactReadBucket(src, names[i], w.opts, bucket.batches, done)
+				close(bucket.batches)
+				if bucket.err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for _, bucket := range buckets {
+		for batch := range bucket.batches {
+			for _, item := range batch {
+				if !item.skip {
+					if err := w.write(item.keys, item.k, item.v, item.seq, item.bopts, item.indexes, item.expires); err != nil {
+						return err
+					}
+				}
+				w.report(item.size)
 			}
 		}
+		if bucket.err != nil {
+			return bucket.err
+		}
+	}
+	return nil
+}
 
-		// Fill the entire page for best compaction.
-		b.FillPercent = 1.0
+// compactReadBucket reads the top-level bucket name of src and sends its
+// items to batches, until done is closed.
+func compactReadBucket(src *DB, name []byte, opts CompactOptions, batches chan<- []compactItem, done <-chan struct{}) error {
+	var batch []compactItem
+	var size int64
+	send := func() error {
+		select {
+		case batches <- batch:
+		case <-done:
+			return errCompactStopped
+		}
+		batch, size = nil, 0
+		return nil
+	}
+	add := func(item compactItem) error {
+		batch = append(batch, item)
+		if size += int64(len(item.k) + len(item.v)); size >= compactBatchSize {
+			return send()
+		}
+		return nil
+	}
 
-		// If there is no value then this is a bucket call.
-		if v == nil {
-			bkt, err := b.CreateBucket(k)
+	err := src.View(func(tx *Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			// Deleted meanwhile.
+			return nil
+		}
+		filter := func(keys [][]byte, k, v []byte) (bool, error) {
+			if opts.Filter == nil || opts.Filter(keys, k, v) {
+				return true, nil
+			}
+			return false, add(compactItem{size: int64(len(k) + len(v)), skip: true})
+		}
+		return walkBucket(b, nil, name, nil, b.Sequence(), 0, filter, func(keys [][]byte, k, v []byte, seq uint64, bopts BucketOptions, indexes []indexDef, expires int64) error {
+			item := compactItem{size: int64(len(k) + len(v)), seq: seq, bopts: bopts, indexes: indexes, expires: expires}
+			nv, skip, err := compactTransform(opts.Transform, keys, k, v)
 			if err != nil {
 				return err
 			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
+			// The keys and values are only valid during the transaction.
+			if item.skip = skip; !skip {
+				item.keys = make([][]byte, len(keys))
+				for i, key := range keys {
+					item.keys[i] = cloneBytes(key)
+				}
+				item.k = cloneBytes(k)
+				if nv != nil {
+					item.v = cloneBytes(nv)
+				}
 			}
-			return nil
-		}
-
-		// Otherwise treat it as a key/value pair.
-		return b.Put(k, v)
-	}); err != nil {
+			return add(item)
+		})
+	})
+	if err != nil {
 		return err
 	}
-	err = tx.Commit()
-
-	return err
+	if len(batch) > 0 {
+		return send()
+	}
+	return nil
 }
 
 // walkFunc is the type of the function called for keys (buckets and "normal"
 // values) discovered by Walk. keys is the list of keys to descend to the bucket
-// owning the discovered key/value pair k/v.
-type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
+// owning the discovered key/value pair k/v. For buckets, opts holds the options
+// the bucket was created with, and indexes its secondary indexes. For values
+// put with Bucket.PutWithTTL, expires is their expiry time in Unix
+// nanoseconds, and zero otherwise.
+type walkFunc func(keys [][]byte, k, v []byte, seq uint64, opts BucketOptions, indexes []indexDef, expires int64) error
+
+// walkFilter is the type of the function deciding whether walk descends to
+// a key, and to the keys of a bucket. An error stops the walk.
+type walkFilter func(keys [][]byte, k, v []byte) (bool, error)
 
-// walk walks recursively the bolt database db, calling walkFn for each key it finds.
-func walk(db *DB, walkFn walkFunc) error {
+// walk walks recursively the bolt database db, calling walkFn for each key it finds
+// that filter keeps.
+func walk(db *DB, filter walkFilter, walkFn walkFunc) error {
 	return db.View(func(tx *Tx) error {
 		return tx.ForEach(func(name []byte, b *Bucket) error {
-			return walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
+			return walkBucket(b, nil, name, nil, b.Sequence(), 0, filter, walkFn)
 		})
 	})
 }
 
-func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
+func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, seq uint64, expires int64, filter walkFilter, fn walkFunc) error {
+	if keep, err := filter(keypath, k, v); err != nil || !keep {
+		return err
+	}
+
 	// Execute callback.
-	if err := fn(keypath, k, v, seq); err != nil {
+	var opts BucketOptions
+	var indexes []indexDef
+	if v == nil {
+		opts = b.Options()
+		indexes = b.indexDefs()
+	}
+	if err := fn(keypath, k, v, seq, opts, indexes, expires); err != nil {
 		return err
 	}
 
@@ -107,13 +423,23 @@ func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFun
 		return nil
 	}
 
-	// Iterate over each child key/value.
+	// Iterate over each child key/value. The expired keys are left out.
 	keypath = append(keypath, k)
-	return b.ForEach(func(k, v []byte) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var err error
 		if v == nil {
-			bkt := b.Bucket(k)
-			return walkBucket(bkt, keypath, k, nil, bkt.Sequence(), fn)
+			var bkt *Bucket
+			if bkt, err = b.OpenBucket(k); err != nil {
+				return err
+			}
+			err = walkBucket(bkt, keypath, k, nil, bkt.Sequence(), 0, filter, fn)
+		} else {
+			err = walkBucket(b, keypath, k, v, b.Sequence(), c.expiry(), filter, fn)
 		}
-		return walkBucket(b, keypath, k, v, b.Sequence(), fn)
-	})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,380 @@
+package bbolt
+
+import (
+	"errors"
+	"runtime"
+	"sort"
+	"time"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+const (
+	// DefaultCompactTxMaxPages is the maximum number of pages relocated by a
+	// read-write transaction of DB.CompactInPlace when
+	// CompactInPlaceOptions.TxMaxPages is not set.
+	DefaultCompactTxMaxPages = 256
+
+	// DefaultAutoCompactRatio is the ratio of free pages over which the
+	// database is compacted in the background when Options.AutoCompactRatio
+	// is not set.
+	DefaultAutoCompactRatio = 0.5
+
+	// maxCompactRounds bounds the number of times the pages are scanned by
+	// DB.CompactInPlace, in case concurrent writers keep filling the end of
+	// the file.
+	maxCompactRounds = 8
+)
+
+// errCompactNoRoom is returned by the commit of a transaction relocating
+// pages when there are not enough free pages below the end of the file.
+var errCompactNoRoom = errors.New("no free pages to relocate to")
+
+// CompactInPlaceOptions represents the options of DB.CompactInPlace.
+type CompactInPlaceOptions struct {
+	// TxMaxPages is the maximum number of pages relocated by each read-write
+	// transaction. Smaller transactions hold the writer lock for less time.
+	// If zero, DefaultCompactTxMaxPages is used.
+	TxMaxPages int
+}
+
+// CompactInPlace shrinks the database file while it is in use. The pages at
+// the end of the file are relocated into free pages at lower ids, by small
+// read-write transactions interleaved with the other writers, then the file
+// is truncated after the last page in use. It returns the number of bytes
+// the file shrank by.
+//
+// The pages at the end of the file that are still used by an open read-only
+// transaction, a named snapshot or a retained transaction are not reclaimed,
+// and the file is not truncated past the end seen by an open read-only
+// transaction, until it is compacted again. The file is not truncated on
+// Windows, where it cannot be while mapped.
+func (db *DB) CompactInPlace(opts *CompactInPlaceOptions) (int64, error) {
+	return db.compactInPlace(opts, nil)
+}
+
+// compactInPlace is like CompactInPlace, but stops early once stop is closed.
+func (db *DB) compactInPlace(opts *CompactInPlaceOptions, stop <-chan struct{}) (int64, error) {
+	if db.readOnly || db.follower {
+		return 0, berrors.ErrDatabaseReadOnly
+	}
+	txMaxPages := DefaultCompactTxMaxPages
+	if opts != nil && opts.TxMaxPages > 0 {
+		txMaxPages = opts.TxMaxPages
+	}
+
+	before, err := db.openFileSize()
+	if err != nil {
+		return 0, err
+	}
+	for round := 0; round < maxCompactRounds; round++ {
+		target, locs, err := db.compactTargets()
+		if err != nil {
+			return 0, err
+		}
+
+		// Relocate the last pages first, so that the file can be truncated
+		// even if there is no room for all of them.
+		for len(locs) > 0 {
+			select {
+			case <-stop:
+				return 0, berrors.ErrDatabaseNotOpen
+			default:
+			}
+			n, pages := 0, 0
+			for n < len(locs) && (n == 0 || pages+locs[n].count <= txMaxPages) {
+				pages += locs[n].count
+				n++
+			}
+			if err := db.relocatePages(target, locs[:n]); errors.Is(err, errCompactNoRoom) {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+			locs = locs[n:]
+		}
+
+		shrunk, err := db.shrink()
+		if err != nil {
+			return 0, err
+		}
+		if !shrunk {
+			break
+		}
+	}
+
+	after, err := db.openFileSize()
+	if err != nil {
+		return 0, err
+	}
+	return int64(before - after), nil
+}
+
+// pageLocation locates a page in use, to relocate it.
+type pageLocation struct {
+	id    common.Pgid
+	count int      // number of pages, including overflow pages
+	path  [][]byte // names of the buckets holding the page
+	key   []byte   // first key of the page
+
+	// freelist is set for the freelist page, which is written to new pages
+	// by any commit.
+	freelist bool
+
+	// blob is set for the pages of a blob, whose key is the key of its value.
+	blob bool
+
+	// value is set for the pages of the chunk tree of a chunked value, the
+	// last name of whose path is the key of the value.
+	value bool
+}
+
+// compactTargets returns the page id under which all the pages in use can be
+// relocated, and the location of those above it, last page first.
+func (db *DB) compactTargets() (common.Pgid, []pageLocation, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	hwm := tx.meta.Pgid()
+	used := make([]bool, hwm)
+	usedN := 0
+	var locs []pageLocation
+	mark := func(id common.Pgid, n int) {
+		for i := 0; i < n; i++ {
+			used[id+common.Pgid(i)] = true
+		}
+		usedN += n
+	}
+	if id := tx.meta.Freelist(); id != common.PgidNoFreelist {
+		loc := pageLocation{id: id, count: int(tx.page(id).Overflow()) + 1, freelist: true}
+		mark(loc.id, loc.count)
+		locs = append(locs, loc)
+	}
+	err = tx.forEachPageLocation(func(loc pageLocation) {
+		mark(loc.id, loc.count)
+		locs = append(locs, loc)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Find the lowest target leaving enough free pages below it for the
+	// pages above it, with some room for the branch pages rewritten along.
+	target := hwm
+	above := 0
+	for id := hwm - 1; id >= 2; id-- {
+		if used[id] {
+			above++
+		}
+		free := int(id) - 2 - (usedN - above)
+		if above+above/4+8 > free {
+			break
+		}
+		target = id
+	}
+
+	n := 0
+	for _, loc := range locs {
+		if loc.id+common.Pgid(loc.count) > target {
+			locs[n] = loc
+			n++
+		}
+	}
+	locs = locs[:n]
+	sort.Slice(locs, func(i, j int) bool { return locs[i].id > locs[j].id })
+	return target, locs, nil
+}
+
+// forEachPageLocation calls fn for each branch, leaf and blob page reachable
+// from the root bucket of the transaction, including the pages of chunked
+// values. The keys of the locations are copied.
+func (tx *Tx) forEachPageLocation(fn func(loc pageLocation)) error {
+	var walk func(b *Bucket, path [][]byte, value bool)
+	walk = func(b *Bucket, path [][]byte, value bool) {
+		b.forEachBlob(func(key []byte, ptr blobPointer) {
+			fn(pageLocation{id: ptr.pgid, count: tx.db.blobPageCount(ptr.size), path: path, key: cloneBytes(key), blob: true})
+		})
+		b.forEachValueTree(func(key []byte, tree *Bucket) {
+			walk(tree, append(append([][]byte(nil), path...), cloneBytes(key)), true)
+		})
+
+		// Inline buckets cannot hold non-inline ones.
+		if b.RootPage() == 0 {
+			return
+		}
+		tx.forEachPage(b.RootPage(), func(p *common.Page, _ int, _ []common.Pgid) {
+			loc := pageLocation{id: p.Id(), count: int(p.Overflow()) + 1, path: path, value: value}
+			if p.IsLeafPage() {
+				for i := 0; i < int(p.Count()); i++ {
+					elem := p.LeafPageElement(uint16(i))
+					if i == 0 {
+						loc.key = cloneBytes(p.LeafPageKey(uint16(i)))
+					}
+					if elem.IsBucketEntry() {
+						child := append(append([][]byte(nil), path...), cloneBytes(p.LeafPageKey(uint16(i))))
+						walk(b.openBucket(elem.Value()), child, false)
+					}
+				}
+			} else if p.IsBranchPage() && p.Count() > 0 {
+				loc.key = cloneBytes(p.BranchPageKey(0))
+			}
+			fn(loc)
+		})
+	}
+	walk(&tx.root, nil, false)
+	return tx.Err()
+}
+
+// relocatePages rewrites the given pages, and the branch pages above them,
+// into free pages below the target.
+func (db *DB) relocatePages(target common.Pgid, locs []pageLocation) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	tx.noGrow = true
+	db.freelist.hold(tx.meta.Txid(), target)
+
+	for _, loc := range locs {
+		if loc.freelist {
+			continue
+		}
+		b := &tx.root
+		path := loc.path
+		if loc.value {
+			path = path[:len(path)-1]
+		}
+		for _, name := range path {
+			if b = b.Bucket(name); b == nil {
+				break
+			}
+		}
+		if b != nil && loc.value {
+			b = b.openValueTree(loc.path[len(loc.path)-1])
+		}
+		// The page may have been removed meanwhile.
+		if b == nil {
+			continue
+		} else if loc.blob {
+			b.relocateBlob(loc.key, loc.id)
+			continue
+		} else if b.RootPage() == 0 {
+			continue
+		}
+
+		// Materializing the nodes down to the key makes them written to new
+		// pages, and their parents updated, on commit.
+		c := b.Cursor()
+		c.seek(loc.key)
+		c.node()
+	}
+	return tx.Commit()
+}
+
+// shrink moves the high water mark down over the free pages at the end of
+// the file, then truncates the file. It reports whether it moved it.
+func (db *DB) shrink() (bool, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	hwm := tx.meta.Pgid()
+	n := db.freelist.freeTail(hwm)
+	if n == 0 {
+		if err := tx.Rollback(); err != nil {
+			return false, err
+		}
+		return false, db.truncateFile()
+	}
+	db.freelist.truncate(hwm - common.Pgid(n))
+	tx.meta.SetPgid(hwm - common.Pgid(n))
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, db.truncateFile()
+}
+
+// openFileSize returns the size of the file, unless the database is closed.
+func (db *DB) openFileSize() (int, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return 0, berrors.ErrDatabaseNotOpen
+	}
+	return db.fileSize()
+}
+
+// truncateFile truncates the file after the high water mark. It is left as
+// is while an open read-only transaction may read the file past it, as
+// Tx.WriteTo does up to its own high water mark.
+func (db *DB) truncateFile() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return berrors.ErrDatabaseNotOpen
+	}
+
+	db.metalock.Lock()
+	hwm := db.meta().Pgid()
+	for _, t := range db.txs {
+		hwm = max(hwm, t.meta.Pgid())
+	}
+	db.metalock.Unlock()
+
+	sz := int64(hwm) * int64(db.pageSize)
+	if fileSize, err := db.fileSize(); err != nil || int64(fileSize) <= sz {
+		return err
+	}
+
+	// The log may hold pages after the high water mark, which would be
+	// written back by the next checkpoint.
+	if db.wal != nil {
+		if err := db.checkpoint(); err != nil {
+			return err
+		}
+	}
+	if err := db.file.Truncate(sz); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// runAutoCompact compacts the database in place at the given interval when
+// the ratio of its free pages is over the given ratio, until stop is closed.
+func (db *DB) runAutoCompact(stop chan struct{}, interval time.Duration, ratio float64) {
+	if ratio <= 0 {
+		ratio = DefaultAutoCompactRatio
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		tx, err := db.Begin(false)
+		if err != nil {
+			return
+		}
+		hwm := tx.meta.Pgid()
+		_ = tx.Rollback()
+		stats := db.Stats()
+		if float64(stats.FreePageN+stats.PendingPageN) <= ratio*float64(hwm) {
+			continue
+		}
+		if _, err := db.compactInPlace(nil, stop); err != nil && !errors.Is(err, berrors.ErrDatabaseNotOpen) {
+			db.Logger().Errorf("compacting bbolt db (%s) in place failed: %v", db.path, err)
+		}
+	}
+}
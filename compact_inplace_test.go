@@ -0,0 +1,166 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// fillAndDelete writes keys to nested buckets, with values spanning overflow
+// pages, then deletes most of them, leaving the pages in use scattered.
+func fillAndDelete(t *testing.T, db *btesting.DB) {
+	for i := 0; i < 10; i++ {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			child, err := b.CreateBucketIfNotExists([]byte(fmt.Sprint("child", i%3)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 1000; j++ {
+				k := []byte(fmt.Sprintf("%02d%06d", i, j))
+				if err := b.Put(k, bytes.Repeat([]byte{'v'}, 100)); err != nil {
+					return err
+				}
+				if j%100 == 0 {
+					if err := child.Put(k, bytes.Repeat([]byte{'w'}, 10000)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		c := b.Cursor()
+		n := 0
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v != nil && n%20 != 0 {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			n++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that compacting a database in place shrinks the file and keeps its
+// data.
+func TestDB_CompactInPlace(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts *bolt.Options
+	}{
+		{name: "array", opts: &bolt.Options{FreelistType: bolt.FreelistArrayType}},
+		{name: "map", opts: &bolt.Options{FreelistType: bolt.FreelistMapType}},
+		{name: "nofreelistsync", opts: &bolt.Options{NoFreelistSync: true}},
+		{name: "wal", opts: &bolt.Options{WAL: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, tc.opts)
+			fillAndDelete(t, db)
+			before := dumpKeys(t, db.DB)
+			require.NoError(t, db.Checkpoint())
+			fi, err := os.Stat(db.Path())
+			require.NoError(t, err)
+
+			shrunk, err := db.CompactInPlace(nil)
+			require.NoError(t, err)
+			require.Greater(t, shrunk, fi.Size()/2)
+			after, err := os.Stat(db.Path())
+			require.NoError(t, err)
+			require.Equal(t, fi.Size()-shrunk, after.Size())
+			require.Equal(t, before, dumpKeys(t, db.DB))
+			db.MustCheck()
+
+			// The database keeps working after being reopened.
+			db.MustClose()
+			db.MustReopen()
+			require.Equal(t, before, dumpKeys(t, db.DB))
+			putKeys(t, db, 0, 1000)
+			db.MustCheck()
+		})
+	}
+}
+
+// Ensure that compacting in place keeps the pages read by open transactions
+// and named snapshots.
+func TestDB_CompactInPlace_Readers(t *testing.T) {
+	// Growing the mapping would wait for the read-only transaction.
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{InitialMmapSize: 1 << 26})
+	fillAndDelete(t, db)
+	require.NoError(t, db.CreateSnapshot("snap"))
+	putKeys(t, db, 0, 100)
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	want := tx.Bucket([]byte("widgets")).Stats().KeyN
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.CompactInPlace(&bolt.CompactInPlaceOptions{TxMaxPages: 16})
+		done <- err
+	}()
+
+	// Writers keep going while the pages are relocated.
+	for i := 0; i < 20; i++ {
+		putKeys(t, db, 100+i, 101+i)
+	}
+	require.Equal(t, want, tx.Bucket([]byte("widgets")).Stats().KeyN)
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, <-done)
+
+	stx, err := db.OpenSnapshot("snap")
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{'v'}, 100), stx.Bucket([]byte("widgets")).Get([]byte("00000000")))
+	require.NoError(t, stx.Rollback())
+	db.MustCheck()
+
+	require.NoError(t, db.Close())
+	rdb, err := bolt.Open(db.Path(), 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer rdb.Close()
+	_, err = rdb.CompactInPlace(nil)
+	require.ErrorIs(t, err, berrors.ErrDatabaseReadOnly)
+}
+
+// Ensure that the database is compacted in the background once enough of
+// its pages are free.
+func TestDB_AutoCompact(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{AutoCompactInterval: 10 * time.Millisecond})
+	fillAndDelete(t, db)
+	fi, err := os.Stat(db.Path())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		after, err := os.Stat(db.Path())
+		require.NoError(t, err)
+		return after.Size() < fi.Size()/2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Checking the database is not safe while it is being compacted.
+	require.NoError(t, db.Close())
+	rdb, err := bolt.Open(db.Path(), 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer rdb.Close()
+	err = rdb.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,239 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// Ensure that CompactWithOptions leaves out the keys and buckets filtered
+// out, rewrites the values and reports its progress, whether the top-level
+// buckets are read concurrently or not.
+func TestCompactWithOptions(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprint("workers=", workers), func(t *testing.T) {
+			testCompactWithOptions(t, workers)
+		})
+	}
+}
+
+func testCompactWithOptions(t *testing.T, workers int) {
+	src := btesting.MustCreateDB(t)
+	err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+		child, err := b.CreateBucket([]byte("expired"))
+		if err != nil {
+			return err
+		}
+		if err := child.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("empty"))
+		return err
+	})
+	require.NoError(t, err)
+
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	var progress []bolt.CompactProgress
+	err = bolt.CompactWithOptions(dst, src.DB, bolt.CompactOptions{
+		TxMaxSize:   64,
+		FillPercent: 0.5,
+		Workers:     workers,
+		Filter: func(keys [][]byte, k, v []byte) bool {
+			// Leave out the odd keys and the expired bucket.
+			if v == nil {
+				return string(k) != "expired"
+			}
+			return k[len(k)-1]%2 == 0
+		},
+		Transform: func(keys [][]byte, k, v []byte) ([]byte, error) {
+			require.Equal(t, [][]byte{[]byte("widgets")}, keys)
+			// Leave out a key by returning nil.
+			if string(k) == "000" {
+				return nil, nil
+			}
+			return bytes.ToUpper(append([]byte("v"), v...)), nil
+		},
+		Progress: func(p bolt.CompactProgress) {
+			progress = append(progress, p)
+		},
+	})
+	require.NoError(t, err)
+
+	err = dst.View(func(tx *bolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("empty")))
+		b := tx.Bucket([]byte("widgets"))
+		require.Nil(t, b.Bucket([]byte("expired")))
+		require.Equal(t, 49, b.Stats().KeyN)
+		require.Nil(t, b.Get([]byte("000")))
+		require.Nil(t, b.Get([]byte("001")))
+		require.Equal(t, []byte("V42"), b.Get([]byte("042")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Every bucket and key of src is reported, even if left out, but not
+	// the content of the buckets left out.
+	require.Len(t, progress, 103)
+	for i, p := range progress {
+		require.Equal(t, int64(i+1), p.Keys)
+	}
+	require.Greater(t, progress[len(progress)-1].Bytes, int64(100*3))
+}
+
+// Ensure that an error returned by the transformation stops the compaction.
+func TestCompactWithOptions_TransformError(t *testing.T) {
+	src := btesting.MustCreateDB(t)
+	putKeys(t, src, 0, 10)
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	errBad := errors.New("bad value")
+	for _, workers := range []int{0, 4} {
+		err = bolt.CompactWithOptions(dst, src.DB, bolt.CompactOptions{
+			Workers: workers,
+			Transform: func(keys [][]byte, k, v []byte) ([]byte, error) {
+				return nil, errBad
+			},
+		})
+		require.ErrorIs(t, err, errBad)
+		err = dst.View(func(tx *bolt.Tx) error {
+			require.Nil(t, tx.Bucket([]byte("widgets")))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// Ensure that a parallel compaction copies many top-level buckets in order,
+// and stops on the first error.
+func TestCompactWithOptions_Workers(t *testing.T) {
+	src := btesting.MustCreateDB(t)
+	err := src.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 20; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket%02d", i)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 1000; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%08d", j)), bytes.Repeat([]byte{'v'}, 100)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst.Close()
+	var keys int64
+	err = bolt.CompactWithOptions(dst, src.DB, bolt.CompactOptions{
+		TxMaxSize: 64 * 1024,
+		Workers:   3,
+		Filter: func(keys [][]byte, k, v []byte) bool {
+			return true
+		},
+		Progress: func(p bolt.CompactProgress) {
+			// The progress is reported in order, by the writer.
+			keys++
+			require.Equal(t, keys, p.Keys)
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(20*1001), keys)
+	err = dst.View(func(tx *bolt.Tx) error {
+		for i := 0; i < 20; i++ {
+			b := tx.Bucket([]byte(fmt.Sprintf("bucket%02d", i)))
+			require.Equal(t, 1000, b.Stats().KeyN)
+			require.Equal(t, bytes.Repeat([]byte{'v'}, 100), b.Get([]byte("00000999")))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// An error in a bucket read ahead of the writer stops the compaction
+	// once the writer reaches it.
+	errBad := errors.New("bad value")
+	dst2, err := bolt.Open(filepath.Join(t.TempDir(), "dst2.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst2.Close()
+	err = bolt.CompactWithOptions(dst2, src.DB, bolt.CompactOptions{
+		TxMaxSize: 64 * 1024,
+		Workers:   3,
+		Transform: func(keys [][]byte, k, v []byte) ([]byte, error) {
+			if string(keys[0]) == "bucket05" {
+				return nil, errBad
+			}
+			return v, nil
+		},
+	})
+	require.ErrorIs(t, err, errBad)
+	err = dst2.View(func(tx *bolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("bucket04")))
+		require.Nil(t, tx.Bucket([]byte("bucket06")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// BenchmarkCompactWithOptions_Workers compacts a database of 16 top-level
+// buckets, whose values are re-encoded, with an increasing number of workers.
+func BenchmarkCompactWithOptions_Workers(b *testing.B) {
+	src := btesting.MustCreateDB(b)
+	for i := 0; i < 16; i++ {
+		err := src.Update(func(tx *bolt.Tx) error {
+			bkt, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket%02d", i)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 5000; j++ {
+				if err := bkt.Put([]byte(fmt.Sprintf("%08d", j)), bytes.Repeat([]byte{byte(j)}, 256)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(b, err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint("workers=", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dst, err := bolt.Open(filepath.Join(b.TempDir(), "dst.db"), 0600, &bolt.Options{NoSync: true})
+				require.NoError(b, err)
+				err = bolt.CompactWithOptions(dst, src.DB, bolt.CompactOptions{
+					TxMaxSize: 1 << 20,
+					Workers:   workers,
+					Transform: func(keys [][]byte, k, v []byte) ([]byte, error) {
+						sum := sha256.Sum256(v)
+						return sum[:], nil
+					},
+				})
+				require.NoError(b, err)
+				require.NoError(b, dst.Close())
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package bbolt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// FlateCompression is the name of the built-in compressor based on
+// compress/flate. It is always available and does not need to be registered.
+const FlateCompression = "flate"
+
+// DefaultCompressionThreshold is the minimum size of a value, in bytes, that
+// gets compressed when BucketOptions.CompressionThreshold is not set.
+const DefaultCompressionThreshold = 128
+
+// Compressor compresses the values of a bucket. Implementations must be safe
+// for concurrent use and must always be able to decompress what they
+// compressed, including after the database has been reopened.
+type Compressor interface {
+	// Compress appends the compressed form of src to dst and returns the
+	// extended buffer.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst and returns the
+	// extended buffer.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// flateCompressor implements Compressor using compress/flate. Writers are
+// pooled as they are expensive to allocate.
+type flateCompressor struct {
+	writers sync.Pool
+}
+
+func newFlateCompressor() *flateCompressor {
+	return &flateCompressor{}
+}
+
+func (c *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compress returns the representation of value stored in the bucket and the
+// element flags to store it with. Values below the threshold, and values that
+// do not get smaller, are stored as is.
+//
+// A compressed value is prefixed with its uncompressed length as a uvarint, so
+// that statistics can be gathered without decompressing it.
+func (b *Bucket) compress(value []byte) ([]byte, uint32, error) {
+	if b.compressor == nil || len(value) < int(b.opts.CompressionThreshold) {
+		return value, 0, nil
+	}
+
+	buf := binary.AppendUvarint(make([]byte, 0, len(value)), uint64(len(value)))
+	buf, err := b.compressor.Compress(buf, value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("compress value: %w", err)
+	}
+	if len(buf) >= len(value) {
+		return value, 0, nil
+	}
+	return buf, common.CompressedValueFlag, nil
+}
+
+// decompress returns the original value of a compressed element value.
+func (b *Bucket) decompress(v []byte) []byte {
+	n, sz := binary.Uvarint(v)
+	if sz <= 0 {
+		panic(fmt.Sprintf("corrupted compressed value: invalid length prefix %x", v[:min(len(v), binary.MaxVarintLen64)]))
+	}
+	if b.compressor == nil {
+		panic(fmt.Sprintf("compressed value in bucket without compressor %q", b.opts.Compression))
+	}
+
+	value, err := b.compressor.Decompress(make([]byte, 0, n), v[sz:])
+	if err != nil {
+		panic(fmt.Sprintf("corrupted compressed value: %v", err))
+	} else if uint64(len(value)) != n {
+		panic(fmt.Sprintf("corrupted compressed value: length %d, expected %d", len(value), n))
+	}
+	return value
+}
+
+// rawValueSize returns the uncompressed size of a compressed element value.
+func rawValueSize(v []byte) int {
+	n, sz := binary.Uvarint(v)
+	if sz <= 0 {
+		return len(v)
+	}
+	return int(n)
+}
+
+// value returns an element value the way it is exposed to callers: nil for
+// nested buckets, without the expiry time for expiring values, decompressed
+// for compressed values, read from the blob for blob values and as is
+// otherwise.
+func (c *Cursor) value(v []byte, flags uint32) []byte {
+	if (flags & common.BucketLeafFlag) != 0 {
+		return nil
+	}
+	if isStoredBlob(flags) {
+		return c.bucket.blob(readBlobPointer(v, flags))
+	}
+	if (flags & common.ChunkedValueFlag) != 0 {
+		k, _, _ := c.keyValue()
+		return c.bucket.chunkedValue(k, v)
+	}
+	if (flags & common.ExpiringValueFlag) != 0 {
+		v = v[expirySize:]
+	}
+	if (flags & common.CompressedValueFlag) != 0 {
+		return c.bucket.decompress(v)
+	}
+	return v
+}
@@ -0,0 +1,194 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// rleCompressor is a test compressor using a byte-wise run-length encoding.
+type rleCompressor struct{}
+
+func (rleCompressor) Compress(dst, src []byte) ([]byte, error) {
+	for i := 0; i < len(src); {
+		j := i + 1
+		for j < len(src) && j-i < 255 && src[j] == src[i] {
+			j++
+		}
+		dst = append(dst, byte(j-i), src[i])
+		i = j
+	}
+	return dst, nil
+}
+
+func (rleCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	if len(src)%2 != 0 {
+		return nil, fmt.Errorf("invalid run-length encoding")
+	}
+	for i := 0; i < len(src); i += 2 {
+		dst = append(dst, bytes.Repeat(src[i+1:i+2], int(src[i]))...)
+	}
+	return dst, nil
+}
+
+func jsonValue(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"items":[%s]}`, i, strings.Repeat(`{"name":"widget","color":"blue"},`, 40)))
+}
+
+// Ensure that values are compressed transparently.
+func TestBucket_Compression(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	const n = 200
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Compression: bolt.FlateCompression})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, bolt.DefaultCompressionThreshold, b.Options().CompressionThreshold)
+
+		for i := 0; i < n; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), jsonValue(i)); err != nil {
+				return err
+			}
+		}
+		// Values below the threshold are stored as is.
+		if err := b.Put([]byte("small"), []byte("tiny")); err != nil {
+			return err
+		}
+
+		// Values are readable within the same transaction.
+		require.Equal(t, jsonValue(7), b.Get([]byte("0007")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	verify := func() {
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			require.Equal(t, bolt.FlateCompression, b.Options().Compression)
+			require.Equal(t, []byte("tiny"), b.Get([]byte("small")))
+			require.Equal(t, jsonValue(42), b.Get([]byte("0042")))
+
+			i := 0
+			c := b.Cursor()
+			for k, v := c.First(); k != nil && !bytes.Equal(k, []byte("small")); k, v = c.Next() {
+				require.Equal(t, jsonValue(i), v)
+				i++
+			}
+			require.Equal(t, n, i)
+
+			k, v := c.Seek([]byte("0100"))
+			require.Equal(t, []byte("0100"), k)
+			require.Equal(t, jsonValue(100), v)
+
+			stats := b.Stats()
+			require.Equal(t, n, stats.CompressedValueN)
+			raw := len("tiny")
+			for i := 0; i < n; i++ {
+				raw += len(jsonValue(i))
+			}
+			require.Equal(t, raw, stats.ValueRawBytes)
+			require.Less(t, stats.ValueStoredBytes*5, stats.ValueRawBytes)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	verify()
+
+	db.MustClose()
+	db.MustReopen()
+	verify()
+}
+
+// Ensure that a registered compressor is used and required to open the bucket.
+func TestBucket_Compression_Custom(t *testing.T) {
+	opts := &bolt.Options{
+		PageSize:    4096,
+		Compressors: map[string]bolt.Compressor{"rle": rleCompressor{}},
+	}
+	db := btesting.MustCreateDBWithOption(t, opts)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketWithOptions([]byte("nope"), bolt.BucketOptions{Compression: "unknown"})
+		require.ErrorIs(t, err, berrors.ErrCompressorNotRegistered)
+
+		root, err := tx.CreateBucket([]byte("root"))
+		if err != nil {
+			return err
+		}
+		// An inline bucket with compressed values.
+		b, err := root.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Compression: "rle", CompressionThreshold: 4})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), bytes.Repeat([]byte("a"), 100))
+	})
+	require.NoError(t, err)
+
+	db.MustClose()
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("root")).Bucket([]byte("widgets"))
+		require.Equal(t, bolt.BucketOptions{Compression: "rle", CompressionThreshold: 4}, b.Options())
+		require.Equal(t, bytes.Repeat([]byte("a"), 100), b.Get([]byte("key")))
+		require.Equal(t, 1, b.Stats().CompressedValueN)
+		return nil
+	})
+	require.NoError(t, err)
+
+	db.MustClose()
+	db.SetOptions(&bolt.Options{PageSize: 4096})
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("root")).Bucket([]byte("widgets")))
+		return nil
+	})
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte("root")).CreateBucketIfNotExists([]byte("widgets"))
+		require.ErrorIs(t, err, berrors.ErrCompressorNotRegistered)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that Compact keeps values compressed.
+func TestCompact_Compression(t *testing.T) {
+	src := btesting.MustCreateDB(t)
+	err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Compression: bolt.FlateCompression, CompressionThreshold: 512})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), jsonValue(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, bolt.Compact(dst, src.DB, 0))
+
+	err = dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, 512, b.Options().CompressionThreshold)
+		require.Equal(t, 100, b.Stats().CompressedValueN)
+		require.Equal(t, jsonValue(99), b.Get([]byte("0099")))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -1,7 +1,6 @@
 package bbolt
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
 
@@ -22,23 +21,35 @@ import (
 type Cursor struct {
 	bucket *Bucket
 	stack  []elemRef
+	keyBuf []byte // full page keys compared with a custom comparator
+	keys   []byte // arena of the keys returned at prefix-compressed pages
 }
 
+// cursorKeyArenaSize is the size of the arenas a cursor builds the keys of
+// prefix-compressed pages in, after the first key.
+const cursorKeyArenaSize = 4096
+
 // Bucket returns the bucket that this cursor was created from.
 func (c *Cursor) Bucket() *Bucket {
 	return c.bucket
 }
 
+// Err returns the error of the transaction of the cursor, see Tx.Err. Once it
+// is not nil, the cursor may have skipped the keys of a page failing its
+// checksum or decryption, and the keys and values it returned must not be
+// trusted.
+func (c *Cursor) Err() error {
+	return c.bucket.tx.Err()
+}
+
 // First moves the cursor to the first item in the bucket and returns its key and value.
 // If the bucket is empty then a nil key and value are returned.
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) First() (key []byte, value []byte) {
 	common.Assert(c.bucket.tx.db != nil, "tx closed")
-	k, v, flags := c.first()
-	if (flags & uint32(common.BucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
+	c.bucket.tx.opt.scan(c.bucket)
+	k, v, flags := c.skipNext(c.first())
+	return k, c.value(v, flags)
 }
 
 func (c *Cursor) first() (key []byte, value []byte, flags uint32) {
@@ -65,6 +76,14 @@ func (c *Cursor) first() (key []byte, value []byte, flags uint32) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Last() (key []byte, value []byte) {
 	common.Assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.opt.scan(c.bucket)
+	k, v, flags := c.skipPrev(c.lastKeyValue())
+	return k, c.value(v, flags)
+}
+
+// lastKeyValue moves the cursor to the last item in the bucket and returns
+// its key, value and flags.
+func (c *Cursor) lastKeyValue() (key []byte, value []byte, flags uint32) {
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.RootPage())
 	ref := elemRef{page: p, node: n}
@@ -79,14 +98,10 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 	}
 
 	if len(c.stack) == 0 {
-		return nil, nil
+		return nil, nil, 0
 	}
 
-	k, v, flags := c.keyValue()
-	if (flags & uint32(common.BucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
+	return c.keyValue()
 }
 
 // Next moves the cursor to the next item in the bucket and returns its key and value.
@@ -94,11 +109,9 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Next() (key []byte, value []byte) {
 	common.Assert(c.bucket.tx.db != nil, "tx closed")
-	k, v, flags := c.next()
-	if (flags & uint32(common.BucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
+	c.bucket.tx.opt.scan(c.bucket)
+	k, v, flags := c.skipNext(c.next())
+	return k, c.value(v, flags)
 }
 
 // Prev moves the cursor to the previous item in the bucket and returns its key and value.
@@ -106,11 +119,9 @@ func (c *Cursor) Next() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Prev() (key []byte, value []byte) {
 	common.Assert(c.bucket.tx.db != nil, "tx closed")
-	k, v, flags := c.prev()
-	if (flags & uint32(common.BucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
+	c.bucket.tx.opt.scan(c.bucket)
+	k, v, flags := c.skipPrev(c.prev())
+	return k, c.value(v, flags)
 }
 
 // Seek moves the cursor to a given key using a b-tree search and returns it.
@@ -119,20 +130,13 @@ func (c *Cursor) Prev() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
 	common.Assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.opt.scan(c.bucket)
 
-	k, v, flags := c.seek(seek)
-
-	// If we ended up after the last element of a page then move to the next one.
-	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
-		k, v, flags = c.next()
-	}
-
+	k, v, flags := c.skipNext(c.seekNext(seek))
 	if k == nil {
 		return nil, nil
-	} else if (flags & uint32(common.BucketLeafFlag)) != 0 {
-		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 }
 
 // Delete removes the current key/value under the cursor from the bucket.
@@ -144,16 +148,61 @@ func (c *Cursor) Delete() error {
 		return errors.ErrTxNotWritable
 	}
 
-	key, _, flags := c.keyValue()
+	key, v, flags := c.keyValue()
 	// Return an error if current value is a bucket.
 	if (flags & common.BucketLeafFlag) != 0 {
 		return errors.ErrIncompatibleValue
 	}
+	indexes, err := c.bucket.indexUpdates()
+	if err != nil {
+		return err
+	}
+	indexes.remove(key, c.value(v, flags))
+	if c.bucket.tx.changes != nil {
+		c.bucket.tx.changes.add(c.bucket, Change{Op: ChangeDelete, Key: key, OldValue: append([]byte{}, c.value(v, flags)...)})
+	}
+	var expires int64
+	if (flags & common.ExpiringValueFlag) != 0 {
+		expires = valueExpiry(v)
+	}
+	c.bucket.freeValue(key, v, flags)
 	c.node().del(key)
+	c.bucket.unindexExpiry(key, expires)
+	indexes.apply()
+	c.bucket.touchVersion(key)
+	c.bucket.tx.opt.write(c.bucket, optimisticWrite{op: opDelete, key: key})
 
 	return nil
 }
 
+// expiry returns the expiry time of the current element, in Unix nanoseconds,
+// or zero if it does not expire.
+func (c *Cursor) expiry() int64 {
+	_, v, flags := c.keyValue()
+	if (flags & common.ExpiringValueFlag) == 0 {
+		return 0
+	}
+	return valueExpiry(v)
+}
+
+// skipNext moves the cursor forward past the elements hidden from callers,
+// starting with the given one, and returns the first one that is not.
+func (c *Cursor) skipNext(k, v []byte, flags uint32) ([]byte, []byte, uint32) {
+	for k != nil && c.bucket.hidden(k, v, flags) {
+		k, v, flags = c.next()
+	}
+	return k, v, flags
+}
+
+// skipPrev moves the cursor backward past the elements hidden from callers,
+// starting with the given one, and returns the first one that is not.
+func (c *Cursor) skipPrev(k, v []byte, flags uint32) ([]byte, []byte, uint32) {
+	for k != nil && c.bucket.hidden(k, v, flags) {
+		k, v, flags = c.prev()
+	}
+	return k, v, flags
+}
+
 // seek moves the cursor to a given key and returns it.
 // If the key does not exist then the next key is used.
 func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
@@ -165,6 +214,17 @@ func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
 	return c.keyValue()
 }
 
+// seekNext moves the cursor to the first key greater than or equal to seek.
+// If the search ends up after the last element of a page then it moves on to
+// the next page.
+func (c *Cursor) seekNext(seek []byte) (key []byte, value []byte, flags uint32) {
+	k, v, flags := c.seek(seek)
+	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+		k, v, flags = c.next()
+	}
+	return k, v, flags
+}
+
 // first moves the cursor to the first leaf element under the last page in the stack.
 func (c *Cursor) goToFirstElementOnTheStack() {
 	for {
@@ -306,11 +366,11 @@ func (c *Cursor) searchNode(key []byte, n *node) {
 	index := sort.Search(len(n.inodes), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(n.inodes[i].Key(), key)
+		ret := c.bucket.compareKeys(n.inodes[i].Key(), key)
 		if ret == 0 {
 			exact = true
 		}
-		return ret != -1
+		return ret >= 0
 	})
 	if !exact && index > 0 {
 		index--
@@ -326,14 +386,15 @@ func (c *Cursor) searchPage(key []byte, p *common.Page) {
 	inodes := p.BranchPageElements()
 
 	var exact bool
+	prefix := p.KeyPrefix()
 	index := sort.Search(int(p.Count()), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(inodes[i].Key(), key)
+		ret := c.comparePageKey(prefix, inodes[i].Key(), key)
 		if ret == 0 {
 			exact = true
 		}
-		return ret != -1
+		return ret >= 0
 	})
 	if !exact && index > 0 {
 		index--
@@ -352,20 +413,36 @@ func (c *Cursor) nsearch(key []byte) {
 	// If we have a node then search its inodes.
 	if n != nil {
 		index := sort.Search(len(n.inodes), func(i int) bool {
-			return bytes.Compare(n.inodes[i].Key(), key) != -1
+			return c.bucket.compareKeys(n.inodes[i].Key(), key) >= 0
 		})
 		e.index = index
 		return
 	}
 
 	// If we have a page then search its leaf elements.
-	inodes := p.LeafPageElements()
+	prefix := p.KeyPrefix()
+	elems := p.LeafPageElements()
 	index := sort.Search(int(p.Count()), func(i int) bool {
-		return bytes.Compare(inodes[i].Key(), key) != -1
+		return c.comparePageKey(prefix, elems[i].Key(), key) >= 0
 	})
 	e.index = index
 }
 
+// comparePageKey compares the key of a page element, made of the page prefix
+// and the key stored in the element, with key, in the key order of the
+// bucket. The page key is only built for custom comparators, in a buffer
+// reused by the cursor.
+func (c *Cursor) comparePageKey(prefix, suffix, key []byte) int {
+	if len(prefix) == 0 {
+		return c.bucket.compareKeys(suffix, key)
+	}
+	if c.bucket.compare == nil {
+		return common.ComparePrefixedKey(prefix, suffix, key)
+	}
+	c.keyBuf = append(append(c.keyBuf[:0], prefix...), suffix...)
+	return c.bucket.compareKeys(c.keyBuf, key)
+}
+
 // keyValue returns the key and value of the current leaf element.
 func (c *Cursor) keyValue() ([]byte, []byte, uint32) {
 	ref := &c.stack[len(c.stack)-1]
@@ -383,7 +460,30 @@ func (c *Cursor) keyValue() ([]byte, []byte, uint32) {
 
 	// Or retrieve value from page.
 	elem := ref.page.LeafPageElement(uint16(ref.index))
-	return elem.Key(), elem.Value(), elem.Flags()
+	return c.pageKey(ref.page, elem.Key()), elem.Value(), elem.Flags()
+}
+
+// pageKey returns the key of a leaf element of a page, given the key stored
+// in the element. On a prefix-compressed page, the key is built in an arena
+// of the cursor, so that scans do not allocate a key per element. The arena
+// is never overwritten, but replaced once full, so that the keys stay valid
+// for the life of the transaction like the keys pointing into the mmap.
+func (c *Cursor) pageKey(p *common.Page, suffix []byte) []byte {
+	prefix := p.KeyPrefix()
+	if len(prefix) == 0 {
+		return suffix
+	}
+	n := len(prefix) + len(suffix)
+	if cap(c.keys)-len(c.keys) < n {
+		size := n
+		if c.keys != nil {
+			size = max(n, cursorKeyArenaSize)
+		}
+		c.keys = make([]byte, 0, size)
+	}
+	start := len(c.keys)
+	c.keys = append(append(c.keys, prefix...), suffix...)
+	return c.keys[start:len(c.keys):len(c.keys)]
 }
 
 // node returns the node that the cursor is currently positioned on.
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -105,6 +106,13 @@ type DB struct {
 	// Do not change concurrently with calls to Batch.
 	MaxBatchDelay time.Duration
 
+	// MaxOptimisticRetries is the number of times OptimisticUpdate runs its
+	// function again after a conflict. Default value is copied from
+	// DefaultMaxOptimisticRetries in Open.
+	//
+	// If <=0, conflicts are returned without retrying.
+	MaxOptimisticRetries int
+
 	// AllocSize is the amount of space allocated when the database
 	// needs to create new pages. This is done to amortize the cost
 	// of truncate() and fsync() when growing the data file.
@@ -118,6 +126,23 @@ type DB struct {
 
 	logger Logger
 
+	comparators map[string]Comparator
+	compressors map[string]Compressor
+	cipher      Cipher
+	pageCache   *pageCache
+
+	indexExtractors map[string]IndexExtractor
+
+	pageChecksums bool            // pages end with a checksum
+	checkedPages  []atomic.Uint64 // bitmap of pages whose checksum is verified
+
+	keyPrefixCompression bool // branch and leaf pages are written with key prefix compression
+
+	blobThreshold int // values larger than this are stored in blobs, zero to disable
+
+	wal               *wal // write-ahead log, nil unless in WAL mode or replaying one read-only
+	walCheckpointSize int64
+
 	path     string
 	openFile func(string, int, os.FileMode) (*os.File, error)
 	file     *os.File
@@ -142,6 +167,37 @@ type DB struct {
 	batchMu sync.Mutex
 	batch   *batch
 
+	bucketLocksMu   sync.Mutex
+	bucketLocks     map[string]*bucketLock // top-level buckets held by UpdateBuckets
+	bucketUpdatesMu sync.Mutex
+	bucketUpdates   []*bucketUpdate // UpdateBuckets calls waiting to be merged
+
+	captureChanges    atomic.Bool // whether read-write transactions record their changes
+	subsMu            sync.Mutex
+	subs              []*Subscription
+	changeHistory     []*ChangeSet
+	changeHistorySize int
+	changesTxid       common.Txid // last transaction whose changes were published
+
+	captureReplica     atomic.Bool // whether read-write transactions record their pages
+	replicasMu         sync.Mutex
+	replicas           []*replica
+	replicaHistory     []*replicaFrame
+	replicaHistorySize int
+
+	pageTxids *pageTxids // set by Options.IncrementalBackup
+
+	snapshots map[string]*common.Meta // named snapshots, protected by metalock
+
+	txHistorySize      int
+	txHistoryRetention time.Duration
+	retained           []retainedTx // transactions retained by the history, oldest first, protected by metalock
+
+	autoCompactStop chan struct{} // closed to stop Options.AutoCompactInterval
+
+	expiryReapTxMaxKeys int
+	expiryReapStop      chan struct{} // closed to stop Options.ExpiryReapInterval
+
 	rwlock   sync.Mutex   // Allows only one writer at a time.
 	metalock sync.Mutex   // Protects meta page access.
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
@@ -154,6 +210,10 @@ type DB struct {
 	// Read only mode.
 	// When true, Update() and Begin(true) return ErrDatabaseReadOnly immediately.
 	readOnly bool
+
+	// Follower mode, set by Options.Follower. The database is only changed
+	// by DB.Follow; Update() and Begin(true) return ErrDatabaseReadOnly.
+	follower bool
 }
 
 // Path returns the path to currently open database file.
@@ -191,10 +251,27 @@ func Open(path string, mode os.FileMode, options *Options) (db *DB, err error) {
 	db.PreLoadFreelist = options.PreLoadFreelist
 	db.FreelistType = options.FreelistType
 	db.Mlock = options.Mlock
+	db.comparators = options.Comparators
+	db.indexExtractors = options.IndexExtractors
+	db.compressors = map[string]Compressor{FlateCompression: newFlateCompressor()}
+	for name, c := range options.Compressors {
+		db.compressors[name] = c
+	}
+	if options.Cipher != nil {
+		db.cipher = options.Cipher
+		db.pageCache = newPageCache(options.PageCacheSize)
+	}
+	db.pageChecksums = options.PageChecksums
+	db.keyPrefixCompression = options.KeyPrefixCompression
+	db.blobThreshold = options.BlobThreshold
+	db.expiryReapTxMaxKeys = options.ExpiryReapTxMaxKeys
+	db.txHistorySize = options.TxHistorySize
+	db.txHistoryRetention = options.TxHistoryRetention
 
 	// Set default values for later DB operations.
 	db.MaxBatchSize = common.DefaultMaxBatchSize
 	db.MaxBatchDelay = common.DefaultMaxBatchDelay
+	db.MaxOptimisticRetries = common.DefaultMaxOptimisticRetries
 	db.AllocSize = common.DefaultAllocSize
 
 	if options.Logger == nil {
@@ -220,8 +297,10 @@ func Open(path string, mode os.FileMode, options *Options) (db *DB, err error) {
 		flag = os.O_RDONLY
 		db.readOnly = true
 	} else {
-		// always load free pages in write mode
-		db.PreLoadFreelist = true
+		// always load free pages in write mode, except for a follower,
+		// which never allocates any
+		db.follower = options.Follower
+		db.PreLoadFreelist = !db.follower
 		flag |= os.O_CREATE
 	}
 
@@ -260,12 +339,14 @@ func Open(path string, mode os.FileMode, options *Options) (db *DB, err error) {
 	}
 
 	// Initialize the database if it doesn't exist.
+	var created bool
 	if info, statErr := db.file.Stat(); statErr != nil {
 		_ = db.close()
 		lg.Errorf("failed to get db file's stats (%s): %v", path, err)
 		return nil, statErr
 	} else if info.Size() == 0 {
 		// Initialize new files with meta pages.
+		created = true
 		if err = db.init(); err != nil {
 			// clean up file descriptor on initialization fail
 			_ = db.close()
@@ -288,21 +369,83 @@ func Open(path string, mode os.FileMode, options *Options) (db *DB, err error) {
 		},
 	}
 
-	// Memory map the data file.
-	if err = db.mmap(options.InitialMmapSize); err != nil {
+	// Replay the write-ahead log, and open it in WAL mode.
+	if err = db.openWAL(mode, options, created); err != nil {
+		_ = db.close()
+		lg.Errorf("failed to open write-ahead log of db file (%s): %v", path, err)
+		return nil, err
+	}
+
+	// Memory map the data file. A read-only database serving transactions
+	// from the write-ahead log maps the pages they have allocated, although
+	// they are read from the log.
+	mmapSize := options.InitialMmapSize
+	if db.wal != nil {
+		if m := db.wal.lastMeta(); m != nil {
+			mmapSize = max(mmapSize, int(m.Pgid())*db.pageSize)
+		}
+	}
+	if err = db.mmap(mmapSize); err != nil {
 		_ = db.close()
 		lg.Errorf("failed to map db file (%s): %v", path, err)
 		return nil, err
 	}
 
+	if err = db.checkCipher(); err != nil {
+		_ = db.close()
+		lg.Errorf("failed to decrypt db file (%s): %v", path, err)
+		return nil, err
+	}
+
+	// Existing databases keep the page format they were created with.
+	db.pageChecksums = db.meta().Flags()&common.MetaPageChecksumFlag != 0
+	db.resetCheckedPages()
+
+	if options.IncrementalBackup {
+		db.loadPageTxids()
+	}
+
+	if err = db.loadSnapshots(); err != nil {
+		_ = db.close()
+		lg.Errorf("failed to load snapshots of db file (%s): %v", path, err)
+		return nil, err
+	}
+
 	if db.PreLoadFreelist {
-		db.loadFreelist()
+		if err = db.loadFreelist(); err != nil {
+			_ = db.close()
+			lg.Errorf("failed to load freelist of db file (%s): %v", path, err)
+			return nil, err
+		}
 	}
 
-	if db.readOnly {
+	if db.readOnly || db.follower {
 		return db, nil
 	}
 
+	if db.wal != nil {
+		go db.runCheckpointer(db.wal, options.WALCheckpointInterval)
+	}
+	if options.AutoCompactInterval > 0 {
+		db.autoCompactStop = make(chan struct{})
+		go db.runAutoCompact(db.autoCompactStop, options.AutoCompactInterval, options.AutoCompactRatio)
+	}
+	if options.ExpiryReapInterval > 0 {
+		db.expiryReapStop = make(chan struct{})
+		go db.runReaper(db.expiryReapStop, options.ExpiryReapInterval)
+	}
+
+	// Start recording the changes for the history.
+	db.changesTxid = db.meta().Txid()
+	if options.ChangeHistory > 0 {
+		db.changeHistorySize = options.ChangeHistory
+		db.captureChanges.Store(true)
+	}
+	if options.ReplicationHistory > 0 {
+		db.replicaHistorySize = options.ReplicationHistory
+		db.captureReplica.Store(true)
+	}
+
 	// Flush freelist when transitioning from no sync to sync so
 	// NoFreelistSync unaware boltdb can open the db later.
 	if !db.NoFreelistSync && !db.hasSyncedFreelist() {
@@ -413,8 +556,10 @@ func (db *DB) getPageSizeFromSecondMeta() (int, bool, error) {
 
 // loadFreelist reads the freelist if it is synced, or reconstructs it
 // by scanning the DB if it is not synced. It assumes there are no
-// concurrent accesses being made to the freelist.
-func (db *DB) loadFreelist() {
+// concurrent accesses being made to the freelist. Returns an error if the
+// pages recorded for the named snapshots, or the pages of the retained
+// transactions, cannot be read, the first time it is called.
+func (db *DB) loadFreelist() (err error) {
 	db.freelistLoad.Do(func() {
 		db.freelist = newFreelist(db.FreelistType)
 		if !db.hasSyncedFreelist() {
@@ -422,10 +567,19 @@ func (db *DB) loadFreelist() {
 			db.freelist.readIDs(db.freepages())
 		} else {
 			// Read free list from freelist page.
-			db.freelist.read(db.page(db.meta().Freelist()))
+			p, perr := db.pageE(db.meta().Freelist(), db.meta().Txid())
+			if perr != nil {
+				err = perr
+				return
+			}
+			db.freelist.read(p)
 		}
+		// The pages of the named snapshots and retained transactions
+		// are saved as free pages.
+		err = db.pinSnapshots()
 		db.stats.FreePageN = db.freelist.free_count()
 	})
+	return err
 }
 
 func (db *DB) hasSyncedFreelist() bool {
@@ -446,10 +600,14 @@ func (db *DB) fileSize() (int, error) {
 
 // mmap opens the underlying memory-mapped file and initializes the meta references.
 // minsz is the minimum size that the new mmap can be.
-func (db *DB) mmap(minsz int) (err error) {
+func (db *DB) mmap(minsz int) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
+	return db.remap(minsz)
+}
 
+// remap maps the data file while the mmap lock is held.
+func (db *DB) remap(minsz int) (err error) {
 	lg := db.Logger()
 
 	// Ensure the size is at least the minimum size.
@@ -512,8 +670,8 @@ func (db *DB) mmap(minsz int) (err error) {
 	}
 
 	// Save references to the meta pages.
-	db.meta0 = db.page(0).Meta()
-	db.meta1 = db.page(1).Meta()
+	db.meta0 = db.rawPage(0).Meta()
+	db.meta1 = db.rawPage(1).Meta()
 
 	// Validate the meta pages. We only return an error if both meta pages fail
 	// validation, since meta0 failing validation means that it wasn't saved
@@ -525,6 +683,8 @@ func (db *DB) mmap(minsz int) (err error) {
 		return err0
 	}
 
+	db.resetCheckedPages()
+
 	return nil
 }
 
@@ -636,6 +796,12 @@ func (db *DB) init() error {
 		m.SetRootBucket(common.NewInBucket(3, 0))
 		m.SetPgid(4)
 		m.SetTxid(common.Txid(i))
+		if db.cipher != nil {
+			m.SetFeatureFlags(common.MetaEncryptedFlag)
+		}
+		if db.pageChecksums {
+			m.SetFeatureFlags(common.MetaPageChecksumFlag)
+		}
 		m.SetChecksum(m.Sum64())
 	}
 
@@ -651,6 +817,20 @@ func (db *DB) init() error {
 	p.SetFlags(common.LeafPageFlag)
 	p.SetCount(0)
 
+	// Add checksums to the freelist and the leaf page, then encrypt them.
+	for id := common.Pgid(2); id < 4; id++ {
+		if db.pageChecksums {
+			db.setPageChecksum(db.pageInBuffer(buf, id))
+		}
+		if db.cipher != nil {
+			enc, err := db.encryptPage(db.pageInBuffer(buf, id), 0)
+			if err != nil {
+				return err
+			}
+			copy(buf[int(id)*db.pageSize:], enc)
+		}
+	}
+
 	// Write the buffer to our data file.
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		db.Logger().Errorf("writeAt failed: %w", err)
@@ -687,12 +867,36 @@ func (db *DB) close() error {
 
 	db.opened = false
 
+	if db.autoCompactStop != nil {
+		close(db.autoCompactStop)
+		db.autoCompactStop = nil
+	}
+	if db.expiryReapStop != nil {
+		close(db.expiryReapStop)
+		db.expiryReapStop = nil
+	}
 	db.freelist = nil
+	db.closeSubscriptions()
+	db.closeReplicas()
+
+	var errs []error
+	// Fold the write-ahead log into the data file.
+	if db.wal != nil {
+		if err := db.closeWAL(); err != nil {
+			errs = append(errs, fmt.Errorf("write-ahead log close: %w", err))
+		}
+	}
+
+	// Keep the tracked pages for the next session.
+	if db.pageTxids != nil && !db.readOnly && len(errs) == 0 {
+		if err := db.savePageTxids(); err != nil {
+			errs = append(errs, fmt.Errorf("page txids save: %w", err))
+		}
+	}
 
 	// Clear ops.
 	db.ops.writeAt = nil
 
-	var errs []error
 	// Close the mmap.
 	if err := db.munmap(); err != nil {
 		errs = append(errs, err)
@@ -766,6 +970,19 @@ func (db *DB) Logger() Logger {
 }
 
 func (db *DB) beginTx() (*Tx, error) {
+	return db.beginSnapshotTx(&Tx{})
+}
+
+// beginSnapshotTx initializes t from the current meta page and keeps track of
+// it like a read-only transaction, so that the pages it reads are not reused
+// until it is removed.
+func (db *DB) beginSnapshotTx(t *Tx) (*Tx, error) {
+	return db.beginTxAt(t, func() (*common.Meta, error) { return db.meta(), nil })
+}
+
+// beginTxAt is like beginSnapshotTx, but initializes t from the meta returned
+// by metaFn, which is called with the meta lock held.
+func (db *DB) beginTxAt(t *Tx, metaFn func() (*common.Meta, error)) (*Tx, error) {
 	// Lock the meta pages while we initialize the transaction. We obtain
 	// the meta lock before the mmap lock because that's the order that the
 	// write transaction will obtain them.
@@ -790,9 +1007,15 @@ func (db *DB) beginTx() (*Tx, error) {
 		return nil, berrors.ErrInvalidMapping
 	}
 
+	m, err := metaFn()
+	if err != nil {
+		db.mmaplock.RUnlock()
+		db.metalock.Unlock()
+		return nil, err
+	}
+
 	// Create a transaction associated with the database.
-	t := &Tx{}
-	t.init(db)
+	t.initAt(db, m)
 
 	// Keep track of transaction until it closes.
 	db.txs = append(db.txs, t)
@@ -811,15 +1034,21 @@ func (db *DB) beginTx() (*Tx, error) {
 }
 
 func (db *DB) beginRWTx() (*Tx, error) {
-	// If the database was opened with Options.ReadOnly, return an error.
-	if db.readOnly {
+	// If the database was opened with Options.ReadOnly, or is a follower,
+	// return an error.
+	if db.readOnly || db.follower {
 		return nil, berrors.ErrDatabaseReadOnly
 	}
 
 	// Obtain writer lock. This is released by the transaction when it closes.
 	// This enforces only one writer transaction at a time.
 	db.rwlock.Lock()
+	return db.beginLockedRWTx()
+}
 
+// beginLockedRWTx starts a read-write transaction once the writer lock is
+// held. The lock is released if it fails.
+func (db *DB) beginLockedRWTx() (*Tx, error) {
 	// Once we have the writer lock then we can lock the meta pages so that
 	// we can set up the transaction.
 	db.metalock.Lock()
@@ -838,44 +1067,57 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	}
 
 	// Create a transaction associated with the database.
-	t := &Tx{writable: true}
+	t := &Tx{writable: true, changes: db.newChangeLog(), replica: db.newReplicaLog()}
 	t.init(db)
 	db.rwtx = t
 	db.freePages()
 	return t, nil
 }
 
-// freePages releases any pages associated with closed read-only transactions.
+// freePages releases any pages associated with closed read-only transactions
+// and dropped snapshots, or no longer retained by the transaction history.
 func (db *DB) freePages() {
+	// Named snapshots and retained transactions hold their pages like open
+	// transactions.
+	txids := make([]common.Txid, 0, len(db.txs)+len(db.snapshots)+len(db.retained))
+	for _, t := range db.txs {
+		txids = append(txids, t.meta.Txid())
+	}
+	for _, m := range db.snapshots {
+		txids = append(txids, m.Txid())
+	}
+	for _, r := range db.retained {
+		txids = append(txids, r.meta.Txid())
+	}
+	sort.Slice(txids, func(i, j int) bool { return txids[i] < txids[j] })
+
 	// Free all pending pages prior to earliest open transaction.
-	sort.Sort(txsById(db.txs))
 	minid := common.Txid(0xFFFFFFFFFFFFFFFF)
-	if len(db.txs) > 0 {
-		minid = db.txs[0].meta.Txid()
+	if len(txids) > 0 {
+		minid = txids[0]
 	}
 	if minid > 0 {
 		db.freelist.release(minid - 1)
 	}
 	// Release unused txid extents.
-	for _, t := range db.txs {
-		db.freelist.releaseRange(minid, t.meta.Txid()-1)
-		minid = t.meta.Txid() + 1
+	for _, txid := range txids {
+		db.freelist.releaseRange(minid, txid-1)
+		minid = txid + 1
 	}
 	db.freelist.releaseRange(minid, common.Txid(0xFFFFFFFFFFFFFFFF))
 	// Any page both allocated and freed in an extent is safe to release.
 }
 
-type txsById []*Tx
-
-func (t txsById) Len() int           { return len(t) }
-func (t txsById) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t txsById) Less(i, j int) bool { return t[i].meta.Txid() < t[j].meta.Txid() }
-
 // removeTx removes a transaction from the database.
 func (db *DB) removeTx(tx *Tx) {
 	// Release the read lock on the mmap.
 	db.mmaplock.RUnlock()
+	db.untrackTx(tx)
+}
 
+// untrackTx removes a transaction whose read lock on the mmap is already
+// released.
+func (db *DB) untrackTx(tx *Tx) {
 	// Use the meta lock to restrict access to the DB object.
 	db.metalock.Lock()
 
@@ -905,10 +1147,11 @@ func (db *DB) removeTx(tx *Tx) {
 // If no error is returned from the function then the transaction is committed.
 // If an error is returned then the entire transaction is rolled back.
 // Any error that is returned from the function or returned from the commit is
-// returned from the Update() method.
+// returned from the Update() method. A page checksum mismatch found by the
+// function is returned as an error wrapping ErrPageChecksum.
 //
 // Attempting to manually commit or rollback within the function will cause a panic.
-func (db *DB) Update(fn func(*Tx) error) error {
+func (db *DB) Update(fn func(*Tx) error) (err error) {
 	t, err := db.Begin(true)
 	if err != nil {
 		return err
@@ -920,13 +1163,15 @@ func (db *DB) Update(fn func(*Tx) error) error {
 			t.rollback()
 		}
 	}()
-
 	// Mark as a managed tx so that the inner function cannot manually commit.
 	t.managed = true
 
 	// If an error is returned from the function then rollback and return error.
 	err = fn(t)
 	t.managed = false
+	if terr := t.Err(); terr != nil {
+		err = terr
+	}
 	if err != nil {
 		_ = t.Rollback()
 		return err
@@ -937,9 +1182,11 @@ func (db *DB) Update(fn func(*Tx) error) error {
 
 // View executes a function within the context of a managed read-only transaction.
 // Any error that is returned from the function is returned from the View() method.
+// A page checksum mismatch found by the function is returned as an error
+// wrapping ErrPageChecksum.
 //
 // Attempting to manually rollback within the function will cause a panic.
-func (db *DB) View(fn func(*Tx) error) error {
+func (db *DB) View(fn func(*Tx) error) (err error) {
 	t, err := db.Begin(false)
 	if err != nil {
 		return err
@@ -951,13 +1198,15 @@ func (db *DB) View(fn func(*Tx) error) error {
 			t.rollback()
 		}
 	}()
-
 	// Mark as a managed tx so that the inner function cannot manually rollback.
 	t.managed = true
 
 	// If an error is returned from the function then pass it through.
 	err = fn(t)
 	t.managed = false
+	if terr := t.Err(); terr != nil {
+		err = terr
+	}
 	if err != nil {
 		_ = t.Rollback()
 		return err
@@ -1128,8 +1377,27 @@ func (db *DB) Info() *Info {
 	return &Info{uintptr(unsafe.Pointer(&db.data[0])), db.pageSize}
 }
 
-// page retrieves a page reference from the mmap based on the current page size.
-func (db *DB) page(id common.Pgid) *common.Page {
+// pageE retrieves a page reference from the mmap based on the current page
+// size. If the database is encrypted, the page is decrypted into the page
+// cache, and an error is returned if it cannot be decrypted or was written
+// after txid; transactions read their pages with Tx.page instead, which fails
+// the transaction.
+func (db *DB) pageE(id common.Pgid, txid common.Txid) (*common.Page, error) {
+	if db.cipher == nil || id <= 1 {
+		return db.rawPage(id), nil
+	}
+	return db.openPage(id, txid)
+}
+
+// rawPage retrieves a page reference directly from the mmap, or from the
+// write-ahead log if it has not been checkpointed yet. If the database is
+// encrypted, only the page header can be read from it.
+func (db *DB) rawPage(id common.Pgid) *common.Page {
+	if db.wal != nil {
+		if buf := db.wal.page(id); buf != nil {
+			return (*common.Page)(unsafe.Pointer(&buf[0]))
+		}
+	}
 	pos := id * common.Pgid(db.pageSize)
 	return (*common.Page)(unsafe.Pointer(&db.data[pos]))
 }
@@ -1141,6 +1409,14 @@ func (db *DB) pageInBuffer(b []byte, id common.Pgid) *common.Page {
 
 // meta retrieves the current meta page reference.
 func (db *DB) meta() *common.Meta {
+	// The last transaction committed to the write-ahead log is the current
+	// one until it is checkpointed.
+	if db.wal != nil {
+		if m := db.wal.lastMeta(); m != nil {
+			return m
+		}
+	}
+
 	// We have to return the meta with the highest txid which doesn't fail
 	// validation. Otherwise, we can cause errors when in fact the database is
 	// in a consistent state. metaA is the one with the higher txid.
@@ -1175,26 +1451,35 @@ func (db *DB) allocate(txid common.Txid, count int) (*common.Page, error) {
 	p := (*common.Page)(unsafe.Pointer(&buf[0]))
 	p.SetOverflow(uint32(count - 1))
 
+	id, err := db.allocateRun(txid, count)
+	if err != nil {
+		return nil, err
+	}
+	p.SetId(id)
+	return p, nil
+}
+
+// allocateRun returns the id of the first page of a run of count pages, taken
+// from the freelist or above the high water mark, without a buffer for them.
+func (db *DB) allocateRun(txid common.Txid, count int) (common.Pgid, error) {
 	// Use pages from the freelist if they are available.
-	p.SetId(db.freelist.allocate(txid, count))
-	if p.Id() != 0 {
-		return p, nil
+	if id := db.freelist.allocate(txid, count); id != 0 {
+		return id, nil
 	}
 
 	// Resize mmap() if we're at the end.
-	p.SetId(db.rwtx.meta.Pgid())
-	var minsz = int((p.Id()+common.Pgid(count))+1) * db.pageSize
+	id := db.rwtx.meta.Pgid()
+	var minsz = int((id+common.Pgid(count))+1) * db.pageSize
 	if minsz >= db.datasz {
 		if err := db.mmap(minsz); err != nil {
-			return nil, fmt.Errorf("mmap allocate error: %s", err)
+			return 0, fmt.Errorf("mmap allocate error: %s", err)
 		}
 	}
 
 	// Move the page id high water mark.
-	curPgid := db.rwtx.meta.Pgid()
-	db.rwtx.meta.SetPgid(curPgid + common.Pgid(count))
+	db.rwtx.meta.SetPgid(id + common.Pgid(count))
 
-	return p, nil
+	return id, nil
 }
 
 // grow grows the size of the database to the given sz.
@@ -1253,7 +1538,7 @@ func (db *DB) freepages() []common.Pgid {
 	defer func() {
 		err = tx.Rollback()
 		if err != nil {
-			panic("freepages: failed to rollback tx")
+			panic(fmt.Sprintf("freepages: failed to rollback tx (%v)", err))
 		}
 	}()
 	if err != nil {
@@ -1343,6 +1628,133 @@ type Options struct {
 
 	// Logger is the logger used for bbolt.
 	Logger Logger
+
+	// Comparators registers the named key comparators that buckets created
+	// with BucketOptions.Comparator may refer to. A bucket whose comparator
+	// is not registered cannot be opened.
+	Comparators map[string]Comparator
+
+	// Compressors registers the named value compressors that buckets created
+	// with BucketOptions.Compression may refer to, in addition to the built-in
+	// FlateCompression. A bucket whose compressor is not registered cannot be
+	// opened.
+	Compressors map[string]Compressor
+
+	// IndexExtractors registers the named index extractors that the
+	// secondary indexes created with Bucket.CreateIndex may refer to. A
+	// bucket with an index whose extractor is not registered can be read,
+	// but not written to.
+	IndexExtractors map[string]IndexExtractor
+
+	// Cipher encrypts every page of the database except the meta pages.
+	// It must be set when creating the database and every time it is opened.
+	Cipher Cipher
+
+	// PageCacheSize is the maximum number of decrypted pages kept in memory
+	// when Cipher is set. If zero, DefaultPageCacheSize is used.
+	PageCacheSize int
+
+	// PageChecksums adds a CRC-32C checksum to every page of a newly created
+	// database except the meta pages, in the last bytes of the page rather
+	// than in its header. It has no effect on existing databases, which keep
+	// the format they were created with; use Compact to convert one.
+	PageChecksums bool
+
+	// KeyPrefixCompression writes the branch and leaf pages with the prefix
+	// shared by their keys stored once, rather than in every key, when it
+	// saves space. Each page records whether it is prefix-compressed, so the
+	// pages written with and without it can be read either way; existing
+	// pages are converted as they are rewritten, and Compact converts a
+	// whole database. Databases with prefix-compressed pages cannot be read
+	// by versions of bbolt without it.
+	KeyPrefixCompression bool
+
+	// BlobThreshold is the size above which Bucket.Put stores a value in a
+	// blob: a run of pages of its own, outside of the B+tree, pointed to by a
+	// small reference in the leaf page. Large values then no longer make the
+	// leaf pages overflow, so the keys around them are updated without
+	// rewriting them. Blobs are not compressed. If zero, values are only
+	// stored in blobs by Bucket.PutStream. Databases with blobs cannot be
+	// read by versions of bbolt without them.
+	BlobThreshold int
+
+	// WAL enables write-ahead log mode. Commits append their dirty pages and
+	// meta page to a log file next to the database, named after it with a
+	// "-wal" suffix, and sync it once, instead of writing them in place with
+	// two syncs. The log is checkpointed into the database file in the
+	// background, and when the database is closed.
+	//
+	// The log left by a crash is replayed by Open whether or not WAL is set.
+	WAL bool
+
+	// WALCheckpointInterval is the interval between two checkpoints in WAL
+	// mode. If zero, DefaultWALCheckpointInterval is used.
+	WALCheckpointInterval time.Duration
+
+	// WALCheckpointSize is the size in bytes of the write-ahead log above
+	// which a checkpoint is started. If zero, DefaultWALCheckpointSize is
+	// used.
+	WALCheckpointSize int64
+
+	// AutoCompactInterval, if set, starts a background goroutine which
+	// compacts the database in place with DB.CompactInPlace at this interval,
+	// when the ratio of free pages in the file is over AutoCompactRatio.
+	AutoCompactInterval time.Duration
+
+	// AutoCompactRatio is the ratio of free and pending pages over which the
+	// database is compacted when AutoCompactInterval is set. If zero,
+	// DefaultAutoCompactRatio is used.
+	AutoCompactRatio float64
+
+	// ChangeHistory is the number of the last change sets held in memory, so
+	// that DB.Subscribe can catch up on the transactions committed before it
+	// is called. Setting it makes every read-write transaction record its
+	// changes, as they do while there is a subscriber.
+	ChangeHistory int
+
+	// Follower opens the database as a follower of a primary database,
+	// which only changes through DB.Follow and serves read-only
+	// transactions. The write-ahead log is not used by a follower.
+	Follower bool
+
+	// ReplicationHistory is the number of the last commits held in memory,
+	// so that DB.Replicate can resume a follower that disconnected without
+	// copying the whole database. Setting it makes every read-write
+	// transaction record its pages, as they do while there is a follower.
+	ReplicationHistory int
+
+	// IncrementalBackup tracks the transaction that last wrote each page, so
+	// that Tx.WriteIncremental can copy the pages written since a previous
+	// backup. The tracking takes 8 bytes of memory per page, and is saved
+	// next to the database, in a file named after it with a "-txids"
+	// suffix, when it is closed. If the database is modified without it, for
+	// example after a crash, the tracking starts over from the transaction
+	// the database is opened at.
+	IncrementalBackup bool
+
+	// ExpiryReapInterval, if set, starts a background goroutine which deletes
+	// the keys put with Bucket.PutWithTTL that have expired, with
+	// DB.ReapExpired, at this interval.
+	ExpiryReapInterval time.Duration
+
+	// ExpiryReapTxMaxKeys is the maximum number of expired keys deleted by
+	// each read-write transaction of DB.ReapExpired. Smaller transactions
+	// hold the writer lock for less time. If zero,
+	// DefaultExpiryReapTxMaxKeys is used.
+	ExpiryReapTxMaxKeys int
+
+	// TxHistorySize is the number of previous transactions kept readable
+	// with DB.BeginAt. The pages they read are not reused, even across
+	// restarts, until they fall out of the history, so the database grows
+	// with the data modified within it. Each commit also rewrites the
+	// history. If TxHistoryRetention is set too, transactions are kept
+	// while both allow it. If both are zero, no transaction is retained,
+	// and those retained before are released by the next commit.
+	TxHistorySize int
+
+	// TxHistoryRetention is how long previous transactions are kept
+	// readable with DB.BeginAt once superseded, like TxHistorySize.
+	TxHistoryRetention time.Duration
 }
 
 func (o *Options) String() string {
@@ -1380,6 +1792,9 @@ type Stats struct {
 	// Transaction stats
 	TxN     int // total number of started read transactions
 	OpenTxN int // number of currently open read transactions
+
+	// Expiry stats
+	ExpiredKeyN int // total number of expired keys deleted by DB.ReapExpired
 }
 
 // Sub calculates and returns the difference between two sets of database stats.
@@ -1395,6 +1810,7 @@ func (s *Stats) Sub(other *Stats) Stats {
 	diff.FreeAlloc = s.FreeAlloc
 	diff.FreelistInuse = s.FreelistInuse
 	diff.TxN = s.TxN - other.TxN
+	diff.ExpiredKeyN = s.ExpiredKeyN - other.ExpiredKeyN
 	diff.TxStats = s.TxStats.Sub(&other.TxStats)
 	return diff
 }
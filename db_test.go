@@ -36,7 +36,7 @@ type meta struct {
 	_       uint32
 	version uint32
 	_       uint32
-	_       uint32
+	flags   uint32
 	_       [16]byte
 	_       uint64
 	pgid    uint64
@@ -164,11 +164,12 @@ func TestOpen_ErrVersionMismatch(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Rewrite meta pages.
+	// Rewrite meta pages, skipping the version of the files using features
+	// older versions cannot read.
 	meta0 := (*meta)(unsafe.Pointer(&buf[pageHeaderSize]))
-	meta0.version++
+	meta0.version += 2
 	meta1 := (*meta)(unsafe.Pointer(&buf[pageSize+pageHeaderSize]))
-	meta1.version++
+	meta1.version += 2
 	if err := os.WriteFile(path, buf, 0666); err != nil {
 		t.Fatal(err)
 	}
@@ -179,6 +180,29 @@ func TestOpen_ErrVersionMismatch(t *testing.T) {
 	}
 }
 
+// Ensure that opening a file whose meta pages flag a feature unknown to this
+// version returns ErrVersionMismatch.
+func TestOpen_ErrVersionMismatch_UnknownFeature(t *testing.T) {
+	if pageSize != os.Getpagesize() {
+		t.Skip("page size mismatch")
+	}
+
+	db := btesting.MustCreateDB(t)
+	path := db.Path()
+	require.NoError(t, db.Close())
+
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	meta0 := (*meta)(unsafe.Pointer(&buf[pageHeaderSize]))
+	meta0.flags |= 0x80000000
+	meta1 := (*meta)(unsafe.Pointer(&buf[pageSize+pageHeaderSize]))
+	meta1.flags |= 0x80000000
+	require.NoError(t, os.WriteFile(path, buf, 0666))
+
+	_, err = bolt.Open(path, 0600, nil)
+	require.ErrorIs(t, err, berrors.ErrVersionMismatch)
+}
+
 // Ensure that opening a file with two invalid checksums returns ErrChecksum.
 func TestOpen_ErrChecksum(t *testing.T) {
 	if pageSize != os.Getpagesize() {
@@ -1,13 +1,18 @@
 package bbolt
 
 import (
+	"bytes"
+	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
 )
 
 func TestOpenWithPreLoadFreelist(t *testing.T) {
@@ -124,3 +129,151 @@ func prepareData(t *testing.T) (string, error) {
 
 	return fileName, nil
 }
+
+// Ensure that rolling back a failed commit returns an error, rather than
+// panicking, when the freelist page cannot be decrypted.
+func TestTx_rollback_ErrDecrypt(t *testing.T) {
+	c, err := NewAESGCMCipher([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	db, err := Open(path, 0600, &Options{Cipher: c})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}))
+
+	// Tamper with the ciphertext of the freelist page once it is loaded.
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	offset := int64(db.meta().Freelist())*int64(db.pageSize) + 100
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	db.pageCache.reset()
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	require.ErrorIs(t, tx.rollback(), errors.ErrDecrypt)
+	require.Nil(t, tx.db)
+}
+
+// Ensure that writing a feature older versions cannot read sets its flag, and
+// FeatureVersion, in the meta, and that a database without them keeps the
+// original version.
+func TestDB_FeatureFlags(t *testing.T) {
+	c, err := NewAESGCMCipher([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	large := bytes.Repeat([]byte("x"), 8192)
+
+	testCases := []struct {
+		name  string
+		opts  *Options
+		fn    func(b *Bucket) error
+		flags uint32
+	}{
+		{
+			name: "none",
+			fn:   func(b *Bucket) error { return b.Put([]byte("foo"), large) },
+		},
+		{
+			name:  "encryption",
+			opts:  &Options{Cipher: c},
+			fn:    func(b *Bucket) error { return b.Put([]byte("foo"), []byte("bar")) },
+			flags: common.MetaEncryptedFlag,
+		},
+		{
+			name:  "page checksums",
+			opts:  &Options{PageChecksums: true},
+			fn:    func(b *Bucket) error { return b.Put([]byte("foo"), []byte("bar")) },
+			flags: common.MetaPageChecksumFlag,
+		},
+		{
+			name: "bucket options",
+			fn: func(b *Bucket) error {
+				_, err := b.CreateBucketWithOptions([]byte("versioned"), BucketOptions{MaxVersions: 1})
+				return err
+			},
+			flags: common.MetaBucketOptionsFlag,
+		},
+		{
+			name: "key prefix compression",
+			opts: &Options{KeyPrefixCompression: true},
+			fn: func(b *Bucket) error {
+				for i := 0; i < 1000; i++ {
+					if err := b.Put([]byte(fmt.Sprintf("prefix-%04d", i)), []byte("bar")); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			flags: common.MetaKeyPrefixFlag,
+		},
+		{
+			name: "compressed value",
+			fn: func(b *Bucket) error {
+				cb, err := b.CreateBucketWithOptions([]byte("compressed"), BucketOptions{Compression: FlateCompression})
+				if err != nil {
+					return err
+				}
+				return cb.Put([]byte("foo"), large)
+			},
+			flags: common.MetaBucketOptionsFlag | common.MetaCompressedValueFlag,
+		},
+		{
+			name:  "expiring value",
+			fn:    func(b *Bucket) error { return b.PutWithTTL([]byte("foo"), []byte("bar"), time.Hour) },
+			flags: common.MetaExpiringValueFlag,
+		},
+		{
+			name:  "blob value",
+			opts:  &Options{BlobThreshold: 1024},
+			fn:    func(b *Bucket) error { return b.Put([]byte("foo"), large) },
+			flags: common.MetaBlobValueFlag,
+		},
+		{
+			name: "chunked value",
+			fn: func(b *Bucket) error {
+				h, err := b.OpenValue([]byte("foo"))
+				if err != nil {
+					return err
+				}
+				_, err = h.WriteAt([]byte("bar"), 0)
+				return err
+			},
+			flags: common.MetaChunkedValueFlag,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db, err := Open(path, 0600, tc.opts)
+			require.NoError(t, err)
+			require.Equal(t, tc.flags&(common.MetaEncryptedFlag|common.MetaPageChecksumFlag), db.meta().Flags())
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				return tc.fn(b)
+			}))
+			require.NoError(t, db.Close())
+
+			db, err = Open(path, 0600, tc.opts)
+			require.NoError(t, err)
+			defer db.Close()
+			require.Equal(t, tc.flags, db.meta().Flags())
+			if tc.flags == 0 {
+				require.Equal(t, common.Version, db.meta().Version())
+			} else {
+				require.Equal(t, common.FeatureVersion, db.meta().Version())
+			}
+		})
+	}
+}
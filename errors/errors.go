@@ -27,6 +27,22 @@ var (
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
+
+	// ErrCipherRequired is returned when opening an encrypted database
+	// without setting Options.Cipher.
+	ErrCipherRequired = errors.New("database is encrypted but no cipher was provided")
+
+	// ErrNotEncrypted is returned when opening a database that is not
+	// encrypted with Options.Cipher set.
+	ErrNotEncrypted = errors.New("database is not encrypted")
+
+	// ErrDecrypt is returned when a page cannot be decrypted, either because
+	// the wrong key is used or because the page is corrupted.
+	ErrDecrypt = errors.New("page decryption failed")
+
+	// ErrPageChecksum is returned when the checksum of a page does not match
+	// its content. The error names the page id and the bucket path.
+	ErrPageChecksum = errors.New("page checksum mismatch")
 )
 
 // These errors can occur when beginning or committing a Tx.
@@ -46,6 +62,11 @@ var (
 	// ErrFreePagesNotLoaded is returned when a readonly transaction without
 	// preloading the free pages is trying to access the free pages.
 	ErrFreePagesNotLoaded = errors.New("free pages are not pre-loaded")
+
+	// ErrTxConflict is returned when committing a transaction whose data was
+	// changed by another transaction after it started. The transaction can be
+	// retried.
+	ErrTxConflict = errors.New("tx conflicts with a concurrent commit")
 )
 
 // These errors can occur when putting or deleting a value or a bucket.
@@ -60,6 +81,11 @@ var (
 	// ErrBucketNameRequired is returned when creating a bucket with a blank name.
 	ErrBucketNameRequired = errors.New("bucket name required")
 
+	// ErrBucketNameReserved is returned when creating or moving a bucket
+	// whose name starts with "\x00bbolt-", the names reserved for the
+	// buckets used by the library itself.
+	ErrBucketNameReserved = errors.New("bucket name reserved")
+
 	// ErrKeyRequired is returned when inserting a zero-length key.
 	ErrKeyRequired = errors.New("key required")
 
@@ -81,4 +107,125 @@ var (
 	// ErrDifferentDB is returned when trying to move a sub-bucket between
 	// source and target buckets, while source and target buckets are in different database files.
 	ErrDifferentDB = errors.New("the source and target buckets are in different database files")
+
+	// ErrComparatorNotRegistered is returned when creating or opening a bucket
+	// whose key comparator has not been registered in Options.Comparators.
+	ErrComparatorNotRegistered = errors.New("comparator not registered")
+
+	// ErrCompressorNotRegistered is returned when creating or opening a bucket
+	// whose value compressor has not been registered in Options.Compressors.
+	ErrCompressorNotRegistered = errors.New("compressor not registered")
+
+	// ErrBucketNotDeclared is returned when a transaction started by
+	// DB.UpdateBuckets creates or deletes a top-level bucket it did not
+	// declare.
+	ErrBucketNotDeclared = errors.New("bucket not declared")
+)
+
+// These errors can occur when subscribing to changes.
+var (
+	// ErrChangesUnavailable is returned when subscribing from a transaction
+	// whose following change sets are no longer held in memory.
+	ErrChangesUnavailable = errors.New("changes no longer available")
+
+	// ErrSubscriberTooSlow is returned by Subscription.Err when the
+	// subscription was closed because its buffer was full, and by
+	// DB.Replicate when the follower falls too far behind.
+	ErrSubscriberTooSlow = errors.New("subscriber too slow")
+)
+
+// These errors can occur during replication.
+var (
+	// ErrNotFollower is returned when following a primary with a database
+	// that was not opened with Options.Follower.
+	ErrNotFollower = errors.New("database is not a follower")
+
+	// ErrReplicationStream is returned when the data received from the
+	// other end of a replication connection is invalid.
+	ErrReplicationStream = errors.New("invalid replication stream")
+)
+
+// These errors can occur with incremental backups.
+var (
+	// ErrIncrementalUnavailable is returned by Tx.WriteIncremental when the
+	// pages written since the given transaction are not tracked.
+	ErrIncrementalUnavailable = errors.New("pages written since the transaction are not tracked")
+
+	// ErrIncrementalMismatch is returned when applying an incremental backup
+	// to a database that is not at the transaction it was taken since.
+	ErrIncrementalMismatch = errors.New("incremental backup does not apply to the database")
+
+	// ErrInvalidIncremental is returned when applying an incremental backup
+	// that is corrupted or truncated.
+	ErrInvalidIncremental = errors.New("invalid incremental backup")
+)
+
+// These errors can occur with named snapshots.
+var (
+	// ErrSnapshotExists is returned when creating a snapshot with the name
+	// of an existing one.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+
+	// ErrSnapshotNotFound is returned when opening or dropping a snapshot
+	// that does not exist.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// These errors can occur with point-in-time reads.
+var (
+	// ErrTxNotRetained is returned when beginning a transaction at a
+	// transaction id which is neither the last committed one, nor retained
+	// by the transaction history, nor the one of a named snapshot.
+	ErrTxNotRetained = errors.New("transaction not retained")
+)
+
+// These errors can occur with keys that expire.
+var (
+	// ErrInvalidTTL is returned when putting a key with a time-to-live that
+	// is not positive.
+	ErrInvalidTTL = errors.New("time-to-live must be positive")
+)
+
+// These errors can occur with secondary indexes.
+var (
+	// ErrIndexNameRequired is returned when creating an index with a blank
+	// name.
+	ErrIndexNameRequired = errors.New("index name required")
+
+	// ErrIndexExists is returned when creating an index that already exists.
+	ErrIndexExists = errors.New("index already exists")
+
+	// ErrIndexNotFound is returned when deleting an index that does not
+	// exist.
+	ErrIndexNotFound = errors.New("index not found")
+
+	// ErrExtractorNotRegistered is returned when creating an index, or
+	// writing to a bucket with an index, whose extractor is not registered in
+	// Options.IndexExtractors.
+	ErrExtractorNotRegistered = errors.New("index extractor not registered")
+
+	// ErrIndexKeyTooLarge is returned when an index key and the key it
+	// refers to are too large together to be stored in an index.
+	ErrIndexKeyTooLarge = errors.New("index key too large")
+)
+
+// These errors can occur with typed buckets.
+var (
+	// ErrInvalidEncoding is returned when decoding a key or a value that was
+	// not encoded by the codec of a typed bucket.
+	ErrInvalidEncoding = errors.New("invalid encoding")
+)
+
+// These errors can occur with values stored in blobs.
+var (
+	// ErrBlobSizeMismatch is returned by Bucket.PutStream when the reader
+	// ends before the given size.
+	ErrBlobSizeMismatch = errors.New("stream shorter than the blob size")
+)
+
+// These errors can occur with value handles.
+var (
+	// ErrValueNotFound is returned when opening a value that does not exist
+	// in a read-only transaction.
+	ErrValueNotFound = errors.New("value not found")
 )
@@ -7,94 +7,141 @@ import (
 	"go.etcd.io/bbolt/internal/common"
 )
 
+// TreeElementsComparer is used by SeekCustom to steer the b-tree search.
+//
+// Deprecated: Use SeekLE, SeekLT or a PrefixIterator instead.
 type TreeElementsComparer func(k, v []byte) (right, exact, hasPrefix bool)
+
+// Search is the binary search function used by SeekCustom.
+//
+// Deprecated: Use SeekLE, SeekLT or a PrefixIterator instead.
 type Search func(flag uint8, n int, f func(int) (bool, bool)) int
 
-func (c *Cursor) SeekReverse(seek []byte) (key, value []byte) {
-
-	var maxValue, saved, highest []byte
-	saved = append(saved, seek...)
-	maxValue = append(maxValue, seek...)
-	highest = append(highest, seek...)
-	if maxValue[len(maxValue)-1] == 255 {
-		var shouldIncreasePlace = true
-		var newMaxValue = make([]byte, len(maxValue), len(maxValue))
-		copy(newMaxValue, maxValue)
-		for i := len(maxValue) - 1; i >= 0; i-- {
-			if maxValue[i] < 255 {
-				newMaxValue[i] = maxValue[i] + 1
-				shouldIncreasePlace = false
-				break
-			} else {
-				newMaxValue[i] = 0
-			}
-		}
-		if shouldIncreasePlace {
-			maxValue = append(maxValue, 0)
-		} else {
-			maxValue = newMaxValue
-		}
-	} else {
-		maxValue[len(maxValue)-1] = maxValue[len(maxValue)-1] + 1
+// SeekLE moves the cursor to the largest key that is less than or equal to
+// the given key and returns it. If no such key exists, a nil key is returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekLE(seek []byte) (key []byte, value []byte) {
+	common.Assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.opt.scan(c.bucket)
+	k, v, flags := c.skipPrev(c.seekBefore(seek, true))
+	return k, c.value(v, flags)
+}
+
+// SeekLT moves the cursor to the largest key that is strictly less than the
+// given key and returns it. If no such key exists, a nil key is returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekLT(seek []byte) (key []byte, value []byte) {
+	common.Assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.opt.scan(c.bucket)
+	k, v, flags := c.skipPrev(c.seekBefore(seek, false))
+	return k, c.value(v, flags)
+}
+
+// seekBefore positions the cursor on the last key below seek, or on seek
+// itself if inclusive is set and the key exists.
+func (c *Cursor) seekBefore(seek []byte, inclusive bool) (key []byte, value []byte, flags uint32) {
+	k, v, flags := c.seekNext(seek)
+
+	// Every key in the bucket sorts before seek, so the answer is the last one.
+	if k == nil {
+		return c.lastKeyValue()
 	}
 
-	cp := func(k, v []byte) (right, exact, hasPrefix bool) {
-		if bytes.Compare(k, seek) > 0 {
-			if bytes.Compare(k, maxValue) < 0 {
-				if bytes.HasPrefix(k, saved) {
-					seek = k
-					hasPrefix = true
-					if len(highest) < len(k) {
-						for i := range len(k) {
-							if len(highest) <= i {
-								highest = append(highest, 255)
-							}
-						}
-					}
-					if bytes.Compare(k, highest) == 0 {
-						return true, true, true
-					}
-				}
-
-				return false, false, hasPrefix
-			}
-			return true, false, hasPrefix
-		} else if bytes.Compare(k, seek) == 0 {
-			return true, true, hasPrefix
-		} else {
-			return false, false, hasPrefix
-		}
+	if inclusive && c.bucket.compareKeys(k, seek) == 0 {
+		return k, v, flags
 	}
-	s := func(flag uint8, n int, f func(int) (right, hasPrefix bool)) int {
-		// Define f(-1) == false and f(n) == true.
-		// Invariant: f(i-1) == false, f(j) == true.
-		i, j, b := 0, n, 0
-		var hasPrefix, right bool
-		for i < j {
-			h := int(uint(i+j) >> 1) // avoid overflow when computing h
-			// i ≤ h < j
-			right, hasPrefix = f(h)
-			if hasPrefix {
-				b = h
-			}
-			if !right {
-				i = h + 1 // preserves f(i-1) == false
-			} else {
-				j = h // preserves f(j) == true
-			}
-		}
-		if flag == common.LeafPageFlag && i == n && hasPrefix {
-			return b
+	return c.prev()
+}
+
+// SeekReverse moves the cursor to the last key that starts with the given
+// prefix and returns it. If no key has the prefix, a nil key is returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekReverse(prefix []byte) (key, value []byte) {
+	return c.Prefix(prefix).Last()
+}
+
+// PrefixIterator walks the keys of a bucket that share a common prefix, in
+// either direction. It is obtained from Cursor.Prefix and shares the
+// position of the underlying cursor.
+type PrefixIterator struct {
+	c      *Cursor
+	prefix []byte
+	upper  []byte // exclusive upper bound; nil if every key above prefix matches
+}
+
+// Prefix returns an iterator over the keys that start with prefix.
+// An empty prefix matches every key in the bucket. Prefix scans rely on the
+// default byte-wise key order and are not meaningful for buckets created
+// with a custom comparator.
+func (c *Cursor) Prefix(prefix []byte) *PrefixIterator {
+	return &PrefixIterator{
+		c:      c,
+		prefix: cloneBytes(prefix),
+		upper:  prefixUpperBound(prefix),
+	}
+}
+
+// Cursor returns the cursor that the iterator moves.
+func (it *PrefixIterator) Cursor() *Cursor {
+	return it.c
+}
+
+// First moves to the first key with the prefix and returns it.
+// If no key has the prefix then a nil key and value are returned.
+func (it *PrefixIterator) First() (key []byte, value []byte) {
+	return it.filter(it.c.Seek(it.prefix))
+}
+
+// Last moves to the last key with the prefix and returns it.
+// If no key has the prefix then a nil key and value are returned.
+func (it *PrefixIterator) Last() (key []byte, value []byte) {
+	if it.upper == nil {
+		return it.filter(it.c.Last())
+	}
+	return it.filter(it.c.SeekLT(it.upper))
+}
+
+// Next moves to the next key with the prefix and returns it.
+// A nil key is returned once the iterator moves past the last matching key.
+func (it *PrefixIterator) Next() (key []byte, value []byte) {
+	return it.filter(it.c.Next())
+}
+
+// Prev moves to the previous key with the prefix and returns it.
+// A nil key is returned once the iterator moves before the first matching key.
+func (it *PrefixIterator) Prev() (key []byte, value []byte) {
+	return it.filter(it.c.Prev())
+}
+
+// filter hides keys that fall outside of the prefix range.
+func (it *PrefixIterator) filter(k, v []byte) ([]byte, []byte) {
+	if k == nil || !bytes.HasPrefix(k, it.prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+// prefixUpperBound returns the smallest key that sorts after every key
+// starting with prefix. Trailing 0xFF bytes cannot be incremented so they
+// are dropped; if the prefix consists only of 0xFF bytes (or is empty) there
+// is no such key and nil is returned.
+func prefixUpperBound(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xFF {
+			upper := cloneBytes(prefix[:i+1])
+			upper[i]++
+			return upper
 		}
-		// i == j, f(i-1) == false, and f(j) (= f(i)) == true  =>  answer is i.
-		return i
 	}
-	key, value = c.SeekCustom(s, cp)
-	return
+	return nil
 }
 
+// SeekCustom performs a b-tree search driven by the given search and comparer functions.
+//
+// Deprecated: Use SeekLE, SeekLT or a PrefixIterator instead.
 func (c *Cursor) SeekCustom(s Search, f TreeElementsComparer) (key, value []byte) {
 	common.Assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.opt.scan(c.bucket)
 
 	k, v, flags := c.seekCustom(s, f)
 
@@ -102,13 +149,12 @@ func (c *Cursor) SeekCustom(s Search, f TreeElementsComparer) (key, value []byte
 	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
 		k, v, flags = c.next()
 	}
+	k, v, flags = c.skipNext(k, v, flags)
 
 	if k == nil {
 		return nil, nil
-	} else if (flags & uint32(common.BucketLeafFlag)) != 0 {
-		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 }
 
 func (c *Cursor) seekCustom(s Search, f TreeElementsComparer) (key []byte, value []byte, flags uint32) {
@@ -159,7 +205,7 @@ func (c *Cursor) nsearchCustom(s Search, f TreeElementsComparer) {
 	// If we have a page then search its leaf elements.
 	inodes := p.LeafPageElements()
 	index := s(common.LeafPageFlag, int(p.Count()), func(i int) (right, hasPrefix bool) {
-		right, _, hasPrefix = f(inodes[i].Key(), inodes[i].Value())
+		right, _, hasPrefix = f(p.LeafPageKey(uint16(i)), inodes[i].Value())
 		return right, hasPrefix
 	})
 	e.index = index
@@ -198,7 +244,7 @@ func (c *Cursor) searchPageCustom(p *common.Page, s Search, f TreeElementsCompar
 	index = s(0, int(p.Count()), func(i int) (right, hasPrefix bool) {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		k := inodes[i].Key()
+		k := p.BranchPageKey(uint16(i))
 
 		right, exact, hasPrefix = f(k, []byte{})
 
@@ -213,6 +259,10 @@ func (c *Cursor) searchPageCustom(p *common.Page, s Search, f TreeElementsCompar
 	c.searchCustom(inodes[index].Pgid(), s, f)
 }
 
+// SeekReverseSlow returns the last key that starts with the given prefix by
+// scanning all of them.
+//
+// Deprecated: Use SeekLE or a PrefixIterator instead.
 func (c *Cursor) SeekReverseSlow(prefix []byte) ([]byte, []byte) {
 	var K, V []byte
 	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
@@ -7,7 +7,10 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
 	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/btesting"
 )
 
 const NUM_OF_KEYS = 16777216
@@ -651,3 +654,223 @@ func BenchmarkSeek(b *testing.B) {
 	})
 
 }
+
+func TestCursor_SeekLE_SeekLT(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	// Use enough keys to span multiple leaf pages.
+	const n = 2000
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			k := make([]byte, 4)
+			binary.BigEndian.PutUint32(k, uint32(i*2))
+			if err := b.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		key := func(i int) []byte {
+			k := make([]byte, 4)
+			binary.BigEndian.PutUint32(k, uint32(i))
+			return k
+		}
+
+		for i := 0; i < n*2+2; i++ {
+			// Largest even number <= i.
+			wantLE := i &^ 1
+			if wantLE >= n*2 {
+				wantLE = (n - 1) * 2
+			}
+			k, v := c.SeekLE(key(i))
+			require.Equal(t, key(wantLE), k, "SeekLE(%d)", i)
+			require.Equal(t, key(wantLE), v, "SeekLE(%d)", i)
+
+			// Largest even number < i.
+			wantLT := (i - 1) &^ 1
+			if wantLT >= n*2 {
+				wantLT = (n - 1) * 2
+			}
+			k, _ = c.SeekLT(key(i))
+			if i == 0 {
+				require.Nil(t, k, "SeekLT(0)")
+				continue
+			}
+			require.Equal(t, key(wantLT), k, "SeekLT(%d)", i)
+		}
+
+		// The cursor must remain usable after seeking.
+		k, _ := c.SeekLE(key(11))
+		require.Equal(t, key(10), k)
+		k, _ = c.Prev()
+		require.Equal(t, key(8), k)
+		k, _ = c.Next()
+		require.Equal(t, key(10), k)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursor_SeekLE_EmptyBucket(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		k, v := c.SeekLE([]byte("foo"))
+		require.Nil(t, k)
+		require.Nil(t, v)
+		k, v = c.SeekLT([]byte("foo"))
+		require.Nil(t, k)
+		require.Nil(t, v)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that SeekLE finds the key equal to the seek key according to the
+// comparator of the bucket.
+func TestCursor_SeekLE_Comparator(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		Comparators: map[string]bolt.Comparator{"fold": func(a, b []byte) int {
+			return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+		}},
+	})
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Comparator: "fold"})
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a", "B", "c"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		k, _ := b.Cursor().SeekLE([]byte("b"))
+		require.Equal(t, []byte("B"), k)
+		k, _ = b.Cursor().SeekLT([]byte("b"))
+		require.Equal(t, []byte("a"), k)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursor_PrefixIterator(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	keys := [][]byte{
+		{0x61},
+		{0x61, 0xfe},
+		{0x61, 0xff},
+		{0x61, 0xff, 0x00},
+		{0x61, 0xff, 0xff},
+		{0x62},
+		{0xff},
+		{0xff, 0x00},
+		{0xff, 0xff, 0x01},
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Put(k, k); err != nil {
+				return err
+			}
+		}
+		// Nested buckets are reported with a nil value.
+		_, err = b.CreateBucket([]byte{0x61, 0xff, 0x80})
+		return err
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   [][]byte
+	}{
+		{name: "single byte", prefix: []byte{0x61}, want: [][]byte{{0x61}, {0x61, 0xfe}, {0x61, 0xff}, {0x61, 0xff, 0x00}, {0x61, 0xff, 0x80}, {0x61, 0xff, 0xff}}},
+		{name: "0xFF suffix", prefix: []byte{0x61, 0xff}, want: [][]byte{{0x61, 0xff}, {0x61, 0xff, 0x00}, {0x61, 0xff, 0x80}, {0x61, 0xff, 0xff}}},
+		{name: "all 0xFF", prefix: []byte{0xff}, want: [][]byte{{0xff}, {0xff, 0x00}, {0xff, 0xff, 0x01}}},
+		{name: "all 0xFF, two bytes", prefix: []byte{0xff, 0xff}, want: [][]byte{{0xff, 0xff, 0x01}}},
+		{name: "no match", prefix: []byte{0x63}, want: nil},
+		{name: "empty prefix", prefix: nil, want: append(append([][]byte{}, keys[:4]...), append([][]byte{{0x61, 0xff, 0x80}}, keys[4:]...)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.View(func(tx *bolt.Tx) error {
+				it := tx.Bucket([]byte("widgets")).Cursor().Prefix(tt.prefix)
+
+				var forward [][]byte
+				for k, _ := it.First(); k != nil; k, _ = it.Next() {
+					forward = append(forward, k)
+				}
+				require.Equal(t, tt.want, forward)
+
+				var backward [][]byte
+				for k, _ := it.Last(); k != nil; k, _ = it.Prev() {
+					backward = append([][]byte{k}, backward...)
+				}
+				require.Equal(t, tt.want, backward)
+
+				k, _ := it.Cursor().SeekReverse(tt.prefix)
+				if len(tt.want) == 0 {
+					require.Nil(t, k)
+				} else {
+					require.Equal(t, tt.want[len(tt.want)-1], k)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+// Ensure the newest N entries under a prefix can be read backwards.
+func TestCursor_PrefixIterator_LatestN(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("series"))
+		if err != nil {
+			return err
+		}
+		for _, series := range []string{"cpu", "mem"} {
+			for i := 0; i < 500; i++ {
+				k := make([]byte, len(series)+1+8)
+				copy(k, series+"/")
+				binary.BigEndian.PutUint64(k[len(series)+1:], uint64(i))
+				if err := b.Put(k, []byte(strconv.Itoa(i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		it := tx.Bucket([]byte("series")).Cursor().Prefix([]byte("cpu/"))
+		var got []string
+		for _, v := it.Last(); v != nil && len(got) < 3; _, v = it.Prev() {
+			got = append(got, string(v))
+		}
+		require.Equal(t, []string{"499", "498", "497"}, got)
+		return nil
+	})
+	require.NoError(t, err)
+}
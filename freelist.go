@@ -391,3 +391,68 @@ func (f *freelist) arrayMergeSpans(ids common.Pgids) {
 	sort.Sort(ids)
 	f.ids = common.Pgids(f.ids).Merge(ids)
 }
+
+// pin moves the free pages reachable from a named snapshot to the pending
+// list of the newest snapshot reaching them, as if it had freed them. They
+// are released once no snapshot, nor open transaction, can read them.
+func (f *freelist) pin(pins map[common.Pgid]pagePin) {
+	var ids []common.Pgid
+	for _, id := range f.getFreePageIDs() {
+		pin, ok := pins[id]
+		if !ok {
+			ids = append(ids, id)
+			continue
+		}
+		// The page was allocated at or before the oldest snapshot reaching
+		// it, so releaseRange keeps it while any of them is open.
+		txp := f.pending[pin.max]
+		if txp == nil {
+			txp = &txPending{}
+			f.pending[pin.max] = txp
+		}
+		txp.ids = append(txp.ids, id)
+		txp.alloctx = append(txp.alloctx, pin.min)
+	}
+	f.readIDs(ids)
+}
+
+// hold takes the free pages at or above the given id out of the free list
+// for the transaction, so that it only allocates pages below it. They are
+// pending on the transaction as if it had allocated and freed them, so they
+// are released with it, or put back if it is rolled back.
+func (f *freelist) hold(txid common.Txid, from common.Pgid) {
+	ids := f.getFreePageIDs()
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= from })
+	if i == len(ids) {
+		return
+	}
+
+	txp := f.pending[txid]
+	if txp == nil {
+		txp = &txPending{}
+		f.pending[txid] = txp
+	}
+	for _, id := range ids[i:] {
+		txp.ids = append(txp.ids, id)
+		txp.alloctx = append(txp.alloctx, txid)
+	}
+	f.readIDs(append([]common.Pgid(nil), ids[:i]...))
+}
+
+// freeTail returns the number of free pages right below the high water mark.
+func (f *freelist) freeTail(hwm common.Pgid) int {
+	ids := f.getFreePageIDs()
+	n := 0
+	for n < len(ids) && ids[len(ids)-1-n] == hwm-1-common.Pgid(n) {
+		n++
+	}
+	return n
+}
+
+// truncate removes the free pages at or above the given id, once the high
+// water mark is moved down to it.
+func (f *freelist) truncate(hwm common.Pgid) {
+	ids := f.getFreePageIDs()
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= hwm })
+	f.readIDs(append([]common.Pgid(nil), ids[:i]...))
+}
@@ -166,23 +166,23 @@ func (f *freelist) delSpan(start common.Pgid, size uint64) {
 // initial from pgids using when use hashmap version
 // pgids must be sorted
 func (f *freelist) init(pgids []common.Pgid) {
+	// reset the counter and the spans when freelist init
+	f.freePagesCount = 0
+	f.freemaps = make(map[uint64]pidSet)
+	f.forwardMap = make(map[common.Pgid]uint64)
+	f.backwardMap = make(map[common.Pgid]uint64)
+
 	if len(pgids) == 0 {
 		return
 	}
 
 	size := uint64(1)
 	start := pgids[0]
-	// reset the counter when freelist init
-	f.freePagesCount = 0
 
 	if !sort.SliceIsSorted([]common.Pgid(pgids), func(i, j int) bool { return pgids[i] < pgids[j] }) {
 		panic("pgids not sorted")
 	}
 
-	f.freemaps = make(map[uint64]pidSet)
-	f.forwardMap = make(map[common.Pgid]uint64)
-	f.backwardMap = make(map[common.Pgid]uint64)
-
 	for i := 1; i < len(pgids); i++ {
 		// continuous page
 		if pgids[i] == pgids[i-1]+1 {
@@ -0,0 +1,381 @@
+package bbolt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// pageTxidsSuffix is appended to the path of a database to name the file
+// holding the transaction ids of its pages between two sessions.
+const pageTxidsSuffix = "-txids"
+
+const (
+	incrementalMagic      = 0x42424931 // "BBI1"
+	incrementalHeaderSize = 40         // magic, page size, base txid, txid, high water mark and run count
+
+	pageTxidsMagic      = 0x42425431 // "BBT1"
+	pageTxidsHeaderSize = 40         // magic, page size, tracking txid, meta txid, meta checksum and count
+
+	// maxIncrementalRun is the maximum number of pages copied at once.
+	maxIncrementalRun = 256
+)
+
+// pageTxids tracks the id of the last transaction that wrote each page, so
+// that Tx.WriteIncremental can copy the pages written since a backup. Its
+// methods do nothing on a nil tracker.
+type pageTxids struct {
+	mu    sync.RWMutex
+	since common.Txid   // the pages written after this transaction are tracked
+	txids []common.Txid // indexed by page id
+}
+
+// mark records that a transaction wrote a run of n pages.
+func (t *pageTxids) mark(id common.Pgid, n int, txid common.Txid) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if end := int(id) + n; end > len(t.txids) {
+		t.txids = append(t.txids, make([]common.Txid, end-len(t.txids))...)
+	}
+	for i := 0; i < n; i++ {
+		t.txids[int(id)+i] = txid
+	}
+}
+
+// reset forgets all the pages once the whole file is replaced.
+func (t *pageTxids) reset(txid common.Txid) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.since = txid
+	t.txids = nil
+}
+
+// pageRun is a range of pages copied by an incremental backup.
+type pageRun struct {
+	id common.Pgid
+	n  int
+}
+
+// runs returns the data pages below hwm written after since, up to until.
+func (t *pageTxids) runs(since, until common.Txid, hwm common.Pgid) ([]pageRun, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if since < t.since {
+		return nil, fmt.Errorf("%w: tracking started at transaction %d", berrors.ErrIncrementalUnavailable, t.since)
+	}
+
+	var runs []pageRun
+	for id := common.Pgid(2); id < hwm && int(id) < len(t.txids); id++ {
+		if txid := t.txids[id]; txid <= since || txid > until {
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].id+common.Pgid(runs[n-1].n) == id && runs[n-1].n < maxIncrementalRun {
+			runs[n-1].n++
+			continue
+		}
+		runs = append(runs, pageRun{id: id, n: 1})
+	}
+	return runs, nil
+}
+
+// loadPageTxids starts tracking the pages written from now on, resuming
+// from the file saved when the database was last closed if it still matches
+// the database.
+func (db *DB) loadPageTxids() {
+	meta := db.meta()
+	t := &pageTxids{since: meta.Txid()}
+	db.pageTxids = t
+
+	data, err := os.ReadFile(db.path + pageTxidsSuffix)
+	if err != nil || len(data) < pageTxidsHeaderSize+4 {
+		return
+	}
+	body := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(data)-4:]) != crc32.Checksum(body, walCRCTable) ||
+		binary.LittleEndian.Uint32(body[0:]) != pageTxidsMagic ||
+		int(binary.LittleEndian.Uint32(body[4:])) != db.pageSize ||
+		common.Txid(binary.LittleEndian.Uint64(body[16:])) != meta.Txid() ||
+		binary.LittleEndian.Uint64(body[24:]) != meta.Checksum() {
+		return
+	}
+	count := binary.LittleEndian.Uint64(body[32:])
+	if uint64(len(body)-pageTxidsHeaderSize) != count*8 {
+		return
+	}
+	t.since = common.Txid(binary.LittleEndian.Uint64(body[8:]))
+	t.txids = make([]common.Txid, count)
+	for i := range t.txids {
+		t.txids[i] = common.Txid(binary.LittleEndian.Uint64(body[pageTxidsHeaderSize+8*i:]))
+	}
+}
+
+// savePageTxids saves the tracked pages when the database is closed. The
+// file is only used if the database is not modified in between.
+func (db *DB) savePageTxids() error {
+	t := db.pageTxids
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	meta := db.meta()
+	buf := make([]byte, pageTxidsHeaderSize, pageTxidsHeaderSize+8*len(t.txids)+4)
+	binary.LittleEndian.PutUint32(buf[0:], pageTxidsMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(db.pageSize))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(t.since))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(meta.Txid()))
+	binary.LittleEndian.PutUint64(buf[24:], meta.Checksum())
+	binary.LittleEndian.PutUint64(buf[32:], uint64(len(t.txids)))
+	for _, txid := range t.txids {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(txid))
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, walCRCTable))
+
+	// Replace the file atomically; a torn write is caught by the checksum.
+	path := db.path + pageTxidsSuffix
+	if err := os.WriteFile(path+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// WriteIncremental writes the pages of the database that changed after the
+// transaction with the given id, usually the one of the transaction that
+// took the previous backup with WriteTo or WriteIncremental, followed by the
+// meta page of this transaction. ApplyIncremental applies it to a copy of
+// the database at sinceTxid to bring it to this transaction.
+//
+// The database must be opened with Options.IncrementalBackup, and sinceTxid
+// must not be older than the transaction the pages have been tracked from;
+// ErrIncrementalUnavailable is returned otherwise.
+func (tx *Tx) WriteIncremental(w io.Writer, sinceTxid int) (n int64, err error) {
+	if tx.db.pageTxids == nil {
+		return 0, fmt.Errorf("%w: Options.IncrementalBackup is not set", berrors.ErrIncrementalUnavailable)
+	}
+	since := common.Txid(sinceTxid)
+	if since > tx.meta.Txid() {
+		return 0, fmt.Errorf("%w: transaction %d is after %d", berrors.ErrIncrementalUnavailable, since, tx.meta.Txid())
+	}
+	runs, err := tx.db.pageTxids.runs(since, tx.meta.Txid(), tx.meta.Pgid())
+	if err != nil {
+		return 0, err
+	}
+
+	// Attempt to open reader with WriteFlag
+	f, err := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	// The pages not checkpointed yet in WAL mode are read from the log.
+	var walPages []walPage
+	if tx.db.wal != nil {
+		walPages, _ = tx.db.wal.snapshot()
+	}
+
+	crc := crc32.New(walCRCTable)
+	cw := &countingWriter{w: io.MultiWriter(w, crc)}
+
+	hdr := binary.LittleEndian.AppendUint32(nil, incrementalMagic)
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(tx.db.pageSize))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(since))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(tx.meta.Txid()))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(tx.meta.Pgid()))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(len(runs)))
+	if _, err := cw.Write(hdr); err != nil {
+		return cw.n, err
+	}
+
+	pageSize := int64(tx.db.pageSize)
+	for _, run := range runs {
+		buf := make([]byte, int64(run.n)*pageSize)
+		if _, err := f.ReadAt(buf, int64(run.id)*pageSize); err != nil && err != io.EOF {
+			return cw.n, err
+		}
+		overlayWALPages(buf, run, walPages, tx.db.pageSize)
+
+		rh := binary.LittleEndian.AppendUint64(nil, uint64(run.id))
+		rh = binary.LittleEndian.AppendUint64(rh, uint64(run.n))
+		if _, err := cw.Write(rh); err != nil {
+			return cw.n, err
+		}
+		if _, err := cw.Write(buf); err != nil {
+			return cw.n, err
+		}
+	}
+
+	// Write the meta page of the transaction.
+	buf := make([]byte, tx.db.pageSize)
+	page := (*common.Page)(unsafe.Pointer(&buf[0]))
+	page.SetFlags(common.MetaPageFlag)
+	*page.Meta() = *tx.meta
+	page.Meta().SetChecksum(page.Meta().Sum64())
+	if _, err := cw.Write(buf); err != nil {
+		return cw.n, err
+	}
+
+	nn, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return cw.n + int64(nn), err
+}
+
+// overlayWALPages copies the parts of the pages of the log that fall within
+// a run read from the data file.
+func overlayWALPages(buf []byte, run pageRun, pages []walPage, pageSize int) {
+	end := run.id + common.Pgid(run.n)
+	for _, p := range pages {
+		pend := p.id + common.Pgid(len(p.buf)/pageSize)
+		if pend <= run.id || p.id >= end {
+			continue
+		}
+		src, dst := p.buf, buf
+		if p.id < run.id {
+			src = src[int(run.id-p.id)*pageSize:]
+		} else {
+			dst = dst[int(p.id-run.id)*pageSize:]
+		}
+		copy(dst, src)
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ApplyIncremental applies an incremental backup written by
+// Tx.WriteIncremental to the database file at path, which must not be open.
+// The database must be at the transaction the backup was taken since, as
+// restored from a backup written by Tx.WriteTo and the preceding incremental
+// backups, otherwise ErrIncrementalMismatch is returned. The backup is
+// checked before the database is modified; if applying it is interrupted,
+// the database must be restored again.
+func ApplyIncremental(path, incrementalPath string) error {
+	inc, err := os.Open(incrementalPath)
+	if err != nil {
+		return err
+	}
+	defer inc.Close()
+
+	// Check the whole backup first.
+	fi, err := inc.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size < incrementalHeaderSize+4 {
+		return fmt.Errorf("%w: truncated file", berrors.ErrInvalidIncremental)
+	}
+	crc := crc32.New(walCRCTable)
+	if _, err := io.Copy(crc, io.NewSectionReader(inc, 0, size-4)); err != nil {
+		return err
+	}
+	var tail [4]byte
+	if _, err := inc.ReadAt(tail[:], size-4); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(tail[:]) != crc.Sum32() {
+		return fmt.Errorf("%w: checksum mismatch", berrors.ErrInvalidIncremental)
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(inc, 0, size-4))
+	hdr := make([]byte, incrementalHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != incrementalMagic {
+		return fmt.Errorf("%w: bad magic", berrors.ErrInvalidIncremental)
+	}
+	pageSize := int(binary.LittleEndian.Uint32(hdr[4:]))
+	base := common.Txid(binary.LittleEndian.Uint64(hdr[8:]))
+	txid := common.Txid(binary.LittleEndian.Uint64(hdr[16:]))
+	hwm := int64(binary.LittleEndian.Uint64(hdr[24:]))
+	nruns := binary.LittleEndian.Uint64(hdr[32:])
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The database must be at the base of the backup.
+	metas := make([]byte, 2*pageSize)
+	if _, err := f.ReadAt(metas, 0); err != nil {
+		return fmt.Errorf("%w: reading meta pages: %v", berrors.ErrIncrementalMismatch, err)
+	}
+	slot := -1
+	var cur *common.Meta
+	for i := 0; i < 2; i++ {
+		m := (*common.Page)(unsafe.Pointer(&metas[i*pageSize])).Meta()
+		if m.Validate() == nil && int(m.PageSize()) == pageSize && (cur == nil || m.Txid() > cur.Txid()) {
+			slot, cur = i, m
+		}
+	}
+	if cur == nil {
+		return fmt.Errorf("%w: no valid meta page with a page size of %d", berrors.ErrIncrementalMismatch, pageSize)
+	}
+	if cur.Txid() != base {
+		return fmt.Errorf("%w: database at transaction %d, backup taken since %d", berrors.ErrIncrementalMismatch, cur.Txid(), base)
+	}
+
+	// Copy the pages, then the meta page over the older one.
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() < hwm*int64(pageSize) {
+		if err := f.Truncate(hwm * int64(pageSize)); err != nil {
+			return err
+		}
+	}
+	for i := uint64(0); i < nruns; i++ {
+		var rh [16]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			return fmt.Errorf("%w: %v", berrors.ErrInvalidIncremental, err)
+		}
+		id, n := int64(binary.LittleEndian.Uint64(rh[0:])), int64(binary.LittleEndian.Uint64(rh[8:]))
+		if id < 2 || n < 1 || n > maxIncrementalRun || id+n > hwm {
+			return fmt.Errorf("%w: invalid run of %d pages at page %d", berrors.ErrInvalidIncremental, n, id)
+		}
+		if _, err := io.CopyN(io.NewOffsetWriter(f, id*int64(pageSize)), r, n*int64(pageSize)); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, pageSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("%w: %v", berrors.ErrInvalidIncremental, err)
+	}
+	page := (*common.Page)(unsafe.Pointer(&buf[0]))
+	if err := page.Meta().Validate(); err != nil || page.Meta().Txid() != txid {
+		return fmt.Errorf("%w: invalid meta page", berrors.ErrInvalidIncremental)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	page.SetId(common.Pgid(1 - slot))
+	if _, err := f.WriteAt(buf, int64(1-slot)*int64(pageSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,203 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// dumpKeys returns the keys and values of the widgets bucket and of its
+// nested buckets.
+func dumpKeys(t *testing.T, db *bolt.DB) []string {
+	var keys []string
+	err := db.View(func(tx *bolt.Tx) error {
+		var walk func(prefix string, b *bolt.Bucket) error
+		walk = func(prefix string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return walk(prefix+string(k)+"/", b.Bucket(k))
+				}
+				keys = append(keys, prefix+string(k)+"="+string(v))
+				return nil
+			})
+		}
+		return walk("", tx.Bucket([]byte("widgets")))
+	})
+	require.NoError(t, err)
+	return keys
+}
+
+// writeIncremental writes an incremental backup since the given transaction
+// and returns the id of the transaction it brings the database to.
+func writeIncremental(t *testing.T, db *btesting.DB, path string, since int) int {
+	var txid int
+	err := db.View(func(tx *bolt.Tx) error {
+		txid = tx.ID()
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = tx.WriteIncremental(f, since)
+		return err
+	})
+	require.NoError(t, err)
+	return txid
+}
+
+// Ensure that a full backup and a chain of incremental backups restore the
+// database, and that the incremental backups only hold the changed pages.
+func TestTx_WriteIncremental(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts func() *bolt.Options
+	}{
+		{name: "plain", opts: func() *bolt.Options { return &bolt.Options{IncrementalBackup: true} }},
+		{name: "wal", opts: func() *bolt.Options { return &bolt.Options{IncrementalBackup: true, WAL: true} }},
+		{name: "encrypted", opts: func() *bolt.Options {
+			return &bolt.Options{IncrementalBackup: true, Cipher: mustCipher(t, "0123456789abcdef0123456789abcdef"), PageChecksums: true}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, tc.opts())
+			dir := t.TempDir()
+			putKeys(t, db, 0, 5000)
+
+			var full int
+			err := db.View(func(tx *bolt.Tx) error {
+				full = tx.ID()
+				return tx.CopyFile(filepath.Join(dir, "full"), 0600)
+			})
+			require.NoError(t, err)
+
+			putKeys(t, db, 5000, 5010)
+			inc1 := writeIncremental(t, db, filepath.Join(dir, "inc1"), full)
+
+			err = db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				if err := b.Delete([]byte("00000042")); err != nil {
+					return err
+				}
+				child, err := b.CreateBucket([]byte("child"))
+				if err != nil {
+					return err
+				}
+				if err := child.Put([]byte("foo"), bytes.Repeat([]byte("bar"), 5000)); err != nil {
+					return err
+				}
+				stream := bytes.Repeat([]byte("baz"), 5000)
+				return child.PutStream([]byte("stream"), bytes.NewReader(stream), int64(len(stream)))
+			})
+			require.NoError(t, err)
+			writeIncremental(t, db, filepath.Join(dir, "inc2"), inc1)
+
+			fi, err := os.Stat(filepath.Join(dir, "inc1"))
+			require.NoError(t, err)
+			full1, err := os.Stat(filepath.Join(dir, "full"))
+			require.NoError(t, err)
+			require.Less(t, fi.Size(), full1.Size()/4)
+
+			// The incremental backups must be applied in order.
+			restored := filepath.Join(dir, "restored")
+			require.NoError(t, copyFile(filepath.Join(dir, "full"), restored))
+			err = bolt.ApplyIncremental(restored, filepath.Join(dir, "inc2"))
+			require.ErrorIs(t, err, berrors.ErrIncrementalMismatch)
+			require.NoError(t, bolt.ApplyIncremental(restored, filepath.Join(dir, "inc1")))
+			require.NoError(t, bolt.ApplyIncremental(restored, filepath.Join(dir, "inc2")))
+
+			opts := tc.opts()
+			opts.IncrementalBackup = false
+			rdb, err := bolt.Open(restored, 0600, opts)
+			require.NoError(t, err)
+			defer rdb.Close()
+			require.Equal(t, dumpKeys(t, db.DB), dumpKeys(t, rdb))
+			err = rdb.View(func(tx *bolt.Tx) error {
+				for err := range tx.Check() {
+					return err
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+// Ensure that the tracked pages survive reopening the database, but not a
+// modification of the database made without them.
+func TestTx_WriteIncremental_Reopen(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{IncrementalBackup: true})
+	dir := t.TempDir()
+	putKeys(t, db, 0, 1000)
+	var full int
+	err := db.View(func(tx *bolt.Tx) error {
+		full = tx.ID()
+		return tx.CopyFile(filepath.Join(dir, "full"), 0600)
+	})
+	require.NoError(t, err)
+	putKeys(t, db, 1000, 1010)
+
+	db.MustClose()
+	db.MustReopen()
+	putKeys(t, db, 1010, 1020)
+	writeIncremental(t, db, filepath.Join(dir, "inc"), full)
+
+	restored := filepath.Join(dir, "restored")
+	require.NoError(t, copyFile(filepath.Join(dir, "full"), restored))
+	require.NoError(t, bolt.ApplyIncremental(restored, filepath.Join(dir, "inc")))
+	rdb, err := bolt.Open(restored, 0600, nil)
+	require.NoError(t, err)
+	require.Equal(t, dumpKeys(t, db.DB), dumpKeys(t, rdb))
+	require.NoError(t, rdb.Close())
+
+	// Modify the database without tracking its pages.
+	require.NoError(t, db.Close())
+	plain, err := bolt.Open(db.Path(), 0600, nil)
+	require.NoError(t, err)
+	err = plain.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, plain.Close())
+
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteIncremental(&bytes.Buffer{}, full)
+		return err
+	})
+	require.ErrorIs(t, err, berrors.ErrIncrementalUnavailable)
+}
+
+// Ensure that a corrupted incremental backup is not applied.
+func TestApplyIncremental_Corrupted(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{IncrementalBackup: true})
+	dir := t.TempDir()
+	var full int
+	err := db.View(func(tx *bolt.Tx) error {
+		full = tx.ID()
+		return tx.CopyFile(filepath.Join(dir, "full"), 0600)
+	})
+	require.NoError(t, err)
+	putKeys(t, db, 0, 100)
+	inc := filepath.Join(dir, "inc")
+	writeIncremental(t, db, inc, full)
+
+	data, err := os.ReadFile(inc)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(inc, data, 0600))
+
+	before, err := os.ReadFile(filepath.Join(dir, "full"))
+	require.NoError(t, err)
+	err = bolt.ApplyIncremental(filepath.Join(dir, "full"), inc)
+	require.ErrorIs(t, err, berrors.ErrInvalidIncremental)
+	after, err := os.ReadFile(filepath.Join(dir, "full"))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
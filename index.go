@@ -0,0 +1,405 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// IndexExtractor returns the index keys of a key/value pair of a bucket, for
+// a secondary index created with Bucket.CreateIndex. It may return no index
+// key, to leave the pair out of the index, or several.
+//
+// An extractor must be deterministic: the index keys of a value are
+// extracted again when it is replaced or deleted, to remove its entries from
+// the index. It must not modify the key and value, nor keep them once it
+// returns.
+type IndexExtractor func(key, value []byte) [][]byte
+
+// indexesKey is the name of the nested bucket holding the secondary indexes
+// of a bucket, one nested bucket per index. It is hidden from the cursors of
+// the bucket.
+//
+// An index holds a key with an empty value, called an entry, for each index
+// key of each key/value pair of the bucket: the index key, with its 0x00
+// bytes escaped as 0x00 0xff, followed by 0x00 0x01 and the key of the pair.
+// The entries sort by index key, then by key. The name of the extractor of an
+// index is persisted in the options of its bucket.
+const indexesKey = "\x00bbolt-indexes"
+
+// indexEntry returns the entry of an index for an index key of a key.
+func indexEntry(indexKey, key []byte) []byte {
+	e := appendEscaped(make([]byte, 0, len(indexKey)+2+len(key)), indexKey)
+	e = append(e, 0x00, 0x01)
+	return append(e, key...)
+}
+
+// bucketIndex is a secondary index of a bucket.
+type bucketIndex struct {
+	name    []byte
+	extract IndexExtractor
+	bucket  *Bucket
+}
+
+// entries returns the entries of the index for a key/value pair.
+func (idx *bucketIndex) entries(key, value []byte) [][]byte {
+	indexKeys := idx.extract(key, value)
+	entries := make([][]byte, 0, len(indexKeys))
+	for _, ik := range indexKeys {
+		entries = append(entries, indexEntry(ik, key))
+	}
+	return entries
+}
+
+// CreateIndex creates a secondary index of the bucket, whose index keys are
+// returned for each key/value pair by the extractor registered under the
+// given name in Options.IndexExtractors. The index is built from the pairs
+// already in the bucket, then kept up to date by Put, Delete and
+// Cursor.Delete within the same transaction. Use Index to look it up.
+//
+// The extractor must be registered every time the database is opened, for
+// the bucket to be written to.
+// Returns an error if the index name is blank, if the index already exists,
+// if the extractor is not registered, or if an index key is too large.
+func (b *Bucket) CreateIndex(name []byte, extractor string) error {
+	if b.tx.db == nil {
+		return errors.ErrTxClosed
+	} else if !b.Writable() {
+		return errors.ErrTxNotWritable
+	} else if len(name) == 0 {
+		return errors.ErrIndexNameRequired
+	}
+	extract := b.tx.db.indexExtractors[extractor]
+	if extract == nil {
+		return errors.ErrExtractorNotRegistered
+	}
+
+	indexes := b.internalBucket(indexesKey, true, common.BucketOptions{})
+	if indexes == nil {
+		return errors.ErrIncompatibleValue
+	}
+	if indexes.internalBucket(string(name), false, common.BucketOptions{}) != nil {
+		return errors.ErrIndexExists
+	}
+	idx := &bucketIndex{
+		name:    cloneBytes(name),
+		extract: extract,
+		bucket:  indexes.internalBucket(string(name), true, common.BucketOptions{IndexExtractor: extractor}),
+	}
+	b.indexesLoaded = false
+
+	// Index the pairs already in the bucket, including those that expired
+	// but are not deleted yet, as deleting them removes their entries.
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if (flags & common.BucketLeafFlag) != 0 {
+			continue
+		}
+		for _, e := range idx.entries(k, c.value(v, flags)) {
+			if len(e) > MaxKeySize {
+				b.dropIndex(idx.name)
+				return errors.ErrIndexKeyTooLarge
+			}
+			idx.bucket.putIndexKey(e)
+		}
+	}
+	b.tx.opt.write(b, optimisticWrite{op: opCreateIndex, key: idx.name, extractor: extractor})
+	return nil
+}
+
+// DeleteIndex deletes a secondary index of the bucket.
+// Returns an error if the index does not exist.
+func (b *Bucket) DeleteIndex(name []byte) error {
+	if b.tx.db == nil {
+		return errors.ErrTxClosed
+	} else if !b.Writable() {
+		return errors.ErrTxNotWritable
+	}
+
+	indexes := b.internalBucket(indexesKey, false, common.BucketOptions{})
+	if indexes == nil || indexes.internalBucket(string(name), false, common.BucketOptions{}) == nil {
+		return errors.ErrIndexNotFound
+	}
+	b.dropIndex(name)
+	b.tx.opt.write(b, optimisticWrite{op: opDeleteIndex, key: cloneBytes(name)})
+	return nil
+}
+
+// dropIndex deletes an existing secondary index of the bucket, and the
+// bucket holding the indexes once it is empty.
+func (b *Bucket) dropIndex(name []byte) {
+	indexes := b.internalBucket(indexesKey, false, common.BucketOptions{})
+	indexes.dropInternalBucket(string(name))
+	if k, _, _ := indexes.Cursor().first(); k == nil {
+		b.dropInternalBucket(indexesKey)
+	}
+	b.indexesLoaded = false
+}
+
+// freeIndexes releases the pages of the secondary indexes of a bucket being
+// deleted.
+func (b *Bucket) freeIndexes() {
+	indexes := b.internalBucket(indexesKey, false, common.BucketOptions{})
+	if indexes == nil {
+		return
+	}
+	c := indexes.Cursor()
+	for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
+		if (flags & common.BucketLeafFlag) != 0 {
+			_, v, _ := c.keyValue()
+			indexes.openBucket(v).free()
+		}
+	}
+	indexes.free()
+}
+
+// loadIndexes returns the secondary indexes of the bucket. It returns an
+// error if the extractor of one of them is not registered.
+func (b *Bucket) loadIndexes() ([]*bucketIndex, error) {
+	if b.indexesLoaded {
+		return b.indexes, nil
+	}
+
+	var idxs []*bucketIndex
+	if indexes := b.internalBucket(indexesKey, false, common.BucketOptions{}); indexes != nil {
+		var names [][]byte
+		c := indexes.Cursor()
+		for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
+			if (flags & common.BucketLeafFlag) != 0 {
+				names = append(names, cloneBytes(k))
+			}
+		}
+		for _, name := range names {
+			ib := indexes.internalBucket(string(name), false, common.BucketOptions{})
+			extract := b.tx.db.indexExtractors[ib.opts.IndexExtractor]
+			if extract == nil {
+				return nil, fmt.Errorf("%w: %q", errors.ErrExtractorNotRegistered, ib.opts.IndexExtractor)
+			}
+			idxs = append(idxs, &bucketIndex{name: name, extract: extract, bucket: ib})
+		}
+	}
+	b.indexes, b.indexesLoaded = idxs, true
+	return idxs, nil
+}
+
+// indexDefs returns the name and the extractor name of each secondary index
+// of the bucket.
+func (b *Bucket) indexDefs() []indexDef {
+	indexes := b.internalBucket(indexesKey, false, common.BucketOptions{})
+	if indexes == nil {
+		return nil
+	}
+	var defs []indexDef
+	c := indexes.Cursor()
+	for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
+		if (flags & common.BucketLeafFlag) != 0 {
+			_, v, _ := c.keyValue()
+			defs = append(defs, indexDef{name: cloneBytes(k), extractor: indexes.openBucket(v).opts.IndexExtractor})
+		}
+	}
+	return defs
+}
+
+// indexDef is the definition of a secondary index.
+type indexDef struct {
+	name      []byte
+	extractor string
+}
+
+// indexUpdate holds the entries to remove from, and to add to, a secondary
+// index for a change of a key.
+type indexUpdate struct {
+	idx      *bucketIndex
+	del, put [][]byte
+}
+
+// indexUpdates holds the updates of all the secondary indexes of a bucket.
+type indexUpdates []indexUpdate
+
+// indexUpdates returns empty updates of the secondary indexes of the bucket.
+func (b *Bucket) indexUpdates() (indexUpdates, error) {
+	idxs, err := b.loadIndexes()
+	if err != nil || len(idxs) == 0 {
+		return nil, err
+	}
+	u := make(indexUpdates, len(idxs))
+	for i, idx := range idxs {
+		u[i].idx = idx
+	}
+	return u, nil
+}
+
+// remove records the removal of the entries of a key/value pair.
+func (u indexUpdates) remove(key, value []byte) {
+	for i := range u {
+		u[i].del = append(u[i].del, u[i].idx.entries(key, value)...)
+	}
+}
+
+// add records the addition of the entries of a key/value pair.
+// Returns ErrIndexKeyTooLarge if an entry is too large.
+func (u indexUpdates) add(key, value []byte) error {
+	for i := range u {
+		for _, e := range u[i].idx.entries(key, value) {
+			if len(e) > MaxKeySize {
+				return errors.ErrIndexKeyTooLarge
+			}
+			u[i].put = append(u[i].put, e)
+		}
+	}
+	return nil
+}
+
+// apply updates the secondary indexes.
+func (u indexUpdates) apply() {
+	for _, up := range u {
+		for _, e := range up.del {
+			if !slices.ContainsFunc(up.put, func(p []byte) bool { return bytes.Equal(p, e) }) {
+				up.idx.bucket.deleteIndexKey(e)
+			}
+		}
+		for _, e := range up.put {
+			up.idx.bucket.putIndexKey(e)
+		}
+	}
+}
+
+// Index returns a cursor over the entries of a secondary index of the bucket
+// created with CreateIndex, or nil if the index does not exist.
+// The cursor is only valid as long as the transaction is open.
+func (b *Bucket) Index(name []byte) *IndexCursor {
+	b.tx.opt.scan(b)
+	indexes := b.internalBucket(indexesKey, false, common.BucketOptions{})
+	if indexes == nil {
+		return nil
+	}
+	ib := indexes.internalBucket(string(name), false, common.BucketOptions{})
+	if ib == nil {
+		return nil
+	}
+	return &IndexCursor{c: ib.Cursor()}
+}
+
+// IndexCursor iterates over the entries of a secondary index, in order of
+// their index keys, then of the keys of the bucket they refer to. Each entry
+// is returned as an index key and the key of the bucket it was extracted
+// from, whose value is read with Bucket.Get. Keys that have expired are in
+// the index until they are deleted, and Get returns nil for them.
+//
+// The returned keys are only valid for the life of the transaction. Changing
+// the bucket while iterating may move the cursor, as for Cursor.
+type IndexCursor struct {
+	c *Cursor
+}
+
+// First moves the cursor to the first entry of the index and returns it.
+// If the index is empty then nil keys are returned.
+func (ic *IndexCursor) First() (indexKey []byte, key []byte) {
+	e, _ := ic.c.First()
+	return ic.entry(e)
+}
+
+// Last moves the cursor to the last entry of the index and returns it.
+// If the index is empty then nil keys are returned.
+func (ic *IndexCursor) Last() (indexKey []byte, key []byte) {
+	e, _ := ic.c.Last()
+	return ic.entry(e)
+}
+
+// Next moves the cursor to the next entry of the index and returns it.
+// If the cursor is at the end of the index then nil keys are returned.
+func (ic *IndexCursor) Next() (indexKey []byte, key []byte) {
+	e, _ := ic.c.Next()
+	return ic.entry(e)
+}
+
+// Prev moves the cursor to the previous entry of the index and returns it.
+// If the cursor is at the beginning of the index then nil keys are returned.
+func (ic *IndexCursor) Prev() (indexKey []byte, key []byte) {
+	e, _ := ic.c.Prev()
+	return ic.entry(e)
+}
+
+// Seek moves the cursor to the first entry whose index key is equal to or
+// after the given one, and returns it. If no such entry exists then nil keys
+// are returned.
+func (ic *IndexCursor) Seek(indexKey []byte) ([]byte, []byte) {
+	e, _ := ic.c.Seek(appendEscaped(nil, indexKey))
+	return ic.entry(e)
+}
+
+// entry splits an entry of the index.
+func (ic *IndexCursor) entry(e []byte) ([]byte, []byte) {
+	if e == nil {
+		return nil, nil
+	}
+	indexKey, key, ok := cutEscaped(e)
+	if !ok {
+		panic(fmt.Sprintf("invalid index entry: %x", e))
+	}
+	return indexKey, key
+}
+
+// checkIndexes verifies that the secondary indexes of bucket b hold exactly
+// the entries extracted from its key/value pairs.
+func (tx *Tx) checkIndexes(b *Bucket, keyToString func([]byte) string, ch chan error) {
+	// The buckets are opened directly, as the check may run concurrently
+	// with the transaction. Buckets whose comparator or compressor is not
+	// registered cannot be read.
+	if b.optionsError() != nil {
+		return
+	}
+	c := b.Cursor()
+	k, v, flags := c.seek([]byte(indexesKey))
+	if string(k) != indexesKey || (flags&common.BucketLeafFlag) == 0 {
+		return
+	}
+	indexes := b.openBucket(v)
+
+	ic := indexes.Cursor()
+	for name, _, flags := ic.first(); name != nil; name, _, flags = ic.next() {
+		if (flags & common.BucketLeafFlag) == 0 {
+			ch <- fmt.Errorf("page %d: index %q: not a bucket", b.RootPage(), name)
+			continue
+		}
+		_, v, _ := ic.keyValue()
+		ib := indexes.openBucket(v)
+		idx := &bucketIndex{name: name, extract: tx.db.indexExtractors[ib.opts.IndexExtractor], bucket: ib}
+		if idx.extract == nil {
+			ch <- fmt.Errorf("page %d: cannot verify index %q: extractor %q is not registered", b.RootPage(), name, ib.opts.IndexExtractor)
+			continue
+		}
+
+		// Every pair has its entries in the index.
+		ec := ib.Cursor()
+		for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+			if (flags & common.BucketLeafFlag) != 0 {
+				continue
+			}
+			for _, e := range idx.entries(k, c.value(v, flags)) {
+				if ek, _, _ := ec.seek(e); !bytes.Equal(e, ek) {
+					ik, _, _ := cutEscaped(e)
+					ch <- fmt.Errorf("page %d: index %q: missing entry %s for key %s", b.RootPage(), name, keyToString(ik), keyToString(k))
+				}
+			}
+		}
+
+		// Every entry of the index is extracted from its pair.
+		kc := b.Cursor()
+		for e, _, _ := ec.first(); e != nil; e, _, _ = ec.next() {
+			ik, key, ok := cutEscaped(e)
+			if !ok {
+				ch <- fmt.Errorf("page %d: index %q: invalid entry %s", b.RootPage(), name, keyToString(e))
+				continue
+			}
+			k, v, flags := kc.seek(key)
+			if !bytes.Equal(key, k) || (flags&common.BucketLeafFlag) != 0 ||
+				!slices.ContainsFunc(idx.extract(k, kc.value(v, flags)), func(x []byte) bool { return bytes.Equal(x, ik) }) {
+				ch <- fmt.Errorf("page %d: index %q: stale entry %s for key %s", b.RootPage(), name, keyToString(ik), keyToString(key))
+			}
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// cityExtractor indexes the values "name,city" by city, and leaves out the
+// values without one.
+func cityExtractor(_, value []byte) [][]byte {
+	_, city, ok := bytes.Cut(value, []byte(","))
+	if !ok {
+		return nil
+	}
+	return [][]byte{city}
+}
+
+// tagsExtractor indexes the values by each of their space-separated words.
+func tagsExtractor(_, value []byte) [][]byte {
+	return bytes.Fields(value)
+}
+
+var indexOptions = &bolt.Options{IndexExtractors: map[string]bolt.IndexExtractor{
+	"city": cityExtractor,
+	"tags": tagsExtractor,
+}}
+
+// indexEntries returns the entries of an index, as "indexKey=key", forward
+// and backward.
+func indexEntries(t *testing.T, b *bolt.Bucket, name string) []string {
+	ic := b.Index([]byte(name))
+	require.NotNil(t, ic)
+	var entries, reversed []string
+	for ik, k := ic.First(); ik != nil; ik, k = ic.Next() {
+		entries = append(entries, fmt.Sprintf("%s=%s", ik, k))
+	}
+	for ik, k := ic.Last(); ik != nil; ik, k = ic.Prev() {
+		reversed = append([]string{fmt.Sprintf("%s=%s", ik, k)}, reversed...)
+	}
+	require.Equal(t, entries, reversed)
+	return entries
+}
+
+// Ensure that a secondary index is built from the existing keys, then kept up
+// to date by Put, Delete and Cursor.Delete.
+func TestBucket_CreateIndex(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, b.Put([]byte("alice"), []byte("Alice,Paris")))
+		require.NoError(t, b.Put([]byte("bob"), []byte("Bob,Berlin")))
+		require.NoError(t, b.Put([]byte("carol"), []byte("Carol")))
+
+		require.ErrorIs(t, b.CreateIndex(nil, "city"), berrors.ErrIndexNameRequired)
+		require.ErrorIs(t, b.CreateIndex([]byte("city"), "zip"), berrors.ErrExtractorNotRegistered)
+		require.NoError(t, b.CreateIndex([]byte("city"), "city"))
+		require.ErrorIs(t, b.CreateIndex([]byte("city"), "city"), berrors.ErrIndexExists)
+		require.Nil(t, b.Index([]byte("zip")))
+		require.Equal(t, []string{"Berlin=bob", "Paris=alice"}, indexEntries(t, b, "city"))
+
+		require.NoError(t, b.Put([]byte("dave"), []byte("Dave,Paris")))
+		require.NoError(t, b.Put([]byte("bob"), []byte("Bob,Rome")))
+		require.NoError(t, b.Put([]byte("carol"), []byte("Carol,Berlin")))
+		require.Equal(t, []string{"Berlin=carol", "Paris=alice", "Paris=dave", "Rome=bob"}, indexEntries(t, b, "city"))
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		require.NoError(t, b.Delete([]byte("alice")))
+		c := b.Cursor()
+		k, _ := c.Seek([]byte("carol"))
+		require.Equal(t, []byte("carol"), k)
+		require.NoError(t, c.Delete())
+		require.Equal(t, []string{"Paris=dave", "Rome=bob"}, indexEntries(t, b, "city"))
+
+		// The indexes are hidden from the cursors of the bucket.
+		require.Equal(t, []string{"bob", "dave"}, visibleKeys(t, b))
+		return b.ForEachBucket(func(k []byte) error {
+			return fmt.Errorf("unexpected bucket %q", k)
+		})
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	db.MustClose()
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		ic := b.Index([]byte("city"))
+		ik, k := ic.Seek([]byte("Paris"))
+		require.Equal(t, []byte("Paris"), ik)
+		require.Equal(t, []byte("dave"), k)
+		ik, k = ic.Seek([]byte("Q"))
+		require.Equal(t, []byte("Rome"), ik)
+		require.Equal(t, []byte("Bob,Rome"), b.Get(k))
+		ik, k = ic.Seek([]byte("S"))
+		require.Nil(t, ik)
+		require.Nil(t, k)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that the entries of an index sort by index key, including index keys
+// holding zero bytes, then by key, and that a value may have several index
+// keys or none.
+func TestBucket_CreateIndex_Order(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, b.CreateIndex([]byte("tags"), "tags"))
+		require.NoError(t, b.Put([]byte("2"), []byte("a\x00 ab a")))
+		require.NoError(t, b.Put([]byte("1"), []byte("a a\x00\x00")))
+		require.NoError(t, b.Put([]byte("3"), []byte("")))
+		require.Equal(t, []string{"a=1", "a=2", "a\x00=2", "a\x00\x00=1", "ab=2"}, indexEntries(t, b, "tags"))
+
+		ik, k := b.Index([]byte("tags")).Seek([]byte("a\x00"))
+		require.Equal(t, []byte("a\x00"), ik)
+		require.Equal(t, []byte("2"), k)
+
+		// Replacing a value only changes the index keys that differ.
+		require.NoError(t, b.Put([]byte("2"), []byte("ab b")))
+		require.Equal(t, []string{"a=1", "a\x00\x00=1", "ab=2", "b=2"}, indexEntries(t, b, "tags"))
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
+// Ensure that the indexes of a bucket with a comparator are not passed to the
+// comparator, which only accepts 8-byte keys.
+func TestBucket_CreateIndex_Comparator(t *testing.T) {
+	opts := comparatorOptions()
+	opts.IndexExtractors = indexOptions.IndexExtractors
+	db := btesting.MustCreateDBWithOption(t, opts)
+	const n = 1000
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("users"), bolt.BucketOptions{Comparator: "uint64-desc"})
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n/2; i++ {
+			if err := b.Put(u64(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				return err
+			}
+		}
+		if err := b.CreateIndex([]byte("city"), "city"); err != nil {
+			return err
+		}
+		for i := uint64(n / 2); i < n; i++ {
+			if err := b.Put(u64(i), []byte(fmt.Sprintf("v%d,Paris", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		var keys []uint64
+		ic := b.Index([]byte("city"))
+		for ik, k := ic.First(); ik != nil; ik, k = ic.Next() {
+			require.Equal(t, []byte("Paris"), ik)
+			keys = append(keys, binary.BigEndian.Uint64(k))
+		}
+		require.Len(t, keys, n/2)
+		require.Equal(t, uint64(n/2), keys[0])
+
+		k, _ := b.Cursor().First()
+		require.Equal(t, uint64(n-1), binary.BigEndian.Uint64(k))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that an index key too large to be stored is rejected, leaving the
+// bucket and its indexes unchanged.
+func TestBucket_CreateIndex_KeyTooLarge(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	large := strings.Repeat("x", bolt.MaxKeySize)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, b.Put([]byte("foo"), []byte(large)))
+		require.ErrorIs(t, b.CreateIndex([]byte("tags"), "tags"), berrors.ErrIndexKeyTooLarge)
+		require.Nil(t, b.Index([]byte("tags")))
+
+		require.NoError(t, b.Delete([]byte("foo")))
+		require.NoError(t, b.CreateIndex([]byte("tags"), "tags"))
+		require.ErrorIs(t, b.Put([]byte("foo"), []byte(large)), berrors.ErrIndexKeyTooLarge)
+		require.Nil(t, b.Get([]byte("foo")))
+		require.Empty(t, indexEntries(t, b, "tags"))
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
+// Ensure that deleting an index, or its bucket, releases its pages.
+func TestBucket_DeleteIndex(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"widgets", "gadgets"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("x,%d", i%10))); err != nil {
+					return err
+				}
+			}
+			require.NoError(t, b.CreateIndex([]byte("city"), "city"))
+			require.NoError(t, b.CreateIndex([]byte("tags"), "tags"))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.ErrorIs(t, b.DeleteIndex([]byte("zip")), berrors.ErrIndexNotFound)
+		require.NoError(t, b.DeleteIndex([]byte("city")))
+		require.Nil(t, b.Index([]byte("city")))
+		require.NoError(t, b.DeleteIndex([]byte("tags")))
+		require.NoError(t, b.Put([]byte("0000"), []byte("y,0")))
+		return tx.DeleteBucket([]byte("gadgets"))
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		// The bucket holding the indexes is deleted with the last one.
+		require.Equal(t, 1, tx.Bucket([]byte("widgets")).Stats().BucketN)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a bucket whose index extractor is not registered can be read,
+// but not written to.
+func TestBucket_CreateIndex_ExtractorNotRegistered(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, b.CreateIndex([]byte("city"), "city"))
+		return b.Put([]byte("alice"), []byte("Alice,Paris"))
+	})
+	require.NoError(t, err)
+
+	db.MustClose()
+	db.SetOptions(&bolt.Options{})
+	db.MustReopen()
+	db.ForceDisableStrictMode()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		require.Equal(t, []byte("Alice,Paris"), b.Get([]byte("alice")))
+		require.Equal(t, []string{"Paris=alice"}, indexEntries(t, b, "city"))
+		require.ErrorIs(t, b.Put([]byte("bob"), []byte("Bob,Rome")), berrors.ErrExtractorNotRegistered)
+		require.ErrorIs(t, b.Delete([]byte("alice")), berrors.ErrExtractorNotRegistered)
+
+		var errs []string
+		for err := range tx.Check() {
+			errs = append(errs, err.Error())
+		}
+		require.Len(t, errs, 1)
+		require.Contains(t, errs[0], `cannot verify index "city": extractor "city" is not registered`)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Let the database be checked once the test ends.
+	db.MustClose()
+	db.SetOptions(indexOptions)
+	db.MustReopen()
+}
+
+// Ensure that Tx.Check reports the entries an index misses and those it
+// should not hold.
+func TestTx_Check_Index(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, b.CreateIndex([]byte("city"), "city"))
+		return b.Put([]byte("alice"), []byte("Alice,Paris"))
+	})
+	require.NoError(t, err)
+
+	// The extractor changes, so the index no longer matches the values.
+	db.MustClose()
+	db.SetOptions(&bolt.Options{IndexExtractors: map[string]bolt.IndexExtractor{
+		"city": func(key, value []byte) [][]byte {
+			return [][]byte{bytes.ToUpper(cityExtractor(key, value)[0])}
+		},
+	}})
+	db.MustReopen()
+	err = db.View(func(tx *bolt.Tx) error {
+		var errs []string
+		for err := range tx.Check(bolt.WithKVStringer(stringKVStringer{})) {
+			errs = append(errs, err.Error())
+		}
+		require.Len(t, errs, 2)
+		require.Contains(t, errs[0], `index "city": missing entry PARIS for key alice`)
+		require.Contains(t, errs[1], `index "city": stale entry Paris for key alice`)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Let the database be checked once the test ends.
+	db.MustClose()
+	db.SetOptions(indexOptions)
+	db.MustReopen()
+}
+
+// stringKVStringer prints the keys and values as strings.
+type stringKVStringer struct{}
+
+func (stringKVStringer) KeyToString(key []byte) string     { return string(key) }
+func (stringKVStringer) ValueToString(value []byte) string { return string(value) }
+
+// Ensure that compacting builds the secondary indexes again, from the keys
+// kept.
+func TestCompact_Index(t *testing.T) {
+	src := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		for _, bkt := range []*bolt.Bucket{b, child} {
+			require.NoError(t, bkt.CreateIndex([]byte("city"), "city"))
+			require.NoError(t, bkt.Put([]byte("alice"), []byte("Alice,Paris")))
+			require.NoError(t, bkt.Put([]byte("bob"), []byte("Bob,Rome")))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, indexOptions)
+			require.NoError(t, err)
+			defer dst.Close()
+			err = bolt.CompactWithOptions(dst, src.DB, bolt.CompactOptions{
+				Workers: workers,
+				Filter: func(keys [][]byte, k, v []byte) bool {
+					return string(k) != "bob"
+				},
+			})
+			require.NoError(t, err)
+
+			err = dst.View(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("users"))
+				require.Equal(t, []string{"Paris=alice"}, indexEntries(t, b, "city"))
+				require.Equal(t, []string{"Paris=alice"}, indexEntries(t, b.Bucket([]byte("child")), "city"))
+				for err := range tx.Check() {
+					t.Error(err)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+
+	// The extractors must be registered in the destination database.
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst.Close()
+	require.ErrorIs(t, bolt.Compact(dst, src.DB, 0), berrors.ErrExtractorNotRegistered)
+}
+
+// Ensure that the indexes created and the keys put by an optimistic
+// transaction are indexed once replayed.
+func TestDB_OptimisticUpdate_Index(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("alice"), []byte("Alice,Paris"))
+	})
+	require.NoError(t, err)
+
+	err = db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		if err := b.CreateIndex([]byte("city"), "city"); err != nil {
+			return err
+		}
+		return b.Put([]byte("bob"), []byte("Bob,Rome"))
+	})
+	require.NoError(t, err)
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []string{"Paris=alice", "Rome=bob"}, indexEntries(t, tx.Bucket([]byte("users")), "city"))
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
+// Ensure that reaping the expired keys removes their entries.
+func TestDB_ReapExpired_Index(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, b.CreateIndex([]byte("city"), "city"))
+		require.NoError(t, b.Put([]byte("alice"), []byte("Alice,Paris")))
+		return b.PutWithTTL([]byte("bob"), []byte("Bob,Rome"), time.Millisecond)
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		// The entries of the keys expired remain until they are deleted.
+		b := tx.Bucket([]byte("users"))
+		require.Equal(t, []string{"Paris=alice", "Rome=bob"}, indexEntries(t, b, "city"))
+		require.Nil(t, b.Get([]byte("bob")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	n, err := db.ReapExpired()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []string{"Paris=alice"}, indexEntries(t, tx.Bucket([]byte("users")), "city"))
+		return nil
+	})
+	require.NoError(t, err)
+}
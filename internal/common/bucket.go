@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/binary"
 	"fmt"
 	"unsafe"
 )
@@ -46,9 +47,173 @@ func (b *InBucket) IncSequence() {
 }
 
 func (b *InBucket) InlinePage(v []byte) *Page {
-	return (*Page)(unsafe.Pointer(&v[BucketHeaderSize]))
+	return (*Page)(unsafe.Pointer(&v[BucketHeaderSize+BucketOptionsSize(v)]))
 }
 
 func (b *InBucket) String() string {
 	return fmt.Sprintf("<pgid=%d,seq=%d>", b.root, b.sequence)
 }
+
+// bucketOptionsMagic marks a bucket options record following the bucket
+// header. An inline page always starts with a zero page id, so the record
+// can never be confused with one.
+const bucketOptionsMagic uint32 = 0xB0C7A5E1
+
+// bucketOptionsHeaderSize is the size of the magic and record size fields.
+const bucketOptionsHeaderSize = 8
+
+// Tags of the entries stored in a bucket options record.
+const (
+	bucketOptionComparator           uint16 = 1
+	bucketOptionCompression          uint16 = 2
+	bucketOptionCompressionThreshold uint16 = 3
+	bucketOptionIndexExtractor       uint16 = 4
+	bucketOptionMaxVersions          uint16 = 5
+	bucketOptionVersionRetention     uint16 = 6
+)
+
+// BucketOptions represents the optional, persisted settings of a bucket.
+//
+// The options are stored in a record between the bucket header and the
+// inline page (if any). The record starts with a magic number and its total
+// size, followed by tag/length/value entries, and is padded to a multiple of
+// 8 bytes so the inline page stays aligned. Buckets without options have no
+// record at all, which keeps them readable by older versions.
+type BucketOptions struct {
+	Comparator           string // name of the key comparator; empty means byte order
+	Compression          string // name of the value compressor; empty means none
+	CompressionThreshold uint32 // minimum size of a value to be compressed
+	IndexExtractor       string // name of the extractor of a secondary index bucket
+	MaxVersions          uint32 // number of previous versions of a key retained
+	VersionRetention     int64  // nanoseconds the previous versions of a key are retained for
+}
+
+// IsZero returns true if no option is set.
+func (o *BucketOptions) IsZero() bool {
+	return *o == BucketOptions{}
+}
+
+// Size returns the size of the encoded options record, or 0 if no option is set.
+func (o *BucketOptions) Size() int {
+	if o.IsZero() {
+		return 0
+	}
+	sz := bucketOptionsHeaderSize
+	if o.Comparator != "" {
+		sz += 4 + len(o.Comparator)
+	}
+	if o.Compression != "" {
+		sz += 4 + len(o.Compression) + 4 + 4
+	}
+	if o.IndexExtractor != "" {
+		sz += 4 + len(o.IndexExtractor)
+	}
+	if o.MaxVersions != 0 {
+		sz += 4 + 4
+	}
+	if o.VersionRetention != 0 {
+		sz += 4 + 8
+	}
+	return (sz + 7) &^ 7
+}
+
+// Write encodes the options record into buf, which must be at least Size() bytes.
+func (o *BucketOptions) Write(buf []byte) {
+	sz := o.Size()
+	if sz == 0 {
+		return
+	}
+	binary.LittleEndian.PutUint32(buf[0:], bucketOptionsMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(sz))
+
+	pos := bucketOptionsHeaderSize
+	if o.Comparator != "" {
+		pos += writeBucketOption(buf[pos:], bucketOptionComparator, []byte(o.Comparator))
+	}
+	if o.Compression != "" {
+		pos += writeBucketOption(buf[pos:], bucketOptionCompression, []byte(o.Compression))
+		pos += writeBucketOption(buf[pos:], bucketOptionCompressionThreshold, binary.LittleEndian.AppendUint32(nil, o.CompressionThreshold))
+	}
+	if o.IndexExtractor != "" {
+		pos += writeBucketOption(buf[pos:], bucketOptionIndexExtractor, []byte(o.IndexExtractor))
+	}
+	if o.MaxVersions != 0 {
+		pos += writeBucketOption(buf[pos:], bucketOptionMaxVersions, binary.LittleEndian.AppendUint32(nil, o.MaxVersions))
+	}
+	if o.VersionRetention != 0 {
+		pos += writeBucketOption(buf[pos:], bucketOptionVersionRetention, binary.LittleEndian.AppendUint64(nil, uint64(o.VersionRetention)))
+	}
+	clear(buf[pos:sz])
+}
+
+// writeBucketOption writes a single tag/length/value entry and returns its size.
+func writeBucketOption(buf []byte, tag uint16, value []byte) int {
+	binary.LittleEndian.PutUint16(buf[0:], tag)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(value)))
+	return 4 + copy(buf[4:], value)
+}
+
+// BucketOptionsSize returns the size of the options record stored in the
+// bucket value v, or 0 if the bucket has no options.
+func BucketOptionsSize(v []byte) int {
+	if len(v) < BucketHeaderSize+bucketOptionsHeaderSize {
+		return 0
+	}
+	rec := v[BucketHeaderSize:]
+	if binary.LittleEndian.Uint32(rec[0:]) != bucketOptionsMagic {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(rec[4:]))
+}
+
+// ReadBucketOptions decodes the options record stored in the bucket value v.
+// Entries with unknown tags are skipped.
+func ReadBucketOptions(v []byte) (BucketOptions, error) {
+	var o BucketOptions
+	sz := BucketOptionsSize(v)
+	if sz == 0 {
+		return o, nil
+	}
+	if sz < bucketOptionsHeaderSize || BucketHeaderSize+sz > len(v) {
+		return o, fmt.Errorf("invalid bucket options record size: %d", sz)
+	}
+
+	rec := v[BucketHeaderSize : BucketHeaderSize+sz]
+	for pos := bucketOptionsHeaderSize; pos+4 <= len(rec); {
+		tag := binary.LittleEndian.Uint16(rec[pos:])
+		n := int(binary.LittleEndian.Uint16(rec[pos+2:]))
+		pos += 4
+		if tag == 0 {
+			// Padding.
+			break
+		}
+		if pos+n > len(rec) {
+			return o, fmt.Errorf("invalid bucket option %d: length %d exceeds record", tag, n)
+		}
+		switch tag {
+		case bucketOptionComparator:
+			o.Comparator = string(rec[pos : pos+n])
+		case bucketOptionCompression:
+			o.Compression = string(rec[pos : pos+n])
+		case bucketOptionCompressionThreshold:
+			if n != 4 {
+				return o, fmt.Errorf("invalid compression threshold length: %d", n)
+			}
+			o.CompressionThreshold = binary.LittleEndian.Uint32(rec[pos:])
+		case bucketOptionIndexExtractor:
+			o.IndexExtractor = string(rec[pos : pos+n])
+		case bucketOptionMaxVersions:
+			if n != 4 {
+				return o, fmt.Errorf("invalid max versions length: %d", n)
+			}
+			o.MaxVersions = binary.LittleEndian.Uint32(rec[pos:])
+		case bucketOptionVersionRetention:
+			if n != 8 {
+				return o, fmt.Errorf("invalid version retention length: %d", n)
+			}
+			o.VersionRetention = int64(binary.LittleEndian.Uint64(rec[pos:]))
+		}
+		pos += n
+	}
+	return o, nil
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// Ensure that bucket options round-trip and keep the inline page aligned.
+func TestBucketOptions_RoundTrip(t *testing.T) {
+	opts := BucketOptions{Comparator: "uint64-desc", Compression: "flate", CompressionThreshold: 512, IndexExtractor: "email",
+		MaxVersions: 10, VersionRetention: 3600e9}
+	sz := opts.Size()
+	if sz%8 != 0 {
+		t.Fatalf("unaligned options record size: %d", sz)
+	}
+
+	v := make([]byte, BucketHeaderSize+sz+int(PageHeaderSize))
+	opts.Write(v[BucketHeaderSize:])
+	if got := BucketOptionsSize(v); got != sz {
+		t.Fatalf("exp=%d; got=%d", sz, got)
+	}
+	got, err := ReadBucketOptions(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != opts {
+		t.Fatalf("exp=%+v; got=%+v", opts, got)
+	}
+
+	var b InBucket
+	if p := b.InlinePage(v); uintptr(unsafe.Pointer(p)) != uintptr(unsafe.Pointer(&v[BucketHeaderSize+sz])) {
+		t.Fatal("inline page does not follow the options record")
+	}
+}
+
+// Ensure that buckets without options have no options record.
+func TestBucketOptions_None(t *testing.T) {
+	var opts BucketOptions
+	if sz := opts.Size(); sz != 0 {
+		t.Fatalf("exp=0; got=%d", sz)
+	}
+
+	// An inline bucket: the header is directly followed by a leaf page.
+	v := make([]byte, BucketHeaderSize+int(PageHeaderSize))
+	(*Page)(unsafe.Pointer(&v[BucketHeaderSize])).SetFlags(LeafPageFlag)
+	if sz := BucketOptionsSize(v); sz != 0 {
+		t.Fatalf("exp=0; got=%d", sz)
+	}
+	got, err := ReadBucketOptions(v[:BucketHeaderSize])
+	if err != nil || !got.IsZero() {
+		t.Fatalf("unexpected options: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// PageChecksumSize is the size of the checksum of a run of pages when page
+// checksums are enabled. The page header has no room for it, so it is stored
+// in the last bytes of the run that are not reserved for a cipher.
+const PageChecksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SetPageChecksum computes the CRC-32C of a run of pages, including its
+// header, and stores it in the last PageChecksumSize bytes of buf.
+func SetPageChecksum(buf []byte) {
+	n := len(buf) - PageChecksumSize
+	binary.LittleEndian.PutUint32(buf[n:], crc32.Checksum(buf[:n], castagnoli))
+}
+
+// UpdatePageChecksum returns the CRC-32C crc updated with p, so that the
+// checksum of a run of pages can be computed as it is written in parts,
+// starting from 0, and stored like SetPageChecksum does.
+func UpdatePageChecksum(crc uint32, p []byte) uint32 {
+	return crc32.Update(crc, castagnoli, p)
+}
+
+// VerifyPageChecksum returns true if the checksum stored in the last
+// PageChecksumSize bytes of buf matches its content.
+func VerifyPageChecksum(buf []byte) bool {
+	n := len(buf) - PageChecksumSize
+	return binary.LittleEndian.Uint32(buf[n:]) == crc32.Checksum(buf[:n], castagnoli)
+}
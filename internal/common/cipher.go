@@ -0,0 +1,72 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PageTxidSize is the number of bytes at the end of an encrypted run of pages
+// holding the id of the transaction which wrote it.
+const PageTxidSize = 8
+
+// SealFunc encrypts and authenticates plaintext, authenticates additionalData
+// and appends the result to dst.
+type SealFunc func(dst, plaintext, additionalData []byte) ([]byte, error)
+
+// OpenFunc decrypts and authenticates a ciphertext produced by a SealFunc and
+// appends the resulting plaintext to dst.
+type OpenFunc func(dst, ciphertext, additionalData []byte) ([]byte, error)
+
+// SealPage encrypts a run of pages written by the transaction txid. The page
+// header and txid are kept in clear text, so that the length of the run can be
+// determined before decrypting it, and are authenticated along with the rest
+// of the page. The last overhead bytes of the run must be unused as they are
+// replaced by the cipher overhead and the txid, which takes PageTxidSize of
+// them.
+func SealPage(buf []byte, overhead int, txid Txid, seal SealFunc) ([]byte, error) {
+	n := len(buf) - PageTxidSize
+	out := make([]byte, PageHeaderSize, len(buf))
+	copy(out, buf[:PageHeaderSize])
+	out, err := seal(out, buf[PageHeaderSize:len(buf)-overhead], sealedPageAdditionalData(buf[:PageHeaderSize], txid))
+	if err != nil {
+		return nil, err
+	} else if len(out) != n {
+		return nil, fmt.Errorf("sealed page has %d bytes, expected %d", len(out), n)
+	}
+	return binary.BigEndian.AppendUint64(out, uint64(txid)), nil
+}
+
+// OpenPage decrypts a run of pages encrypted by SealPage. The returned buffer
+// has the same length as buf, with the bytes used by the cipher overhead set
+// to zero and the txid left in place, see SealedPageTxid.
+func OpenPage(buf []byte, open OpenFunc) ([]byte, error) {
+	if len(buf) < int(PageHeaderSize)+PageTxidSize {
+		return nil, fmt.Errorf("sealed page has %d bytes, expected at least %d", len(buf), int(PageHeaderSize)+PageTxidSize)
+	}
+	n := len(buf) - PageTxidSize
+	txid := SealedPageTxid(buf)
+	out := make([]byte, PageHeaderSize, len(buf))
+	copy(out, buf[:PageHeaderSize])
+	out, err := open(out, buf[PageHeaderSize:n], sealedPageAdditionalData(buf[:PageHeaderSize], txid))
+	if err != nil {
+		return nil, err
+	} else if len(out) > n {
+		return nil, fmt.Errorf("opened page has %d bytes, expected at most %d", len(out), n)
+	}
+	out = append(out, make([]byte, n-len(out))...)
+	return binary.BigEndian.AppendUint64(out, uint64(txid)), nil
+}
+
+// SealedPageTxid returns the id of the transaction which wrote a run of pages
+// sealed by SealPage, or opened by OpenPage.
+func SealedPageTxid(buf []byte) Txid {
+	return Txid(binary.BigEndian.Uint64(buf[len(buf)-PageTxidSize:]))
+}
+
+// sealedPageAdditionalData returns the data authenticated along with a run of
+// pages: its header followed by the txid which wrote it.
+func sealedPageAdditionalData(header []byte, txid Txid) []byte {
+	ad := make([]byte, 0, len(header)+PageTxidSize)
+	ad = append(ad, header...)
+	return binary.BigEndian.AppendUint64(ad, uint64(txid))
+}
@@ -46,58 +46,90 @@ func (in *Inode) SetValue(value []byte) {
 	in.value = value
 }
 
+// ReadInodeFromPage reads the elements of a page into inodes. The keys and
+// values point into the page, except the keys of a prefix-compressed page,
+// which are rebuilt from the page prefix in a single buffer for all of them.
 func ReadInodeFromPage(p *Page) Inodes {
 	inodes := make(Inodes, int(p.Count()))
 	isLeaf := p.IsLeafPage()
+	prefix := p.KeyPrefix()
+	var keys []byte
+	if len(prefix) > 0 {
+		keys = make([]byte, 0, len(prefix)*int(p.Count())+p.keySuffixesSize())
+	}
 	for i := 0; i < int(p.Count()); i++ {
 		inode := &inodes[i]
+		var key []byte
 		if isLeaf {
 			elem := p.LeafPageElement(uint16(i))
 			inode.SetFlags(elem.Flags())
-			inode.SetKey(elem.Key())
 			inode.SetValue(elem.Value())
+			key = elem.Key()
 		} else {
 			elem := p.BranchPageElement(uint16(i))
 			inode.SetPgid(elem.Pgid())
-			inode.SetKey(elem.Key())
+			key = elem.Key()
+		}
+		if len(prefix) > 0 {
+			start := len(keys)
+			keys = append(append(keys, prefix...), key...)
+			key = keys[start:len(keys):len(keys)]
 		}
+		inode.SetKey(key)
 		Assert(len(inode.Key()) > 0, "read: zero-length inode key")
 	}
 
 	return inodes
 }
 
+// WriteInodeToPage writes the inodes to the page, whose flags must be set.
+// If the page is prefix-compressed, the prefix shared by the keys is written
+// once and elided from the keys.
 func WriteInodeToPage(inodes Inodes, p *Page) uint32 {
 	// Loop over each item and write it to the page.
 	// off tracks the offset into p of the start of the next data.
 	off := unsafe.Sizeof(*p) + p.PageElementSize()*uintptr(len(inodes))
+
+	// Write the key prefix after the elements.
+	var prefix []byte
+	if p.IsPrefixCompressed() {
+		prefix = KeyPrefix(inodes)
+		*(*uint32)(UnsafeAdd(unsafe.Pointer(p), off)) = uint32(len(prefix))
+		off += KeyPrefixHeaderSize
+		copy(UnsafeByteSlice(unsafe.Pointer(p), off, 0, len(prefix)), prefix)
+		off += uintptr(len(prefix))
+	}
+
 	isLeaf := p.IsLeafPage()
 	for i, item := range inodes {
 		Assert(len(item.Key()) > 0, "write: zero-length inode key")
+		key := item.Key()[len(prefix):]
 
 		// Create a slice to write into of needed size and advance
-		// byte pointer for next iteration.
-		sz := len(item.Key()) + len(item.Value())
+		// byte pointer for next iteration. The slice is empty if the key is
+		// the prefix and there is no value.
+		sz := len(key) + len(item.Value())
 		b := UnsafeByteSlice(unsafe.Pointer(p), off, 0, sz)
+		data := UnsafeAdd(unsafe.Pointer(p), off)
 		off += uintptr(sz)
 
 		// Write the page element.
 		if isLeaf {
 			elem := p.LeafPageElement(uint16(i))
-			elem.SetPos(uint32(uintptr(unsafe.Pointer(&b[0])) - uintptr(unsafe.Pointer(elem))))
+			elem.SetPos(uint32(uintptr(data) - uintptr(unsafe.Pointer(elem))))
 			elem.SetFlags(item.Flags())
-			elem.SetKsize(uint32(len(item.Key())))
+			elem.SetKsize(uint32(len(key)))
 			elem.SetVsize(uint32(len(item.Value())))
 		} else {
 			elem := p.BranchPageElement(uint16(i))
-			elem.SetPos(uint32(uintptr(unsafe.Pointer(&b[0])) - uintptr(unsafe.Pointer(elem))))
-			elem.SetKsize(uint32(len(item.Key())))
+			elem.SetPos(uint32(uintptr(data) - uintptr(unsafe.Pointer(elem))))
+			elem.SetKsize(uint32(len(key)))
 			elem.SetPgid(item.Pgid())
 			Assert(elem.Pgid() != p.Id(), "write: circular dependency occurred")
 		}
 
 		// Write data for the element to the end of the page.
-		l := copy(b, item.Key())
+		l := copy(b, key)
 		copy(b[l:], item.Value())
 	}
 
@@ -106,10 +138,45 @@ func WriteInodeToPage(inodes Inodes, p *Page) uint32 {
 
 func UsedSpaceInPage(inodes Inodes, p *Page) uint32 {
 	off := unsafe.Sizeof(*p) + p.PageElementSize()*uintptr(len(inodes))
+	var prefix int
+	if p.IsPrefixCompressed() {
+		prefix = len(KeyPrefix(inodes))
+		off += KeyPrefixHeaderSize + uintptr(prefix)
+	}
 	for _, item := range inodes {
-		sz := len(item.Key()) + len(item.Value())
+		sz := len(item.Key()) - prefix + len(item.Value())
 		off += uintptr(sz)
 	}
 
 	return uint32(off)
 }
+
+// KeyPrefix returns the longest prefix shared by the keys of the inodes.
+func KeyPrefix(inodes Inodes) []byte {
+	if len(inodes) == 0 {
+		return nil
+	}
+	prefix := inodes[0].Key()
+	for i := 1; i < len(inodes) && len(prefix) > 0; i++ {
+		prefix = prefix[:SharedPrefixLen(prefix, inodes[i].Key())]
+	}
+	return prefix
+}
+
+// SharedPrefixLen returns the length of the longest prefix shared by a and b.
+func SharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// KeyPrefixSaving returns the number of bytes saved by writing count
+// elements whose keys share a prefix of prefixLen bytes on a
+// prefix-compressed page, which may be negative.
+func KeyPrefixSaving(count, prefixLen int) int {
+	return (count-1)*prefixLen - KeyPrefixHeaderSize
+}
@@ -9,6 +9,56 @@ import (
 	"go.etcd.io/bbolt/errors"
 )
 
+// Flags of the meta page, describing the format of the other pages. Each
+// one marks a feature older versions of bbolt cannot read, so a meta with any
+// of them set is written with FeatureVersion, and a meta with a flag unknown
+// to this version is rejected.
+const (
+	// MetaEncryptedFlag is set when every page other than the meta pages is
+	// encrypted.
+	MetaEncryptedFlag = 0x01
+
+	// MetaPageChecksumFlag is set when every page other than the meta pages
+	// ends with a checksum.
+	MetaPageChecksumFlag = 0x02
+
+	// MetaBucketOptionsFlag is set once a bucket options record is written.
+	MetaBucketOptionsFlag = 0x04
+
+	// MetaKeyPrefixFlag is set once a prefix-compressed page is written.
+	MetaKeyPrefixFlag = 0x08
+
+	// MetaCompressedValueFlag, MetaExpiringValueFlag, MetaBlobValueFlag and
+	// MetaChunkedValueFlag are set once a leaf element with the matching
+	// element flag is written.
+	MetaCompressedValueFlag = 0x10
+	MetaExpiringValueFlag   = 0x20
+	MetaBlobValueFlag       = 0x40
+	MetaChunkedValueFlag    = 0x80
+
+	// MetaFlags holds all the flags known to this version.
+	MetaFlags = 0xFF
+)
+
+// ElementMetaFlags returns the meta flags of the features used by a leaf
+// element with the given flags.
+func ElementMetaFlags(flags uint32) uint32 {
+	var m uint32
+	if flags&CompressedValueFlag != 0 {
+		m |= MetaCompressedValueFlag
+	}
+	if flags&ExpiringValueFlag != 0 {
+		m |= MetaExpiringValueFlag
+	}
+	if flags&BlobValueFlag != 0 {
+		m |= MetaBlobValueFlag
+	}
+	if flags&ChunkedValueFlag != 0 {
+		m |= MetaChunkedValueFlag
+	}
+	return m
+}
+
 type Meta struct {
 	magic    uint32
 	version  uint32
@@ -21,11 +71,13 @@ type Meta struct {
 	checksum uint64
 }
 
-// Validate checks the marker bytes and version of the meta page to ensure it matches this binary.
+// Validate checks the marker bytes, version and flags of the meta page to ensure it matches this binary.
 func (m *Meta) Validate() error {
 	if m.magic != Magic {
 		return errors.ErrInvalid
-	} else if m.version != Version {
+	} else if m.version != Version && m.version != FeatureVersion {
+		return errors.ErrVersionMismatch
+	} else if m.flags&^MetaFlags != 0 {
 		return errors.ErrVersionMismatch
 	} else if m.checksum != m.Sum64() {
 		return errors.ErrChecksum
@@ -96,6 +148,15 @@ func (m *Meta) SetFlags(v uint32) {
 	m.flags = v
 }
 
+// SetFeatureFlags sets the given flags, and FeatureVersion as the version,
+// once the file uses a feature older versions of bbolt cannot read.
+func (m *Meta) SetFeatureFlags(flags uint32) {
+	if m.flags&flags != flags {
+		m.flags |= flags
+		m.version = FeatureVersion
+	}
+}
+
 func (m *Meta) SetRootBucket(b InBucket) {
 	m.root = b
 }
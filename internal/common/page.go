@@ -1,6 +1,7 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"sort"
@@ -22,8 +23,26 @@ const (
 	FreelistPageFlag = 0x10
 )
 
+// PrefixCompressedPageFlag is set on the branch and leaf pages whose keys are
+// stored without the prefix they share. The prefix is stored once, after the
+// page elements, as a 4-byte length followed by its bytes.
+const PrefixCompressedPageFlag = 0x20
+
+// KeyPrefixHeaderSize is the size of the length of the key prefix of a
+// prefix-compressed page.
+const KeyPrefixHeaderSize = 4
+
+// BlobPageFlag is set on the runs of pages storing a single value outside of
+// the B+tree. The value follows the page header; its size is kept by the leaf
+// element pointing to it.
+const BlobPageFlag = 0x40
+
 const (
-	BucketLeafFlag = 0x01
+	BucketLeafFlag      = 0x01
+	CompressedValueFlag = 0x02
+	ExpiringValueFlag   = 0x04
+	BlobValueFlag       = 0x08
+	ChunkedValueFlag    = 0x10
 )
 
 type Pgid uint64
@@ -44,7 +63,8 @@ func NewPage(id Pgid, flags, count uint16, overflow uint32) *Page {
 	}
 }
 
-// Typ returns a human-readable page type string used for debugging.
+// Typ returns a human-readable page type string used for debugging. The
+// prefix compression of a page does not change its type.
 func (p *Page) Typ() string {
 	if p.IsBranchPage() {
 		return "branch"
@@ -54,16 +74,24 @@ func (p *Page) Typ() string {
 		return "meta"
 	} else if p.IsFreelistPage() {
 		return "freelist"
+	} else if p.IsBlobPage() {
+		return "blob"
 	}
 	return fmt.Sprintf("unknown<%02x>", p.flags)
 }
 
 func (p *Page) IsBranchPage() bool {
-	return p.flags == BranchPageFlag
+	return p.flags&^PrefixCompressedPageFlag == BranchPageFlag
 }
 
 func (p *Page) IsLeafPage() bool {
-	return p.flags == LeafPageFlag
+	return p.flags&^PrefixCompressedPageFlag == LeafPageFlag
+}
+
+// IsPrefixCompressed returns true if the keys of the page are stored without
+// the prefix they share.
+func (p *Page) IsPrefixCompressed() bool {
+	return p.flags&PrefixCompressedPageFlag != 0
 }
 
 func (p *Page) IsMetaPage() bool {
@@ -74,6 +102,10 @@ func (p *Page) IsFreelistPage() bool {
 	return p.flags == FreelistPageFlag
 }
 
+func (p *Page) IsBlobPage() bool {
+	return p.flags == BlobPageFlag
+}
+
 // Meta returns a pointer to the metadata section of the page.
 func (p *Page) Meta() *Meta {
 	return (*Meta)(UnsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
@@ -85,7 +117,8 @@ func (p *Page) FastCheck(id Pgid) {
 	Assert(p.IsBranchPage() ||
 		p.IsLeafPage() ||
 		p.IsMetaPage() ||
-		p.IsFreelistPage(),
+		p.IsFreelistPage() ||
+		p.IsBlobPage(),
 		"page %v: has unexpected type/flags: %x", p.id, p.flags)
 }
 
@@ -105,6 +138,72 @@ func (p *Page) LeafPageElements() []leafPageElement {
 	return elems
 }
 
+// KeyPrefix returns the prefix elided from the keys of a prefix-compressed
+// page, or nil if the page is not prefix-compressed.
+func (p *Page) KeyPrefix() []byte {
+	if !p.IsPrefixCompressed() {
+		return nil
+	}
+	off := unsafe.Sizeof(*p) + p.PageElementSize()*uintptr(p.count)
+	n := *(*uint32)(UnsafeAdd(unsafe.Pointer(p), off))
+	return UnsafeByteSlice(unsafe.Pointer(p), off+KeyPrefixHeaderSize, 0, int(n))
+}
+
+// LeafPageKey returns the key of the leaf node at index. On a
+// prefix-compressed page the key is rebuilt from the page prefix, in a new
+// slice, rather than pointing into the page; searches should compare the
+// keys with ComparePrefixedKey instead.
+func (p *Page) LeafPageKey(index uint16) []byte {
+	return p.withKeyPrefix(p.LeafPageElement(index).Key())
+}
+
+// BranchPageKey returns the key of the branch node at index, like
+// LeafPageKey.
+func (p *Page) BranchPageKey(index uint16) []byte {
+	return p.withKeyPrefix(p.BranchPageElement(index).Key())
+}
+
+// keySuffixesSize returns the total size of the keys stored on the page,
+// without the page prefix.
+func (p *Page) keySuffixesSize() int {
+	var n int
+	for i := uint16(0); i < p.count; i++ {
+		if p.IsLeafPage() {
+			n += int(p.LeafPageElement(i).ksize)
+		} else {
+			n += int(p.BranchPageElement(i).ksize)
+		}
+	}
+	return n
+}
+
+// withKeyPrefix returns a key stored on the page with the page prefix added
+// back, if any.
+func (p *Page) withKeyPrefix(suffix []byte) []byte {
+	prefix := p.KeyPrefix()
+	if len(prefix) == 0 {
+		return suffix
+	}
+	key := make([]byte, len(prefix)+len(suffix))
+	copy(key, prefix)
+	copy(key[len(prefix):], suffix)
+	return key
+}
+
+// ComparePrefixedKey compares the key made of prefix followed by suffix with
+// key, like bytes.Compare, without building it. It lets the keys of a
+// prefix-compressed page be searched without allocating.
+func ComparePrefixedKey(prefix, suffix, key []byte) int {
+	n := min(len(prefix), len(key))
+	if c := bytes.Compare(prefix[:n], key[:n]); c != 0 {
+		return c
+	}
+	if len(key) < len(prefix) {
+		return 1
+	}
+	return bytes.Compare(suffix, key[len(prefix):])
+}
+
 // BranchPageElement retrieves the branch node by index
 func (p *Page) BranchPageElement(index uint16) *branchPageElement {
 	return (*branchPageElement)(UnsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p),
@@ -240,7 +339,8 @@ func (n *branchPageElement) SetPgid(v Pgid) {
 	n.pgid = v
 }
 
-// Key returns a byte slice of the node key.
+// Key returns a byte slice of the node key, as stored on the page: on a
+// prefix-compressed page it lacks the page prefix, see Page.BranchPageKey.
 func (n *branchPageElement) Key() []byte {
 	return UnsafeByteSlice(unsafe.Pointer(n), 0, int(n.pos), int(n.pos)+int(n.ksize))
 }
@@ -294,7 +394,8 @@ func (n *leafPageElement) SetVsize(v uint32) {
 	n.vsize = v
 }
 
-// Key returns a byte slice of the node key.
+// Key returns a byte slice of the node key, as stored on the page: on a
+// prefix-compressed page it lacks the page prefix, see Page.LeafPageKey.
 func (n *leafPageElement) Key() []byte {
 	i := int(n.pos)
 	j := i + int(n.ksize)
@@ -1,10 +1,12 @@
 package common
 
 import (
+	"bytes"
 	"reflect"
 	"sort"
 	"testing"
 	"testing/quick"
+	"unsafe"
 )
 
 // Ensure that the page type can be returned in human readable format.
@@ -21,11 +23,72 @@ func TestPage_typ(t *testing.T) {
 	if typ := (&Page{flags: FreelistPageFlag}).Typ(); typ != "freelist" {
 		t.Fatalf("exp=freelist; got=%v", typ)
 	}
+	if typ := (&Page{flags: BlobPageFlag}).Typ(); typ != "blob" {
+		t.Fatalf("exp=blob; got=%v", typ)
+	}
 	if typ := (&Page{flags: 20000}).Typ(); typ != "unknown<4e20>" {
 		t.Fatalf("exp=unknown<4e20>; got=%v", typ)
 	}
 }
 
+// Ensure that the keys of a prefix-compressed page are written without their
+// shared prefix and read back in full.
+func TestPage_prefixCompressed(t *testing.T) {
+	if typ := (&Page{flags: LeafPageFlag | PrefixCompressedPageFlag}).Typ(); typ != "leaf" {
+		t.Fatalf("exp=leaf; got=%v", typ)
+	}
+
+	var inodes Inodes
+	for _, k := range []string{"users/1", "users/10", "users/2", "users/"} {
+		var in Inode
+		in.SetKey([]byte(k))
+		in.SetValue([]byte("v" + k))
+		inodes = append(inodes, in)
+	}
+	if prefix := KeyPrefix(inodes); string(prefix) != "users/" {
+		t.Fatalf("exp=users/; got=%q", prefix)
+	}
+
+	buf := make([]byte, 4096)
+	p := (*Page)(unsafe.Pointer(&buf[0]))
+	p.SetFlags(LeafPageFlag | PrefixCompressedPageFlag)
+	p.SetCount(uint16(len(inodes)))
+	off := WriteInodeToPage(inodes, p)
+	if used := UsedSpaceInPage(inodes, p); used != off {
+		t.Fatalf("exp=%d; got=%d", off, used)
+	}
+
+	if !p.IsLeafPage() || !p.IsPrefixCompressed() {
+		t.Fatalf("unexpected page flags: %x", p.Flags())
+	}
+	if prefix := p.KeyPrefix(); string(prefix) != "users/" {
+		t.Fatalf("exp=users/; got=%q", prefix)
+	}
+	if k := p.LeafPageElement(1).Key(); string(k) != "10" {
+		t.Fatalf("exp=10; got=%q", k)
+	}
+	for i, in := range ReadInodeFromPage(p) {
+		if !bytes.Equal(in.Key(), inodes[i].Key()) || !bytes.Equal(in.Value(), inodes[i].Value()) {
+			t.Fatalf("%d: exp=%q/%q; got=%q/%q", i, inodes[i].Key(), inodes[i].Value(), in.Key(), in.Value())
+		}
+	}
+}
+
+// Ensure that comparing a prefixed key matches comparing the full key.
+func TestComparePrefixedKey(t *testing.T) {
+	keys := []string{"", "a", "ab", "abc", "abd", "abcd", "b", "aa"}
+	for _, prefix := range []string{"", "a", "ab"} {
+		for _, suffix := range []string{"", "c", "cd", "a"} {
+			for _, key := range keys {
+				exp := bytes.Compare([]byte(prefix+suffix), []byte(key))
+				if got := ComparePrefixedKey([]byte(prefix), []byte(suffix), []byte(key)); got != exp {
+					t.Fatalf("%q+%q vs %q: exp=%d; got=%d", prefix, suffix, key, exp, got)
+				}
+			}
+		}
+	}
+}
+
 // Ensure that the hexdump debugging function doesn't blow up.
 func TestPage_dump(t *testing.T) {
 	(&Page{id: 256}).hexdump(16)
@@ -12,6 +12,10 @@ const MaxMmapStep = 1 << 30 // 1GB
 // Version represents the data file format version.
 const Version uint32 = 2
 
+// FeatureVersion is the data file format version of the files using a
+// feature flagged in their meta, which older versions cannot read.
+const FeatureVersion uint32 = 3
+
 // Magic represents a marker value to indicate that a file is a Bolt DB.
 const Magic uint32 = 0xED0CDAED
 
@@ -28,9 +32,10 @@ const IgnoreNoSync = runtime.GOOS == "openbsd"
 
 // Default values if not set in a DB instance.
 const (
-	DefaultMaxBatchSize  int = 1000
-	DefaultMaxBatchDelay     = 10 * time.Millisecond
-	DefaultAllocSize         = 16 * 1024 * 1024
+	DefaultMaxBatchSize         int = 1000
+	DefaultMaxBatchDelay            = 10 * time.Millisecond
+	DefaultAllocSize                = 16 * 1024 * 1024
+	DefaultMaxOptimisticRetries     = 10
 )
 
 // DefaultPageSize is the default page size for db which is set to the OS page size.
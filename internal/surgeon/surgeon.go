@@ -1,6 +1,7 @@
 package surgeon
 
 import (
+	"bytes"
 	"fmt"
 
 	"go.etcd.io/bbolt/internal/common"
@@ -68,24 +69,21 @@ func ClearPageElements(path string, pgId common.Pgid, start, end int, abandonFre
 
 	preOverflow := p.Overflow()
 
-	var (
-		dataWritten uint32
-	)
-	if end == int(p.Count()) || end == -1 {
-		inodes := common.ReadInodeFromPage(p)
-		inodes = inodes[:start]
-
-		p.SetCount(uint16(start))
-		// no need to write inode & data again, we just need to get
-		// the data size which will be kept.
-		dataWritten = common.UsedSpaceInPage(inodes, p)
-	} else {
-		inodes := common.ReadInodeFromPage(p)
-		inodes = append(inodes[:start], inodes[end:]...)
+	if end == -1 {
+		end = elementCnt
+	}
+	inodes := common.ReadInodeFromPage(p)
+	inodes = append(inodes[:start], inodes[end:]...)
 
-		p.SetCount(uint16(len(inodes)))
-		dataWritten = common.WriteInodeToPage(inodes, p)
+	// The page is always written again, as the key prefix of a compressed
+	// page follows the elements. The keys and values are copied first, as
+	// they may point to the bytes being overwritten.
+	for i := range inodes {
+		inodes[i].SetKey(bytes.Clone(inodes[i].Key()))
+		inodes[i].SetValue(bytes.Clone(inodes[i].Value()))
 	}
+	p.SetCount(uint16(len(inodes)))
+	dataWritten := common.WriteInodeToPage(inodes, p)
 
 	pageSize, _, err := guts_cli.ReadPageAndHWMSize(path)
 	if err != nil {
@@ -5,9 +5,12 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	bolt "go.etcd.io/bbolt"
 	"go.etcd.io/bbolt/internal/btesting"
+	"go.etcd.io/bbolt/internal/common"
+	"go.etcd.io/bbolt/internal/guts_cli"
 	"go.etcd.io/bbolt/internal/surgeon"
 )
 
@@ -55,3 +58,46 @@ func TestRevertMetaPage(t *testing.T) {
 				return nil
 			}))
 }
+
+// Ensure that clearing the last elements of a prefix-compressed leaf page
+// writes the key prefix of the remaining ones after their elements.
+func TestClearPageElements_KeyPrefixCompression(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, KeyPrefixCompression: true})
+	assert.NoError(t,
+		db.Fill([]byte("data"), 1, 100,
+			func(tx int, k int) []byte { return []byte(fmt.Sprintf("tenant/0001/events/%04d", k)) },
+			func(tx int, k int) []byte { return make([]byte, 100) },
+		))
+	var root common.Pgid
+	assert.NoError(t, db.View(func(tx *bolt.Tx) error {
+		root = tx.Bucket([]byte("data")).RootPage()
+		return nil
+	}))
+	db.Close()
+
+	// Clear all the keys of the first leaf but two.
+	p, _, err := guts_cli.ReadPage(db.Path(), uint64(root))
+	require.NoError(t, err)
+	require.True(t, p.IsBranchPage())
+	leaf := p.BranchPageElement(0).Pgid()
+	p, _, err = guts_cli.ReadPage(db.Path(), uint64(leaf))
+	require.NoError(t, err)
+	require.True(t, p.IsPrefixCompressed())
+	require.Greater(t, int(p.Count()), 2)
+	_, err = surgeon.ClearPageElements(db.Path(), leaf, 2, -1, false)
+	require.NoError(t, err)
+
+	p, _, err = guts_cli.ReadPage(db.Path(), uint64(leaf))
+	require.NoError(t, err)
+	require.Equal(t, uint16(2), p.Count())
+	require.Equal(t, []byte("tenant/0001/events/000"), p.KeyPrefix())
+	require.Equal(t, []byte("tenant/0001/events/0001"), p.LeafPageKey(1))
+
+	db.MustReopen()
+	assert.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("data"))
+		assert.Equal(t, make([]byte, 100), b.Get([]byte("tenant/0001/events/0001")))
+		assert.Nil(t, b.Get([]byte("tenant/0001/events/0002")))
+		return nil
+	}))
+}
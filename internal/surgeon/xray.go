@@ -85,7 +85,7 @@ func (n XRay) FindPathsToKey(key []byte) ([][]common.Pgid, error) {
 		func(page *common.Page, stack []common.Pgid) error {
 			if page.Typ() == "leaf" {
 				for i := uint16(0); i < page.Count(); i++ {
-					if bytes.Equal(page.LeafPageElement(i).Key(), key) {
+					if bytes.Equal(page.LeafPageKey(i), key) {
 						var copyPath []common.Pgid
 						copyPath = append(copyPath, stack...)
 						found = append(found, copyPath)
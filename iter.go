@@ -0,0 +1,121 @@
+//go:build go1.23
+
+package bbolt
+
+import (
+	"bytes"
+	"iter"
+
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// All returns an iterator over the key/value pairs of the bucket in key
+// order. Nested buckets are yielded with a nil value.
+//
+// See Cursor.Seq for the behavior when the loop body modifies the bucket.
+func (b *Bucket) All() iter.Seq2[[]byte, []byte] {
+	return b.Cursor().Seq(nil)
+}
+
+// Keys returns an iterator over the keys of the bucket in key order,
+// including the names of nested buckets.
+func (b *Bucket) Keys() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		b.Cursor().walk(nil, func(k, _ []byte, _ uint32) bool {
+			return yield(k)
+		})
+	}
+}
+
+// Buckets returns an iterator over the nested buckets of the bucket,
+// yielding the name and the bucket itself.
+func (b *Bucket) Buckets() iter.Seq2[[]byte, *Bucket] {
+	return func(yield func([]byte, *Bucket) bool) {
+		b.Cursor().walk(nil, func(k, _ []byte, flags uint32) bool {
+			if flags&common.BucketLeafFlag == 0 {
+				return true
+			}
+			return yield(k, b.Bucket(k))
+		})
+	}
+}
+
+// Buckets returns an iterator over the top-level buckets, yielding the name
+// and the bucket itself.
+func (tx *Tx) Buckets() iter.Seq2[[]byte, *Bucket] {
+	return func(yield func([]byte, *Bucket) bool) {
+		for k, b := range tx.root.Buckets() {
+			if tx.inScope(k) && !yield(k, b) {
+				return
+			}
+		}
+	}
+}
+
+// Seq returns an iterator over the key/value pairs of the bucket starting at
+// from, or at the first key after it if from does not exist. A nil from
+// starts at the first key. Nested buckets are yielded with a nil value.
+//
+// The cursor is positioned on the yielded key while the loop body runs, so
+// the body may call Cursor.Delete to remove it. In a writable transaction the
+// body may also put or delete other keys; iteration always resumes at the
+// first key greater than the one last yielded, as seen after the body ran.
+func (c *Cursor) Seq(from []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		c.walk(from, func(k, v []byte, flags uint32) bool {
+			return yield(k, c.value(v, flags))
+		})
+	}
+}
+
+// walk calls fn for every element from the given key onwards until fn
+// returns false.
+func (c *Cursor) walk(from []byte, fn func(k, v []byte, flags uint32) bool) {
+	common.Assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.opt.scan(c.bucket)
+
+	var k, v []byte
+	var flags uint32
+	if from == nil {
+		k, v, flags = c.skipNext(c.first())
+	} else {
+		k, v, flags = c.skipNext(c.seekNext(from))
+	}
+
+	for k != nil {
+		// Read-only transactions cannot change the bucket under us.
+		if !c.bucket.Writable() {
+			if !fn(k, v, flags) {
+				return
+			}
+			k, v, flags = c.skipNext(c.next())
+			continue
+		}
+
+		last := cloneBytes(k)
+		if !fn(k, v, flags) {
+			return
+		}
+
+		// The callback may have deleted or inserted keys, shifting or
+		// materializing the node under the cursor, so search again from
+		// the last key we returned.
+		k, v, flags = c.seekNext(last)
+		if k != nil && bytes.Equal(k, last) {
+			k, v, flags = c.next()
+		}
+		k, v, flags = c.skipNext(k, v, flags)
+	}
+}
+
+// All returns an iterator over the key/value pairs of the range, suitable
+// for use with a range-over-func loop. Stopping the loop early is supported.
+func (it *RangeIterator) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for k, v := it.First(); k != nil; k, v = it.Next() {
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+//go:build go1.23
+
+package bbolt_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+func TestRangeIterator_All(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%02d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+
+		var got []string
+		for k, v := range b.Range(bolt.RangeOptions{Start: []byte("03"), End: []byte("07"), Reverse: true}).All() {
+			got = append(got, string(k)+"="+string(v))
+		}
+		require.Equal(t, []string{"06=v6", "05=v5", "04=v4", "03=v3"}, got)
+
+		// Breaking out of the loop stops the iteration.
+		got = got[:0]
+		for k := range b.Range(bolt.RangeOptions{}).All() {
+			if len(got) == 2 {
+				break
+			}
+			got = append(got, string(k))
+		}
+		require.Equal(t, []string{"00", "01"}, got)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBucket_All(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("0000")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("baz"), []byte("0001")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket([]byte("bar")); err != nil {
+			return err
+		}
+		_, err = b.CreateBucket([]byte("qux"))
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+
+		var all []string
+		for k, v := range b.All() {
+			all = append(all, fmt.Sprintf("%s=%s", k, v))
+		}
+		require.Equal(t, []string{"bar=", "baz=0001", "foo=0000", "qux="}, all)
+
+		var keys []string
+		for k := range b.Keys() {
+			keys = append(keys, string(k))
+		}
+		require.Equal(t, []string{"bar", "baz", "foo", "qux"}, keys)
+
+		var buckets []string
+		for name, child := range b.Buckets() {
+			require.NotNil(t, child)
+			buckets = append(buckets, string(name))
+		}
+		require.Equal(t, []string{"bar", "qux"}, buckets)
+
+		var from []string
+		for k := range b.Cursor().Seq([]byte("bat")) {
+			from = append(from, string(k))
+		}
+		require.Equal(t, []string{"baz", "foo", "qux"}, from)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTx_Buckets(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"foo", "bar", "baz"} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		var names []string
+		for name, b := range tx.Buckets() {
+			require.NotNil(t, b)
+			if string(name) == "baz" {
+				break
+			}
+			names = append(names, string(name))
+		}
+		require.Equal(t, []string{"bar"}, names)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that deleting keys from within the loop body neither skips nor
+// repeats any key, regardless of how many pages the bucket spans.
+func TestCursor_Seq_Delete(t *testing.T) {
+	for _, every := range []int{1, 2, 3} {
+		t.Run(fmt.Sprintf("every %d", every), func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+			const n = 1000
+			err := db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				for i := 0; i < n; i++ {
+					if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 64)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+
+			err = db.Update(func(tx *bolt.Tx) error {
+				c := tx.Bucket([]byte("widgets")).Cursor()
+				i := 0
+				for k := range c.Seq(nil) {
+					require.Equal(t, fmt.Sprintf("%04d", i), string(k))
+					if i%every == 0 {
+						require.NoError(t, c.Delete())
+					}
+					i++
+				}
+				require.Equal(t, n, i)
+				return nil
+			})
+			require.NoError(t, err)
+
+			err = db.View(func(tx *bolt.Tx) error {
+				var remaining int
+				for k := range tx.Bucket([]byte("widgets")).Keys() {
+					var i int
+					_, err := fmt.Sscanf(string(k), "%04d", &i)
+					require.NoError(t, err)
+					require.NotZero(t, i%every)
+					remaining++
+				}
+				require.Equal(t, n-(n+every-1)/every, remaining)
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+// Ensure that keys put from within the loop body are visited if they sort
+// after the current key.
+func TestBucket_All_Put(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"b", "d", "f"} {
+			if err := b.Put([]byte(k), nil); err != nil {
+				return err
+			}
+		}
+
+		var seen []string
+		for k := range b.All() {
+			seen = append(seen, string(k))
+			switch string(k) {
+			case "b":
+				require.NoError(t, b.Put([]byte("a"), nil))
+				require.NoError(t, b.Put([]byte("c"), nil))
+			case "d":
+				require.NoError(t, b.Delete([]byte("f")))
+				require.NoError(t, b.Put([]byte("e"), nil))
+			}
+		}
+		require.Equal(t, []string{"b", "c", "d", "e"}, seen)
+		return nil
+	})
+	require.NoError(t, err)
+}
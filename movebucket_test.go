@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"go.etcd.io/bbolt"
 	"go.etcd.io/bbolt/errors"
@@ -216,6 +217,27 @@ func TestTx_MoveBucket(t *testing.T) {
 	}
 }
 
+// Ensure that moving an internal bucket, or moving a bucket under a reserved
+// name, returns an error.
+func TestTx_MoveBucket_ErrBucketNameReserved(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bbolt.Tx) error {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, widgets.PutWithTTL([]byte("foo"), []byte("bar"), time.Hour))
+		require.ErrorIs(t, tx.MoveBucket([]byte("\x00bbolt-ttl"), widgets, nil), errors.ErrBucketNameReserved)
+
+		gadgets, err := tx.CreateBucket([]byte("gadgets"))
+		require.NoError(t, err)
+		require.ErrorIs(t, tx.MoveBucket([]byte("\x00bbolt-ttl"), widgets, gadgets), errors.ErrBucketNameReserved)
+		require.ErrorIs(t, tx.MoveBucket([]byte("\x00bbolt-snapshots"), nil, gadgets), errors.ErrBucketNameReserved)
+		require.Equal(t, []byte("bar"), widgets.Get([]byte("foo")))
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
 func TestBucket_MoveBucket_DiffDB(t *testing.T) {
 	srcBucketPath := []string{"sb1", "sb2"}
 	dstBucketPath := []string{"db1", "db2"}
@@ -44,6 +44,9 @@ func (n *node) size() int {
 		item := &n.inodes[i]
 		sz += elsz + uintptr(len(item.Key())) + uintptr(len(item.Value()))
 	}
+	if prefixLen := n.keyPrefixLen(); prefixLen > 0 {
+		sz -= uintptr(common.KeyPrefixSaving(len(n.inodes), prefixLen))
+	}
 	return int(sz)
 }
 
@@ -51,6 +54,10 @@ func (n *node) size() int {
 // This is an optimization to avoid calculating a large node when we only need
 // to know if it fits inside a certain page size.
 func (n *node) sizeLessThan(v uintptr) bool {
+	if n.prefixCompression() {
+		// The size depends on the prefix shared by all the keys.
+		return uintptr(n.size()) < v
+	}
 	sz, elsz := common.PageHeaderSize, n.pageElementSize()
 	for i := 0; i < len(n.inodes); i++ {
 		item := &n.inodes[i]
@@ -62,6 +69,26 @@ func (n *node) sizeLessThan(v uintptr) bool {
 	return true
 }
 
+// prefixCompression returns true if the node is written on prefix-compressed
+// pages when it is worth it. The root node of a new inline bucket has no
+// bucket yet, nor any key.
+func (n *node) prefixCompression() bool {
+	return n.bucket != nil && n.bucket.tx.db.keyPrefixCompression
+}
+
+// keyPrefixLen returns the length of the prefix elided from the keys when the
+// node is written, or zero if its page is not prefix-compressed.
+func (n *node) keyPrefixLen() int {
+	if !n.prefixCompression() {
+		return 0
+	}
+	prefixLen := len(common.KeyPrefix(n.inodes))
+	if common.KeyPrefixSaving(len(n.inodes), prefixLen) <= 0 {
+		return 0
+	}
+	return prefixLen
+}
+
 // pageElementSize returns the size of each page element based on the type of node.
 func (n *node) pageElementSize() uintptr {
 	if n.isLeaf {
@@ -80,7 +107,7 @@ func (n *node) childAt(index int) *node {
 
 // childIndex returns the index of a given child node.
 func (n *node) childIndex(child *node) int {
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].Key(), child.key) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.compareKeys(n.inodes[i].Key(), child.key) >= 0 })
 	return index
 }
 
@@ -124,7 +151,7 @@ func (n *node) put(oldKey, newKey, value []byte, pgId common.Pgid, flags uint32)
 	}
 
 	// Find insertion index.
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].Key(), oldKey) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.compareKeys(n.inodes[i].Key(), oldKey) >= 0 })
 
 	// Add capacity and shift nodes if we don't have an exact match and need to insert.
 	exact := len(n.inodes) > 0 && index < len(n.inodes) && bytes.Equal(n.inodes[index].Key(), oldKey)
@@ -133,6 +160,10 @@ func (n *node) put(oldKey, newKey, value []byte, pgId common.Pgid, flags uint32)
 		copy(n.inodes[index+1:], n.inodes[index:])
 	}
 
+	if f := common.ElementMetaFlags(flags); f != 0 {
+		n.bucket.tx.meta.SetFeatureFlags(f)
+	}
+
 	inode := &n.inodes[index]
 	inode.SetFlags(flags)
 	inode.SetKey(newKey)
@@ -144,7 +175,7 @@ func (n *node) put(oldKey, newKey, value []byte, pgId common.Pgid, flags uint32)
 // del removes a key from the node.
 func (n *node) del(key []byte) {
 	// Find index of key.
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].Key(), key) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.compareKeys(n.inodes[i].Key(), key) >= 0 })
 
 	// Exit if the key isn't found.
 	if index >= len(n.inodes) || !bytes.Equal(n.inodes[index].Key(), key) {
@@ -185,6 +216,10 @@ func (n *node) write(p *common.Page) {
 	} else {
 		p.SetFlags(common.BranchPageFlag)
 	}
+	if n.keyPrefixLen() > 0 {
+		p.SetFlags(p.Flags() | common.PrefixCompressedPageFlag)
+		n.bucket.tx.meta.SetFeatureFlags(common.MetaKeyPrefixFlag)
+	}
 
 	if len(n.inodes) >= 0xFFFF {
 		panic(fmt.Sprintf("inode overflow: %d (pgid=%d)", len(n.inodes), p.Id()))
@@ -271,20 +306,40 @@ func (n *node) splitTwo(pageSize uintptr) (*node, *node) {
 func (n *node) splitIndex(threshold int) (index, sz uintptr) {
 	sz = common.PageHeaderSize
 
+	// With prefix compression, the size of the first page is its size
+	// without compression less the saving of the prefix shared by its keys.
+	compress := n.prefixCompression()
+	var raw uintptr
+	var prefix []byte
+
 	// Loop until we only have the minimum number of keys required for the second page.
 	for i := 0; i < len(n.inodes)-common.MinKeysPerPage; i++ {
 		index = uintptr(i)
 		inode := n.inodes[i]
 		elsize := n.pageElementSize() + uintptr(len(inode.Key())) + uintptr(len(inode.Value()))
 
+		next := sz + elsize
+		if compress {
+			if i == 0 {
+				prefix = inode.Key()
+			} else {
+				prefix = prefix[:common.SharedPrefixLen(prefix, inode.Key())]
+			}
+			next = common.PageHeaderSize + raw + elsize
+			if saving := common.KeyPrefixSaving(i+1, len(prefix)); saving > 0 {
+				next -= uintptr(saving)
+			}
+		}
+
 		// If we have at least the minimum number of keys and adding another
 		// node would put us over the threshold then exit and return.
-		if index >= common.MinKeysPerPage && sz+elsize > uintptr(threshold) {
+		if index >= common.MinKeysPerPage && next > uintptr(threshold) {
 			break
 		}
 
 		// Add the element size to the total size.
-		sz += elsize
+		raw += elsize
+		sz = next
 	}
 
 	return
@@ -312,16 +367,17 @@ func (n *node) spill() error {
 	n.children = nil
 
 	// Split nodes into appropriate sizes. The first node will always be n.
-	var nodes = n.split(uintptr(tx.db.pageSize))
+	// The end of each page is reserved for the cipher overhead, if any.
+	var nodes = n.split(uintptr(tx.db.pageSize - tx.db.pageOverhead()))
 	for _, node := range nodes {
 		// Add node's page to the freelist if it's not new.
 		if node.pgid > 0 {
-			tx.db.freelist.free(tx.meta.Txid(), tx.page(node.pgid))
+			tx.freePage(tx.page(node.pgid))
 			node.pgid = 0
 		}
 
 		// Allocate contiguous space for the node.
-		p, err := tx.allocate((node.size() + tx.db.pageSize - 1) / tx.db.pageSize)
+		p, err := tx.allocate((node.size() + tx.db.pageOverhead() + tx.db.pageSize - 1) / tx.db.pageSize)
 		if err != nil {
 			return err
 		}
@@ -493,7 +549,7 @@ func (n *node) dereference() {
 // free adds the node's underlying page to the freelist.
 func (n *node) free() {
 	if n.pgid != 0 {
-		n.bucket.tx.db.freelist.free(n.bucket.tx.meta.Txid(), n.bucket.tx.page(n.pgid))
+		n.bucket.tx.freePage(n.bucket.tx.page(n.pgid))
 		n.pgid = 0
 	}
 }
@@ -525,14 +581,10 @@ func (n *node) dump() {
 }
 */
 
-func compareKeys(left, right []byte) int {
-	return bytes.Compare(left, right)
-}
-
 type nodes []*node
 
 func (s nodes) Len() int      { return len(s) }
 func (s nodes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 func (s nodes) Less(i, j int) bool {
-	return bytes.Compare(s[i].inodes[0].Key(), s[j].inodes[0].Key()) == -1
+	return s[i].bucket.compareKeys(s[i].inodes[0].Key(), s[j].inodes[0].Key()) < 0
 }
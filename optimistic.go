@@ -0,0 +1,387 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// OptimisticUpdate executes a function within the context of a read-write
+// managed transaction without holding the writer lock while it runs. The
+// function works on the last committed state; the keys, nested buckets and
+// sequences it reads, the buckets it iterates, and the changes it makes are
+// recorded.
+//
+// Once the function returns, the writer lock is obtained and the reads are
+// checked against the current state. If any of them changed meanwhile, the
+// function is run again on the new state, up to DB.MaxOptimisticRetries
+// times, after which ErrTxConflict is returned. Otherwise the recorded
+// changes are applied and committed. Iterating a bucket conflicts with any
+// change to it or to its nested buckets, while reading a key only conflicts
+// with a change to that key. A change which can no longer be made, because
+// the bucket it creates now exists or the bucket or value it writes to was
+// deleted or replaced, conflicts too; other errors are returned as is.
+//
+// The function may be called several times, so it must be idempotent and
+// only have side effects through the transaction and Tx.OnCommit.
+//
+// Attempting to manually commit or rollback within the function will cause a
+// panic.
+func (db *DB) OptimisticUpdate(fn func(*Tx) error) error {
+	if db.readOnly || db.follower {
+		return berrors.ErrDatabaseReadOnly
+	}
+	for retries := 0; ; retries++ {
+		err := db.optimisticUpdate(fn)
+		if !errors.Is(err, berrors.ErrTxConflict) || retries >= db.MaxOptimisticRetries {
+			return err
+		}
+	}
+}
+
+// optimisticUpdate makes a single attempt of OptimisticUpdate.
+func (db *DB) optimisticUpdate(fn func(*Tx) error) (err error) {
+	t, err := db.beginSnapshotTx(&Tx{writable: true, opt: &optimisticLog{}})
+	if err != nil {
+		return err
+	}
+
+	// Make sure the transaction is discarded in the event of a panic.
+	mapped := true
+	defer func() {
+		if mapped {
+			t.discard()
+			return
+		}
+		db.untrackTx(t)
+		t.clear()
+	}()
+	// Mark as a managed tx so that the inner function cannot manually commit.
+	t.managed = true
+	err = fn(t)
+	t.managed = false
+	if terr := t.Err(); terr != nil {
+		err = terr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Evaluate the reads against the snapshot, which is left untouched by
+	// the changes of the transaction.
+	l := t.opt
+	snapshot := t.snapshot()
+	for i := range l.reads {
+		l.reads[i].value = l.reads[i].eval(&snapshot.root)
+	}
+	if err := snapshot.Err(); err != nil {
+		return err
+	}
+	handlers := t.commitHandlers
+
+	// The writer may need to remap the database, which waits for the read
+	// lock to be released. The transaction stays tracked until the reads are
+	// validated, so that the pages of the snapshot are not reused meanwhile
+	// and an unchanged bucket value means an unchanged bucket.
+	db.mmaplock.RUnlock()
+	mapped = false
+
+	if len(l.writes) == 0 {
+		for _, fn := range handlers {
+			fn()
+		}
+		return nil
+	}
+
+	tx, err := db.beginRWTx()
+	if err != nil {
+		return err
+	}
+
+	// Make sure the transaction rolls back in the event of a panic.
+	defer func() {
+		if tx.db != nil {
+			tx.rollback()
+		}
+	}()
+
+	if err := tx.replay(l); err != nil {
+		return tx.rollbackAfter(err)
+	}
+	tx.commitHandlers = handlers
+	return tx.Commit()
+}
+
+// snapshot returns a read-only view of the state a transaction started from.
+func (tx *Tx) snapshot() *Tx {
+	t := &Tx{db: tx.db, meta: tx.meta}
+	t.root = newBucket(t)
+	t.root.InBucket = tx.meta.RootBucket()
+	return t
+}
+
+// clear closes a transaction that is no longer tracked.
+func (tx *Tx) clear() {
+	tx.db = nil
+	tx.meta = nil
+	tx.root = Bucket{tx: tx}
+	tx.pages = nil
+	tx.freed = nil
+}
+
+// replay checks that the reads of an optimistic transaction still have the
+// same values, then makes its changes again in the transaction.
+func (tx *Tx) replay(l *optimisticLog) error {
+	for i := range l.reads {
+		r := &l.reads[i]
+		if !bytes.Equal(r.eval(&tx.root), r.value) {
+			return berrors.ErrTxConflict
+		}
+	}
+
+	for _, w := range l.writes {
+		b := tx.root.bucketAt(w.path)
+		if b == nil {
+			return berrors.ErrTxConflict
+		}
+		var err error
+		switch w.op {
+		case opPut:
+			err = b.putValue(w.key, w.value, w.expires, w.blob, nil)
+		case opDelete:
+			err = b.Delete(w.key)
+		case opCreateBucket:
+			_, err = b.CreateBucketWithOptions(w.key, w.opts)
+		case opDeleteBucket:
+			err = b.DeleteBucket(w.key)
+		case opMoveBucket:
+			dst := tx.root.bucketAt(w.dst)
+			if dst == nil {
+				return berrors.ErrTxConflict
+			}
+			err = b.MoveBucket(w.key, dst)
+		case opSetSequence:
+			err = b.SetSequence(w.seq)
+		case opCreateIndex:
+			err = b.CreateIndex(w.key, w.extractor)
+		case opDeleteIndex:
+			err = b.DeleteIndex(w.key)
+		case opWriteValue:
+			var h *ValueHandle
+			if h, err = b.OpenValue(w.key); err == nil {
+				_, err = h.WriteAt(w.value, w.off)
+			}
+		}
+		if err != nil {
+			// The reads were unchanged, so a change failing on the state
+			// of the keys or buckets it writes was valid on the snapshot
+			// but is no longer. Other errors are returned as is.
+			if errors.Is(err, berrors.ErrBucketExists) ||
+				errors.Is(err, berrors.ErrBucketNotFound) ||
+				errors.Is(err, berrors.ErrIncompatibleValue) {
+				return berrors.ErrTxConflict
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketAt returns the nested bucket at the given path, or nil if it does
+// not exist.
+func (b *Bucket) bucketAt(path []string) *Bucket {
+	for _, name := range path {
+		if b = b.Bucket([]byte(name)); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// optimisticLog records the reads and the changes of a transaction started
+// by OptimisticUpdate. All its methods do nothing on a nil log, so that they
+// can be called from any transaction.
+type optimisticLog struct {
+	reads   []optimisticRead
+	writes  []optimisticWrite
+	seen    map[string]struct{}  // reads already recorded
+	written map[string]struct{}  // reads that would see a change of the tx
+	scanned map[*Bucket]struct{} // buckets already iterated
+}
+
+type readKind uint8
+
+const (
+	readEntry    readKind = iota // a key or a nested bucket
+	readScan                     // the whole bucket
+	readSequence                 // the sequence of the bucket
+)
+
+// optimisticRead is a read whose value must be unchanged at commit time.
+type optimisticRead struct {
+	kind  readKind
+	path  []string
+	key   []byte
+	value []byte // the value in the snapshot
+}
+
+type writeOp uint8
+
+const (
+	opPut writeOp = iota
+	opDelete
+	opCreateBucket
+	opDeleteBucket
+	opMoveBucket
+	opSetSequence
+	opCreateIndex
+	opDeleteIndex
+	opWriteValue
+)
+
+// optimisticWrite is a change replayed at commit time.
+type optimisticWrite struct {
+	op    writeOp
+	path  []string
+	key   []byte
+	value []byte
+	opts  BucketOptions
+	dst   []string
+	seq   uint64
+
+	// expires is the expiry time of a put key, in Unix nanoseconds, or
+	// zero if it does not expire.
+	expires int64
+
+	// extractor is the name of the extractor of a created index.
+	extractor string
+
+	// blob is set if a put value is stored in a blob whatever its size.
+	blob bool
+
+	// off is the offset of a value written through a ValueHandle.
+	off int64
+}
+
+// readID identifies a read of a bucket.
+func readID(kind readKind, path []string, key []byte) string {
+	return fmt.Sprintf("%d%q%q", kind, path, key)
+}
+
+// read records that the transaction read a key, or a nested bucket, of b.
+func (l *optimisticLog) read(b *Bucket, key []byte) {
+	if l != nil {
+		l.record(readEntry, b.path(), key)
+	}
+}
+
+// scan records that the transaction iterated over b.
+func (l *optimisticLog) scan(b *Bucket) {
+	if l == nil {
+		return
+	}
+	if _, ok := l.scanned[b]; ok {
+		return
+	}
+	if l.scanned == nil {
+		l.scanned = make(map[*Bucket]struct{})
+	}
+	l.scanned[b] = struct{}{}
+	l.record(readScan, b.path(), nil)
+}
+
+// readSequence records that the transaction read the sequence of b.
+func (l *optimisticLog) readSequence(b *Bucket) {
+	if l != nil {
+		l.record(readSequence, b.path(), nil)
+	}
+}
+
+func (l *optimisticLog) record(kind readKind, path []string, key []byte) {
+	id := readID(kind, path, key)
+	if _, ok := l.written[id]; ok {
+		// The transaction reads its own change.
+		return
+	}
+	if _, ok := l.seen[id]; ok {
+		return
+	}
+	if l.seen == nil {
+		l.seen = make(map[string]struct{})
+	}
+	l.seen[id] = struct{}{}
+	l.reads = append(l.reads, optimisticRead{kind: kind, path: path, key: cloneBytes(key)})
+}
+
+// write records a change to b. The key and value are copied.
+func (l *optimisticLog) write(b *Bucket, w optimisticWrite) {
+	if l == nil {
+		return
+	}
+	w.path = b.path()
+	w.key = cloneBytes(w.key)
+	if w.value != nil {
+		w.value = cloneBytes(w.value)
+	}
+	l.wrote(w.path, w.op, w.key)
+	if w.op == opMoveBucket {
+		l.wrote(w.dst, w.op, w.key)
+	}
+	l.writes = append(l.writes, w)
+}
+
+func (l *optimisticLog) wrote(path []string, op writeOp, key []byte) {
+	if l.written == nil {
+		l.written = make(map[string]struct{})
+	}
+	if op == opSetSequence {
+		l.written[readID(readSequence, path, nil)] = struct{}{}
+		return
+	}
+	l.written[readID(readEntry, path, key)] = struct{}{}
+}
+
+// eval returns the value of the read in the tree of the given root bucket,
+// or nil if the bucket it reads does not exist.
+func (r *optimisticRead) eval(root *Bucket) []byte {
+	if r.kind == readScan && len(r.path) > 0 {
+		// Any change to a bucket changes its value in its parent.
+		parent := root.bucketAt(r.path[:len(r.path)-1])
+		if parent == nil {
+			return nil
+		}
+		return parent.bucketValue([]byte(r.path[len(r.path)-1]))
+	}
+
+	b := root.bucketAt(r.path)
+	if b == nil {
+		return nil
+	}
+	switch r.kind {
+	case readScan:
+		// The root bucket has no value; iterating over it only reads the
+		// names of the top-level buckets.
+		names := []byte{}
+		c := b.Cursor()
+		for k, _, _ := c.first(); k != nil; k, _, _ = c.next() {
+			names = binary.AppendUvarint(names, uint64(len(k)))
+			names = append(names, k...)
+		}
+		return names
+	case readSequence:
+		return binary.BigEndian.AppendUint64(nil, b.Sequence())
+	}
+
+	k, v, flags := b.Cursor().seek(r.key)
+	switch {
+	case !bytes.Equal(k, r.key):
+		return []byte{0}
+	case flags&common.BucketLeafFlag != 0:
+		return []byte{1}
+	}
+	return append([]byte{2}, v...)
+}
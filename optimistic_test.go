@@ -0,0 +1,255 @@
+package bbolt_test
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// Ensure that the changes made by OptimisticUpdate are committed and that the
+// commit handlers are called.
+func TestDB_OptimisticUpdate(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	var committed bool
+	err := db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("baz")); err != nil {
+			return err
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if _, err := child.NextSequence(); err != nil {
+			return err
+		}
+		tx.OnCommit(func() { committed = true })
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, committed)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("bar"), b.Get([]byte("foo")))
+		require.Nil(t, b.Get([]byte("baz")))
+		require.Equal(t, uint64(1), b.Bucket([]byte("child")).Sequence())
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that OptimisticUpdate runs the function again when a key it read is
+// changed meanwhile, but not when another key of the bucket is.
+func TestDB_OptimisticUpdate_Conflict(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("0"))
+	})
+	require.NoError(t, err)
+
+	for _, key := range []string{"foo", "other"} {
+		t.Run(key, func(t *testing.T) {
+			var calls int
+			err := db.OptimisticUpdate(func(tx *bolt.Tx) error {
+				calls++
+				b := tx.Bucket([]byte("widgets"))
+				v := b.Get([]byte("foo"))
+				if calls == 1 {
+					// Update does not wait for OptimisticUpdate functions to
+					// return.
+					err := db.Update(func(tx *bolt.Tx) error {
+						return tx.Bucket([]byte("widgets")).Put([]byte(key), []byte("1"))
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return b.Put([]byte("copy"), v)
+			})
+			require.NoError(t, err)
+
+			err = db.View(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				require.Equal(t, b.Get([]byte("foo")), b.Get([]byte("copy")))
+				return nil
+			})
+			require.NoError(t, err)
+			if key == "foo" {
+				require.Equal(t, 2, calls)
+			} else {
+				require.Equal(t, 1, calls)
+			}
+		})
+	}
+}
+
+// Ensure that iterating over a bucket conflicts with any change to it.
+func TestDB_OptimisticUpdate_ScanConflict(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	})
+	require.NoError(t, err)
+
+	var calls int
+	err = db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		calls++
+		b := tx.Bucket([]byte("widgets"))
+		var n int
+		if err := b.ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			return err
+		}
+		if calls == 1 {
+			err := db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return b.SetSequence(uint64(n))
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, uint64(1), tx.Bucket([]byte("widgets")).Sequence())
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that OptimisticUpdate returns ErrTxConflict, without committing
+// anything, once the retries are exhausted.
+func TestDB_OptimisticUpdate_MaxRetries(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	db.MaxOptimisticRetries = 2
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	})
+	require.NoError(t, err)
+
+	var calls int
+	err = db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		calls++
+		b := tx.Bucket([]byte("widgets"))
+		b.Get([]byte("foo"))
+		if err := b.Put([]byte("mine"), []byte("value")); err != nil {
+			return err
+		}
+		return db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte{byte(calls)})
+		})
+	})
+	require.ErrorIs(t, err, berrors.ErrTxConflict)
+	require.Equal(t, 3, calls)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("widgets")).Get([]byte("mine")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a change failing on replay for a reason other than a conflict
+// returns its error rather than ErrTxConflict, and is not retried.
+func TestDB_OptimisticUpdate_ReplayError(t *testing.T) {
+	// The function commits while its snapshot is open, so the database
+	// must not be remapped.
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		IndexExtractors: indexOptions.IndexExtractors,
+		InitialMmapSize: 1 << 20,
+	})
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	})
+	require.NoError(t, err)
+
+	large := strings.Repeat("x", bolt.MaxKeySize)
+	var calls int
+	err = db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		calls++
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte(large)); err != nil {
+			return err
+		}
+		return db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).CreateIndex([]byte("tags"), "tags")
+		})
+	})
+	require.ErrorIs(t, err, berrors.ErrIndexKeyTooLarge)
+	require.Equal(t, 1, calls)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that concurrent read-modify-write OptimisticUpdate calls on the same
+// key do not lose updates.
+func TestDB_OptimisticUpdate_Counter(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	db.MaxOptimisticRetries = 1000
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("counters"))
+		return err
+	})
+	require.NoError(t, err)
+
+	const writers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				err := db.OptimisticUpdate(func(tx *bolt.Tx) error {
+					b := tx.Bucket([]byte("counters"))
+					var n uint64
+					if v := b.Get([]byte("n")); v != nil {
+						n = binary.BigEndian.Uint64(v)
+					}
+					return b.Put([]byte("n"), binary.BigEndian.AppendUint64(nil, n+1))
+				})
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("counters")).Get([]byte("n"))
+		require.Equal(t, uint64(writers*rounds), binary.BigEndian.Uint64(v))
+		return nil
+	})
+	require.NoError(t, err)
+}
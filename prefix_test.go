@@ -0,0 +1,263 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// prefixKey returns a key sharing a long prefix with the other keys of its
+// tenant.
+func prefixKey(tenant, i int) []byte {
+	return []byte(fmt.Sprintf("tenant/%08d-4b1e-9c3a-7f2d5e8a1b0c/events/%08d", tenant, i))
+}
+
+// fillPrefixed writes n keys of two tenants, a nested bucket and an inline
+// bucket whose keys are their shared prefix and longer.
+func fillPrefixed(t testing.TB, db *bolt.DB, n int) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("events"))
+		if err != nil {
+			return err
+		}
+		for tenant := 0; tenant < 2; tenant++ {
+			for i := 0; i < n; i++ {
+				if err := b.Put(prefixKey(tenant, i), []byte(fmt.Sprintf("value %d", i))); err != nil {
+					return err
+				}
+			}
+		}
+		inline, err := b.CreateBucketIfNotExists([]byte("x-inline"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a", "aa", "aaa", "aab"} {
+			if err := inline.Put([]byte(k), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// verifyPrefixed checks the keys written by fillPrefixed.
+func verifyPrefixed(t testing.TB, db *bolt.DB, n int) {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("events"))
+		c := b.Cursor()
+		k, _ := c.First()
+		for tenant := 0; tenant < 2; tenant++ {
+			for i := 0; i < n; i++ {
+				require.Equal(t, prefixKey(tenant, i), k)
+				k, _ = c.Next()
+			}
+		}
+		require.Equal(t, []byte("x-inline"), k)
+
+		k, v := c.Seek(prefixKey(1, n/2))
+		require.Equal(t, prefixKey(1, n/2), k)
+		require.Equal(t, []byte(fmt.Sprintf("value %d", n/2)), v)
+		k, _ = c.Prev()
+		require.Equal(t, prefixKey(1, n/2-1), k)
+		require.Equal(t, []byte("value 7"), b.Get(prefixKey(0, 7)))
+
+		var keys []string
+		require.NoError(t, b.Bucket([]byte("x-inline")).ForEach(func(k, v []byte) error {
+			require.Empty(t, v)
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"a", "aa", "aaa", "aab"}, keys)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that keys sharing a prefix take less space with prefix compression,
+// and read the same.
+func TestDB_KeyPrefixCompression(t *testing.T) {
+	const n = 2000
+	stats := make(map[bool]bolt.BucketStats)
+	allocs := make(map[bool]float64)
+	for _, compress := range []bool{false, true} {
+		db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, KeyPrefixCompression: compress})
+		fillPrefixed(t, db.DB, n)
+		verifyPrefixed(t, db.DB, n)
+		db.MustCheck()
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("events"))
+			stats[compress] = b.Stats()
+			key := prefixKey(1, n/3)
+			allocs[compress] = testing.AllocsPerRun(100, func() { b.Get(key) })
+			return nil
+		}))
+	}
+	require.Less(t, stats[true].LeafPageN, stats[false].LeafPageN*2/3)
+	require.Equal(t, stats[false].KeyN, stats[true].KeyN)
+
+	// Searching the pages does not build their keys; only the key found is.
+	require.LessOrEqual(t, allocs[true], allocs[false]+1)
+}
+
+// Ensure that the pages written with and without prefix compression can be
+// read and updated either way.
+func TestDB_KeyPrefixCompression_Mixed(t *testing.T) {
+	const n = 1000
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	fillPrefixed(t, db.DB, n)
+
+	for _, compress := range []bool{true, false, true} {
+		db.MustClose()
+		db.SetOptions(&bolt.Options{PageSize: 4096, KeyPrefixCompression: compress})
+		db.MustReopen()
+		verifyPrefixed(t, db.DB, n)
+
+		// Rewrite some of the pages.
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("events"))
+			for i := 0; i < n; i += 97 {
+				if err := b.Put(prefixKey(0, i), []byte(fmt.Sprintf("value %d", i))); err != nil {
+					return err
+				}
+			}
+			return b.Bucket([]byte("x-inline")).Put([]byte("aab"), nil)
+		})
+		require.NoError(t, err)
+		db.MustCheck()
+	}
+	verifyPrefixed(t, db.DB, n)
+}
+
+// Ensure that the keys of a custom order are compressed too.
+func TestDB_KeyPrefixCompression_Comparator(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		PageSize:             4096,
+		KeyPrefixCompression: true,
+		Comparators:          map[string]bolt.Comparator{"reverse": func(a, b []byte) int { return bytes.Compare(b, a) }},
+	})
+	const n = 1000
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("events"), bolt.BucketOptions{Comparator: "reverse"})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := b.Put(prefixKey(0, i), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("events")).Cursor()
+		i := n - 1
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			require.Equal(t, prefixKey(0, i), k)
+			i--
+		}
+		require.Equal(t, -1, i)
+		k, _ := c.Seek(prefixKey(0, 500))
+		require.Equal(t, prefixKey(0, 500), k)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that Compact converts a database to prefix compression.
+func TestCompact_KeyPrefixCompression(t *testing.T) {
+	const n = 2000
+	src := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	fillPrefixed(t, src.DB, n)
+
+	dst := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, KeyPrefixCompression: true})
+	require.NoError(t, bolt.Compact(dst.DB, src.DB, 0))
+	verifyPrefixed(t, dst.DB, n)
+	dst.MustCheck()
+
+	var srcStats, dstStats bolt.BucketStats
+	require.NoError(t, src.View(func(tx *bolt.Tx) error {
+		srcStats = tx.Bucket([]byte("events")).Stats()
+		return nil
+	}))
+	require.NoError(t, dst.View(func(tx *bolt.Tx) error {
+		dstStats = tx.Bucket([]byte("events")).Stats()
+		return nil
+	}))
+	require.Less(t, dstStats.LeafInuse, srcStats.LeafInuse*2/3)
+}
+
+// Ensure that the keys read from prefix-compressed pages stay valid for the
+// life of the transaction, after the cursor moves on.
+func TestCursor_KeyPrefixCompression_KeyLifetime(t *testing.T) {
+	const n = 2000
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, KeyPrefixCompression: true})
+	fillPrefixed(t, db.DB, n)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		require.NoError(t, tx.Bucket([]byte("events")).ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		}))
+		for tenant := 0; tenant < 2; tenant++ {
+			for i := 0; i < n; i++ {
+				require.Equal(t, prefixKey(tenant, i), keys[tenant*n+i])
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that scanning prefix-compressed pages does not allocate a key per
+// element.
+func TestCursor_KeyPrefixCompression_Allocs(t *testing.T) {
+	const n = 2000
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, KeyPrefixCompression: true})
+	fillPrefixed(t, db.DB, n)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("events"))
+		allocs := testing.AllocsPerRun(10, func() {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			}
+		})
+		require.Less(t, allocs, float64(n/10))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// BenchmarkCursor_KeyPrefixCompression scans a bucket whose keys share a long
+// prefix, written with and without prefix compression.
+func BenchmarkCursor_KeyPrefixCompression(b *testing.B) {
+	const n = 10000
+	for _, compressed := range []bool{false, true} {
+		b.Run(fmt.Sprint("compressed=", compressed), func(b *testing.B) {
+			db := btesting.MustCreateDBWithOption(b, &bolt.Options{PageSize: 4096, KeyPrefixCompression: compressed})
+			fillPrefixed(b, db.DB, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			err := db.View(func(tx *bolt.Tx) error {
+				bkt := tx.Bucket([]byte("events"))
+				for i := 0; i < b.N; i++ {
+					c := bkt.Cursor()
+					for k, _ := c.First(); k != nil; k, _ = c.Next() {
+					}
+				}
+				return nil
+			})
+			require.NoError(b, err)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package bbolt
+
+import (
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// RangeOptions describes a bounded scan over the keys of a bucket.
+//
+// By default the range is half-open: Start is inclusive and End is
+// exclusive. A nil Start begins at the first key of the bucket and a nil End
+// runs until the last key.
+type RangeOptions struct {
+	// Start is the lower bound of the range.
+	Start []byte
+
+	// End is the upper bound of the range.
+	End []byte
+
+	// StartExclusive excludes Start itself from the range.
+	StartExclusive bool
+
+	// EndInclusive includes End itself in the range.
+	EndInclusive bool
+
+	// Reverse walks the range from the upper bound down to the lower bound.
+	Reverse bool
+
+	// Limit caps the number of keys returned. Zero means no limit.
+	Limit int
+
+	// KeysOnly skips values; every value returned by the iterator is nil.
+	KeysOnly bool
+}
+
+// RangeIterator walks the keys of a bucket within the bounds described by
+// RangeOptions. It is obtained from Bucket.Range and follows the same
+// First/Next protocol as a Cursor:
+//
+//	it := b.Range(bolt.RangeOptions{Start: from, End: to})
+//	for k, v := it.First(); k != nil; k, v = it.Next() {
+//		...
+//	}
+//
+// The iterator is only valid for the life of the transaction. Nested buckets
+// are returned with a nil value.
+type RangeIterator struct {
+	c    *Cursor
+	opts RangeOptions
+	n    int // number of keys returned so far
+}
+
+// Range returns an iterator over the keys of the bucket that fall within the
+// given bounds.
+func (b *Bucket) Range(opts RangeOptions) *RangeIterator {
+	return &RangeIterator{c: b.Cursor(), opts: opts}
+}
+
+// Cursor returns the cursor that the iterator moves.
+func (it *RangeIterator) Cursor() *Cursor {
+	return it.c
+}
+
+// First moves to the first key of the range in iteration order and returns it.
+// If the range is empty then a nil key and value are returned.
+func (it *RangeIterator) First() (key []byte, value []byte) {
+	common.Assert(it.c.bucket.tx.db != nil, "tx closed")
+	it.n = 0
+
+	var k, v []byte
+	if !it.opts.Reverse {
+		if it.opts.Start == nil {
+			k, v = it.c.First()
+		} else {
+			k, v = it.c.Seek(it.opts.Start)
+			if it.opts.StartExclusive && k != nil && it.c.bucket.compareKeys(k, it.opts.Start) == 0 {
+				k, v = it.c.Next()
+			}
+		}
+	} else {
+		switch {
+		case it.opts.End == nil:
+			k, v = it.c.Last()
+		case it.opts.EndInclusive:
+			k, v = it.c.SeekLE(it.opts.End)
+		default:
+			k, v = it.c.SeekLT(it.opts.End)
+		}
+	}
+	return it.filter(k, v)
+}
+
+// Next moves to the next key of the range in iteration order and returns it.
+// A nil key is returned once the range or the limit has been exhausted.
+func (it *RangeIterator) Next() (key []byte, value []byte) {
+	if it.opts.Limit > 0 && it.n >= it.opts.Limit {
+		return nil, nil
+	}
+	if it.opts.Reverse {
+		return it.filter(it.c.Prev())
+	}
+	return it.filter(it.c.Next())
+}
+
+// filter hides keys beyond the far bound of the range and enforces the limit.
+func (it *RangeIterator) filter(k, v []byte) ([]byte, []byte) {
+	if k == nil || !it.inRange(k) {
+		return nil, nil
+	}
+	if it.opts.Limit > 0 && it.n >= it.opts.Limit {
+		return nil, nil
+	}
+	it.n++
+	if it.opts.KeysOnly {
+		return k, nil
+	}
+	return k, v
+}
+
+// inRange reports whether k is within the bound that iteration moves towards.
+// The near bound has already been honoured when positioning the cursor.
+func (it *RangeIterator) inRange(k []byte) bool {
+	if !it.opts.Reverse {
+		if it.opts.End == nil {
+			return true
+		}
+		cmp := it.c.bucket.compareKeys(k, it.opts.End)
+		return cmp < 0 || (cmp == 0 && it.opts.EndInclusive)
+	}
+	if it.opts.Start == nil {
+		return true
+	}
+	cmp := it.c.bucket.compareKeys(k, it.opts.Start)
+	return cmp > 0 || (cmp == 0 && !it.opts.StartExclusive)
+}
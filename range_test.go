@@ -0,0 +1,157 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+func TestBucket_Range(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	// Keys "k000".."k999", spanning many leaf pages.
+	key := func(i int) string { return fmt.Sprintf("k%03d", i) }
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(key(i)), []byte("v"+key(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	keys := func(from, to, step int) []string {
+		var ks []string
+		for i := from; i != to; i += step {
+			ks = append(ks, key(i))
+		}
+		return ks
+	}
+
+	tests := []struct {
+		name string
+		opts bolt.RangeOptions
+		want []string
+	}{
+		{name: "half open", opts: bolt.RangeOptions{Start: []byte(key(10)), End: []byte(key(15))}, want: keys(10, 15, 1)},
+		{name: "closed", opts: bolt.RangeOptions{Start: []byte(key(10)), End: []byte(key(15)), EndInclusive: true}, want: keys(10, 16, 1)},
+		{name: "open", opts: bolt.RangeOptions{Start: []byte(key(10)), End: []byte(key(15)), StartExclusive: true}, want: keys(11, 15, 1)},
+		{name: "bounds between keys", opts: bolt.RangeOptions{Start: []byte("k0105"), End: []byte("k0145")}, want: keys(11, 15, 1)},
+		{name: "unbounded start", opts: bolt.RangeOptions{End: []byte(key(3))}, want: keys(0, 3, 1)},
+		{name: "unbounded end", opts: bolt.RangeOptions{Start: []byte(key(997))}, want: keys(997, 1000, 1)},
+		{name: "limit", opts: bolt.RangeOptions{Start: []byte(key(500)), Limit: 4}, want: keys(500, 504, 1)},
+		{name: "empty", opts: bolt.RangeOptions{Start: []byte(key(20)), End: []byte(key(20))}, want: nil},
+		{name: "inverted", opts: bolt.RangeOptions{Start: []byte(key(30)), End: []byte(key(20))}, want: nil},
+		{name: "reverse half open", opts: bolt.RangeOptions{Start: []byte(key(10)), End: []byte(key(15)), Reverse: true}, want: keys(14, 9, -1)},
+		{name: "reverse closed", opts: bolt.RangeOptions{Start: []byte(key(10)), End: []byte(key(15)), EndInclusive: true, Reverse: true}, want: keys(15, 9, -1)},
+		{name: "reverse open", opts: bolt.RangeOptions{Start: []byte(key(10)), End: []byte(key(15)), StartExclusive: true, Reverse: true}, want: keys(14, 10, -1)},
+		{name: "reverse unbounded", opts: bolt.RangeOptions{Start: []byte(key(996)), Reverse: true}, want: keys(999, 995, -1)},
+		{name: "reverse limit", opts: bolt.RangeOptions{End: []byte(key(500)), Reverse: true, Limit: 3}, want: keys(499, 496, -1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.View(func(tx *bolt.Tx) error {
+				it := tx.Bucket([]byte("widgets")).Range(tt.opts)
+				var got []string
+				for k, v := it.First(); k != nil; k, v = it.Next() {
+					require.Equal(t, "v"+string(k), string(v))
+					got = append(got, string(k))
+				}
+				require.Equal(t, tt.want, got)
+
+				// Restarting the iterator yields the same keys.
+				got = got[:0]
+				for k, _ := it.First(); k != nil; k, _ = it.Next() {
+					got = append(got, string(k))
+				}
+				if tt.want == nil {
+					require.Empty(t, got)
+				} else {
+					require.Equal(t, tt.want, got)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+// Ensure that StartExclusive skips the key equal to Start according to the
+// comparator of the bucket.
+func TestBucket_Range_Comparator(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		Comparators: map[string]bolt.Comparator{"fold": func(a, b []byte) int {
+			return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+		}},
+	})
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Comparator: "fold"})
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a", "B", "c"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		k, _ := b.Range(bolt.RangeOptions{Start: []byte("b"), StartExclusive: true}).First()
+		require.Equal(t, []byte("c"), k)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure a range can be paginated by restarting after the last key seen.
+func TestBucket_Range_Pagination(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 25; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%02d", i)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	var pages [][]string
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		opts := bolt.RangeOptions{Limit: 10, KeysOnly: true}
+		for {
+			var page []string
+			it := b.Range(opts)
+			for k, v := it.First(); k != nil; k, v = it.Next() {
+				require.Nil(t, v)
+				page = append(page, string(k))
+			}
+			if len(page) == 0 {
+				return nil
+			}
+			pages = append(pages, page)
+			opts.Start, opts.StartExclusive = []byte(page[len(page)-1]), true
+		}
+	})
+	require.NoError(t, err)
+	require.Len(t, pages, 3)
+	require.Len(t, pages[0], 10)
+	require.Len(t, pages[1], 10)
+	require.Equal(t, []string{"20", "21", "22", "23", "24"}, pages[2])
+}
@@ -0,0 +1,622 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+	"unsafe"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// DefaultReplicationBufferSize is the number of commits buffered for a
+// follower before it is disconnected.
+const DefaultReplicationBufferSize = 256
+
+const (
+	replMagic      = 0x42525031 // "BRP1"
+	replHelloSize  = 24         // magic, page size, txid and meta checksum
+	replHeaderSize = 17         // frame type, txid and payload size
+
+	replSnapshot byte = 1 // the whole database file, as written by Tx.WriteTo
+	replCommit   byte = 2 // the pages and the meta page written by a commit
+)
+
+// replica is a follower connected to DB.Replicate.
+type replica struct {
+	ch      chan []byte // frames of the commits to send
+	closed  bool        // protected by DB.replicasMu
+	err     error       // protected by DB.replicasMu
+	copying bool        // whether a copy of the database is sent, protected by DB.replicasMu
+	pending [][]byte    // frames of the commits made during the copy, up to DefaultReplicationBufferSize, protected by DB.replicasMu
+}
+
+// replicaFrame is a commit kept in the history to resume followers.
+type replicaFrame struct {
+	txid  common.Txid
+	prev  uint64 // checksum of the meta page the transaction started from
+	frame []byte
+}
+
+// Replicate streams the committed transactions to a follower connected over
+// rw, which runs DB.Follow on the other end. It returns when the connection
+// fails, when the database is closed, or with ErrSubscriberTooSlow when the
+// follower falls DefaultReplicationBufferSize commits behind.
+//
+// The follower is brought up to date first. If it is at a transaction that
+// is still held in memory, which is up to Options.ReplicationHistory, it
+// receives the following commits; otherwise it receives a copy of the whole
+// database, taken like Tx.WriteTo does. The commits made while the copy is
+// sent are held in memory, and sent once it is complete; if more than
+// DefaultReplicationBufferSize commits are made meanwhile, the copy is stopped
+// and Replicate returns ErrSubscriberTooSlow.
+//
+// If rw has a SetReadDeadline method, like a net.Conn, Replicate also returns
+// as soon as the follower disconnects, and clears the read deadline before
+// returning; otherwise a disconnection is only noticed by the next commit.
+//
+// Replicate waits for the current read-write transaction to close, so it
+// must not be called from one.
+func (db *DB) Replicate(rw io.ReadWriter) error {
+	if db.readOnly || db.follower {
+		return berrors.ErrDatabaseReadOnly
+	}
+
+	var hello [replHelloSize]byte
+	if _, err := io.ReadFull(rw, hello[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hello[0:]) != replMagic {
+		return fmt.Errorf("%w: bad magic", berrors.ErrReplicationStream)
+	}
+	if sz := int(binary.BigEndian.Uint32(hello[4:])); sz != db.pageSize {
+		return fmt.Errorf("%w: follower page size %d, want %d", berrors.ErrReplicationStream, sz, db.pageSize)
+	}
+	txid := common.Txid(binary.BigEndian.Uint64(hello[8:]))
+	sum := binary.BigEndian.Uint64(hello[16:])
+
+	r, snapshot, err := db.addReplica(txid, sum)
+	if err != nil {
+		return err
+	}
+	defer db.removeReplica(r)
+
+	if snapshot != nil {
+		err := writeSnapshot(&copyWriter{db: db, r: r, w: rw}, snapshot)
+		_ = snapshot.Rollback()
+		if err != nil {
+			db.replicasMu.Lock()
+			defer db.replicasMu.Unlock()
+			if r.closed && r.err != nil {
+				return r.err
+			}
+			return err
+		}
+		db.resumeReplica(r)
+	}
+
+	// The follower sends nothing else, so reading only returns once the
+	// connection is closed, which must end Replicate even while no commit
+	// is sent. The read is interrupted by a deadline when Replicate returns,
+	// so it is only done when rw supports one; otherwise a closed
+	// connection is noticed by the next write.
+	var gone chan error
+	if d, ok := rw.(readDeadliner); ok {
+		gone = make(chan error, 1)
+		go func() {
+			_, err := rw.Read(make([]byte, 1))
+			if err == nil {
+				err = fmt.Errorf("%w: unexpected data from follower", berrors.ErrReplicationStream)
+			}
+			gone <- err
+		}()
+		defer func() {
+			if gone != nil {
+				_ = d.SetReadDeadline(time.Now())
+				<-gone
+				_ = d.SetReadDeadline(time.Time{})
+			}
+		}()
+	}
+
+	for {
+		select {
+		case frame, ok := <-r.ch:
+			if !ok {
+				db.replicasMu.Lock()
+				defer db.replicasMu.Unlock()
+				return r.err
+			}
+			if _, err := rw.Write(frame); err != nil {
+				return err
+			}
+		case err := <-gone:
+			gone = nil
+			return err
+		}
+	}
+}
+
+// copyWriter writes the copy of the database sent to a follower, and fails
+// once the follower is disconnected, so that the rest of the copy is not sent.
+type copyWriter struct {
+	db *DB
+	r  *replica
+	w  io.Writer
+}
+
+func (w *copyWriter) Write(p []byte) (int, error) {
+	w.db.replicasMu.Lock()
+	closed, err := w.r.closed, w.r.err
+	w.db.replicasMu.Unlock()
+	if closed {
+		if err == nil {
+			err = berrors.ErrDatabaseNotOpen
+		}
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// readDeadliner is implemented by the connections whose reads can be
+// interrupted, such as a net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// addReplica registers a follower at the given transaction and returns the
+// read-only transaction to copy to it if it cannot be brought up to date
+// from the history.
+func (db *DB) addReplica(txid common.Txid, sum uint64) (*replica, *Tx, error) {
+	// Hold the writer lock so that all the transactions committed after the
+	// follower is registered are sent to it.
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return nil, nil, berrors.ErrDatabaseNotOpen
+	}
+
+	db.replicasMu.Lock()
+	defer db.replicasMu.Unlock()
+
+	var backlog []*replicaFrame
+	var snapshot *Tx
+	if meta := db.meta(); txid != meta.Txid() || sum != meta.Checksum() {
+		i := len(db.replicaHistory) - 1
+		for ; i >= 0; i-- {
+			if f := db.replicaHistory[i]; f.txid == txid+1 && f.prev == sum {
+				break
+			}
+		}
+		if i >= 0 {
+			backlog = db.replicaHistory[i:]
+		} else {
+			t, err := db.beginTx()
+			if err != nil {
+				return nil, nil, err
+			}
+			snapshot = t
+		}
+	}
+
+	r := &replica{ch: make(chan []byte, DefaultReplicationBufferSize+len(backlog)), copying: snapshot != nil}
+	for _, f := range backlog {
+		r.ch <- f.frame
+	}
+	db.replicas = append(db.replicas, r)
+	db.captureReplica.Store(true)
+	return r, snapshot, nil
+}
+
+// resumeReplica queues the commits made while a copy of the database was sent
+// to a follower, which follow the transaction of the copy.
+func (db *DB) resumeReplica(r *replica) {
+	db.replicasMu.Lock()
+	defer db.replicasMu.Unlock()
+	if r.closed {
+		return
+	}
+	// Only Replicate receives from the channel, and it has not started yet.
+	r.ch = make(chan []byte, DefaultReplicationBufferSize+len(r.pending))
+	for _, frame := range r.pending {
+		r.ch <- frame
+	}
+	r.copying, r.pending = false, nil
+}
+
+// removeReplica unregisters a follower once Replicate returns.
+func (db *DB) removeReplica(r *replica) {
+	db.replicasMu.Lock()
+	defer db.replicasMu.Unlock()
+	if !r.closed {
+		db.closeReplica(r, nil)
+	}
+}
+
+// closeReplica closes the channel of a follower and stops recording the
+// commits if nothing needs them anymore. DB.replicasMu must be held.
+func (db *DB) closeReplica(r *replica, err error) {
+	for i, rr := range db.replicas {
+		if rr == r {
+			db.replicas = append(db.replicas[:i], db.replicas[i+1:]...)
+			break
+		}
+	}
+	r.closed, r.err = true, err
+	r.pending = nil
+	close(r.ch)
+	if len(db.replicas) == 0 && db.replicaHistorySize == 0 {
+		db.captureReplica.Store(false)
+	}
+}
+
+// publishReplica sends the pages of a transaction that has just been
+// committed to the followers and adds them to the history.
+func (db *DB) publishReplica(tx *Tx) {
+	if tx.replica == nil {
+		return
+	}
+	f := &replicaFrame{
+		txid:  tx.meta.Txid(),
+		prev:  tx.replica.prev,
+		frame: tx.replica.frame(tx.meta.Txid()),
+	}
+
+	db.replicasMu.Lock()
+	defer db.replicasMu.Unlock()
+	if db.replicaHistorySize > 0 {
+		if len(db.replicaHistory) == db.replicaHistorySize {
+			db.replicaHistory[0] = nil
+			db.replicaHistory = db.replicaHistory[1:]
+		}
+		db.replicaHistory = append(db.replicaHistory, f)
+	}
+	for _, r := range append([]*replica(nil), db.replicas...) {
+		if r.copying {
+			if len(r.pending) == DefaultReplicationBufferSize {
+				db.closeReplica(r, berrors.ErrSubscriberTooSlow)
+				continue
+			}
+			r.pending = append(r.pending, f.frame)
+			continue
+		}
+		select {
+		case r.ch <- f.frame:
+		default:
+			db.closeReplica(r, berrors.ErrSubscriberTooSlow)
+		}
+	}
+}
+
+// closeReplicas disconnects all the followers when the database closes.
+func (db *DB) closeReplicas() {
+	db.replicasMu.Lock()
+	defer db.replicasMu.Unlock()
+	for len(db.replicas) > 0 {
+		db.closeReplica(db.replicas[0], berrors.ErrDatabaseNotOpen)
+	}
+	db.replicaHistory = nil
+}
+
+// replicaLog records the pages written by a read-write transaction while
+// there is a follower or a replication history. Its methods do nothing on a
+// nil log.
+type replicaLog struct {
+	prev uint64 // checksum of the meta page the transaction started from
+	n    uint32
+	body []byte // the page runs, then the meta page
+}
+
+// newReplicaLog returns a log if the pages of a transaction starting now
+// must be recorded. DB.metalock must be held.
+func (db *DB) newReplicaLog() *replicaLog {
+	if !db.captureReplica.Load() {
+		return nil
+	}
+	return &replicaLog{prev: db.meta().Checksum()}
+}
+
+// page records a run of pages as written to the data file.
+func (l *replicaLog) page(id common.Pgid, buf []byte) {
+	if l == nil {
+		return
+	}
+	l.n++
+	l.body = binary.BigEndian.AppendUint64(l.body, uint64(id))
+	l.body = binary.BigEndian.AppendUint32(l.body, uint32(len(buf)))
+	l.body = append(l.body, buf...)
+}
+
+// meta records the meta page, which comes last.
+func (l *replicaLog) meta(buf []byte) {
+	if l != nil {
+		l.body = append(l.body, buf...)
+	}
+}
+
+// frame encodes the commit to send to the followers.
+func (l *replicaLog) frame(txid common.Txid) []byte {
+	payload := make([]byte, 4, 4+len(l.body))
+	binary.BigEndian.PutUint32(payload, l.n)
+	payload = append(payload, l.body...)
+
+	frame := appendReplHeader(make([]byte, 0, replHeaderSize+len(payload)+4), replCommit, txid, uint64(len(payload)))
+	frame = append(frame, payload...)
+	return binary.BigEndian.AppendUint32(frame, crc32.Checksum(payload, walCRCTable))
+}
+
+func appendReplHeader(b []byte, typ byte, txid common.Txid, size uint64) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint64(b, uint64(txid))
+	return binary.BigEndian.AppendUint64(b, size)
+}
+
+// writeSnapshot sends a copy of the whole database as of tx.
+func writeSnapshot(w io.Writer, tx *Tx) error {
+	size := tx.Size()
+	if _, err := w.Write(appendReplHeader(nil, replSnapshot, tx.meta.Txid(), uint64(size))); err != nil {
+		return err
+	}
+	crc := crc32.New(walCRCTable)
+	n, err := tx.WriteTo(io.MultiWriter(w, crc))
+	if err != nil {
+		return err
+	} else if n != size {
+		return fmt.Errorf("snapshot copied %d bytes, want %d", n, size)
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// Follow connects a follower to a primary over rw, which runs DB.Replicate
+// on the other end, and applies the transactions it commits until the
+// connection fails or the database is closed. Each transaction is applied
+// atomically: read-only transactions see the state before or after it. When
+// the connection is lost, Follow can be called again to resume from the last
+// applied transaction.
+//
+// The database must be opened with Options.Follower, and with the same page
+// size, cipher and page checksums setting as the primary.
+func (db *DB) Follow(rw io.ReadWriter) error {
+	if !db.follower {
+		return berrors.ErrNotFollower
+	}
+
+	db.mmaplock.RLock()
+	meta := db.meta()
+	hello := binary.BigEndian.AppendUint32(nil, replMagic)
+	hello = binary.BigEndian.AppendUint32(hello, uint32(db.pageSize))
+	hello = binary.BigEndian.AppendUint64(hello, uint64(meta.Txid()))
+	hello = binary.BigEndian.AppendUint64(hello, meta.Checksum())
+	db.mmaplock.RUnlock()
+	if _, err := rw.Write(hello); err != nil {
+		return err
+	}
+
+	var hdr [replHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+			return err
+		}
+		txid := common.Txid(binary.BigEndian.Uint64(hdr[1:]))
+		size := int64(binary.BigEndian.Uint64(hdr[9:]))
+
+		var err error
+		switch hdr[0] {
+		case replSnapshot:
+			err = db.applySnapshot(rw, txid, size)
+		case replCommit:
+			err = db.applyCommit(rw, txid, size)
+		default:
+			err = fmt.Errorf("%w: unknown frame type %d", berrors.ErrReplicationStream, hdr[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readReplPayload reads the payload of a frame and checks its checksum.
+func readReplPayload(r io.Reader, w io.Writer, size int64) error {
+	crc := crc32.New(walCRCTable)
+	if _, err := io.CopyN(io.MultiWriter(w, crc), r, size); err != nil {
+		return err
+	}
+	return checkReplCRC(r, crc.Sum32())
+}
+
+// checkReplCRC reads the checksum following the payload of a frame.
+func checkReplCRC(r io.Reader, want uint32) error {
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(sum[:]) != want {
+		return fmt.Errorf("%w: checksum mismatch", berrors.ErrReplicationStream)
+	}
+	return nil
+}
+
+// replMeta validates the meta page of a frame.
+func (db *DB) replMeta(buf []byte, txid common.Txid) (*common.Meta, error) {
+	if len(buf) != db.pageSize {
+		return nil, fmt.Errorf("%w: truncated meta page", berrors.ErrReplicationStream)
+	}
+	m := (*common.Page)(unsafe.Pointer(&buf[0])).Meta()
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", berrors.ErrReplicationStream, err)
+	}
+	if m.Txid() != txid {
+		return nil, fmt.Errorf("%w: meta of transaction %d, want %d", berrors.ErrReplicationStream, m.Txid(), txid)
+	}
+	return m, nil
+}
+
+// applyCommit writes the pages of a commit, then its meta page, once the
+// read-only transactions that may still use the pages freed on the primary
+// are closed.
+func (db *DB) applyCommit(r io.Reader, txid common.Txid, size int64) error {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if err := checkReplCRC(r, crc32.Checksum(buf, walCRCTable)); err != nil {
+		return err
+	}
+
+	// Decode the page runs.
+	type run struct {
+		id  common.Pgid
+		buf []byte
+	}
+	if len(buf) < 4 {
+		return fmt.Errorf("%w: truncated commit", berrors.ErrReplicationStream)
+	}
+	runs := make([]run, binary.BigEndian.Uint32(buf))
+	rest := buf[4:]
+	for i := range runs {
+		if len(rest) < 12 {
+			return fmt.Errorf("%w: truncated commit", berrors.ErrReplicationStream)
+		}
+		id, n := common.Pgid(binary.BigEndian.Uint64(rest)), int(binary.BigEndian.Uint32(rest[8:]))
+		if len(rest) < 12+n || n == 0 || n%db.pageSize != 0 {
+			return fmt.Errorf("%w: truncated commit", berrors.ErrReplicationStream)
+		}
+		runs[i], rest = run{id: id, buf: rest[12 : 12+n]}, rest[12+n:]
+	}
+	meta, err := db.replMeta(rest, txid)
+	if err != nil {
+		return err
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return berrors.ErrDatabaseNotOpen
+	}
+	if cur := db.meta().Txid(); txid != cur+1 {
+		return fmt.Errorf("%w: transaction %d after %d", berrors.ErrReplicationStream, txid, cur)
+	}
+
+	// Grow the mmap and the file first, like a commit does.
+	sz := int(meta.Pgid()+1) * db.pageSize
+	if sz > db.datasz {
+		if err := db.mmap(sz); err != nil {
+			return err
+		}
+	}
+	if err := db.grow(sz); err != nil {
+		return err
+	}
+
+	// The pages written are free once the last applied transaction is
+	// committed, so they can only be read by the read-only transactions
+	// started before it, which must close first. Those started later are
+	// not blocked.
+	if db.hasReadersBefore(txid - 1) {
+		db.mmaplock.Lock()
+		defer db.mmaplock.Unlock()
+	}
+	for _, run := range runs {
+		if db.pageChecksums {
+			db.uncheckPage(run.id)
+		}
+		if db.pageCache != nil {
+			db.pageCache.evict(run.id)
+		}
+		if _, err := db.ops.writeAt(run.buf, int64(run.id)*int64(db.pageSize)); err != nil {
+			return err
+		}
+		db.pageTxids.mark(run.id, len(run.buf)/db.pageSize, txid)
+	}
+	if err := db.syncReplica(); err != nil {
+		return err
+	}
+	if _, err := db.ops.writeAt(rest, int64(txid%2)*int64(db.pageSize)); err != nil {
+		return err
+	}
+	return db.syncReplica()
+}
+
+// hasReadersBefore returns whether a read-only transaction started before the
+// transaction of the given id was committed is open.
+func (db *DB) hasReadersBefore(txid common.Txid) bool {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	for _, t := range db.txs {
+		if t.meta.Txid() < txid {
+			return true
+		}
+	}
+	return false
+}
+
+// applySnapshot replaces the data file with a copy of the primary. The copy
+// is received into a temporary file first, so that read-only transactions
+// are only blocked while it is copied over the data file.
+func (db *DB) applySnapshot(r io.Reader, txid common.Txid, size int64) (err error) {
+	if size < int64(db.pageSize)*2 {
+		return fmt.Errorf("%w: truncated snapshot", berrors.ErrReplicationStream)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), filepath.Base(db.path)+".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	if err := readReplPayload(r, tmp, size); err != nil {
+		return err
+	}
+	buf := make([]byte, db.pageSize)
+	if _, err := tmp.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	meta, err := db.replMeta(buf, txid)
+	if err != nil {
+		return err
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return berrors.ErrDatabaseNotOpen
+	}
+
+	db.mmaplock.Lock()
+	defer db.mmaplock.Unlock()
+	if _, err := io.Copy(io.NewOffsetWriter(db.file, 0), io.NewSectionReader(tmp, 0, size)); err != nil {
+		return err
+	}
+	if err := db.file.Truncate(size); err != nil {
+		return err
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	if db.pageCache != nil {
+		db.pageCache.reset()
+	}
+	db.pageChecksums = meta.Flags()&common.MetaPageChecksumFlag != 0
+	db.pageTxids.reset(txid)
+	return db.remap(int(size))
+}
+
+// syncReplica flushes the pages applied by a follower.
+func (db *DB) syncReplica() error {
+	if db.NoSync && !common.IgnoreNoSync {
+		return nil
+	}
+	if err := fdatasync(db); err != nil {
+		db.Logger().Errorf("[GOOS: %s, GOARCH: %s] fdatasync failed: %v", runtime.GOOS, runtime.GOARCH, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// replicate connects a follower to a primary and returns a function that
+// disconnects it and returns the errors of both ends.
+func replicate(t *testing.T, primary, follower *btesting.DB) func() (error, error) {
+	pc, fc := net.Pipe()
+	perr, ferr := make(chan error, 1), make(chan error, 1)
+	go func() { perr <- primary.Replicate(pc) }()
+	go func() { ferr <- follower.Follow(fc) }()
+	return func() (error, error) {
+		_ = pc.Close()
+		_ = fc.Close()
+		return <-perr, <-ferr
+	}
+}
+
+// putKeys commits a transaction setting keys from..to-1 of the widgets bucket.
+func putKeys(t *testing.T, db *btesting.DB, from, to int) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := from; i < to; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i)), []byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// waitFor waits for the follower to see the widgets bucket with n keys.
+func waitFor(t *testing.T, db *btesting.DB, n int) {
+	require.Eventually(t, func() bool {
+		var count int
+		err := db.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket([]byte("widgets")); b != nil {
+				count = b.Stats().KeyN
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return count == n
+	}, 10*time.Second, time.Millisecond)
+}
+
+// Ensure that a follower receives a copy of the primary, then the
+// transactions it commits, and cannot be written to.
+func TestDB_Replicate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts func() *bolt.Options
+	}{
+		{name: "plain", opts: func() *bolt.Options { return &bolt.Options{} }},
+		{name: "wal", opts: func() *bolt.Options { return &bolt.Options{WAL: true} }},
+		{name: "encrypted", opts: func() *bolt.Options {
+			return &bolt.Options{Cipher: mustCipher(t, "0123456789abcdef0123456789abcdef"), PageChecksums: true}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := btesting.MustCreateDBWithOption(t, tc.opts())
+			fopts := tc.opts()
+			fopts.Follower = true
+			follower := btesting.MustCreateDBWithOption(t, fopts)
+
+			putKeys(t, primary, 0, 100)
+			disconnect := replicate(t, primary, follower)
+			waitFor(t, follower, 100)
+
+			// Commits larger than the mapping make the follower grow.
+			putKeys(t, primary, 100, 5000)
+			waitFor(t, follower, 5000)
+			err := follower.View(func(tx *bolt.Tx) error {
+				require.Equal(t, []byte("4999"), tx.Bucket([]byte("widgets")).Get([]byte("00004999")))
+				return nil
+			})
+			require.NoError(t, err)
+
+			// Blobs put from a reader are sent too.
+			stream := blobValue(0, 100000)
+			err = primary.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).PutStream([]byte("stream"), bytes.NewReader(stream), int64(len(stream)))
+			})
+			require.NoError(t, err)
+			waitFor(t, follower, 5001)
+			err = follower.View(func(tx *bolt.Tx) error {
+				require.Equal(t, stream, tx.Bucket([]byte("widgets")).Get([]byte("stream")))
+				return nil
+			})
+			require.NoError(t, err)
+
+			err = follower.Update(func(tx *bolt.Tx) error { return nil })
+			require.ErrorIs(t, err, berrors.ErrDatabaseReadOnly)
+			err = primary.Follow(nil)
+			require.ErrorIs(t, err, berrors.ErrNotFollower)
+
+			disconnect()
+		})
+	}
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	io.ReadWriter
+	mu sync.Mutex
+	n  int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.mu.Lock()
+	c.n += n
+	c.mu.Unlock()
+	return n, err
+}
+
+// Ensure that a follower resumes from the history after reconnecting, and
+// receives a copy of the primary again once the history is exhausted.
+func TestDB_Replicate_Resume(t *testing.T) {
+	primary := btesting.MustCreateDBWithOption(t, &bolt.Options{ReplicationHistory: 2})
+	follower := btesting.MustCreateDBWithOption(t, &bolt.Options{Follower: true})
+	putKeys(t, primary, 0, 2000)
+
+	follow := func() (*countingConn, func()) {
+		pc, fc := net.Pipe()
+		conn := &countingConn{ReadWriter: fc}
+		done := make(chan struct{}, 2)
+		go func() { _ = primary.Replicate(pc); done <- struct{}{} }()
+		go func() { _ = follower.Follow(conn); done <- struct{}{} }()
+		return conn, func() {
+			_ = pc.Close()
+			_ = fc.Close()
+			<-done
+			<-done
+		}
+	}
+
+	_, disconnect := follow()
+	waitFor(t, follower, 2000)
+	disconnect()
+
+	// The two transactions committed meanwhile are held in the history.
+	putKeys(t, primary, 2000, 2001)
+	putKeys(t, primary, 2001, 2002)
+	conn, disconnect := follow()
+	waitFor(t, follower, 2002)
+	disconnect()
+	conn.mu.Lock()
+	resumed := conn.n
+	conn.mu.Unlock()
+
+	for i := 2002; i < 2005; i++ {
+		putKeys(t, primary, i, i+1)
+	}
+	conn, disconnect = follow()
+	waitFor(t, follower, 2005)
+	disconnect()
+	conn.mu.Lock()
+	copied := conn.n
+	conn.mu.Unlock()
+
+	info, err := primary.Begin(false)
+	require.NoError(t, err)
+	size := int(info.Size())
+	require.NoError(t, info.Rollback())
+	require.Less(t, resumed, size)
+	require.GreaterOrEqual(t, copied, size)
+}
+
+// gatedConn blocks the writes to a connection until its gate is opened, and
+// reports the first one.
+type gatedConn struct {
+	net.Conn
+	once    sync.Once
+	writing chan struct{}
+	gate    chan struct{}
+}
+
+func (c *gatedConn) Write(p []byte) (int, error) {
+	c.once.Do(func() { close(c.writing) })
+	<-c.gate
+	return c.Conn.Write(p)
+}
+
+// Ensure that the commits made while a copy of the primary is sent to a new
+// follower are sent after it, up to DefaultReplicationBufferSize of them.
+func TestDB_Replicate_CommitDuringCopy(t *testing.T) {
+	primary := btesting.MustCreateDBWithOption(t, &bolt.Options{InitialMmapSize: 64 << 20})
+	follower := btesting.MustCreateDBWithOption(t, &bolt.Options{Follower: true})
+	putKeys(t, primary, 0, 2000)
+
+	pc, fc := net.Pipe()
+	conn := &gatedConn{Conn: pc, writing: make(chan struct{}), gate: make(chan struct{})}
+	perr, ferr := make(chan error, 1), make(chan error, 1)
+	go func() { perr <- primary.Replicate(conn) }()
+	go func() { ferr <- follower.Follow(fc) }()
+
+	// The copy is being sent while the commits are made.
+	<-conn.writing
+	const commits = bolt.DefaultReplicationBufferSize
+	for i := 0; i < commits; i++ {
+		putKeys(t, primary, 2000+i, 2001+i)
+	}
+	close(conn.gate)
+	waitFor(t, follower, 2000+commits)
+
+	putKeys(t, primary, 2000+commits, 2001+commits)
+	waitFor(t, follower, 2001+commits)
+
+	_ = pc.Close()
+	_ = fc.Close()
+	require.NotErrorIs(t, <-perr, berrors.ErrSubscriberTooSlow)
+	<-ferr
+}
+
+// Ensure that the copy of the primary sent to a new follower is stopped when
+// more than DefaultReplicationBufferSize commits are made meanwhile.
+func TestDB_Replicate_CommitDuringCopy_TooSlow(t *testing.T) {
+	primary := btesting.MustCreateDBWithOption(t, &bolt.Options{InitialMmapSize: 64 << 20})
+	follower := btesting.MustCreateDBWithOption(t, &bolt.Options{Follower: true})
+	putKeys(t, primary, 0, 2000)
+
+	pc, fc := net.Pipe()
+	conn := &gatedConn{Conn: pc, writing: make(chan struct{}), gate: make(chan struct{})}
+	perr, ferr := make(chan error, 1), make(chan error, 1)
+	go func() { perr <- primary.Replicate(conn) }()
+	go func() { ferr <- follower.Follow(fc) }()
+
+	<-conn.writing
+	const commits = bolt.DefaultReplicationBufferSize + 1
+	for i := 0; i < commits; i++ {
+		putKeys(t, primary, 2000+i, 2001+i)
+	}
+	close(conn.gate)
+	require.ErrorIs(t, <-perr, berrors.ErrSubscriberTooSlow)
+	_ = pc.Close()
+	_ = fc.Close()
+	<-ferr
+}
+
+// Ensure that a follower applies the commits that do not grow it while a
+// read-only transaction started after the last applied one is open.
+func TestDB_Replicate_OpenReader(t *testing.T) {
+	primary := btesting.MustCreateDB(t)
+	follower := btesting.MustCreateDBWithOption(t, &bolt.Options{Follower: true})
+	putKeys(t, primary, 0, 2000)
+	disconnect := replicate(t, primary, follower)
+	waitFor(t, follower, 2000)
+
+	tx, err := follower.Begin(false)
+	require.NoError(t, err)
+	putKeys(t, primary, 2000, 2001)
+	waitFor(t, follower, 2001)
+	require.Equal(t, 2000, tx.Bucket([]byte("widgets")).Stats().KeyN)
+	require.NoError(t, tx.Rollback())
+	disconnect()
+}
+
+// Ensure that Replicate stops reading from the connection before returning.
+func TestDB_Replicate_Return(t *testing.T) {
+	primary := btesting.MustCreateDB(t)
+	follower := btesting.MustCreateDBWithOption(t, &bolt.Options{Follower: true})
+	putKeys(t, primary, 0, 100)
+	pc, fc := net.Pipe()
+	defer func() {
+		_ = pc.Close()
+		_ = fc.Close()
+	}()
+	perr, ferr := make(chan error, 1), make(chan error, 1)
+	go func() { perr <- primary.Replicate(pc) }()
+	go func() { ferr <- follower.Follow(fc) }()
+	waitFor(t, follower, 100)
+
+	// Stop the follower without closing the connection, then the primary.
+	require.NoError(t, fc.SetReadDeadline(time.Now()))
+	require.ErrorIs(t, <-ferr, os.ErrDeadlineExceeded)
+	primary.MustClose()
+	require.ErrorIs(t, <-perr, berrors.ErrDatabaseNotOpen)
+
+	// The connection can be read again.
+	go func() { _, _ = fc.Write([]byte{1}) }()
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(10*time.Second)))
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(pc, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, buf)
+}
+
+// Ensure that the read-only transactions of a follower see each transaction
+// applied atomically.
+func TestDB_Replicate_ConcurrentReaders(t *testing.T) {
+	primary := btesting.MustCreateDB(t)
+	follower := btesting.MustCreateDBWithOption(t, &bolt.Options{Follower: true})
+	err := primary.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("accounts"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("a"), []byte{100}); err != nil {
+			return err
+		}
+		return b.Put([]byte("b"), []byte{0})
+	})
+	require.NoError(t, err)
+	disconnect := replicate(t, primary, follower)
+
+	const transfers = 100
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := follower.View(func(tx *bolt.Tx) error {
+					b := tx.Bucket([]byte("accounts"))
+					if b == nil {
+						return nil
+					}
+					if sum := int(b.Get([]byte("a"))[0]) + int(b.Get([]byte("b"))[0]); sum != 100 {
+						return fmt.Errorf("unexpected sum %d", sum)
+					}
+					return nil
+				})
+				require.NoError(t, err)
+			}
+		}()
+	}
+
+	for i := 0; i < transfers; i++ {
+		err := primary.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("accounts"))
+			a, c := b.Get([]byte("a"))[0], b.Get([]byte("b"))[0]
+			if err := b.Put([]byte("a"), []byte{a - 1}); err != nil {
+				return err
+			}
+			return b.Put([]byte("b"), []byte{c + 1})
+		})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		var v byte
+		err := follower.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket([]byte("accounts")); b != nil {
+				v = b.Get([]byte("b"))[0]
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return v == transfers
+	}, 10*time.Second, time.Millisecond)
+	close(stop)
+	wg.Wait()
+	disconnect()
+}
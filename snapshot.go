@@ -0,0 +1,415 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"unsafe"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// snapshotsKey is the name of the top-level bucket holding the named
+// snapshots of the database, by name. It is hidden like the internal buckets
+// of a bucket, and only modified by DB.CreateSnapshot and DB.DropSnapshot.
+const snapshotsKey = "\x00bbolt-snapshots"
+
+// SnapshotInfo describes a named snapshot.
+type SnapshotInfo struct {
+	// Name is the name of the snapshot.
+	Name string
+
+	// Txid is the id of the transaction the snapshot was taken at.
+	Txid int
+
+	// PinnedSize is the size in bytes of the pages kept only for the
+	// snapshot, which are reclaimed when it is dropped.
+	PinnedSize int64
+}
+
+// CreateSnapshot records the last committed transaction under the given
+// name. The pages of a snapshot are never reused, even across restarts, so
+// that it can be read with DB.OpenSnapshot until DB.DropSnapshot is called.
+//
+// A snapshot holds its pages like a read-only transaction that stays open,
+// so the database grows as the data it saw is modified. Use DB.Snapshots
+// to see the space it costs.
+//
+// Creating a snapshot reads every page of the database, to record the pages
+// it holds along with it, so that DB.Open does not have to read them again.
+func (db *DB) CreateSnapshot(name string) error {
+	key := []byte(name)
+	if len(key) == 0 {
+		return berrors.ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return berrors.ErrKeyTooLarge
+	}
+
+	var m *common.Meta
+	err := db.Update(func(tx *Tx) error {
+		b := tx.root.internalBucket(snapshotsKey, true, common.BucketOptions{})
+		c := b.Cursor()
+		if k, _, _ := c.seek(key); bytes.Equal(key, k) {
+			return berrors.ErrSnapshotExists
+		}
+
+		// The writer lock keeps the last committed meta from changing.
+		m = &common.Meta{}
+		db.meta().Copy(m)
+		var stx Tx
+		stx.initAt(db, m)
+		var ids common.Pgids
+		if err := stx.forEachReachablePage(func(id common.Pgid) { ids = append(ids, id) }); err != nil {
+			return err
+		}
+		c.node().put(key, key, append(encodeSnapshot(m), encodePageRuns(ids)...), 0, 0)
+
+		// Pin the pages before the writer lock is released, as the next
+		// read-write transaction could otherwise reuse them.
+		db.metalock.Lock()
+		if db.snapshots == nil {
+			db.snapshots = make(map[string]*common.Meta)
+		}
+		db.snapshots[name] = m
+		db.metalock.Unlock()
+		return nil
+	})
+	if err != nil && m != nil {
+		db.metalock.Lock()
+		if db.snapshots[name] == m {
+			delete(db.snapshots, name)
+		}
+		db.metalock.Unlock()
+	}
+	return err
+}
+
+// DropSnapshot removes a named snapshot. Its pages are reclaimed once they
+// are not used by an open transaction.
+func (db *DB) DropSnapshot(name string) error {
+	key := []byte(name)
+	var m *common.Meta
+	err := db.Update(func(tx *Tx) error {
+		b := tx.root.internalBucket(snapshotsKey, false, common.BucketOptions{})
+		if b == nil {
+			return berrors.ErrSnapshotNotFound
+		}
+		c := b.Cursor()
+		if k, _, _ := c.seek(key); !bytes.Equal(key, k) {
+			return berrors.ErrSnapshotNotFound
+		}
+		db.metalock.Lock()
+		m = db.snapshots[name]
+		db.metalock.Unlock()
+		c.node().del(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.metalock.Lock()
+	if db.snapshots[name] == m {
+		delete(db.snapshots, name)
+	}
+	db.metalock.Unlock()
+	return nil
+}
+
+// OpenSnapshot starts a read-only transaction reading the database as it
+// was when the named snapshot was created.
+//
+// IMPORTANT: You must close the transaction like any read-only transaction.
+func (db *DB) OpenSnapshot(name string) (*Tx, error) {
+	return db.beginTxAt(&Tx{}, func() (*common.Meta, error) {
+		m, ok := db.snapshots[name]
+		if !ok {
+			return nil, berrors.ErrSnapshotNotFound
+		}
+		return m, nil
+	})
+}
+
+// Snapshots returns the named snapshots ordered by transaction id.
+//
+// Computing the pinned size reads every page of the database, along with the
+// pages recorded for each snapshot when it was created.
+func (db *DB) Snapshots() ([]SnapshotInfo, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var infos []SnapshotInfo
+	var pages [][]byte
+	if b := tx.root.internalBucket(snapshotsKey, false, common.BucketOptions{}); b != nil {
+		err := b.ForEach(func(k, v []byte) error {
+			m, runs, err := decodeSnapshotPages(v)
+			if err != nil {
+				return fmt.Errorf("snapshot %q: %w", k, err)
+			}
+			infos = append(infos, SnapshotInfo{Name: string(k), Txid: int(m.Txid())})
+			pages = append(pages, runs)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	order := make([]int, len(infos))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := infos[order[i]], infos[order[j]]
+		if a.Txid != b.Txid {
+			return a.Txid < b.Txid
+		}
+		return a.Name < b.Name
+	})
+
+	// owners maps each page to the index+1 of the only snapshot reaching
+	// it, or to -1 if it is shared.
+	owners := make(map[common.Pgid]int)
+	if err := tx.forEachReachablePage(func(id common.Pgid) { owners[id] = -1 }); err != nil {
+		return nil, err
+	}
+	for i, runs := range pages {
+		err := forEachPageRun(runs, func(id common.Pgid) {
+			if owner, ok := owners[id]; !ok {
+				owners[id] = i + 1
+			} else if owner != i+1 {
+				owners[id] = -1
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %q: %w", infos[i].Name, err)
+		}
+	}
+	for _, owner := range owners {
+		if owner > 0 {
+			infos[owner-1].PinnedSize += int64(db.pageSize)
+		}
+	}
+
+	sorted := make([]SnapshotInfo, len(infos))
+	for i, j := range order {
+		sorted[i] = infos[j]
+	}
+	return sorted, nil
+}
+
+// encodeSnapshot returns the value stored for a snapshot taken at meta m.
+func encodeSnapshot(m *common.Meta) []byte {
+	buf := make([]byte, unsafe.Sizeof(*m))
+	copy(buf, unsafe.Slice((*byte)(unsafe.Pointer(m)), len(buf)))
+	return buf
+}
+
+// decodeSnapshot returns the meta stored for a snapshot.
+func decodeSnapshot(v []byte) (*common.Meta, error) {
+	m := &common.Meta{}
+	if len(v) != int(unsafe.Sizeof(*m)) {
+		return nil, berrors.ErrInvalid
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(m)), len(v)), v)
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeSnapshotPages returns the meta stored for a named snapshot, and the
+// runs of the pages it holds, to be read with forEachPageRun.
+func decodeSnapshotPages(v []byte) (*common.Meta, []byte, error) {
+	n := int(unsafe.Sizeof(common.Meta{}))
+	if len(v) < n {
+		return nil, nil, berrors.ErrInvalid
+	}
+	m, err := decodeSnapshot(v[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, v[n:], nil
+}
+
+// encodePageRuns returns the given page ids as runs of consecutive ids, each
+// stored as the uvarint gap from the end of the previous run followed by the
+// uvarint length of the run.
+func encodePageRuns(ids common.Pgids) []byte {
+	sort.Sort(ids)
+	var buf []byte
+	var end common.Pgid
+	for i := 0; i < len(ids); {
+		j := i + 1
+		for j < len(ids) && ids[j] <= ids[j-1]+1 {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(ids[i]-end))
+		end = ids[j-1] + 1
+		buf = binary.AppendUvarint(buf, uint64(end-ids[i]))
+		i = j
+	}
+	return buf
+}
+
+// forEachPageRun calls fn for each page id encoded by encodePageRuns.
+func forEachPageRun(buf []byte, fn func(id common.Pgid)) error {
+	var end common.Pgid
+	for len(buf) > 0 {
+		gap, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return berrors.ErrInvalid
+		}
+		buf = buf[n:]
+		length, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return berrors.ErrInvalid
+		}
+		buf = buf[n:]
+		start := end + common.Pgid(gap)
+		end = start + common.Pgid(length)
+		for id := start; id < end; id++ {
+			fn(id)
+		}
+	}
+	return nil
+}
+
+// loadSnapshots reads the named snapshots and the transaction history of the
+// last committed transaction.
+func (db *DB) loadSnapshots() (err error) {
+	var tx Tx
+	tx.init(db)
+	defer func() {
+		if err == nil {
+			err = tx.Err()
+		}
+	}()
+	if db.retained, err = tx.root.txHistory(); err != nil {
+		return err
+	}
+	b := tx.root.internalBucket(snapshotsKey, false, common.BucketOptions{})
+	if b == nil {
+		return nil
+	}
+	snapshots := make(map[string]*common.Meta)
+	err = b.ForEach(func(k, v []byte) error {
+		m, _, err := decodeSnapshotPages(v)
+		if err != nil {
+			return fmt.Errorf("snapshot %q: %w", k, err)
+		}
+		snapshots[string(k)] = m
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.snapshots = snapshots
+	return nil
+}
+
+// pagePin holds the oldest and newest snapshots reaching a page.
+type pagePin struct {
+	min, max common.Txid
+}
+
+// pinSnapshots takes the pages of the named snapshots and of the retained
+// transactions out of a freshly loaded freelist. The freelist page saves them
+// as free pages, as it does for the pages held by open transactions. The
+// pages of the named snapshots are recorded along with them, while those of
+// the retained transactions are read from their trees.
+// Returns an error if the pages of one of them cannot be read, in which case
+// the freelist is left unchanged.
+func (db *DB) pinSnapshots() error {
+	db.metalock.Lock()
+	metas := make([]*common.Meta, 0, len(db.retained))
+	for _, r := range db.retained {
+		metas = append(metas, r.meta)
+	}
+	db.metalock.Unlock()
+
+	pins := make(map[common.Pgid]pagePin)
+	pin := func(txid common.Txid) func(id common.Pgid) {
+		return func(id common.Pgid) {
+			p, ok := pins[id]
+			if !ok {
+				p = pagePin{min: txid, max: txid}
+			}
+			p.min = min(p.min, txid)
+			p.max = max(p.max, txid)
+			pins[id] = p
+		}
+	}
+
+	var tx Tx
+	tx.init(db)
+	if b := tx.root.internalBucket(snapshotsKey, false, common.BucketOptions{}); b != nil {
+		err := b.ForEach(func(k, v []byte) error {
+			m, runs, err := decodeSnapshotPages(v)
+			if err == nil {
+				err = forEachPageRun(runs, pin(m.Txid()))
+			}
+			if err != nil {
+				return fmt.Errorf("snapshot %q: %w", k, err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = tx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the pages of the snapshots: %w", err)
+		}
+	}
+	for _, m := range metas {
+		var tx Tx
+		tx.initAt(db, m)
+		if err := tx.forEachReachablePage(pin(m.Txid())); err != nil {
+			return fmt.Errorf("failed to read the pages of transaction %d: %w", m.Txid(), err)
+		}
+	}
+	if len(pins) > 0 {
+		db.freelist.pin(pins)
+	}
+	return nil
+}
+
+// forEachReachablePage calls fn for each page reachable from the root bucket
+// of the transaction, including overflow pages.
+func (tx *Tx) forEachReachablePage(fn func(id common.Pgid)) error {
+	var walk func(b *Bucket)
+	walk = func(b *Bucket) {
+		b.forEachBlob(func(_ []byte, ptr blobPointer) {
+			for i := 0; i < tx.db.blobPageCount(ptr.size); i++ {
+				fn(ptr.pgid + common.Pgid(i))
+			}
+		})
+		b.forEachValueTree(func(_ []byte, tree *Bucket) {
+			walk(tree)
+		})
+
+		// Inline buckets cannot hold non-inline ones.
+		if b.RootPage() == 0 {
+			return
+		}
+		tx.forEachPage(b.RootPage(), func(p *common.Page, _ int, _ []common.Pgid) {
+			for i := common.Pgid(0); i <= common.Pgid(p.Overflow()); i++ {
+				fn(p.Id() + i)
+			}
+			if !p.IsLeafPage() {
+				return
+			}
+			for i := 0; i < int(p.Count()); i++ {
+				if elem := p.LeafPageElement(uint16(i)); elem.IsBucketEntry() {
+					walk(b.openBucket(elem.Value()))
+				}
+			}
+		})
+	}
+	walk(&tx.root)
+	return tx.Err()
+}
@@ -0,0 +1,191 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// snapshotKeys returns the number of keys of the widgets bucket and the value
+// of its first key in a named snapshot.
+func snapshotKeys(t *testing.T, db *btesting.DB, name string) (int, string) {
+	tx, err := db.OpenSnapshot(name)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+	b := tx.Bucket([]byte("widgets"))
+	return b.Stats().KeyN, string(b.Get([]byte("00000000")))
+}
+
+// Ensure that a named snapshot keeps reading the data it was created at,
+// across reopening the database, until it is dropped.
+func TestDB_CreateSnapshot(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts *bolt.Options
+	}{
+		{name: "array", opts: &bolt.Options{FreelistType: bolt.FreelistArrayType}},
+		{name: "map", opts: &bolt.Options{FreelistType: bolt.FreelistMapType}},
+		{name: "nofreelistsync", opts: &bolt.Options{NoFreelistSync: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, tc.opts)
+			putKeys(t, db, 0, 1000)
+			require.NoError(t, db.CreateSnapshot("v1"))
+			require.ErrorIs(t, db.CreateSnapshot("v1"), berrors.ErrSnapshotExists)
+
+			// Overwrite every key, so the pages of the snapshot are freed.
+			update := func(value string) {
+				err := db.Update(func(tx *bolt.Tx) error {
+					b := tx.Bucket([]byte("widgets"))
+					for i := 0; i < 1000; i++ {
+						if err := b.Put([]byte(fmt.Sprintf("%08d", i)), []byte(value)); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				require.NoError(t, err)
+			}
+			for i := 0; i < 5; i++ {
+				update(fmt.Sprint("new", i))
+			}
+			n, v := snapshotKeys(t, db, "v1")
+			require.Equal(t, 1000, n)
+			require.Equal(t, "0", v)
+
+			db.MustClose()
+			db.MustReopen()
+			for i := 0; i < 5; i++ {
+				update(fmt.Sprint("newer", i))
+			}
+			n, v = snapshotKeys(t, db, "v1")
+			require.Equal(t, 1000, n)
+			require.Equal(t, "0", v)
+			db.MustCheck()
+
+			infos, err := db.Snapshots()
+			require.NoError(t, err)
+			require.Len(t, infos, 1)
+			require.Equal(t, "v1", infos[0].Name)
+			require.Greater(t, infos[0].PinnedSize, int64(0))
+
+			// The pages of a dropped snapshot are reused.
+			require.NoError(t, db.DropSnapshot("v1"))
+			_, err = db.OpenSnapshot("v1")
+			require.ErrorIs(t, err, berrors.ErrSnapshotNotFound)
+			var before int64
+			err = db.View(func(tx *bolt.Tx) error {
+				before = tx.Size()
+				return nil
+			})
+			require.NoError(t, err)
+			for i := 0; i < 5; i++ {
+				update(fmt.Sprint("newest", i))
+			}
+			err = db.View(func(tx *bolt.Tx) error {
+				require.Equal(t, before, tx.Size())
+				return nil
+			})
+			require.NoError(t, err)
+			db.MustCheck()
+		})
+	}
+}
+
+// Ensure that the pinned size of snapshots only counts the pages they alone
+// hold.
+func TestDB_Snapshots(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	putKeys(t, db, 0, 1000)
+	require.NoError(t, db.CreateSnapshot("b"))
+	require.NoError(t, db.CreateSnapshot("a"))
+
+	infos, err := db.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, "b", infos[0].Name)
+	require.Equal(t, "a", infos[1].Name)
+	require.Less(t, infos[0].Txid, infos[1].Txid)
+
+	// Nothing has changed since the second snapshot but the snapshots
+	// bucket.
+	putKeys(t, db, 1000, 1001)
+	infos, err = db.Snapshots()
+	require.NoError(t, err)
+	require.Greater(t, infos[1].PinnedSize, int64(0))
+	require.Less(t, infos[1].PinnedSize, int64(8*db.Info().PageSize))
+
+	require.ErrorIs(t, db.DropSnapshot("c"), berrors.ErrSnapshotNotFound)
+	require.ErrorIs(t, db.CreateSnapshot(""), berrors.ErrKeyRequired)
+
+	// The snapshots are hidden, so they cannot be modified directly.
+	err = db.Update(func(tx *bolt.Tx) error {
+		require.NoError(t, tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			require.Equal(t, "widgets", string(name))
+			return nil
+		}))
+		require.ErrorIs(t, tx.DeleteBucket([]byte("\x00bbolt-snapshots")), berrors.ErrBucketNotFound)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.DropSnapshot("a"))
+	require.NoError(t, db.DropSnapshot("b"))
+	infos, err = db.Snapshots()
+	require.NoError(t, err)
+	require.Empty(t, infos)
+}
+
+// Ensure that the pages of a snapshot are recorded when it is created, so
+// that opening the database does not read them, and that a corrupted one is
+// reported when reading the snapshot rather than panicking.
+func TestDB_CreateSnapshot_Corruption(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, PageChecksums: true})
+	putKeys(t, db, 0, 1000)
+	require.NoError(t, db.CreateSnapshot("v1"))
+	tx, err := db.OpenSnapshot("v1")
+	require.NoError(t, err)
+	pgid := int(tx.Bucket([]byte("widgets")).RootPage())
+	require.NoError(t, tx.Rollback())
+
+	// Replace the pages of the snapshot in the current tree.
+	putKeys(t, db, 0, 1000)
+	err = db.View(func(tx *bolt.Tx) error {
+		require.NotEqual(t, pgid, int(tx.Bucket([]byte("widgets")).RootPage()))
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustClose()
+
+	f, err := os.OpenFile(db.Path(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	buf := make([]byte, 1)
+	off := int64(pgid*4096 + 20)
+	_, err = f.ReadAt(buf, off)
+	require.NoError(t, err)
+	buf[0] ^= 0x01
+	_, err = f.WriteAt(buf, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db.MustReopen()
+	db.ForceDisableStrictMode()
+	putKeys(t, db, 0, 1000)
+
+	tx, err = db.OpenSnapshot("v1")
+	require.NoError(t, err)
+	require.Equal(t, pgid, int(tx.Bucket([]byte("widgets")).RootPage()))
+	tx.Bucket([]byte("widgets")).Get([]byte("00000000"))
+	require.ErrorIs(t, tx.Rollback(), berrors.ErrPageChecksum)
+
+	infos, err := db.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Greater(t, infos[0].PinnedSize, int64(0))
+}
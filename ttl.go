@@ -0,0 +1,419 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// DefaultExpiryReapTxMaxKeys is the maximum number of expired keys deleted
+// by a read-write transaction of DB.ReapExpired when
+// Options.ExpiryReapTxMaxKeys is not set.
+const DefaultExpiryReapTxMaxKeys = 1000
+
+// ttlIndexKey is the name of the nested bucket holding the expiry index of
+// a bucket. It is hidden from the cursors of the bucket.
+//
+// The index holds a key made of the big-endian expiry time in Unix
+// nanoseconds followed by the key, for each key of the bucket that expires,
+// and a key made of ttlMarker followed by the name of the bucket, for each
+// nested bucket that has an expiry index itself. The expiry times are
+// positive, so their first byte never is ttlMarker.
+const ttlIndexKey = "\x00bbolt-ttl"
+
+// ttlMarker starts the keys of an expiry index naming a nested bucket.
+const ttlMarker = 0xff
+
+// expirySize is the size of the expiry time stored before the values that
+// expire.
+const expirySize = 8
+
+// PutWithTTL sets the value for a key in the bucket, like Put, and makes the
+// key expire after the given time-to-live. Once expired, the key is hidden
+// from Get and the cursors of the bucket, until it is deleted by
+// DB.ReapExpired or the background reaper started by
+// Options.ExpiryReapInterval. Putting the key again, with or without a
+// time-to-live, replaces its expiry time.
+//
+// The time is read from the clock of the host when the key is put, and when
+// each transaction starts, so the keys expire as the clock goes.
+// Returns ErrInvalidTTL if the time-to-live is not positive.
+func (b *Bucket) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return berrors.ErrInvalidTTL
+	}
+	return b.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// valueExpiry returns the expiry time of an element value that expires.
+func valueExpiry(v []byte) int64 {
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// expiryKey returns the key of the expiry index for a key expiring at the
+// given time.
+func expiryKey(key []byte, expires int64) []byte {
+	return append(binary.BigEndian.AppendUint64(make([]byte, 0, expirySize+len(key)), uint64(expires)), key...)
+}
+
+// now returns the time, in Unix nanoseconds, the keys of the transaction
+// expire at.
+func (tx *Tx) now() int64 {
+	if tx.startTime == 0 {
+		return time.Now().UnixNano()
+	}
+	return tx.startTime
+}
+
+// hidden reports whether an element of the bucket is hidden from callers:
+// the expiry and secondary indexes, the history, and the keys that have
+// expired.
+func (b *Bucket) hidden(k, v []byte, flags uint32) bool {
+	if (flags & common.BucketLeafFlag) != 0 {
+		return internalBucketName(k)
+	}
+	return (flags&common.ExpiringValueFlag) != 0 && valueExpiry(v) <= b.tx.now()
+}
+
+// internalBucketName reports whether a nested bucket name is the name of an
+// index or of the history of the bucket, or of the transaction history or the
+// named snapshots, hidden from callers.
+func internalBucketName(name []byte) bool {
+	return string(name) == ttlIndexKey || string(name) == indexesKey || string(name) == historyKey ||
+		string(name) == txHistoryKey || string(name) == snapshotsKey
+}
+
+// reservedBucketNamePrefix starts the names of all the internal buckets. A
+// user cannot create or move a bucket with such a name.
+const reservedBucketNamePrefix = "\x00bbolt-"
+
+// reservedBucketName reports whether a nested bucket name is reserved for the
+// internal buckets.
+func reservedBucketName(name []byte) bool {
+	return bytes.HasPrefix(name, []byte(reservedBucketNamePrefix))
+}
+
+// internalKey is like internalBucketName, but first checks the byte all the
+// names start with, for the comparisons of keys.
+func internalKey(k []byte) bool {
+	return len(k) > 0 && k[0] == 0 && internalBucketName(k)
+}
+
+// expiryIndex returns the expiry index of the bucket. If it does not exist,
+// it is created if create is set, and nil is returned otherwise. Creating it
+// moves the cursors of the bucket. It also returns nil if a key of the
+// bucket has the name of the index.
+func (b *Bucket) expiryIndex(create bool) *Bucket {
+	return b.internalBucket(ttlIndexKey, create, common.BucketOptions{})
+}
+
+// internalBucket returns the nested bucket name of the bucket, used by the
+// library itself, without recording a read of the transaction. If it does
+// not exist, it is created with the given options if create is set, and nil
+// is returned otherwise. Creating it moves the cursors of the bucket. It
+// also returns nil if a key of the bucket has the name of the bucket.
+func (b *Bucket) internalBucket(name string, create bool, opts common.BucketOptions) *Bucket {
+	if child := b.buckets[name]; child != nil {
+		return child
+	}
+
+	key := []byte(name)
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	if !bytes.Equal(key, k) {
+		if !create {
+			return nil
+		}
+
+		// Create an empty, inline bucket, as CreateBucket does.
+		var bucket = Bucket{
+			tx:          b.tx,
+			InBucket:    &common.InBucket{},
+			rootNode:    &node{isLeaf: true},
+			opts:        opts,
+			FillPercent: DefaultFillPercent,
+		}
+		c.node().put(key, key, bucket.write(), 0, common.BucketLeafFlag)
+		b.page = nil
+		k, v, flags = c.seek(key)
+	}
+	if (flags & common.BucketLeafFlag) == 0 {
+		return nil
+	}
+
+	child := b.openBucket(v)
+	child.parent, child.name = b, k
+	if b.buckets != nil {
+		b.buckets[name] = child
+	}
+	return child
+}
+
+// indexExpiry adds a key expiring at the given time to the expiry index of
+// the bucket, which must exist. It does nothing if expires is zero.
+func (b *Bucket) indexExpiry(key []byte, expires int64) {
+	if expires == 0 {
+		return
+	}
+	b.expiryIndex(false).putIndexKey(expiryKey(key, expires))
+	if b.parent != nil {
+		b.parent.markExpiry(b.name)
+	}
+}
+
+// unindexExpiry removes a key expiring at the given time from the expiry
+// index of the bucket. It does nothing if expires is zero.
+func (b *Bucket) unindexExpiry(key []byte, expires int64) {
+	if expires == 0 {
+		return
+	}
+	if idx := b.expiryIndex(false); idx != nil {
+		idx.deleteIndexKey(expiryKey(key, expires))
+	}
+}
+
+// markExpiry records in the expiry index of the bucket, and of its parents,
+// that its nested bucket name has an expiry index, so that the reaper finds
+// it. The top-level buckets are found without it.
+func (b *Bucket) markExpiry(name []byte) {
+	for ; b.parent != nil; b, name = b.parent, b.name {
+		idx := b.expiryIndex(true)
+		if idx == nil {
+			return
+		}
+		key := append([]byte{ttlMarker}, name...)
+		if !idx.putIndexKey(key) {
+			// The parents are marked already.
+			return
+		}
+	}
+}
+
+// putIndexKey adds a key with an empty value to an expiry or secondary index,
+// without recording it as a change of the transaction. It reports whether the key
+// was added.
+func (b *Bucket) putIndexKey(key []byte) bool {
+	c := b.Cursor()
+	if k, _, _ := c.seek(key); bytes.Equal(key, k) {
+		return false
+	}
+	c.node().put(key, key, nil, 0, 0)
+	return true
+}
+
+// deleteIndexKey removes a key from an expiry or secondary index, without
+// recording it as a change of the transaction.
+func (b *Bucket) deleteIndexKey(key []byte) {
+	c := b.Cursor()
+	if k, _, _ := c.seek(key); bytes.Equal(key, k) {
+		c.node().del(key)
+	}
+}
+
+// ReapExpired deletes the keys put with Bucket.PutWithTTL that have expired,
+// in read-write transactions deleting at most Options.ExpiryReapTxMaxKeys
+// keys each, and returns how many it deleted. The deletions are seen by the
+// subscribers of DB.Subscribe like any other.
+//
+// It is called in the background when Options.ExpiryReapInterval is set.
+func (db *DB) ReapExpired() (int, error) {
+	return db.reapExpired(nil)
+}
+
+// reapExpired is like ReapExpired, but stops early once stop is closed.
+func (db *DB) reapExpired(stop <-chan struct{}) (int, error) {
+	if db.readOnly || db.follower {
+		return 0, berrors.ErrDatabaseReadOnly
+	}
+	txMaxKeys := db.expiryReapTxMaxKeys
+	if txMaxKeys <= 0 {
+		txMaxKeys = DefaultExpiryReapTxMaxKeys
+	}
+
+	// Keys expiring meanwhile are left for the next call, so that it ends
+	// even if keys keep expiring.
+	now := time.Now().UnixNano()
+	total := 0
+	for {
+		select {
+		case <-stop:
+			return total, berrors.ErrDatabaseNotOpen
+		default:
+		}
+
+		var r *reaper
+		var done bool
+		err := db.Update(func(tx *Tx) error {
+			var err error
+			r, done, err = tx.reapExpired(now, txMaxKeys)
+			if err == nil && !r.changed {
+				// Leave the database untouched.
+				return errNothingReaped
+			}
+			return err
+		})
+		if err == errNothingReaped {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+		total += r.deleted
+		db.statlock.Lock()
+		db.stats.ExpiredKeyN += r.deleted
+		db.statlock.Unlock()
+		if done {
+			return total, nil
+		}
+	}
+}
+
+// errNothingReaped rolls back a transaction of DB.ReapExpired which found
+// nothing to delete.
+var errNothingReaped = errors.New("nothing reaped")
+
+// reapExpired deletes at most max keys expired at the given time, from the
+// top-level buckets in order. It reports whether it deleted all of them.
+func (tx *Tx) reapExpired(now int64, max int) (*reaper, bool, error) {
+	var names [][]byte
+	c := tx.root.Cursor()
+	for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
+		if (flags & common.BucketLeafFlag) != 0 {
+			names = append(names, cloneBytes(k))
+		}
+	}
+
+	r := &reaper{now: now, budget: max}
+	for _, name := range names {
+		// Buckets with an unregistered comparator are left as is.
+		if b := tx.root.Bucket(name); b != nil {
+			if err := r.reap(b); err != nil {
+				return r, false, err
+			}
+		}
+		if r.budget <= 0 {
+			return r, false, nil
+		}
+	}
+	return r, true, nil
+}
+
+// reaper deletes the expired keys of a transaction.
+type reaper struct {
+	now     int64
+	budget  int // number of index keys left to remove in the transaction
+	deleted int
+	changed bool // whether the transaction was changed
+}
+
+// reap deletes the expired keys of a bucket, then those of its nested
+// buckets, and drops its expiry index once it is empty.
+func (r *reaper) reap(b *Bucket) error {
+	idx := b.expiryIndex(false)
+	if idx == nil {
+		return nil
+	}
+
+	c := idx.Cursor()
+	for k, _, _ := c.first(); k != nil && k[0] != ttlMarker && r.budget > 0; k, _, _ = c.first() {
+		if valueExpiry(k) > r.now {
+			break
+		}
+		expires, key := valueExpiry(k), cloneBytes(k[expirySize:])
+		r.budget--
+		r.changed = true
+
+		// The key may have been deleted along with its index key, for
+		// example if its bucket was deleted then created again.
+		kc := b.Cursor()
+		if ek, v, flags := kc.seek(key); bytes.Equal(key, ek) && (flags&common.ExpiringValueFlag) != 0 && valueExpiry(v) == expires {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+			r.deleted++
+		} else {
+			idx.deleteIndexKey(expiryKey(key, expires))
+		}
+	}
+
+	// The nested buckets are listed first, as reaping them may change the
+	// index.
+	var names [][]byte
+	for k, _, _ := c.seekNext([]byte{ttlMarker}); k != nil; k, _, _ = c.next() {
+		names = append(names, cloneBytes(k[1:]))
+	}
+	for _, name := range names {
+		if r.budget <= 0 {
+			return nil
+		}
+		child := b.Bucket(name)
+		if child == nil || child.expiryIndex(false) == nil {
+			// The bucket was deleted or moved.
+			idx.deleteIndexKey(append([]byte{ttlMarker}, name...))
+			r.budget--
+			r.changed = true
+			continue
+		}
+		if err := r.reap(child); err != nil {
+			return err
+		}
+	}
+	if r.budget <= 0 {
+		return nil
+	}
+
+	if k, _, _ := idx.Cursor().first(); k == nil {
+		b.dropExpiryIndex()
+		r.changed = true
+	}
+	return nil
+}
+
+// dropExpiryIndex deletes the empty expiry index of the bucket, and its mark
+// in the index of the parent.
+func (b *Bucket) dropExpiryIndex() {
+	b.dropInternalBucket(ttlIndexKey)
+	if b.parent != nil {
+		if pidx := b.parent.expiryIndex(false); pidx != nil {
+			pidx.deleteIndexKey(append([]byte{ttlMarker}, b.name...))
+		}
+	}
+}
+
+// dropInternalBucket deletes the existing nested bucket name of the bucket,
+// used by the library itself, which has no nested buckets of its own.
+func (b *Bucket) dropInternalBucket(name string) {
+	child := b.internalBucket(name, false, common.BucketOptions{})
+	delete(b.buckets, name)
+	child.nodes = nil
+	child.rootNode = nil
+	child.free()
+
+	key := []byte(name)
+	c := b.Cursor()
+	c.seek(key)
+	c.node().del(key)
+}
+
+// runReaper calls DB.ReapExpired at the given interval until stop is closed.
+func (db *DB) runReaper(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := db.reapExpired(stop); err != nil {
+			if errors.Is(err, berrors.ErrDatabaseNotOpen) {
+				return
+			}
+			db.Logger().Errorf("reaping expired keys of bbolt db (%s) failed: %v", db.path, err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package bbolt_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// visibleKeys returns the keys of a bucket seen by its cursor, forward and
+// backward.
+func visibleKeys(t *testing.T, b *bolt.Bucket) []string {
+	var keys, reversed []string
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, string(k))
+	}
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		reversed = append([]string{string(k)}, reversed...)
+	}
+	require.Equal(t, keys, reversed)
+	return keys
+}
+
+// Ensure that the keys put with a time-to-live are hidden once they expire.
+func TestBucket_PutWithTTL(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		require.ErrorIs(t, b.PutWithTTL([]byte("foo"), []byte("bar"), 0), berrors.ErrInvalidTTL)
+		require.NoError(t, b.PutWithTTL([]byte("a"), []byte("1"), 50*time.Millisecond))
+		require.NoError(t, b.Put([]byte("b"), []byte("2")))
+		require.NoError(t, b.PutWithTTL([]byte("c"), []byte("3"), time.Hour))
+		require.NoError(t, b.PutWithTTL([]byte("d"), []byte("4"), 50*time.Millisecond))
+		require.NoError(t, b.PutWithTTL([]byte("e"), []byte("5"), 50*time.Millisecond))
+		// Putting the key again without a time-to-live keeps it.
+		require.NoError(t, b.Put([]byte("e"), []byte("6")))
+		require.Equal(t, []byte("1"), b.Get([]byte("a")))
+		require.Equal(t, []string{"a", "b", "c", "d", "e"}, visibleKeys(t, b))
+		return nil
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Nil(t, b.Get([]byte("a")))
+		require.Equal(t, []byte("3"), b.Get([]byte("c")))
+		require.Equal(t, []byte("6"), b.Get([]byte("e")))
+		require.Equal(t, []string{"b", "c", "e"}, visibleKeys(t, b))
+
+		c := b.Cursor()
+		k, _ := c.Seek([]byte("a"))
+		require.Equal(t, []byte("b"), k)
+		k, _ = c.Seek([]byte("d"))
+		require.Equal(t, []byte("e"), k)
+		k, _ = c.SeekLE([]byte("d"))
+		require.Equal(t, []byte("c"), k)
+		k, _ = c.SeekLT([]byte("b"))
+		require.Nil(t, k)
+
+		// The expiry index is not a nested bucket of its own.
+		err := b.ForEachBucket(func(k []byte) error {
+			return fmt.Errorf("unexpected bucket %q", k)
+		})
+		require.NoError(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Deleting the bucket releases the pages of its expiry index.
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
+// Ensure that the expiry index of a bucket with a comparator is not passed to
+// the comparator, which only accepts 8-byte keys.
+func TestBucket_PutWithTTL_Comparator(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, comparatorOptions())
+	const n = 1000
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Comparator: "uint64-desc"})
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			ttl := time.Hour
+			if i%2 == 0 {
+				ttl = 50 * time.Millisecond
+			}
+			if err := b.PutWithTTL(u64(i), []byte(fmt.Sprintf("v%d", i)), ttl); err != nil {
+				return err
+			}
+		}
+		assertDescending(t, b, n)
+		return nil
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	reaped, err := db.ReapExpired()
+	require.NoError(t, err)
+	require.Equal(t, n/2, reaped)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		want := uint64(n)
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			want -= 2
+			require.Equal(t, want+1, binary.BigEndian.Uint64(k))
+		}
+		require.Zero(t, want)
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
+
+// Ensure that the expired keys of nested buckets are deleted in bounded
+// transactions, along with the expiry indexes once they are empty.
+func TestDB_ReapExpired(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{ExpiryReapTxMaxKeys: 30})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		grandchild, err := child.CreateBucket([]byte("grandchild"))
+		if err != nil {
+			return err
+		}
+		deleted, err := b.CreateBucket([]byte("deleted"))
+		if err != nil {
+			return err
+		}
+		for _, bkt := range []*bolt.Bucket{b, child, grandchild, deleted} {
+			for i := 0; i < 100; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if i%4 == 0 {
+					err = bkt.Put(k, []byte("forever"))
+				} else {
+					err = bkt.PutWithTTL(k, []byte("soon"), 10*time.Millisecond)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The keys of a bucket deleted meanwhile are not counted.
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).DeleteBucket([]byte("deleted"))
+	})
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	var changes int
+	sub, err := db.Subscribe(nil, 0, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	n, err := db.ReapExpired()
+	require.NoError(t, err)
+	require.Equal(t, 3*75, n)
+	require.Equal(t, 3*75, db.Stats().ExpiredKeyN)
+	for changes < 3*75 {
+		cs := <-sub.C()
+		changes += len(cs.Changes)
+	}
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		// The expiry indexes are dropped.
+		stats := b.Stats()
+		require.Equal(t, 3, stats.BucketN)
+		// The keys left, and the two nested buckets.
+		require.Equal(t, 3*25+2, stats.KeyN)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Nothing is committed when there is nothing to delete.
+	txid := func() int {
+		tx, err := db.Begin(false)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		return tx.ID()
+	}
+	before := txid()
+	n, err = db.ReapExpired()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Equal(t, before, txid())
+}
+
+// Ensure that the expired keys are deleted in the background.
+func TestDB_ExpiryReapInterval(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{ExpiryReapInterval: 10 * time.Millisecond})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := b.PutWithTTL([]byte(fmt.Sprint(i)), []byte("v"), time.Millisecond); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return db.Stats().ExpiredKeyN == 10
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Stop the reaper before the database is checked on cleanup, which must
+	// not run along with read-write transactions.
+	db.MustClose()
+	db.SetOptions(&bolt.Options{})
+	db.MustReopen()
+}
+
+// Ensure that compacting keeps the expiry time of the keys and leaves out
+// those that have expired.
+func TestCompact_PutWithTTL(t *testing.T) {
+	src := btesting.MustCreateDB(t)
+	err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.PutWithTTL([]byte("expired"), []byte("v"), time.Millisecond); err != nil {
+			return err
+		}
+		return b.PutWithTTL([]byte("later"), []byte("v"), time.Hour)
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	dst, err := bolt.Open(filepath.Join(t.TempDir(), "dst.db"), 0600, nil)
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, bolt.Compact(dst, src.DB, 0))
+
+	err = dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []string{"later"}, visibleKeys(t, b))
+		// The expiry time is stored before the value, and the expiry index
+		// is a nested bucket.
+		stats := b.Stats()
+		require.Equal(t, 8, stats.ValueStoredBytes-stats.ValueRawBytes)
+		require.Equal(t, 2, stats.BucketN)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that the keys put with a time-to-live by an optimistic transaction
+// keep their expiry time once replayed.
+func TestDB_OptimisticUpdate_PutWithTTL(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).PutWithTTL([]byte("foo"), []byte("bar"), time.Hour)
+	})
+	require.NoError(t, err)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("bar"), b.Get([]byte("foo")))
+		stats := b.Stats()
+		require.Equal(t, 8, stats.ValueStoredBytes-stats.ValueRawBytes)
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
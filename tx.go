@@ -34,6 +34,35 @@ type Tx struct {
 	stats          TxStats
 	commitHandlers []func()
 
+	// scope holds the top-level buckets declared by DB.UpdateBuckets, and
+	// freed the pages it freed, which are released once it is merged.
+	scope map[string]struct{}
+	freed []common.Pgid
+
+	// opt records the reads and changes of a transaction started by
+	// DB.OptimisticUpdate, which are checked and replayed at commit time.
+	opt *optimisticLog
+
+	// changes records the changes delivered to the subscribers once the
+	// transaction is committed.
+	changes *changeLog
+
+	// replica records the pages written by the transaction, which are sent
+	// to the followers once it is committed.
+	replica *replicaLog
+
+	// noGrow makes the commit fail instead of moving the high water mark up,
+	// for the transactions relocating pages during DB.CompactInPlace.
+	noGrow bool
+
+	// startTime is the time the transaction started at, in Unix
+	// nanoseconds, which the keys put with Bucket.PutWithTTL expire at.
+	startTime int64
+
+	// err is the first page checksum mismatch or decryption failure met by
+	// the transaction.
+	err atomic.Pointer[error]
+
 	// WriteFlag specifies the flag for write-related methods like WriteTo().
 	// Tx opens the database file with the specified flag to copy the data.
 	//
@@ -45,12 +74,18 @@ type Tx struct {
 
 // init initializes the transaction.
 func (tx *Tx) init(db *DB) {
+	tx.initAt(db, db.meta())
+}
+
+// initAt initializes the transaction from the given meta.
+func (tx *Tx) initAt(db *DB, m *common.Meta) {
 	tx.db = db
 	tx.pages = nil
+	tx.startTime = time.Now().UnixNano()
 
 	// Copy the meta page since it can be changed by the writer.
 	tx.meta = &common.Meta{}
-	db.meta().Copy(tx.meta)
+	m.Copy(tx.meta)
 
 	// Copy over the root bucket.
 	tx.root = newBucket(tx)
@@ -82,6 +117,20 @@ func (tx *Tx) Size() int64 {
 	return int64(tx.meta.Pgid()) * int64(tx.db.pageSize)
 }
 
+// Err returns the first page checksum mismatch met by the transaction, as an
+// error wrapping ErrPageChecksum, or the first page of an encrypted database
+// which cannot be decrypted, as an error wrapping ErrDecrypt, or nil. The
+// pages failing their checksum or decryption are read as if they held no key,
+// so the values read by a transaction must not be trusted once Err returns an
+// error; Bucket.GetE and Cursor.Err report it where the values are read. A
+// read-write transaction failing either cannot be committed.
+func (tx *Tx) Err() error {
+	if err := tx.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
 // Writable returns whether the transaction can perform write operations.
 func (tx *Tx) Writable() bool {
 	return tx.writable
@@ -91,6 +140,7 @@ func (tx *Tx) Writable() bool {
 // All items in the cursor will return a nil value because all root bucket keys point to buckets.
 // The cursor is only valid as long as the transaction is open.
 // Do not use a cursor after the transaction is closed.
+// The cursor skips the keys of corrupted pages; see Tx.Err.
 func (tx *Tx) Cursor() *Cursor {
 	return tx.root.Cursor()
 }
@@ -106,29 +156,54 @@ func (tx *Tx) Inspect() BucketStructure {
 }
 
 // Bucket retrieves a bucket by name.
-// Returns nil if the bucket does not exist.
+// Returns nil if the bucket does not exist or if it cannot be opened; use
+// OpenBucket to know why.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (tx *Tx) Bucket(name []byte) *Bucket {
+	if !tx.inScope(name) {
+		return nil
+	}
 	return tx.root.Bucket(name)
 }
 
+// OpenBucket retrieves a bucket by name, like Bucket, but returns why it
+// cannot be opened, as Bucket.OpenBucket does.
+// Returns ErrBucketNotDeclared if the bucket is out of the scope of the
+// transaction.
+func (tx *Tx) OpenBucket(name []byte) (*Bucket, error) {
+	if !tx.inScope(name) {
+		return nil, berrors.ErrBucketNotDeclared
+	}
+	return tx.root.OpenBucket(name)
+}
+
 // CreateBucket creates a new bucket.
-// Returns an error if the bucket already exists, if the bucket name is blank, or if the bucket name is too long.
+// Returns an error if the bucket already exists, if the bucket name is blank, if the
+// bucket name is reserved, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	if !tx.inScope(name) {
+		return nil, berrors.ErrBucketNotDeclared
+	}
 	return tx.root.CreateBucket(name)
 }
 
 // CreateBucketIfNotExists creates a new bucket if it doesn't already exist.
-// Returns an error if the bucket name is blank, or if the bucket name is too long.
+// Returns an error if the bucket name is blank, if the bucket name is reserved, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if !tx.inScope(name) {
+		return nil, berrors.ErrBucketNotDeclared
+	}
 	return tx.root.CreateBucketIfNotExists(name)
 }
 
 // DeleteBucket deletes a bucket.
 // Returns an error if the bucket cannot be found or if the key represents a non-bucket value.
 func (tx *Tx) DeleteBucket(name []byte) error {
+	if !tx.inScope(name) {
+		return berrors.ErrBucketNotDeclared
+	}
 	return tx.root.DeleteBucket(name)
 }
 
@@ -136,11 +211,15 @@ func (tx *Tx) DeleteBucket(name []byte) error {
 // Returns an error if
 //  1. the sub-bucket cannot be found in the source bucket;
 //  2. or the key already exists in the destination bucket;
-//  3. the key represents a non-bucket value.
+//  3. the key represents a non-bucket value;
+//  4. or the key is a reserved bucket name.
 //
 // If src is nil, it means moving a top level bucket into the target bucket.
 // If dst is nil, it means converting the child bucket into a top level bucket.
 func (tx *Tx) MoveBucket(child []byte, src *Bucket, dst *Bucket) error {
+	if (src == nil || dst == nil) && !tx.inScope(child) {
+		return berrors.ErrBucketNotDeclared
+	}
 	if src == nil {
 		src = &tx.root
 	}
@@ -152,10 +231,19 @@ func (tx *Tx) MoveBucket(child []byte, src *Bucket, dst *Bucket) error {
 
 // ForEach executes a function for each bucket in the root.
 // If the provided function returns an error then the iteration is stopped and
-// the error is returned to the caller.
+// the error is returned to the caller. The iteration is also stopped if a
+// bucket cannot be opened, for example because its key comparator is not
+// registered, in which case the error of Tx.OpenBucket is returned.
 func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
 	return tx.root.ForEach(func(k, v []byte) error {
-		return fn(k, tx.root.Bucket(k))
+		if !tx.inScope(k) {
+			return nil
+		}
+		b, err := tx.root.OpenBucket(k)
+		if err != nil {
+			return fmt.Errorf("bucket %q: %w", k, err)
+		}
+		return fn(k, b)
 	})
 }
 
@@ -190,6 +278,12 @@ func (tx *Tx) Commit() (err error) {
 
 	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
 
+	// Record the versions of the keys written to in versioned buckets.
+	tx.root.commitVersions()
+
+	// Retain the transaction being superseded, if the history is enabled.
+	retained, retainedChanged := tx.commitTxHistory()
+
 	// Rebalance nodes which have had deletions.
 	var startTime = time.Now()
 	tx.root.rebalance()
@@ -203,8 +297,12 @@ func (tx *Tx) Commit() (err error) {
 	startTime = time.Now()
 	if err = tx.root.spill(); err != nil {
 		lg.Errorf("spilling data onto dirty pages failed: %v", err)
-		tx.rollback()
-		return err
+		return tx.rollbackAfter(err)
+	}
+
+	// The pages failing their checksum were read as empty.
+	if err = tx.Err(); err != nil {
+		return tx.rollbackAfter(err)
 	}
 	tx.stats.IncSpillTime(time.Since(startTime))
 
@@ -213,7 +311,7 @@ func (tx *Tx) Commit() (err error) {
 
 	// Free the old freelist because commit writes out a fresh freelist.
 	if tx.meta.Freelist() != common.PgidNoFreelist {
-		tx.db.freelist.free(tx.meta.Txid(), tx.db.page(tx.meta.Freelist()))
+		tx.db.freelist.free(tx.meta.Txid(), tx.db.rawPage(tx.meta.Freelist()))
 	}
 
 	if !tx.db.NoFreelistSync {
@@ -226,6 +324,10 @@ func (tx *Tx) Commit() (err error) {
 		tx.meta.SetFreelist(common.PgidNoFreelist)
 	}
 
+	if tx.noGrow && tx.meta.Pgid() > opgid {
+		return tx.rollbackAfter(errCompactNoRoom)
+	}
+
 	// If the high water mark has moved up then attempt to grow the database.
 	if tx.meta.Pgid() > opgid {
 		_ = errors.New("")
@@ -234,8 +336,7 @@ func (tx *Tx) Commit() (err error) {
 		// return errors.New(lackOfDiskSpace)
 		if err = tx.db.grow(int(tx.meta.Pgid()+1) * tx.db.pageSize); err != nil {
 			lg.Errorf("growing db size failed, pgid: %d, pagesize: %d, error: %v", tx.meta.Pgid(), tx.db.pageSize, err)
-			tx.rollback()
-			return err
+			return tx.rollbackAfter(err)
 		}
 	}
 
@@ -243,8 +344,7 @@ func (tx *Tx) Commit() (err error) {
 	startTime = time.Now()
 	if err = tx.write(); err != nil {
 		lg.Errorf("writing data failed: %v", err)
-		tx.rollback()
-		return err
+		return tx.rollbackAfter(err)
 	}
 
 	// If strict mode is enabled then perform a consistency check.
@@ -266,11 +366,22 @@ func (tx *Tx) Commit() (err error) {
 	// Write meta to disk.
 	if err = tx.writeMeta(); err != nil {
 		lg.Errorf("writeMeta failed: %v", err)
-		tx.rollback()
-		return err
+		return tx.rollbackAfter(err)
 	}
 	tx.stats.IncWriteTime(time.Since(startTime))
 
+	// Hold the pages of the retained transactions before the writer lock is
+	// released.
+	if retainedChanged {
+		tx.db.metalock.Lock()
+		tx.db.retained = retained
+		tx.db.metalock.Unlock()
+	}
+
+	// Publish the changes now that they are durable.
+	tx.db.publishChanges(tx)
+	tx.db.publishReplica(tx)
+
 	// Finalize the transaction.
 	tx.close()
 
@@ -285,14 +396,12 @@ func (tx *Tx) Commit() (err error) {
 func (tx *Tx) commitFreelist() error {
 	// Allocate new pages for the new free list. This will overestimate
 	// the size of the freelist but not underestimate the size (which would be bad).
-	p, err := tx.allocate((tx.db.freelist.size() / tx.db.pageSize) + 1)
+	p, err := tx.allocate(((tx.db.freelist.size() + tx.db.pageOverhead()) / tx.db.pageSize) + 1)
 	if err != nil {
-		tx.rollback()
-		return err
+		return tx.rollbackAfter(err)
 	}
 	if err := tx.db.freelist.write(p); err != nil {
-		tx.rollback()
-		return err
+		return tx.rollbackAfter(err)
 	}
 	tx.meta.SetFreelist(p.Id())
 
@@ -301,12 +410,18 @@ func (tx *Tx) commitFreelist() error {
 
 // Rollback closes the transaction and ignores all previous updates. Read-only
 // transactions must be rolled back and not committed.
+//
+// Rolling back a read-only transaction returns Err, so that the values read
+// from a corrupted page are not silently trusted.
 func (tx *Tx) Rollback() error {
 	common.Assert(!tx.managed, "managed tx rollback not allowed")
 	if tx.db == nil {
 		return berrors.ErrTxClosed
 	}
 	tx.nonPhysicalRollback()
+	if !tx.writable {
+		return tx.Err()
+	}
 	return nil
 }
 
@@ -322,10 +437,14 @@ func (tx *Tx) nonPhysicalRollback() {
 }
 
 // rollback needs to reload the free pages from disk in case some system error happens like fsync error.
-func (tx *Tx) rollback() {
+// It returns an error if the freelist page cannot be read, for example because
+// it cannot be decrypted, in which case the free pages are left as rolled back
+// in memory.
+func (tx *Tx) rollback() error {
 	if tx.db == nil {
-		return
+		return nil
 	}
+	var err error
 	if tx.writable {
 		tx.db.freelist.rollback(tx.meta.Txid())
 		// When mmap fails, the `data`, `dataref` and `datasz` may be reset to
@@ -337,11 +456,24 @@ func (tx *Tx) rollback() {
 				tx.db.freelist.noSyncReload(tx.db.freepages())
 			} else {
 				// Read free page list from freelist page.
-				tx.db.freelist.reload(tx.db.page(tx.db.meta().Freelist()))
+				var p *common.Page
+				if p, err = tx.db.pageE(tx.db.meta().Freelist(), tx.db.meta().Txid()); err == nil {
+					tx.db.freelist.reload(p)
+				}
 			}
 		}
 	}
 	tx.close()
+	return err
+}
+
+// rollbackAfter rolls back the transaction after err made its commit fail,
+// and returns err along with the error of the rollback, if any.
+func (tx *Tx) rollbackAfter(err error) error {
+	if rerr := tx.rollback(); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	return err
 }
 
 func (tx *Tx) close() {
@@ -425,6 +557,13 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 		return n, fmt.Errorf("meta 1 copy: %s", err)
 	}
 
+	// Copy data pages, some of which may not be checkpointed yet in WAL mode.
+	if tx.db.wal != nil {
+		wn, err := tx.writeWALPagesTo(w, f)
+		n += wn
+		return n, err
+	}
+
 	// Move past the meta pages in the file.
 	if _, err := f.Seek(int64(tx.db.pageSize*2), io.SeekStart); err != nil {
 		return n, fmt.Errorf("seek: %s", err)
@@ -488,19 +627,48 @@ func (tx *Tx) write() error {
 	tx.pages = make(map[common.Pgid]*common.Page)
 	sort.Sort(pages)
 
+	// In WAL mode the pages are appended to the log along with the meta page.
+	wal := tx.db.wal
+	if wal != nil {
+		wal.begin()
+	}
+
 	// Write pages to disk in order.
 	for _, p := range pages {
 		rem := (uint64(p.Overflow()) + 1) * uint64(tx.db.pageSize)
 		offset := int64(p.Id()) * int64(tx.db.pageSize)
 		var written uintptr
 
+		// Add the page checksum and encrypt the page, dropping the state
+		// kept about its previous version.
+		ptr := unsafe.Pointer(p)
+		if tx.db.pageChecksums {
+			tx.db.setPageChecksum(p)
+			tx.db.uncheckPage(p.Id())
+		}
+		if tx.db.cipher != nil {
+			buf, err := tx.db.encryptPage(p, tx.meta.Txid())
+			if err != nil {
+				lg.Errorf("encrypting page failed, pgid: %d, error: %v", p.Id(), err)
+				return err
+			}
+			ptr = unsafe.Pointer(&buf[0])
+			tx.db.pageCache.evict(p.Id())
+		}
+		tx.replica.page(p.Id(), common.UnsafeByteSlice(ptr, 0, 0, int(rem)))
+		tx.db.pageTxids.mark(p.Id(), int(p.Overflow())+1, tx.meta.Txid())
+		if wal != nil {
+			wal.stage(p.Id(), common.UnsafeByteSlice(ptr, 0, 0, int(rem)))
+			continue
+		}
+
 		// Write out page in "max allocation" sized chunks.
 		for {
 			sz := rem
 			if sz > maxAllocSize-1 {
 				sz = maxAllocSize - 1
 			}
-			buf := common.UnsafeByteSlice(unsafe.Pointer(p), written, 0, int(sz))
+			buf := common.UnsafeByteSlice(ptr, written, 0, int(sz))
 
 			if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
 				lg.Errorf("writeAt failed, offset: %d: %w", offset, err)
@@ -523,7 +691,7 @@ func (tx *Tx) write() error {
 	}
 
 	// Ignore file sync if flag is set on DB.
-	if !tx.db.NoSync || common.IgnoreNoSync {
+	if wal == nil && (!tx.db.NoSync || common.IgnoreNoSync) {
 		// gofail: var beforeSyncDataPages struct{}
 		if err := fdatasync(tx.db); err != nil {
 			lg.Errorf("[GOOS: %s, GOARCH: %s] fdatasync failed: %w", runtime.GOOS, runtime.GOARCH, err)
@@ -558,6 +726,24 @@ func (tx *Tx) writeMeta() error {
 	buf := make([]byte, tx.db.pageSize)
 	p := tx.db.pageInBuffer(buf, 0)
 	tx.meta.Write(p)
+	tx.replica.meta(buf)
+
+	// Append the transaction to the write-ahead log in WAL mode.
+	if wal := tx.db.wal; wal != nil {
+		full, err := wal.commit(buf, tx.meta.Txid(), !tx.db.NoSync || common.IgnoreNoSync, tx.db.walCheckpointSize)
+		if err != nil {
+			lg.Errorf("appending to write-ahead log failed, txid: %d, error: %v", tx.meta.Txid(), err)
+			return err
+		}
+		if full {
+			select {
+			case wal.full <- struct{}{}:
+			default:
+			}
+		}
+		tx.stats.IncWrite(1)
+		return nil
+	}
 
 	// Write the meta page to file.
 	if _, err := tx.db.ops.writeAt(buf, int64(p.Id())*int64(tx.db.pageSize)); err != nil {
@@ -589,8 +775,14 @@ func (tx *Tx) page(id common.Pgid) *common.Page {
 		}
 	}
 
-	// Otherwise return directly from the mmap.
-	p := tx.db.page(id)
+	// Otherwise return directly from the mmap. A page of an encrypted
+	// database which cannot be decrypted fails the transaction, which reads
+	// it as empty.
+	p, err := tx.db.pageE(id, tx.meta.Txid())
+	if err != nil {
+		tx.setErr(err)
+		return emptyPage(id)
+	}
 	p.FastCheck(id)
 	return p
 }
@@ -630,8 +822,9 @@ func (tx *Tx) Page(id int) (*common.PageInfo, error) {
 		return nil, berrors.ErrFreePagesNotLoaded
 	}
 
-	// Build the page info.
-	p := tx.db.page(common.Pgid(id))
+	// Build the page info. Only the page header is needed, which is never
+	// encrypted.
+	p := tx.db.rawPage(common.Pgid(id))
 	info := &common.PageInfo{
 		ID:            id,
 		Count:         int(p.Count()),
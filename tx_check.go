@@ -1,6 +1,7 @@
 package bbolt
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 
@@ -37,7 +38,9 @@ func (tx *Tx) Check(options ...CheckOption) <-chan error {
 
 func (tx *Tx) check(cfg checkConfig, ch chan error) {
 	// Force loading free list if opened in ReadOnly mode.
-	tx.db.loadFreelist()
+	if err := tx.db.loadFreelist(); err != nil {
+		ch <- err
+	}
 
 	// Check if any pages are double freed.
 	freed := make(map[common.Pgid]bool)
@@ -55,6 +58,9 @@ func (tx *Tx) check(cfg checkConfig, ch chan error) {
 	reachable[0] = tx.page(0) // meta0
 	reachable[1] = tx.page(1) // meta1
 	if tx.meta.Freelist() != common.PgidNoFreelist {
+		if err := tx.verifyPage(tx.page(tx.meta.Freelist())); err != nil {
+			ch <- err
+		}
 		for i := uint32(0); i <= tx.page(tx.meta.Freelist()).Overflow(); i++ {
 			reachable[tx.meta.Freelist()+common.Pgid(i)] = tx.page(tx.meta.Freelist())
 		}
@@ -85,7 +91,7 @@ func (tx *Tx) check(cfg checkConfig, ch chan error) {
 
 func (tx *Tx) recursivelyCheckPage(pageId common.Pgid, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool,
 	kvStringer KVStringer, ch chan error) {
-	tx.checkInvariantProperties(pageId, reachable, freed, kvStringer, ch)
+	tx.checkInvariantProperties(pageId, &tx.root, reachable, freed, kvStringer, ch)
 	tx.recursivelyCheckBucketInPage(pageId, reachable, freed, kvStringer, ch)
 }
 
@@ -103,16 +109,8 @@ func (tx *Tx) recursivelyCheckBucketInPage(pageId common.Pgid, reachable map[com
 		for i := range p.LeafPageElements() {
 			elem := p.LeafPageElement(uint16(i))
 			if elem.IsBucketEntry() {
-				inBkt := common.NewInBucket(pageId, 0)
-				tmpBucket := Bucket{
-					InBucket:    &inBkt,
-					rootNode:    &node{isLeaf: p.IsLeafPage()},
-					FillPercent: DefaultFillPercent,
-					tx:          tx,
-				}
-				if child := tmpBucket.Bucket(elem.Key()); child != nil {
-					tx.recursivelyCheckBucket(child, reachable, freed, kvStringer, ch)
-				}
+				child := tx.root.openBucket(elem.Value())
+				tx.recursivelyCheckBucket(child, reachable, freed, kvStringer, ch)
 			}
 		}
 	default:
@@ -122,29 +120,46 @@ func (tx *Tx) recursivelyCheckBucketInPage(pageId common.Pgid, reachable map[com
 
 func (tx *Tx) recursivelyCheckBucket(b *Bucket, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool,
 	kvStringer KVStringer, ch chan error) {
+	tx.checkBlobs(b, reachable, freed, ch)
+	tx.checkValueTrees(b, reachable, freed, kvStringer, ch)
+
 	// Ignore inline buckets.
 	if b.RootPage() == 0 {
 		return
 	}
 
-	tx.checkInvariantProperties(b.RootPage(), reachable, freed, kvStringer, ch)
+	tx.checkInvariantProperties(b.RootPage(), b, reachable, freed, kvStringer, ch)
 
-	// Check each bucket within this bucket.
-	_ = b.ForEachBucket(func(k []byte) error {
-		if child := b.Bucket(k); child != nil {
-			tx.recursivelyCheckBucket(child, reachable, freed, kvStringer, ch)
+	// Check each bucket within this bucket. Children are opened directly so
+	// that buckets with an unregistered comparator are still walked. Pages
+	// failing their checksum have already been reported above.
+	c := b.Cursor()
+	for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
+		if flags&common.BucketLeafFlag != 0 {
+			_, v, _ := c.keyValue()
+			tx.recursivelyCheckBucket(b.openBucket(v), reachable, freed, kvStringer, ch)
 		}
-		return nil
-	})
+	}
+
+	tx.checkIndexes(b, kvStringer.KeyToString, ch)
 }
 
-func (tx *Tx) checkInvariantProperties(pageId common.Pgid, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool,
+// checkInvariantProperties verifies the pages reachable from pageId, which is
+// the root page of bucket b (or one of its descendants), and their key order.
+func (tx *Tx) checkInvariantProperties(pageId common.Pgid, b *Bucket, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool,
 	kvStringer KVStringer, ch chan error) {
 	tx.forEachPage(pageId, func(p *common.Page, _ int, stack []common.Pgid) {
 		verifyPageReachable(p, tx.meta.Pgid(), stack, reachable, freed, ch)
+		if err := tx.verifyPage(p); err != nil {
+			ch <- fmt.Errorf("%w (stack: %v)", err, stack)
+		}
 	})
 
-	tx.recursivelyCheckPageKeyOrder(pageId, kvStringer.KeyToString, ch)
+	if b.missingComparator() {
+		ch <- fmt.Errorf("page %d: cannot verify key order: comparator %q is not registered", pageId, b.opts.Comparator)
+		return
+	}
+	tx.recursivelyCheckPageKeyOrder(pageId, b.compareKeys, kvStringer.KeyToString, ch)
 }
 
 func verifyPageReachable(p *common.Page, hwm common.Pgid, stack []common.Pgid, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool, ch chan error) {
@@ -169,12 +184,71 @@ func verifyPageReachable(p *common.Page, hwm common.Pgid, stack []common.Pgid, r
 	}
 }
 
+// checkBlobs verifies the blobs of bucket b, inline or not, and marks their
+// pages reachable.
+func (tx *Tx) checkBlobs(b *Bucket, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool, ch chan error) {
+	b.forEachBlob(func(key []byte, ptr blobPointer) {
+		count := tx.db.blobPageCount(ptr.size)
+		if ptr.pgid < 2 || ptr.pgid+common.Pgid(count) > tx.meta.Pgid() {
+			ch <- fmt.Errorf("page %d: blob of key %x out of bounds: %d", int(ptr.pgid), key, int(tx.meta.Pgid()))
+			return
+		}
+		p := tx.page(ptr.pgid)
+		for i := common.Pgid(0); i < common.Pgid(count); i++ {
+			var id = ptr.pgid + i
+			if _, ok := reachable[id]; ok {
+				ch <- fmt.Errorf("page %d: multiple references (blob of key %x)", int(id), key)
+			}
+			reachable[id] = p
+		}
+		if freed[p.Id()] {
+			ch <- fmt.Errorf("page %d: reachable freed", int(p.Id()))
+		} else if !p.IsBlobPage() {
+			ch <- fmt.Errorf("page %d: invalid type: %s (blob of key %x)", int(p.Id()), p.Typ(), key)
+		} else if int(p.Overflow())+1 != count {
+			ch <- fmt.Errorf("page %d: blob of %d bytes has %d overflow pages (key %x)", int(p.Id()), ptr.size, p.Overflow(), key)
+		} else if err := tx.verifyPage(p); err != nil {
+			ch <- fmt.Errorf("%w (blob of key %x)", err, key)
+		}
+	})
+}
+
+// checkValueTrees verifies the chunk trees of the chunked values of bucket b,
+// inline or not, and marks their pages reachable.
+func (tx *Tx) checkValueTrees(b *Bucket, reachable map[common.Pgid]*common.Page, freed map[common.Pgid]bool,
+	kvStringer KVStringer, ch chan error) {
+	chunkSize := tx.db.valueChunkSize()
+	b.forEachValueTree(func(key []byte, tree *Bucket) {
+		if tree.RootPage() != 0 {
+			tx.checkInvariantProperties(tree.RootPage(), tree, reachable, freed, kvStringer, ch)
+		}
+
+		// Each chunk but the last one is full, and they add up to the size.
+		size, n := int64(tree.InSequence()), int64(0)
+		c := tree.Cursor()
+		for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+			switch {
+			case flags != 0 || !bytes.Equal(k, chunkKey(n)):
+				ch <- fmt.Errorf("chunked value of key %s: unexpected chunk %x (flags: %x)", kvStringer.KeyToString(key), k, flags)
+				return
+			case int64(len(v)) != min(chunkSize, size-n*chunkSize):
+				ch <- fmt.Errorf("chunked value of key %s: chunk %d of %d bytes in a value of %d bytes", kvStringer.KeyToString(key), n, len(v), size)
+				return
+			}
+			n++
+		}
+		if n*chunkSize < size {
+			ch <- fmt.Errorf("chunked value of key %s: %d chunks hold less than %d bytes", kvStringer.KeyToString(key), n, size)
+		}
+	})
+}
+
 // recursivelyCheckPageKeyOrder verifies database consistency with respect to b-tree
 // key order constraints:
 //   - keys on pages must be sorted
 //   - keys on children pages are between 2 consecutive keys on the parent's branch page).
-func (tx *Tx) recursivelyCheckPageKeyOrder(pgId common.Pgid, keyToString func([]byte) string, ch chan error) {
-	tx.recursivelyCheckPageKeyOrderInternal(pgId, nil, nil, nil, keyToString, ch)
+func (tx *Tx) recursivelyCheckPageKeyOrder(pgId common.Pgid, compare Comparator, keyToString func([]byte) string, ch chan error) {
+	tx.recursivelyCheckPageKeyOrderInternal(pgId, nil, nil, nil, compare, keyToString, ch)
 }
 
 // recursivelyCheckPageKeyOrderInternal verifies that all keys in the subtree rooted at `pgid` are:
@@ -184,7 +258,7 @@ func (tx *Tx) recursivelyCheckPageKeyOrder(pgId common.Pgid, keyToString func([]
 //     `pagesStack` is expected to contain IDs of pages from the tree root to `pgid` for the clean debugging message.
 func (tx *Tx) recursivelyCheckPageKeyOrderInternal(
 	pgId common.Pgid, minKeyClosed, maxKeyOpen []byte, pagesStack []common.Pgid,
-	keyToString func([]byte) string, ch chan error) (maxKeyInSubtree []byte) {
+	compare Comparator, keyToString func([]byte) string, ch chan error) (maxKeyInSubtree []byte) {
 
 	p := tx.page(pgId)
 	pagesStack = append(pagesStack, pgId)
@@ -194,25 +268,26 @@ func (tx *Tx) recursivelyCheckPageKeyOrderInternal(
 		runningMin := minKeyClosed
 		for i := range p.BranchPageElements() {
 			elem := p.BranchPageElement(uint16(i))
-			verifyKeyOrder(elem.Pgid(), "branch", i, elem.Key(), runningMin, maxKeyOpen, ch, keyToString, pagesStack)
+			key := p.BranchPageKey(uint16(i))
+			verifyKeyOrder(elem.Pgid(), "branch", i, key, runningMin, maxKeyOpen, compare, ch, keyToString, pagesStack)
 
 			maxKey := maxKeyOpen
 			if i < len(p.BranchPageElements())-1 {
-				maxKey = p.BranchPageElement(uint16(i + 1)).Key()
+				maxKey = p.BranchPageKey(uint16(i + 1))
 			}
-			maxKeyInSubtree = tx.recursivelyCheckPageKeyOrderInternal(elem.Pgid(), elem.Key(), maxKey, pagesStack, keyToString, ch)
+			maxKeyInSubtree = tx.recursivelyCheckPageKeyOrderInternal(elem.Pgid(), key, maxKey, pagesStack, compare, keyToString, ch)
 			runningMin = maxKeyInSubtree
 		}
 		return maxKeyInSubtree
 	case p.IsLeafPage():
 		runningMin := minKeyClosed
 		for i := range p.LeafPageElements() {
-			elem := p.LeafPageElement(uint16(i))
-			verifyKeyOrder(pgId, "leaf", i, elem.Key(), runningMin, maxKeyOpen, ch, keyToString, pagesStack)
-			runningMin = elem.Key()
+			key := p.LeafPageKey(uint16(i))
+			verifyKeyOrder(pgId, "leaf", i, key, runningMin, maxKeyOpen, compare, ch, keyToString, pagesStack)
+			runningMin = key
 		}
 		if p.Count() > 0 {
-			return p.LeafPageElement(p.Count() - 1).Key()
+			return p.LeafPageKey(p.Count() - 1)
 		}
 	default:
 		ch <- fmt.Errorf("unexpected page type (flags: %x) for pgId:%d", p.Flags(), pgId)
@@ -224,7 +299,7 @@ func (tx *Tx) recursivelyCheckPageKeyOrderInternal(
  * verifyKeyOrder checks whether an entry with given #index on pgId (pageType: "branch|leaf") that has given "key",
  * is within range determined by (previousKey..maxKeyOpen) and reports found violations to the channel (ch).
  */
-func verifyKeyOrder(pgId common.Pgid, pageType string, index int, key []byte, previousKey []byte, maxKeyOpen []byte, ch chan error, keyToString func([]byte) string, pagesStack []common.Pgid) {
+func verifyKeyOrder(pgId common.Pgid, pageType string, index int, key []byte, previousKey []byte, maxKeyOpen []byte, compareKeys Comparator, ch chan error, keyToString func([]byte) string, pagesStack []common.Pgid) {
 	if index == 0 && previousKey != nil && compareKeys(previousKey, key) > 0 {
 		ch <- fmt.Errorf("the first key[%d]=(hex)%s on %s page(%d) needs to be >= the key in the ancestor (%s). Stack: %v",
 			index, keyToString(key), pageType, pgId, keyToString(previousKey), pagesStack)
@@ -0,0 +1,153 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// txHistoryKey is the name of the top-level bucket holding the transactions
+// retained by Options.TxHistorySize and Options.TxHistoryRetention. It is
+// hidden like the internal buckets of a bucket.
+//
+// The history holds an entry for each retained transaction, whose key is its
+// big-endian id in 8 bytes, and whose value is the big-endian time it was
+// superseded at in Unix nanoseconds, followed by its meta, stored like the
+// one of a named snapshot.
+const txHistoryKey = "\x00bbolt-tx-history"
+
+// txHistoryTimeSize is the size of the time starting the value of an entry
+// of the transaction history.
+const txHistoryTimeSize = 8
+
+// RetainedTx describes a previous transaction retained by the transaction
+// history.
+type RetainedTx struct {
+	// Txid is the id of the transaction.
+	Txid int
+
+	// Until is the time the transaction was superseded at, that is the time
+	// the next read-write transaction started at.
+	Until time.Time
+}
+
+// retainedTx is a transaction retained by the transaction history.
+type retainedTx struct {
+	meta  *common.Meta
+	until int64 // time the transaction was superseded at, in Unix nanoseconds
+}
+
+// BeginAt starts a read-only transaction reading the database as it was once
+// the transaction of the given id was committed. The id must be the one of
+// the last committed transaction, of a transaction retained by
+// Options.TxHistorySize or Options.TxHistoryRetention, or of a named
+// snapshot. Returns ErrTxNotRetained otherwise.
+//
+// A transaction is retained as long as it is in the history when BeginAt is
+// called; the returned transaction then holds its pages until it is closed,
+// like any read-only transaction.
+//
+// IMPORTANT: You must close the transaction like any read-only transaction.
+func (db *DB) BeginAt(txid int) (*Tx, error) {
+	return db.beginTxAt(&Tx{}, func() (*common.Meta, error) {
+		if m := db.meta(); int(m.Txid()) == txid {
+			return m, nil
+		}
+		for _, r := range db.retained {
+			if int(r.meta.Txid()) == txid {
+				return r.meta, nil
+			}
+		}
+		for _, m := range db.snapshots {
+			if int(m.Txid()) == txid {
+				return m, nil
+			}
+		}
+		return nil, berrors.ErrTxNotRetained
+	})
+}
+
+// RetainedTxs returns the previous transactions retained by the transaction
+// history, from the oldest to the newest. The last committed transaction is
+// not part of them.
+func (db *DB) RetainedTxs() []RetainedTx {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	txs := make([]RetainedTx, 0, len(db.retained))
+	for _, r := range db.retained {
+		txs = append(txs, RetainedTx{Txid: int(r.meta.Txid()), Until: time.Unix(0, r.until)})
+	}
+	return txs
+}
+
+// txHistory reads the transaction history from the root bucket, oldest first.
+func (b *Bucket) txHistory() ([]retainedTx, error) {
+	history := b.internalBucket(txHistoryKey, false, common.BucketOptions{})
+	if history == nil {
+		return nil, nil
+	}
+	var retained []retainedTx
+	c := history.Cursor()
+	for k, v, _ := c.first(); k != nil; k, v, _ = c.next() {
+		if len(k) != 8 || len(v) < txHistoryTimeSize {
+			return nil, fmt.Errorf("transaction history entry %x: %w", k, berrors.ErrInvalid)
+		}
+		m, err := decodeSnapshot(v[txHistoryTimeSize:])
+		if err != nil {
+			return nil, fmt.Errorf("transaction history entry %d: %w", binary.BigEndian.Uint64(k), err)
+		}
+		retained = append(retained, retainedTx{meta: m, until: int64(binary.BigEndian.Uint64(v))})
+	}
+	return retained, nil
+}
+
+// commitTxHistory adds the last committed transaction to the transaction
+// history, which it is superseding, and prunes the transactions no longer
+// retained. It returns the transactions retained once it is committed, and
+// whether they changed. The caller holds the writer lock, so the history is
+// only changed by the transaction.
+func (tx *Tx) commitTxHistory() ([]retainedTx, bool) {
+	db := tx.db
+	enabled := db.txHistorySize > 0 || db.txHistoryRetention > 0
+	if !enabled && len(db.retained) == 0 {
+		return nil, false
+	}
+
+	now := tx.now()
+	retained := db.retained
+	if enabled {
+		m := &common.Meta{}
+		db.meta().Copy(m)
+		retained = append(retained[:len(retained):len(retained)], retainedTx{meta: m, until: now})
+	}
+
+	// A transaction is retained while both the size and the retention of
+	// the history allow it.
+	n := 0
+	for i, r := range retained {
+		if !enabled ||
+			(db.txHistorySize > 0 && len(retained)-i > db.txHistorySize) ||
+			(db.txHistoryRetention > 0 && r.until < now-int64(db.txHistoryRetention)) {
+			n = i + 1
+		}
+	}
+
+	history := tx.root.internalBucket(txHistoryKey, true, common.BucketOptions{})
+	c := history.Cursor()
+	for _, r := range db.retained[:min(n, len(db.retained))] {
+		k := binary.BigEndian.AppendUint64(nil, uint64(r.meta.Txid()))
+		c.seek(k)
+		c.node().del(k)
+	}
+	if enabled {
+		r := retained[len(retained)-1]
+		k := binary.BigEndian.AppendUint64(nil, uint64(r.meta.Txid()))
+		v := append(binary.BigEndian.AppendUint64(nil, uint64(r.until)), encodeSnapshot(r.meta)...)
+		c.seek(k)
+		c.node().put(k, k, v, 0, 0)
+	}
+	return retained[n:], true
+}
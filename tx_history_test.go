@@ -0,0 +1,217 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// overwriteKeys sets the value of the keys of the widgets bucket put by
+// putKeys, and returns the id of the transaction.
+func overwriteKeys(t *testing.T, db *btesting.DB, n int, value string) int {
+	var txid int
+	err := db.Update(func(tx *bolt.Tx) error {
+		txid = tx.ID()
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < n; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i)), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return txid
+}
+
+// valueAt returns the value of the first key of the widgets bucket once the
+// transaction of the given id was committed.
+func valueAt(t *testing.T, db *btesting.DB, txid int) (string, error) {
+	tx, err := db.BeginAt(txid)
+	if err != nil {
+		return "", err
+	}
+	defer func() { require.NoError(t, tx.Rollback()) }()
+	require.Equal(t, txid, tx.ID())
+	b := tx.Bucket([]byte("widgets"))
+	require.Equal(t, 1000, b.Stats().KeyN)
+	return string(b.Get([]byte("00000000"))), nil
+}
+
+// retainedTxids returns the ids of the transactions retained by the history.
+func retainedTxids(db *btesting.DB) []int {
+	var txids []int
+	for _, r := range db.RetainedTxs() {
+		txids = append(txids, r.Txid)
+	}
+	return txids
+}
+
+// Ensure that the transactions retained by TxHistorySize can be read with
+// BeginAt, across reopening the database, and that their pages are reused
+// once the history is disabled.
+func TestDB_BeginAt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts bolt.Options
+	}{
+		{name: "array", opts: bolt.Options{FreelistType: bolt.FreelistArrayType}},
+		{name: "map", opts: bolt.Options{FreelistType: bolt.FreelistMapType}},
+		{name: "nofreelistsync", opts: bolt.Options{NoFreelistSync: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.TxHistorySize = 5
+			db := btesting.MustCreateDBWithOption(t, &opts)
+			putKeys(t, db, 0, 1000)
+
+			var txids []int
+			for i := 0; i < 5; i++ {
+				txids = append(txids, overwriteKeys(t, db, 1000, fmt.Sprint("v", i)))
+			}
+			require.Equal(t, append([]int{txids[0] - 1}, txids[:4]...), retainedTxids(db))
+			for i := 0; i < 5; i++ {
+				v, err := valueAt(t, db, txids[i])
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprint("v", i), v)
+			}
+			_, err := db.BeginAt(txids[0] - 2)
+			require.ErrorIs(t, err, berrors.ErrTxNotRetained)
+			_, err = db.BeginAt(txids[4] + 1)
+			require.ErrorIs(t, err, berrors.ErrTxNotRetained)
+
+			// The history is hidden.
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+					require.Equal(t, "widgets", string(name))
+					return nil
+				})
+			}))
+
+			// All the pages freed are retained, so they are not reused
+			// after reopening the database either.
+			db.MustClose()
+			db.MustReopen()
+			require.Equal(t, append([]int{txids[0] - 1}, txids[:4]...), retainedTxids(db))
+			oldest, err := db.BeginAt(txids[0] - 1)
+			require.NoError(t, err)
+			txids = append(txids, overwriteKeys(t, db, 1000, "v5"))
+			require.Equal(t, txids[:5], retainedTxids(db))
+			v := string(oldest.Bucket([]byte("widgets")).Get([]byte("00000000")))
+			require.NoError(t, oldest.Rollback())
+			require.Equal(t, "0", v)
+			_, err = valueAt(t, db, txids[0]-1)
+			require.ErrorIs(t, err, berrors.ErrTxNotRetained)
+			for i := 0; i < 6; i++ {
+				v, err := valueAt(t, db, txids[i])
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprint("v", i), v)
+			}
+			db.MustCheck()
+
+			// The pages of the transactions no longer retained are reused.
+			db.MustClose()
+			db.SetOptions(&tc.opts)
+			db.MustReopen()
+			overwriteKeys(t, db, 1000, "new")
+			require.Empty(t, db.RetainedTxs())
+			_, err = valueAt(t, db, txids[5])
+			require.ErrorIs(t, err, berrors.ErrTxNotRetained)
+			var before int64
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				before = tx.Size()
+				return nil
+			}))
+			for i := 0; i < 5; i++ {
+				overwriteKeys(t, db, 1000, fmt.Sprint("newer", i))
+			}
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				require.Equal(t, before, tx.Size())
+				return nil
+			}))
+			db.MustCheck()
+		})
+	}
+}
+
+// Ensure that TxHistoryRetention retains the transactions superseded within
+// the retention window.
+func TestDB_BeginAt_TxHistoryRetention(t *testing.T) {
+	const retention = 300 * time.Millisecond
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{TxHistoryRetention: retention})
+	putKeys(t, db, 0, 1000)
+	first := overwriteKeys(t, db, 1000, "v1")
+	second := overwriteKeys(t, db, 1000, "v2")
+	overwriteKeys(t, db, 1000, "v3")
+	require.Equal(t, []int{first - 2, first - 1, first, second}, retainedTxids(db))
+
+	time.Sleep(retention + 100*time.Millisecond)
+	overwriteKeys(t, db, 1000, "v4")
+	_, err := valueAt(t, db, second)
+	require.ErrorIs(t, err, berrors.ErrTxNotRetained)
+	require.Len(t, db.RetainedTxs(), 1)
+	v, err := valueAt(t, db, db.RetainedTxs()[0].Txid)
+	require.NoError(t, err)
+	require.Equal(t, "v3", v)
+	db.MustCheck()
+}
+
+// Ensure that the transactions committed without holding the writer lock
+// and the named snapshots can be read with BeginAt, and that the history is
+// not copied by Compact.
+func TestDB_BeginAt_Writers(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{TxHistorySize: 10})
+	putKeys(t, db, 0, 1000)
+	require.NoError(t, db.CreateSnapshot("v0"))
+	snapshots, err := db.Snapshots()
+	require.NoError(t, err)
+	snapshot := snapshots[0].Txid
+	overwriteKeys(t, db, 1000, "v1")
+
+	var optimistic, scoped int
+	require.NoError(t, db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("00000000"), []byte("optimistic"))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		optimistic = tx.ID()
+		return nil
+	}))
+	require.NoError(t, db.UpdateBuckets([][]byte{[]byte("widgets")}, func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("00000000"), []byte("scoped"))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		scoped = tx.ID()
+		return nil
+	}))
+	overwriteKeys(t, db, 1000, "v2")
+
+	for txid, want := range map[int]string{snapshot: "0", optimistic: "optimistic", scoped: "scoped"} {
+		v, err := valueAt(t, db, txid)
+		require.NoError(t, err)
+		require.Equal(t, want, v)
+	}
+	db.MustCheck()
+
+	// The snapshot stays readable once out of the history.
+	for i := 0; i < 10; i++ {
+		overwriteKeys(t, db, 1000, "v3")
+	}
+	_, err = valueAt(t, db, scoped)
+	require.ErrorIs(t, err, berrors.ErrTxNotRetained)
+	v, err := valueAt(t, db, snapshot)
+	require.NoError(t, err)
+	require.Equal(t, "0", v)
+
+	dst := btesting.MustCreateDB(t)
+	require.NoError(t, bolt.Compact(dst.DB, db.DB, 0))
+	dst.MustClose()
+	dst.MustReopen()
+	require.Empty(t, dst.RetainedTxs())
+	dst.MustCheck()
+}
@@ -0,0 +1,276 @@
+package bbolt
+
+import (
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// TypedBucket wraps a Bucket to put and get keys and values of Go types,
+// encoded by a KeyCodec and a ValueCodec:
+//
+//	users := bolt.NewTypedBucket(tx.Bucket([]byte("users")), bolt.Uint64Codec{}, bolt.JSONCodec[User]{})
+//	err := users.Put(42, User{Name: "alice"})
+//
+// Its cursors and ranges skip the nested buckets. A TypedBucket is only
+// valid for the life of the transaction of its bucket.
+type TypedBucket[K, V any] struct {
+	b      *Bucket
+	keys   KeyCodec[K]
+	values ValueCodec[V]
+}
+
+// NewTypedBucket returns a TypedBucket over b, encoding its keys and values
+// with the given codecs.
+func NewTypedBucket[K, V any](b *Bucket, keys KeyCodec[K], values ValueCodec[V]) *TypedBucket[K, V] {
+	return &TypedBucket[K, V]{b: b, keys: keys, values: values}
+}
+
+// Bucket returns the bucket the typed bucket wraps.
+func (tb *TypedBucket[K, V]) Bucket() *Bucket {
+	return tb.b
+}
+
+// Get retrieves the value of a key, and reports whether the key exists.
+// It returns an error if the key cannot be encoded or the value decoded.
+func (tb *TypedBucket[K, V]) Get(key K) (value V, ok bool, err error) {
+	k, err := tb.keys.Encode(key)
+	if err != nil {
+		return value, false, err
+	}
+	v := tb.b.Get(k)
+	if v == nil {
+		return value, false, nil
+	}
+	value, err = tb.values.Decode(v)
+	return value, err == nil, err
+}
+
+// Put sets the value of a key, like Bucket.Put.
+func (tb *TypedBucket[K, V]) Put(key K, value V) error {
+	k, err := tb.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := tb.values.Encode(value)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		// A nil value would read as a missing key.
+		v = []byte{}
+	}
+	return tb.b.Put(k, v)
+}
+
+// Delete removes a key, like Bucket.Delete.
+func (tb *TypedBucket[K, V]) Delete(key K) error {
+	k, err := tb.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	return tb.b.Delete(k)
+}
+
+// Cursor returns a typed cursor over the keys of the bucket.
+func (tb *TypedBucket[K, V]) Cursor() *TypedCursor[K, V] {
+	return &TypedCursor[K, V]{tb: tb, c: tb.b.Cursor()}
+}
+
+// decode skips the nested buckets from the element k/v the cursor c is at,
+// moving it with next, and decodes the first key/value pair found. It
+// reports false if there is none, and returns an error if the pair cannot be
+// decoded.
+func (tb *TypedBucket[K, V]) decode(c *Cursor, k, v []byte, next func() ([]byte, []byte)) (key K, value V, ok bool, err error) {
+	for k != nil {
+		if _, _, flags := c.keyValue(); (flags & common.BucketLeafFlag) == 0 {
+			break
+		}
+		k, v = next()
+	}
+	if k == nil {
+		return key, value, false, nil
+	}
+	if key, err = tb.keys.Decode(k); err != nil {
+		return key, value, false, err
+	}
+	if value, err = tb.values.Decode(v); err != nil {
+		return key, value, false, err
+	}
+	return key, value, true, nil
+}
+
+// TypedCursor iterates over the key/value pairs of a TypedBucket in key
+// order, like Cursor. Its methods report false once there is no pair left to
+// move to, or if a key or a value cannot be encoded or decoded, in which case
+// Err returns the error:
+//
+//	c := users.Cursor()
+//	for id, user, ok := c.First(); ok; id, user, ok = c.Next() {
+//		...
+//	}
+//	if err := c.Err(); err != nil {
+//		...
+//	}
+type TypedCursor[K, V any] struct {
+	tb  *TypedBucket[K, V]
+	c   *Cursor
+	err error
+}
+
+// First moves the cursor to the first pair of the bucket and returns it.
+func (tc *TypedCursor[K, V]) First() (K, V, bool) {
+	k, v := tc.c.First()
+	return tc.decode(k, v, tc.c.Next)
+}
+
+// Last moves the cursor to the last pair of the bucket and returns it.
+func (tc *TypedCursor[K, V]) Last() (K, V, bool) {
+	k, v := tc.c.Last()
+	return tc.decode(k, v, tc.c.Prev)
+}
+
+// Next moves the cursor to the next pair of the bucket and returns it.
+func (tc *TypedCursor[K, V]) Next() (K, V, bool) {
+	k, v := tc.c.Next()
+	return tc.decode(k, v, tc.c.Next)
+}
+
+// Prev moves the cursor to the previous pair of the bucket and returns it.
+func (tc *TypedCursor[K, V]) Prev() (K, V, bool) {
+	k, v := tc.c.Prev()
+	return tc.decode(k, v, tc.c.Prev)
+}
+
+// Seek moves the cursor to the given key, or to the next one if it does not
+// exist, and returns the pair there.
+func (tc *TypedCursor[K, V]) Seek(key K) (K, V, bool) {
+	seek, err := tc.tb.keys.Encode(key)
+	if err != nil {
+		tc.err = err
+		var k K
+		var v V
+		return k, v, false
+	}
+	k, v := tc.c.Seek(seek)
+	return tc.decode(k, v, tc.c.Next)
+}
+
+// Delete removes the current pair under the cursor from the bucket, like
+// Cursor.Delete.
+func (tc *TypedCursor[K, V]) Delete() error {
+	return tc.c.Delete()
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (tc *TypedCursor[K, V]) Err() error {
+	return tc.err
+}
+
+// decode decodes the pair at the cursor, keeping the error.
+func (tc *TypedCursor[K, V]) decode(k, v []byte, next func() ([]byte, []byte)) (K, V, bool) {
+	key, value, ok, err := tc.tb.decode(tc.c, k, v, next)
+	if err != nil {
+		tc.err = err
+	}
+	return key, value, ok
+}
+
+// TypedRangeOptions describes a bounded scan over the keys of a TypedBucket,
+// like RangeOptions. A nil Start or End leaves the range open on that side.
+type TypedRangeOptions[K any] struct {
+	// Start is the lower bound of the range.
+	Start *K
+
+	// End is the upper bound of the range.
+	End *K
+
+	// StartExclusive excludes Start itself from the range.
+	StartExclusive bool
+
+	// EndInclusive includes End itself in the range.
+	EndInclusive bool
+
+	// Reverse walks the range from the upper bound down to the lower bound.
+	Reverse bool
+
+	// Limit caps the number of pairs returned. Zero means no limit.
+	Limit int
+}
+
+// TypedRangeIterator walks the key/value pairs of a TypedBucket within the
+// bounds described by TypedRangeOptions, like RangeIterator. Its methods
+// report false once the range is exhausted, or if a key or a value cannot be
+// encoded or decoded, in which case Err returns the error.
+type TypedRangeIterator[K, V any] struct {
+	tb    *TypedBucket[K, V]
+	it    *RangeIterator
+	limit int
+	n     int // number of pairs returned so far
+	err   error
+}
+
+// Range returns an iterator over the pairs of the bucket whose keys fall
+// within the given bounds.
+func (tb *TypedBucket[K, V]) Range(opts TypedRangeOptions[K]) *TypedRangeIterator[K, V] {
+	ti := &TypedRangeIterator[K, V]{tb: tb, limit: opts.Limit}
+	ropts := RangeOptions{
+		StartExclusive: opts.StartExclusive,
+		EndInclusive:   opts.EndInclusive,
+		Reverse:        opts.Reverse,
+	}
+	ropts.Start, ti.err = ti.bound(opts.Start)
+	if ti.err == nil {
+		ropts.End, ti.err = ti.bound(opts.End)
+	}
+	ti.it = tb.b.Range(ropts)
+	return ti
+}
+
+// bound encodes a bound of the range, which is nil if the range is open.
+func (ti *TypedRangeIterator[K, V]) bound(key *K) ([]byte, error) {
+	if key == nil {
+		return nil, nil
+	}
+	k, err := ti.tb.keys.Encode(*key)
+	if k == nil {
+		// An empty key is a bound nonetheless.
+		k = []byte{}
+	}
+	return k, err
+}
+
+// First moves to the first pair of the range in iteration order and returns
+// it.
+func (ti *TypedRangeIterator[K, V]) First() (K, V, bool) {
+	if ti.err != nil {
+		var key K
+		var value V
+		return key, value, false
+	}
+	ti.n = 0
+	k, v := ti.it.First()
+	return ti.decode(k, v)
+}
+
+// Next moves to the next pair of the range in iteration order and returns it.
+func (ti *TypedRangeIterator[K, V]) Next() (K, V, bool) {
+	k, v := ti.it.Next()
+	return ti.decode(k, v)
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (ti *TypedRangeIterator[K, V]) Err() error {
+	return ti.err
+}
+
+// decode decodes the pair the iterator is at, enforcing the limit and
+// keeping the error.
+func (ti *TypedRangeIterator[K, V]) decode(k, v []byte) (key K, value V, ok bool) {
+	if ti.err != nil || (ti.limit > 0 && ti.n >= ti.limit) {
+		return key, value, false
+	}
+	key, value, ok, ti.err = ti.tb.decode(ti.it.Cursor(), k, v, ti.it.Next)
+	if ok {
+		ti.n++
+	}
+	return key, value, ok
+}
@@ -0,0 +1,279 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// requireOrdered checks that a key codec round-trips the keys, which are
+// sorted, and that their encodings sort the same.
+func requireOrdered[K any](t *testing.T, codec bolt.KeyCodec[K], keys []K) {
+	t.Helper()
+	var encoded [][]byte
+	for _, k := range keys {
+		e, err := codec.Encode(k)
+		require.NoError(t, err)
+		d, err := codec.Decode(e)
+		require.NoError(t, err)
+		require.Equal(t, k, d)
+		encoded = append(encoded, e)
+	}
+	require.True(t, sort.SliceIsSorted(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	}))
+	for i := 1; i < len(encoded); i++ {
+		require.NotEqual(t, encoded[i-1], encoded[i])
+	}
+}
+
+// Ensure that the key codecs preserve the order of the keys.
+func TestKeyCodecs_Order(t *testing.T) {
+	requireOrdered[uint64](t, bolt.Uint64Codec{}, []uint64{0, 1, 255, 256, math.MaxUint64})
+	requireOrdered[int64](t, bolt.Int64Codec{}, []int64{math.MinInt64, -256, -1, 0, 1, math.MaxInt64})
+	requireOrdered[string](t, bolt.StringCodec{}, []string{"", "a", "a\x00", "ab", "b"})
+	requireOrdered[[]byte](t, bolt.BytesCodec{}, [][]byte{{}, {0}, {0, 0}, {1}})
+	requireOrdered[time.Time](t, bolt.TimeCodec{}, []time.Time{
+		time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(1969, 12, 31, 23, 59, 59, 999999999, time.UTC),
+		time.Unix(0, 0).UTC(),
+		time.Unix(0, 1).UTC(),
+		time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+	})
+	requireOrdered[bolt.Tuple2[string, int64]](t, bolt.Tuple2Codec[string, int64]{A: bolt.StringCodec{}, B: bolt.Int64Codec{}}, []bolt.Tuple2[string, int64]{
+		{A: "", B: 5},
+		{A: "a", B: -1},
+		{A: "a", B: 0},
+		{A: "a\x00", B: -5},
+		{A: "a\x00\x00", B: -5},
+		{A: "ab", B: -5},
+	})
+	requireOrdered[bolt.Tuple3[uint64, string, string]](t, bolt.Tuple3Codec[uint64, string, string]{A: bolt.Uint64Codec{}, B: bolt.StringCodec{}, C: bolt.StringCodec{}}, []bolt.Tuple3[uint64, string, string]{
+		{A: 1, B: "", C: "z"},
+		{A: 1, B: "a", C: ""},
+		{A: 1, B: "a", C: "a"},
+		{A: 2, B: "", C: ""},
+	})
+
+	// A time keeps its instant, in UTC.
+	tm := time.Date(2024, 5, 1, 12, 30, 0, 42, time.FixedZone("CEST", 2*3600))
+	e, err := bolt.TimeCodec{}.Encode(tm)
+	require.NoError(t, err)
+	d, err := bolt.TimeCodec{}.Decode(e)
+	require.NoError(t, err)
+	require.True(t, tm.Equal(d))
+	require.Equal(t, time.UTC, d.Location())
+}
+
+// Ensure that the codecs reject the data they did not encode.
+func TestCodecs_InvalidEncoding(t *testing.T) {
+	_, err := bolt.Uint64Codec{}.Decode([]byte{1, 2})
+	require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+	_, err = bolt.Int64Codec{}.Decode(nil)
+	require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+	_, err = bolt.TimeCodec{}.Decode(make([]byte, 8))
+	require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+	_, err = bolt.TimeCodec{}.Decode(bytes.Repeat([]byte{0xff}, 12))
+	require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+
+	tuple := bolt.Tuple2Codec[string, string]{A: bolt.StringCodec{}, B: bolt.StringCodec{}}
+	for _, data := range []string{"a", "a\x00\x01b", "a\x00\x02b\x00\x01", "a\x00\x01b\x00\x01c"} {
+		_, err = tuple.Decode([]byte(data))
+		require.ErrorIs(t, err, berrors.ErrInvalidEncoding, "%q", data)
+	}
+	_, err = bolt.JSONCodec[map[string]int]{}.Decode([]byte("{"))
+	require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+	_, err = bolt.GobCodec[int]{}.Decode([]byte("x"))
+	require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+}
+
+type user struct {
+	Name string
+	Age  int
+}
+
+// Ensure that a typed bucket puts, gets and deletes keys and values of Go
+// types.
+func TestTypedBucket(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		users := bolt.NewTypedBucket(b, bolt.Int64Codec{}, bolt.JSONCodec[user]{})
+		require.Same(t, b, users.Bucket())
+		require.NoError(t, users.Put(-7, user{Name: "alice", Age: 30}))
+		require.NoError(t, users.Put(42, user{Name: "bob", Age: 40}))
+		require.Equal(t, []byte(`{"Name":"alice","Age":30}`), b.Get([]byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf9}))
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		users := bolt.NewTypedBucket(tx.Bucket([]byte("users")), bolt.Int64Codec{}, bolt.GobCodec[user]{})
+		// The values were not encoded with gob.
+		_, _, err := users.Get(-7)
+		require.ErrorIs(t, err, berrors.ErrInvalidEncoding)
+
+		users = bolt.NewTypedBucket(tx.Bucket([]byte("users")), bolt.Int64Codec{}, bolt.JSONCodec[user]{})
+		u, ok, err := users.Get(-7)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, user{Name: "alice", Age: 30}, u)
+		_, ok, err = users.Get(1)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		require.NoError(t, users.Delete(-7))
+		_, ok, err = users.Get(-7)
+		require.NoError(t, err)
+		require.False(t, ok)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// An empty value is not a missing key.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("names"))
+		if err != nil {
+			return err
+		}
+		names := bolt.NewTypedBucket(b, bolt.StringCodec{}, bolt.BytesCodec{})
+		require.NoError(t, names.Put("empty", nil))
+		v, ok, err := names.Get("empty")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Empty(t, v)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a typed cursor walks the pairs in key order, skipping nested
+// buckets, and stops at the first pair it cannot decode.
+func TestTypedCursor(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("events"))
+		if err != nil {
+			return err
+		}
+		events := bolt.NewTypedBucket(b, bolt.Uint64Codec{}, bolt.StringCodec{})
+		for i, name := range []string{"zero", "one", "two", "three", "four"} {
+			require.NoError(t, events.Put(uint64(i*10), name))
+		}
+		nested, err := bolt.Uint64Codec{}.Encode(15)
+		if err != nil {
+			return err
+		}
+		_, err = b.CreateBucket(nested)
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		events := bolt.NewTypedBucket(tx.Bucket([]byte("events")), bolt.Uint64Codec{}, bolt.StringCodec{})
+		c := events.Cursor()
+		var keys []uint64
+		var names []string
+		for k, v, ok := c.First(); ok; k, v, ok = c.Next() {
+			keys = append(keys, k)
+			names = append(names, v)
+		}
+		require.NoError(t, c.Err())
+		require.Equal(t, []uint64{0, 10, 20, 30, 40}, keys)
+		require.Equal(t, []string{"zero", "one", "two", "three", "four"}, names)
+
+		keys = nil
+		for k, _, ok := c.Last(); ok; k, _, ok = c.Prev() {
+			keys = append(keys, k)
+		}
+		require.Equal(t, []uint64{40, 30, 20, 10, 0}, keys)
+
+		// The nested bucket is skipped.
+		k, v, ok := c.Seek(11)
+		require.True(t, ok)
+		require.Equal(t, uint64(20), k)
+		require.Equal(t, "two", v)
+		k, _, ok = c.Prev()
+		require.True(t, ok)
+		require.Equal(t, uint64(10), k)
+
+		k, _, ok = c.Seek(20)
+		require.True(t, ok)
+		require.Equal(t, uint64(20), k)
+		require.NoError(t, c.Delete())
+		_, ok, err := events.Get(20)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// A key of another encoding stops the cursor.
+		require.NoError(t, events.Bucket().Put([]byte("x"), []byte("garbage")))
+		for _, _, ok := c.First(); ok; _, _, ok = c.Next() {
+		}
+		require.ErrorIs(t, c.Err(), berrors.ErrInvalidEncoding)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a typed range walks the pairs within bounds of Go types.
+func TestTypedBucket_Range(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	key := func(user string, d int) bolt.Tuple2[string, time.Time] {
+		return bolt.Tuple2[string, time.Time]{A: user, B: day(d)}
+	}
+	codec := bolt.Tuple2Codec[string, time.Time]{A: bolt.StringCodec{}, B: bolt.TimeCodec{}}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("logins"))
+		if err != nil {
+			return err
+		}
+		logins := bolt.NewTypedBucket(b, codec, bolt.Int64Codec{})
+		for _, user := range []string{"alice", "bob"} {
+			for d := 1; d <= 5; d++ {
+				if err := logins.Put(key(user, d), int64(d)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		logins := bolt.NewTypedBucket(tx.Bucket([]byte("logins")), codec, bolt.Int64Codec{})
+		days := func(opts bolt.TypedRangeOptions[bolt.Tuple2[string, time.Time]]) []int64 {
+			it := logins.Range(opts)
+			var days []int64
+			for k, v, ok := it.First(); ok; k, v, ok = it.Next() {
+				require.Equal(t, "bob", k.A)
+				days = append(days, v)
+			}
+			require.NoError(t, it.Err())
+			return days
+		}
+
+		start, end := key("bob", 2), key("bob", 4)
+		require.Equal(t, []int64{2, 3}, days(bolt.TypedRangeOptions[bolt.Tuple2[string, time.Time]]{Start: &start, End: &end}))
+		require.Equal(t, []int64{4, 3, 2}, days(bolt.TypedRangeOptions[bolt.Tuple2[string, time.Time]]{Start: &start, End: &end, EndInclusive: true, Reverse: true}))
+		require.Equal(t, []int64{3, 4}, days(bolt.TypedRangeOptions[bolt.Tuple2[string, time.Time]]{Start: &start, StartExclusive: true, Limit: 2}))
+
+		// All the logins of bob: his key is a prefix of the keys of his days.
+		bob := bolt.Tuple2[string, time.Time]{A: "bob"}
+		require.Equal(t, []int64{1, 2, 3, 4, 5}, days(bolt.TypedRangeOptions[bolt.Tuple2[string, time.Time]]{Start: &bob}))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,367 @@
+package bbolt
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// UpdateBuckets executes a function within the context of a read-write
+// managed transaction restricted to the given top-level buckets. Unlike
+// Update, it does not hold the writer lock while the function runs: calls
+// declaring disjoint sets of buckets run concurrently, and their changes are
+// merged into a single commit. Calls declaring a common bucket are serialized.
+//
+// The transaction starts from the last committed state. It can only create,
+// delete or access the declared buckets, including those that do not exist
+// yet; Tx.Bucket returns nil for the other ones and creating or deleting them
+// returns ErrBucketNotDeclared.
+//
+// If a declared bucket was changed by another transaction, such as one
+// started by Update, after the function started, the changes are discarded
+// and ErrTxConflict is returned. The function can then be retried.
+//
+// Attempting to manually commit or rollback within the function will cause a
+// panic.
+func (db *DB) UpdateBuckets(names [][]byte, fn func(*Tx) error) (err error) {
+	if db.readOnly || db.follower {
+		return berrors.ErrDatabaseReadOnly
+	}
+	for _, name := range names {
+		if len(name) == 0 {
+			return berrors.ErrBucketNameRequired
+		}
+	}
+
+	unlock := db.lockBuckets(names)
+	defer unlock()
+
+	u, err := db.beginBucketUpdate(names)
+	if err != nil {
+		return err
+	}
+	t := u.tx
+
+	// Make sure the transaction is discarded in the event of a panic.
+	mapped := true
+	defer func() {
+		if t.db == nil {
+			return
+		}
+		if mapped {
+			t.discard()
+			return
+		}
+		db.untrackTx(t)
+		t.clear()
+	}()
+	// Mark as a managed tx so that the inner function cannot manually commit.
+	t.managed = true
+
+	// If an error is returned from the function then discard and return error.
+	err = fn(t)
+	t.managed = false
+	if terr := t.Err(); terr != nil {
+		err = terr
+	}
+	if err != nil {
+		t.discard()
+		return err
+	}
+
+	handlers := t.commitHandlers
+	u.detach()
+	mapped = false
+	if err = db.commitBucketUpdate(u); err != nil {
+		return err
+	}
+
+	// Execute commit handlers now that the locks have been removed.
+	for _, fn := range handlers {
+		fn()
+	}
+	return nil
+}
+
+// bucketLock serializes the UpdateBuckets calls declaring a top-level bucket.
+type bucketLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockBuckets locks the given top-level buckets in order, so that calls
+// declaring overlapping sets cannot deadlock, and returns a function
+// unlocking them.
+func (db *DB) lockBuckets(names [][]byte) func() {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, string(name))
+	}
+	sort.Strings(keys)
+
+	db.bucketLocksMu.Lock()
+	if db.bucketLocks == nil {
+		db.bucketLocks = make(map[string]*bucketLock)
+	}
+	locks := make([]*bucketLock, 0, len(keys))
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		l := db.bucketLocks[key]
+		if l == nil {
+			l = &bucketLock{}
+			db.bucketLocks[key] = l
+		}
+		l.refs++
+		locks = append(locks, l)
+	}
+	db.bucketLocksMu.Unlock()
+
+	for _, l := range locks {
+		l.mu.Lock()
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].mu.Unlock()
+		}
+		db.bucketLocksMu.Lock()
+		for i, l := range locks {
+			if l.refs--; l.refs == 0 {
+				delete(db.bucketLocks, keys[i])
+			}
+		}
+		db.bucketLocksMu.Unlock()
+	}
+}
+
+// bucketUpdate is an UpdateBuckets call waiting to be merged.
+type bucketUpdate struct {
+	tx       *Tx
+	snapshot map[string][]byte // values of the declared buckets when it started
+	changes  []bucketChange
+	freed    []common.Pgid
+	recorded *changeLog // changes for the subscribers
+
+	taken bool // protected by DB.bucketUpdatesMu
+	err   error
+	done  chan struct{}
+}
+
+// bucketChange is the final state of a declared bucket.
+type bucketChange struct {
+	name  []byte
+	value []byte  // nil if the bucket was deleted
+	child *Bucket // nil if the bucket was not opened
+}
+
+// beginBucketUpdate starts a writable transaction on the last committed
+// state. It is tracked like a read-only transaction until it is merged, so
+// that the pages it reads are not reused meanwhile.
+func (db *DB) beginBucketUpdate(names [][]byte) (*bucketUpdate, error) {
+	t := &Tx{writable: true, scope: make(map[string]struct{}, len(names)), changes: db.newChangeLog()}
+	for _, name := range names {
+		t.scope[string(name)] = struct{}{}
+	}
+	if _, err := db.beginSnapshotTx(t); err != nil {
+		return nil, err
+	}
+
+	u := &bucketUpdate{
+		tx:       t,
+		snapshot: make(map[string][]byte, len(names)),
+		done:     make(chan struct{}),
+	}
+	for key := range t.scope {
+		u.snapshot[key] = t.root.bucketValue([]byte(key))
+	}
+	return u, nil
+}
+
+// detach records the final state of the declared buckets and releases the
+// read lock on the mmap, which the writer merging the update may remap. The
+// nodes are copied out of the mmap for this reason. The transaction stays
+// tracked until the update is merged, or found conflicting, so that the pages
+// it read are not reused meanwhile: a declared bucket whose root page was
+// freed and reused by another transaction would otherwise look unchanged.
+func (u *bucketUpdate) detach() {
+	t := u.tx
+	for key := range t.scope {
+		name := []byte(key)
+		ch := bucketChange{name: name, value: t.root.bucketValue(name), child: t.root.buckets[key]}
+		if ch.child == nil && bytes.Equal(ch.value, u.snapshot[key]) {
+			continue
+		}
+		u.changes = append(u.changes, ch)
+	}
+	t.root.dereference()
+	u.freed = t.freed
+	u.recorded = t.changes
+	t.root = Bucket{tx: t}
+	t.pages = nil
+	t.freed = nil
+	t.db.mmaplock.RUnlock()
+}
+
+// discard closes a transaction started by UpdateBuckets without merging it.
+func (tx *Tx) discard() {
+	tx.db.removeTx(tx)
+	tx.clear()
+}
+
+// commitBucketUpdate queues an update and waits for it to be merged. The
+// first caller to obtain the writer lock merges all the queued updates into
+// a single transaction and commits it.
+func (db *DB) commitBucketUpdate(u *bucketUpdate) error {
+	db.bucketUpdatesMu.Lock()
+	db.bucketUpdates = append(db.bucketUpdates, u)
+	db.bucketUpdatesMu.Unlock()
+
+	db.rwlock.Lock()
+	db.bucketUpdatesMu.Lock()
+	if u.taken {
+		// Another caller is merging it. The writer lock is released when
+		// its transaction closes, before the result is known.
+		db.bucketUpdatesMu.Unlock()
+		db.rwlock.Unlock()
+		<-u.done
+		return u.err
+	}
+	updates := db.bucketUpdates
+	db.bucketUpdates = nil
+	for _, u := range updates {
+		u.taken = true
+	}
+	db.bucketUpdatesMu.Unlock()
+
+	err := db.mergeBucketUpdates(updates)
+	for _, u := range updates {
+		db.untrackTx(u.tx)
+		u.tx.clear()
+		if u.err == nil {
+			u.err = err
+		}
+		close(u.done)
+	}
+	return u.err
+}
+
+// mergeBucketUpdates merges updates into a read-write transaction and commits
+// it. The writer lock must be held, and is released.
+func (db *DB) mergeBucketUpdates(updates []*bucketUpdate) error {
+	tx, err := db.beginLockedRWTx()
+	if err != nil {
+		return err
+	}
+
+	// Make sure the transaction rolls back in the event of a panic.
+	defer func() {
+		if tx.db != nil {
+			tx.rollback()
+		}
+	}()
+
+	var merged int
+	for _, u := range updates {
+		if u.err = tx.mergeBucketUpdate(u); u.err == nil {
+			merged++
+		}
+	}
+	if merged == 0 {
+		tx.nonPhysicalRollback()
+		return nil
+	}
+	return tx.Commit()
+}
+
+// mergeBucketUpdate checks that the buckets declared by an update are
+// unchanged since it started, then moves its changes into the transaction.
+func (tx *Tx) mergeBucketUpdate(u *bucketUpdate) error {
+	for key, value := range u.snapshot {
+		if !bytes.Equal(tx.root.bucketValue([]byte(key)), value) {
+			return berrors.ErrTxConflict
+		}
+	}
+	if tx.changes != nil {
+		if u.recorded == nil {
+			// The first subscriber came after the update started, so its
+			// changes were not recorded.
+			return berrors.ErrTxConflict
+		}
+		tx.changes.changes = append(tx.changes.changes, u.recorded.changes...)
+	}
+
+	for _, id := range u.freed {
+		tx.db.freelist.free(tx.meta.Txid(), tx.page(id))
+	}
+	for _, ch := range u.changes {
+		c := tx.root.Cursor()
+		k, v, _ := c.seek(ch.name)
+		found := bytes.Equal(k, ch.name)
+		if ch.value == nil {
+			if found {
+				c.node().del(ch.name)
+			}
+			continue
+		}
+		if !found || !bytes.Equal(v, ch.value) {
+			c.node().put(ch.name, ch.name, ch.value, 0, common.BucketLeafFlag)
+		}
+		if ch.child != nil {
+			ch.child.setTx(tx)
+			ch.child.parent = &tx.root
+			tx.root.buckets[string(ch.name)] = ch.child
+		}
+	}
+	return nil
+}
+
+// inScope returns whether a top-level bucket can be accessed by the
+// transaction.
+func (tx *Tx) inScope(name []byte) bool {
+	if tx.scope == nil {
+		return true
+	}
+	_, ok := tx.scope[string(name)]
+	return ok
+}
+
+// freePage adds a page of the transaction to the freelist. Transactions
+// started by UpdateBuckets do not hold the writer lock, so they defer it until
+// they are merged. Those started by OptimisticUpdate are never committed as
+// their changes are replayed, so they drop it.
+func (tx *Tx) freePage(p *common.Page) {
+	if tx.opt != nil {
+		return
+	}
+	if tx.scope != nil {
+		tx.freed = append(tx.freed, p.Id())
+		return
+	}
+	tx.db.freelist.free(tx.meta.Txid(), p)
+}
+
+// bucketValue returns a copy of the value of a nested bucket, or nil if it
+// does not exist.
+func (b *Bucket) bucketValue(name []byte) []byte {
+	k, v, flags := b.Cursor().seek(name)
+	if !bytes.Equal(k, name) || flags&common.BucketLeafFlag == 0 {
+		return nil
+	}
+	return cloneBytes(v)
+}
+
+// setTx moves a bucket and its opened nested buckets to another transaction.
+func (b *Bucket) setTx(tx *Tx) {
+	b.tx = tx
+	for _, child := range b.buckets {
+		child.setTx(tx)
+	}
+	for _, tree := range b.values {
+		tree.setTx(tx)
+	}
+}
@@ -0,0 +1,200 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// Ensure that UpdateBuckets calls on disjoint buckets run concurrently and
+// that all their changes are committed.
+func TestDB_UpdateBuckets_Concurrent(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	// The first call waits for the second one to be committed, which would
+	// deadlock if they were serialized.
+	committed := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := db.UpdateBuckets([][]byte{[]byte("a")}, func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("a"))
+			if err != nil {
+				return err
+			}
+			<-committed
+			return b.Put([]byte("foo"), []byte("bar"))
+		})
+		require.NoError(t, err)
+	}()
+	err := db.UpdateBuckets([][]byte{[]byte("b")}, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("baz"), []byte("bat"))
+	})
+	require.NoError(t, err)
+	close(committed)
+	wg.Wait()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("a")).Get([]byte("foo")))
+		require.Equal(t, []byte("bat"), tx.Bucket([]byte("b")).Get([]byte("baz")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that many concurrent UpdateBuckets calls, writing nested buckets and
+// values spanning overflow pages and deleting buckets, along with Update
+// calls on other buckets, keep the database consistent.
+func TestDB_UpdateBuckets_Stress(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	const writers, rounds = 8, 20
+	large := bytes.Repeat([]byte("x"), 10000)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			names := [][]byte{[]byte(fmt.Sprintf("bucket-%d", w)), []byte(fmt.Sprintf("tmp-%d", w))}
+			for r := 0; r < rounds; r++ {
+				err := db.UpdateBuckets(names, func(tx *bolt.Tx) error {
+					b, err := tx.CreateBucketIfNotExists(names[0])
+					if err != nil {
+						return err
+					}
+					for i := 0; i < 50; i++ {
+						if err := b.Put([]byte(fmt.Sprintf("%03d-%03d", r, i)), []byte("value")); err != nil {
+							return err
+						}
+					}
+					if err := b.Put([]byte(fmt.Sprintf("large-%03d", r)), large); err != nil {
+						return err
+					}
+					child, err := b.CreateBucketIfNotExists([]byte("child"))
+					if err != nil {
+						return err
+					}
+					if err := child.Put([]byte(fmt.Sprintf("%03d", r)), []byte("value")); err != nil {
+						return err
+					}
+
+					// Create a bucket in even rounds and delete it in odd ones.
+					if r%2 == 0 {
+						tmp, err := tx.CreateBucket(names[1])
+						if err != nil {
+							return err
+						}
+						return tmp.Put([]byte("large"), large)
+					}
+					return tx.DeleteBucket(names[1])
+				})
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for r := 0; r < rounds; r++ {
+			err := db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("plain"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte(fmt.Sprintf("large-%03d", r)), large)
+			})
+			require.NoError(t, err)
+		}
+	}()
+	wg.Wait()
+
+	err := db.View(func(tx *bolt.Tx) error {
+		for w := 0; w < writers; w++ {
+			b := tx.Bucket([]byte(fmt.Sprintf("bucket-%d", w)))
+			require.NotNil(t, b)
+			require.Equal(t, rounds*50+rounds+1+rounds, b.Stats().KeyN)
+			require.Nil(t, tx.Bucket([]byte(fmt.Sprintf("tmp-%d", w))))
+		}
+		require.Equal(t, rounds, tx.Bucket([]byte("plain")).Stats().KeyN)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that UpdateBuckets returns ErrTxConflict, without committing
+// anything, when a declared bucket is changed by another transaction while
+// its function runs.
+func TestDB_UpdateBuckets_Conflict(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.UpdateBuckets([][]byte{[]byte("widgets"), []byte("other")}, func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("other")); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("mine")); err != nil {
+			return err
+		}
+
+		// Update does not wait for UpdateBuckets functions to return.
+		return db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("theirs"))
+		})
+	})
+	require.ErrorIs(t, err, berrors.ErrTxConflict)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("theirs"), tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		require.Nil(t, tx.Bucket([]byte("other")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a transaction started by UpdateBuckets cannot access the
+// buckets it did not declare.
+func TestDB_UpdateBuckets_Scope(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"a", "b"} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.UpdateBuckets([][]byte{[]byte("a")}, func(tx *bolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("a")))
+		require.Nil(t, tx.Bucket([]byte("b")))
+		_, err := tx.CreateBucket([]byte("c"))
+		require.ErrorIs(t, err, berrors.ErrBucketNotDeclared)
+		require.ErrorIs(t, tx.DeleteBucket([]byte("b")), berrors.ErrBucketNotDeclared)
+
+		var names []string
+		require.NoError(t, tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		}))
+		require.Equal(t, []string{"a"}, names)
+		return nil
+	})
+	require.NoError(t, err)
+}
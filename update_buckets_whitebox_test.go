@@ -0,0 +1,62 @@
+package bbolt
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.etcd.io/bbolt/errors"
+)
+
+// Ensure that an update detached from its transaction conflicts with the
+// transactions committed before it is merged, even once they have freed and
+// reused the root page of a declared bucket.
+func TestDB_UpdateBuckets_ReusedRootPage(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	put := func(tx *Tx, value string) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%03d", i)), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	root := func() (id uint64) {
+		require.NoError(t, db.View(func(tx *Tx) error {
+			id = uint64(tx.Bucket([]byte("widgets")).RootPage())
+			return nil
+		}))
+		return id
+	}
+	require.NoError(t, db.Update(func(tx *Tx) error { return put(tx, "initial") }))
+	before := root()
+
+	u, err := db.beginBucketUpdate([][]byte{[]byte("widgets")})
+	require.NoError(t, err)
+	require.NoError(t, put(u.tx, "stale"))
+	u.detach()
+
+	// Commit until the root page of the bucket would be reused, if its
+	// pages were not held by the update.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Update(func(tx *Tx) error { return put(tx, fmt.Sprint("update", i)) }))
+		if root() == before {
+			break
+		}
+	}
+	require.ErrorIs(t, db.commitBucketUpdate(u), errors.ErrTxConflict)
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.Equal(t, "update", string(tx.Bucket([]byte("widgets")).Get([]byte("000")))[:6])
+		return nil
+	}))
+}
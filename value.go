@@ -0,0 +1,358 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// A chunked value is stored in a tree of its own, in the format of a nested
+// bucket, whose keys are the big-endian indexes of the chunks of the value and
+// whose sequence is the size of the value. Its leaf element in the bucket has
+// common.ChunkedValueFlag set and holds the header of the tree, along with the
+// tree itself if it is inline.
+
+// chunkKeySize is the size of the keys of the chunks of a chunked value.
+const chunkKeySize = 8
+
+// ValueHandle reads and writes the value of a key in place. Once written
+// through a handle, the value is stored in chunks of a fixed size, so that
+// writing to a part of it, or appending to it, only rewrites the pages of the
+// chunks written to on commit. Chunked values are read like any other value,
+// in which case they are assembled into a new slice.
+//
+// A handle is only valid for the life of the transaction. It always reads
+// the current value of its key, even if it is changed by other means.
+type ValueHandle struct {
+	b   *Bucket
+	key []byte
+}
+
+// OpenValue returns a handle to the value of a key. In a read-write
+// transaction, a key that does not exist is created with an empty value.
+// Returns ErrValueNotFound if the key does not exist in a read-only
+// transaction, and ErrIncompatibleValue if the key is a nested bucket or a
+// value that expires, or, in a read-write transaction, if the bucket has
+// secondary indexes, which would have to be updated from the whole value on
+// every write.
+func (b *Bucket) OpenValue(key []byte) (*ValueHandle, error) {
+	if b.tx.db == nil {
+		return nil, errors.ErrTxClosed
+	} else if len(key) == 0 {
+		return nil, errors.ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return nil, errors.ErrKeyTooLarge
+	}
+	b.tx.opt.read(b, key)
+	if b.Writable() {
+		if err := b.checkUnindexed(); err != nil {
+			return nil, err
+		}
+	}
+
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	switch {
+	case !bytes.Equal(key, k) || b.hidden(k, v, flags):
+		if !b.Writable() {
+			return nil, errors.ErrValueNotFound
+		}
+		if err := b.Put(key, []byte{}); err != nil {
+			return nil, err
+		}
+	case (flags & (common.BucketLeafFlag | common.ExpiringValueFlag)) != 0:
+		return nil, errors.ErrIncompatibleValue
+	}
+	return &ValueHandle{b: b, key: cloneBytes(key)}, nil
+}
+
+// Size returns the size of the value.
+func (h *ValueHandle) Size() int64 {
+	tree, value, _ := h.lookup()
+	if tree != nil {
+		return int64(tree.InSequence())
+	}
+	return int64(len(value))
+}
+
+// ReadAt reads len(p) bytes of the value starting at offset off, like
+// io.ReaderAt. It returns io.EOF if fewer bytes are read.
+func (h *ValueHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.b.tx.db == nil {
+		return 0, errors.ErrTxClosed
+	} else if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	tree, value, _ := h.lookup()
+	if tree == nil {
+		if off >= int64(len(value)) {
+			return 0, io.EOF
+		}
+		n := copy(p, value[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	if off >= int64(tree.InSequence()) {
+		return 0, io.EOF
+	}
+	chunkSize := h.b.tx.db.valueChunkSize()
+	skip := off % chunkSize
+	n := 0
+	c := tree.Cursor()
+	for k, v, _ := c.seek(chunkKey(off / chunkSize)); k != nil && n < len(p); k, v, _ = c.next() {
+		n += copy(p[n:], v[skip:])
+		skip = 0
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p to the value at offset off, extending the value as needed.
+// The gap between the end of the value and off, if any, is filled with zeros.
+// Returns an error if the transaction is read-only, if the key has been
+// replaced by a nested bucket or a value that expires, if the bucket has
+// secondary indexes, or if the value would be too large.
+func (h *ValueHandle) WriteAt(p []byte, off int64) (int, error) {
+	b := h.b
+	if b.tx.db == nil {
+		return 0, errors.ErrTxClosed
+	} else if !b.Writable() {
+		return 0, errors.ErrTxNotWritable
+	} else if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	} else if off+int64(len(p)) > MaxValueSize {
+		return 0, errors.ErrValueTooLarge
+	} else if len(p) == 0 {
+		return 0, nil
+	}
+
+	tree, value, err := h.lookup()
+	if err != nil {
+		return 0, err
+	} else if err := b.checkUnindexed(); err != nil {
+		return 0, err
+	}
+
+	if tree == nil {
+		tree = h.convert(value)
+	}
+	tree.writeChunks(p, off)
+	b.touchVersion(h.key)
+	b.tx.opt.write(b, optimisticWrite{op: opWriteValue, key: h.key, value: p, off: off})
+	b.tx.changes.add(b, Change{Op: ChangeWriteAt, Key: h.key, NewValue: p, Offset: off})
+
+	return len(p), nil
+}
+
+// Append writes p at the end of the value, like WriteAt.
+func (h *ValueHandle) Append(p []byte) (int, error) {
+	return h.WriteAt(p, h.Size())
+}
+
+// checkUnindexed returns ErrIncompatibleValue if the bucket has secondary
+// indexes, which cannot be updated from the range written by a handle.
+func (b *Bucket) checkUnindexed() error {
+	idxs, err := b.loadIndexes()
+	if err != nil {
+		return err
+	} else if len(idxs) > 0 {
+		return errors.ErrIncompatibleValue
+	}
+	return nil
+}
+
+// lookup returns the chunk tree of the value, or the value itself if it is
+// not stored in chunks. Both are nil if the key does not exist anymore.
+func (h *ValueHandle) lookup() (*Bucket, []byte, error) {
+	c := h.b.Cursor()
+	k, v, flags := c.seek(h.key)
+	switch {
+	case !bytes.Equal(h.key, k) || h.b.hidden(k, v, flags):
+		return nil, nil, nil
+	case (flags & (common.BucketLeafFlag | common.ExpiringValueFlag)) != 0:
+		return nil, nil, errors.ErrIncompatibleValue
+	case (flags & common.ChunkedValueFlag) != 0:
+		return h.b.valueTree(k, v), nil, nil
+	}
+	return nil, c.value(v, flags), nil
+}
+
+// convert replaces the value of the key, which is not stored in chunks, by a
+// chunk tree holding it, and returns the tree.
+func (h *ValueHandle) convert(value []byte) *Bucket {
+	b := h.b
+	value = cloneBytes(value)
+
+	c := b.Cursor()
+	k, v, flags := c.seek(h.key)
+	if bytes.Equal(h.key, k) {
+		b.freeValue(k, v, flags)
+	}
+	var empty = Bucket{
+		InBucket:    &common.InBucket{},
+		rootNode:    &node{isLeaf: true},
+		FillPercent: maxFillPercent,
+	}
+	c.node().put(h.key, h.key, empty.write(), 0, common.ChunkedValueFlag)
+
+	k, v, _ = c.seek(h.key)
+	tree := b.valueTree(k, v)
+	tree.writeChunks(value, 0)
+	return tree
+}
+
+// chunkKey returns the key of the chunk of the given index.
+func chunkKey(i int64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, chunkKeySize), uint64(i))
+}
+
+// valueChunkSize returns the size of the chunks of chunked values, four of
+// which fill a leaf page.
+func (db *DB) valueChunkSize() int64 {
+	usable := db.pageSize - int(common.PageHeaderSize) - db.pageOverhead()
+	return int64(usable/4 - int(common.LeafPageElementSize) - chunkKeySize)
+}
+
+// valueTree returns the chunk tree of a chunked value of the bucket from its
+// element. In read-write transactions, trees are opened once, so that their
+// changes are written when the bucket is spilled.
+func (b *Bucket) valueTree(key, v []byte) *Bucket {
+	if tree := b.values[string(key)]; tree != nil {
+		return tree
+	}
+	tree := b.openBucket(v)
+	tree.parent = b
+	tree.name = cloneBytes(key)
+	tree.FillPercent = maxFillPercent
+	if b.tx.writable {
+		if b.values == nil {
+			b.values = make(map[string]*Bucket)
+		}
+		b.values[string(key)] = tree
+	}
+	return tree
+}
+
+// openValueTree returns the chunk tree of the value of a key, or nil if the
+// key is not a chunked value.
+func (b *Bucket) openValueTree(key []byte) *Bucket {
+	k, v, flags := b.Cursor().seek(key)
+	if !bytes.Equal(key, k) || (flags&common.ChunkedValueFlag) == 0 {
+		return nil
+	}
+	return b.valueTree(k, v)
+}
+
+// chunkedValue returns the value of a chunked value of the bucket, assembled
+// into a new slice.
+func (b *Bucket) chunkedValue(key, v []byte) []byte {
+	return b.valueTree(key, v).chunks()
+}
+
+// chunks returns the concatenation of the chunks of a chunk tree.
+func (b *Bucket) chunks() []byte {
+	value := make([]byte, 0, b.InSequence())
+	c := b.Cursor()
+	for k, v, _ := c.first(); k != nil; k, v, _ = c.next() {
+		value = append(value, v...)
+	}
+	return value
+}
+
+// writeChunks writes p at offset off of the value of a chunk tree. Only the
+// chunks overlapping the written range, and the zeros filling the gap before
+// it, are rewritten.
+func (b *Bucket) writeChunks(p []byte, off int64) {
+	chunkSize := b.tx.db.valueChunkSize()
+	size := int64(b.InSequence())
+	end := off + int64(len(p))
+	newSize := max(size, end)
+
+	c := b.Cursor()
+	for i := min(off, size) / chunkSize; i*chunkSize < end; i++ {
+		start := i * chunkSize
+		chunk := make([]byte, min(chunkSize, newSize-start))
+		key := chunkKey(i)
+		if k, v, _ := c.seek(key); bytes.Equal(key, k) {
+			copy(chunk, v)
+		}
+		if lo, hi := max(off, start), min(end, start+int64(len(chunk))); lo < hi {
+			copy(chunk[lo-start:], p[lo-off:hi-off])
+		}
+		c.node().put(key, key, chunk, 0, 0)
+	}
+	b.SetInSequence(uint64(newSize))
+}
+
+// spillValues writes the changed chunk trees of the bucket, and updates
+// their elements.
+func (b *Bucket) spillValues() error {
+	for name, tree := range b.values {
+		// Skip the trees which were only read.
+		if tree.rootNode == nil {
+			continue
+		}
+		value, err := tree.spillTree()
+		if err != nil {
+			return err
+		}
+
+		var c = b.Cursor()
+		k, _, flags := c.seek([]byte(name))
+		if !bytes.Equal([]byte(name), k) {
+			panic(fmt.Sprintf("misplaced chunked value header: %x -> %x", []byte(name), k))
+		}
+		if flags&common.ChunkedValueFlag == 0 {
+			panic(fmt.Sprintf("unexpected chunked value header flag: %x", flags))
+		}
+		c.node().put([]byte(name), []byte(name), value, 0, common.ChunkedValueFlag)
+		delete(b.values, name)
+	}
+	return nil
+}
+
+// freeValue releases the pages of an element value stored outside of its
+// leaf, in a blob or in chunks, if any.
+func (b *Bucket) freeValue(key, v []byte, flags uint32) {
+	if (flags & common.ChunkedValueFlag) == 0 {
+		b.freeBlob(v, flags)
+		return
+	}
+	tree := b.valueTree(key, v)
+	delete(b.values, string(key))
+	tree.nodes = nil
+	tree.rootNode = nil
+	tree.free()
+}
+
+// freeValues releases the pages of the values of the bucket stored outside of
+// its leaves, as it is being deleted. Nested buckets are not visited.
+func (b *Bucket) freeValues() {
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if isStoredBlob(flags) || (flags&common.ChunkedValueFlag) != 0 {
+			b.freeValue(k, v, flags)
+		}
+	}
+}
+
+// forEachValueTree calls fn with the key and the chunk tree of each chunked
+// value of the bucket, in storage order. Nested buckets are not visited.
+func (b *Bucket) forEachValueTree(fn func(key []byte, tree *Bucket)) {
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if (flags & common.ChunkedValueFlag) != 0 {
+			fn(k, b.openBucket(v))
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// appendValue appends p to the value of a key of the widgets bucket through a
+// value handle, and returns the stats of the transaction.
+func appendValue(t testing.TB, db *bolt.DB, key string, p []byte) bolt.TxStats {
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+	require.NoError(t, err)
+	h, err := b.OpenValue([]byte(key))
+	require.NoError(t, err)
+	n, err := h.Append(p)
+	require.NoError(t, err)
+	require.Equal(t, len(p), n)
+	require.NoError(t, tx.Commit())
+	return tx.Stats()
+}
+
+// Ensure that appending to a large value only rewrites the pages of its last
+// chunks.
+func TestValueHandle_Append(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	var expected []byte
+	for i := 0; i < 500; i++ {
+		record := blobValue(i, 500)
+		stats := appendValue(t, db.DB, "log", record)
+		expected = append(expected, record...)
+		if i > 100 {
+			require.LessOrEqual(t, stats.GetPageAlloc(), int64(8*4096), "record %d", i)
+		}
+	}
+	db.MustCheck()
+
+	db.MustClose()
+	db.MustReopen()
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, expected, b.Get([]byte("log")))
+
+		h, err := b.OpenValue([]byte("log"))
+		require.NoError(t, err)
+		require.Equal(t, int64(len(expected)), h.Size())
+		got, err := io.ReadAll(io.NewSectionReader(h, 0, h.Size()))
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+
+		s := b.Stats()
+		require.Equal(t, 1, s.ChunkedValueN)
+		require.Equal(t, len(expected), s.ValueRawBytes)
+		require.Greater(t, s.ChunkedAlloc, len(expected))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that writes at any offset, and reads across chunks, behave like the
+// same operations on a plain slice.
+func TestValueHandle_WriteAt(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	var expected []byte
+	writeAt := func(p []byte, off int64) {
+		if end := off + int64(len(p)); end > int64(len(expected)) {
+			expected = append(expected, make([]byte, end-int64(len(expected)))...)
+		}
+		copy(expected[off:], p)
+	}
+	writes := []struct {
+		seed, n int
+		off     int64
+	}{
+		{0, 100, 0},
+		{1, 3000, 50},
+		{2, 10, 10000},
+		{3, 5000, 2000},
+		{4, 1, 0},
+		{5, 20000, 15000},
+		{6, 999, 8191},
+	}
+	for _, w := range writes {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			h, err := b.OpenValue([]byte("k"))
+			if err != nil {
+				return err
+			}
+			if _, err := h.WriteAt(blobValue(w.seed, w.n), w.off); err != nil {
+				return err
+			}
+			writeAt(blobValue(w.seed, w.n), w.off)
+			require.Equal(t, expected, b.Get([]byte("k")))
+			return nil
+		})
+		require.NoError(t, err)
+		db.MustCheck()
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		h, err := tx.Bucket([]byte("widgets")).OpenValue([]byte("k"))
+		require.NoError(t, err)
+		for _, r := range []struct{ off, n int }{{0, 10}, {990, 2000}, {9000, 1}, {30000, 5000}} {
+			p := make([]byte, r.n)
+			n, err := h.ReadAt(p, int64(r.off))
+			if r.off+r.n > len(expected) {
+				require.ErrorIs(t, err, io.EOF)
+				require.Equal(t, len(expected)-r.off, n)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, r.n, n)
+			}
+			require.Equal(t, expected[r.off:r.off+n], p[:n])
+		}
+		_, err = h.ReadAt(make([]byte, 1), int64(len(expected)))
+		require.ErrorIs(t, err, io.EOF)
+
+		_, err = h.WriteAt([]byte("x"), 0)
+		require.ErrorIs(t, err, berrors.ErrTxNotWritable)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that values stored inline, compressed or in blobs are converted to
+// chunks when written through a handle, and that the pages of chunked values
+// are released when they are overwritten or deleted.
+func TestValueHandle_Convert(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, BlobThreshold: 5000})
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Compression: bolt.FlateCompression})
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("blob"), blobValue(0, 10000)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("compressed"), bytes.Repeat([]byte("a"), 1000)); err != nil {
+			return err
+		}
+		return b.Put([]byte("plain"), []byte("plain"))
+	})
+	require.NoError(t, err)
+	requireBlobStats(t, db.DB, "widgets", 1)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, key := range []string{"blob", "compressed", "plain"} {
+			h, err := b.OpenValue([]byte(key))
+			if err != nil {
+				return err
+			}
+			if _, err := h.Append([]byte("!")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, append(blobValue(0, 10000), '!'), b.Get([]byte("blob")))
+		require.Equal(t, append(bytes.Repeat([]byte("a"), 1000), '!'), b.Get([]byte("compressed")))
+		require.Equal(t, []byte("plain!"), b.Get([]byte("plain")))
+
+		s := b.Stats()
+		require.Equal(t, 0, s.BlobValueN)
+		require.Equal(t, 0, s.CompressedValueN)
+		require.Equal(t, 3, s.ChunkedValueN)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Overwrite, delete with the bucket and with a cursor, and drop the
+	// bucket.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("blob"), []byte("small")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("compressed")); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		c.Seek([]byte("plain"))
+		return c.Delete()
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("small"), b.Get([]byte("blob")))
+		require.Equal(t, 0, b.Stats().ChunkedValueN)
+		return nil
+	})
+	require.NoError(t, err)
+
+	appendValue(t, db.DB, "log", blobValue(1, 50000))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("widgets")) }))
+	db.MustCheck()
+}
+
+// Ensure that OpenValue creates missing keys only in read-write transactions,
+// and only opens plain values.
+func TestBucket_OpenValue_Errors(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket([]byte("bucket")); err != nil {
+			return err
+		}
+		if err := b.PutWithTTL([]byte("ttl"), []byte("v"), time.Hour); err != nil {
+			return err
+		}
+
+		_, err = b.OpenValue([]byte("bucket"))
+		require.ErrorIs(t, err, berrors.ErrIncompatibleValue)
+		_, err = b.OpenValue([]byte("ttl"))
+		require.ErrorIs(t, err, berrors.ErrIncompatibleValue)
+		_, err = b.OpenValue(nil)
+		require.ErrorIs(t, err, berrors.ErrKeyRequired)
+
+		h, err := b.OpenValue([]byte("new"))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), h.Size())
+		require.Equal(t, []byte{}, b.Get([]byte("new")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte("widgets")).OpenValue([]byte("missing"))
+		require.ErrorIs(t, err, berrors.ErrValueNotFound)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that values of buckets with secondary indexes cannot be written
+// through handles, whether the index exists when the handle is opened or is
+// created afterwards.
+func TestValueHandle_Indexed(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, indexOptions)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		h, err := b.OpenValue([]byte("foo"))
+		require.NoError(t, err)
+		_, err = h.WriteAt([]byte("red blue"), 0)
+		require.NoError(t, err)
+
+		require.NoError(t, b.CreateIndex([]byte("tags"), "tags"))
+		_, err = h.Append([]byte(" green"))
+		require.ErrorIs(t, err, berrors.ErrIncompatibleValue)
+		_, err = b.OpenValue([]byte("foo"))
+		require.ErrorIs(t, err, berrors.ErrIncompatibleValue)
+		require.Equal(t, []byte("red blue"), b.Get([]byte("foo")))
+		require.Equal(t, []string{"blue=foo", "red=foo"}, indexEntries(t, b, "tags"))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Reading through a handle is still allowed.
+	err = db.View(func(tx *bolt.Tx) error {
+		h, err := tx.Bucket([]byte("widgets")).OpenValue([]byte("foo"))
+		require.NoError(t, err)
+		require.Equal(t, int64(8), h.Size())
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a write through a handle is delivered to subscribers as the
+// range written, rather than as the whole value.
+func TestValueHandle_Subscribe(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	appendValue(t, db.DB, "foo", bytes.Repeat([]byte("a"), 10000))
+
+	s, err := db.Subscribe(nil, 0, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		h, err := tx.Bucket([]byte("widgets")).OpenValue([]byte("foo"))
+		require.NoError(t, err)
+		p := []byte("bc")
+		_, err = h.WriteAt(p, 5000)
+		require.NoError(t, err)
+		p[0] = 'x'
+		_, err = h.Append([]byte("d"))
+		return err
+	})
+	require.NoError(t, err)
+
+	widgets := [][]byte{[]byte("widgets")}
+	cs := <-s.C()
+	require.Equal(t, []bolt.Change{
+		{Op: bolt.ChangeWriteAt, Bucket: widgets, Key: []byte("foo"), NewValue: []byte("bc"), Offset: 5000},
+		{Op: bolt.ChangeWriteAt, Bucket: widgets, Key: []byte("foo"), NewValue: []byte("d"), Offset: 10000},
+	}, cs.Changes)
+	require.Equal(t, "write-at", cs.Changes[0].Op.String())
+}
+
+// Ensure that the writes through value handles of the transactions which do
+// not hold the writer lock are made on commit.
+func TestValueHandle_ConcurrentWriters(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	for _, name := range []string{"a", "b"} {
+		err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte(name))
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	write := func(tx *bolt.Tx, name string) error {
+		b := tx.Bucket([]byte(name))
+		h, err := b.OpenValue([]byte("log"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := h.Append(blobValue(i, 1000)); err != nil {
+				return err
+			}
+		}
+		if _, err := h.WriteAt([]byte("head"), 0); err != nil {
+			return err
+		}
+		require.Equal(t, int64(10000), h.Size())
+		return nil
+	}
+	require.NoError(t, db.OptimisticUpdate(func(tx *bolt.Tx) error { return write(tx, "a") }))
+	require.NoError(t, db.UpdateBuckets([][]byte{[]byte("b")}, func(tx *bolt.Tx) error { return write(tx, "b") }))
+	db.MustCheck()
+
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		expected = append(expected, blobValue(i, 1000)...)
+	}
+	copy(expected, "head")
+	for _, name := range []string{"a", "b"} {
+		err := db.View(func(tx *bolt.Tx) error {
+			require.Equal(t, expected, tx.Bucket([]byte(name)).Get([]byte("log")))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// Ensure that compacting a database, in place or not, and snapshots keep the
+// chunked values.
+func TestCompact_ChunkedValue(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	for i := 0; i < 100; i++ {
+		appendValue(t, db.DB, fmt.Sprintf("%04d", i), blobValue(i, 20000))
+	}
+	appendValue(t, db.DB, "log", blobValue(0, 20000))
+	require.NoError(t, db.CreateSnapshot("v1"))
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 100; i++ {
+			if i%10 != 0 {
+				if err := b.Delete([]byte(fmt.Sprintf("%04d", i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	appendValue(t, db.DB, "log", blobValue(1, 100))
+	db.MustCheck()
+
+	verify := func(db *bolt.DB) {
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 100; i += 10 {
+				require.Equal(t, blobValue(i, 20000), b.Get([]byte(fmt.Sprintf("%04d", i))))
+			}
+			require.Equal(t, append(blobValue(0, 20000), blobValue(1, 100)...), b.Get([]byte("log")))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	dst := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	require.NoError(t, bolt.Compact(dst.DB, db.DB, 0))
+	verify(dst.DB)
+	dst.MustCheck()
+
+	tx, err := db.OpenSnapshot("v1")
+	require.NoError(t, err)
+	require.Equal(t, blobValue(5, 20000), tx.Bucket([]byte("widgets")).Get([]byte("0005")))
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, db.DropSnapshot("v1"))
+
+	fi, err := os.Stat(db.Path())
+	require.NoError(t, err)
+	shrunk, err := db.CompactInPlace(nil)
+	require.NoError(t, err)
+	require.Greater(t, shrunk, fi.Size()/2)
+	verify(db.DB)
+	db.MustCheck()
+}
@@ -0,0 +1,202 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"time"
+
+	"go.etcd.io/bbolt/internal/common"
+)
+
+// historyKey is the name of the nested bucket holding the versions of the
+// keys of a versioned bucket. It is hidden from the cursors of the bucket.
+//
+// The history holds an entry for each retained version of each key, current
+// or not: the big-endian size of the key in 2 bytes, the key, and the
+// big-endian id of the transaction which committed the version in 8 bytes.
+// The entries of a key share the same prefix, which no other key has, and
+// sort from the oldest to the newest. The value of an entry is the
+// big-endian commit time in Unix nanoseconds, versionValue or versionDeleted,
+// and the value of the key if it was not deleted.
+const historyKey = "\x00bbolt-history"
+
+// Kinds of the entries of a history.
+const (
+	versionValue   = 0
+	versionDeleted = 1
+)
+
+// versionTimeSize is the size of the commit time starting the value of an
+// entry of a history.
+const versionTimeSize = 8
+
+// versionKeyOverhead is the size of an entry key of a history in excess of
+// the size of its key.
+const versionKeyOverhead = 2 + 8
+
+// Version is a version of the value of a key of a versioned bucket.
+type Version struct {
+	// Txid is the id of the transaction which committed the version.
+	Txid int
+
+	// Time is the time the transaction which committed the version started
+	// at.
+	Time time.Time
+
+	// Deleted is set if the transaction deleted the key, in which case Value
+	// is nil.
+	Deleted bool
+
+	// Value is the value of the key. It is only valid for the life of the
+	// transaction, and must never be modified.
+	Value []byte
+}
+
+// versionEntry is an entry of a history.
+type versionEntry struct {
+	key []byte // key of the entry
+	Version
+}
+
+// versionPrefix returns the prefix of the entry keys of the versions of a key.
+func versionPrefix(key []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(make([]byte, 0, len(key)+versionKeyOverhead), uint16(len(key))), key...)
+}
+
+// versioned reports whether the bucket retains the previous versions of its
+// keys.
+func (b *Bucket) versioned() bool {
+	return b.opts.MaxVersions != 0 || b.opts.VersionRetention != 0
+}
+
+// touchVersion records that a key of a versioned bucket was written, so that
+// its new version is added to the history on commit. It does nothing if the
+// bucket is not versioned.
+func (b *Bucket) touchVersion(key []byte) {
+	if !b.versioned() {
+		return
+	}
+	if b.written == nil {
+		b.written = make(map[string]struct{})
+	}
+	b.written[string(key)] = struct{}{}
+}
+
+// GetAt returns the value a key had once the transaction of the given id was
+// committed, or nil if the key did not exist then, or if that version of the
+// key is not retained anymore. It returns the current value for the id of
+// the transaction, or later ones, and nil if the bucket is not versioned.
+// The returned value is only valid for the life of the transaction.
+func (b *Bucket) GetAt(key []byte, txid int) []byte {
+	if txid >= b.tx.ID() {
+		return b.Get(key)
+	}
+	for _, v := range b.History(key) {
+		if v.Txid <= txid {
+			return v.Value
+		}
+	}
+	return nil
+}
+
+// History returns the retained versions of a key of a versioned bucket, from
+// the newest to the oldest, or nil if the bucket is not versioned. The
+// versions written by the transaction itself are only added on commit.
+//
+// On commit, the history of each key written to keeps its current version,
+// and the previous versions allowed by BucketOptions.MaxVersions and
+// BucketOptions.VersionRetention. The versions no longer retained by the
+// latter are left out until the key is written again.
+func (b *Bucket) History(key []byte) []Version {
+	b.tx.opt.read(b, key)
+	history := b.internalBucket(historyKey, false, common.BucketOptions{})
+	if history == nil || !b.versioned() {
+		return nil
+	}
+	entries, n := b.versions(history, key, b.tx.now())
+	var versions []Version
+	for _, e := range entries[:n] {
+		versions = append(versions, e.Version)
+	}
+	return versions
+}
+
+// versions returns the entries of the history of a key, from the newest to
+// the oldest, along with the number of them retained at the given time in
+// Unix nanoseconds.
+func (b *Bucket) versions(history *Bucket, key []byte, now int64) ([]versionEntry, int) {
+	prefix := versionPrefix(key)
+	var entries []versionEntry
+	c := history.Cursor()
+	for k, v, _ := c.seekNext(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v, _ = c.next() {
+		e := versionEntry{key: k}
+		e.Txid = int(binary.BigEndian.Uint64(k[len(prefix):]))
+		e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		if v[versionTimeSize] == versionDeleted {
+			e.Deleted = true
+		} else {
+			e.Value = v[versionTimeSize+1:]
+		}
+		entries = append(entries, e)
+	}
+	slices.Reverse(entries)
+
+	// A previous version is retained as long as the one which superseded it
+	// was written within the retention window.
+	n := len(entries)
+	for i := 1; i < len(entries); i++ {
+		if (b.opts.MaxVersions != 0 && i > int(b.opts.MaxVersions)) ||
+			(b.opts.VersionRetention != 0 && entries[i-1].Time.UnixNano() < now-b.opts.VersionRetention) {
+			n = i
+			break
+		}
+	}
+
+	// The oldest versions deleting the key tell nothing once there is no
+	// older version.
+	for n > 0 && entries[n-1].Deleted {
+		n--
+	}
+	return entries, n
+}
+
+// commitVersions adds the versions of the keys written by the transaction
+// to the histories of the bucket and its opened nested buckets, and prunes
+// the versions of these keys no longer retained.
+func (b *Bucket) commitVersions() {
+	for _, child := range b.buckets {
+		child.commitVersions()
+	}
+	if len(b.written) == 0 {
+		return
+	}
+
+	now := b.tx.now()
+	history := b.internalBucket(historyKey, true, common.BucketOptions{})
+	hc := history.Cursor()
+	for name := range b.written {
+		key := []byte(name)
+
+		// Add the current version.
+		entry := binary.BigEndian.AppendUint64(nil, uint64(now))
+		c := b.Cursor()
+		if k, v, flags := c.seek(key); bytes.Equal(key, k) && (flags&common.BucketLeafFlag) == 0 {
+			entry = append(append(entry, versionValue), c.value(v, flags)...)
+		} else {
+			entry = append(entry, versionDeleted)
+		}
+		ek := binary.BigEndian.AppendUint64(versionPrefix(key), uint64(b.tx.ID()))
+		hc.seek(ek)
+		hc.node().put(ek, ek, entry, 0, 0)
+
+		// Prune the versions no longer retained.
+		entries, n := b.versions(history, key, now)
+		for _, e := range entries[n:] {
+			ek := cloneBytes(e.key)
+			hc.seek(ek)
+			hc.node().del(ek)
+		}
+	}
+	b.written = nil
+}
@@ -0,0 +1,288 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+	"go.etcd.io/bbolt/internal/btesting"
+)
+
+// updateVersioned runs fn on the widgets bucket, created with the given
+// options if needed, and returns the id of the transaction.
+func updateVersioned(t testing.TB, db *bolt.DB, opts bolt.BucketOptions, fn func(b *bolt.Bucket) error) int {
+	var txid int
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			var err error
+			if b, err = tx.CreateBucketWithOptions([]byte("widgets"), opts); err != nil {
+				return err
+			}
+		}
+		txid = tx.ID()
+		return fn(b)
+	})
+	require.NoError(t, err)
+	return txid
+}
+
+// history returns the txids and values of the versions of a key of the
+// widgets bucket, with nil values for deletions.
+func history(t testing.TB, db *bolt.DB, key string) ([]int, [][]byte) {
+	var txids []int
+	var values [][]byte
+	err := db.View(func(tx *bolt.Tx) error {
+		for _, v := range tx.Bucket([]byte("widgets")).History([]byte(key)) {
+			require.Equal(t, v.Deleted, v.Value == nil)
+			txids = append(txids, v.Txid)
+			values = append(values, bytes.Clone(v.Value))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return txids, values
+}
+
+// Ensure that the history of a bucket with a comparator is not passed to the
+// comparator, which only accepts 8-byte keys.
+func TestBucket_History_Comparator(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, comparatorOptions())
+	opts := bolt.BucketOptions{Comparator: "uint64-desc", MaxVersions: 2}
+	const n = 500
+	var txids []int
+	for round := 0; round < 3; round++ {
+		txids = append(txids, updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+			for i := uint64(0); i < n; i++ {
+				if err := b.Put(u64(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	db.MustCheck()
+
+	got, values := history(t, db.DB, string(u64(42)))
+	require.Equal(t, []int{txids[2], txids[1], txids[0]}, got)
+	require.Equal(t, []byte("v42"), values[0])
+	err := db.View(func(tx *bolt.Tx) error {
+		assertDescending(t, tx.Bucket([]byte("widgets")), n)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a bucket with MaxVersions keeps that many previous versions of
+// its keys, tagged with the id of the transaction which committed them.
+func TestBucket_History_MaxVersions(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	opts := bolt.BucketOptions{MaxVersions: 2}
+	put := func(v string) int {
+		return updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+			return b.Put([]byte("k"), []byte(v))
+		})
+	}
+
+	var txids []int
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		txids = append(txids, put(v))
+	}
+
+	// Only the last write of a transaction makes a version.
+	txids = append(txids, updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+		require.NoError(t, b.Put([]byte("k"), []byte("tmp")))
+		require.Empty(t, b.History([]byte("other")))
+		return b.Put([]byte("k"), []byte("v5"))
+	}))
+	db.MustCheck()
+
+	gotTxids, values := history(t, db.DB, "k")
+	require.Equal(t, []int{txids[4], txids[3], txids[2]}, gotTxids)
+	require.Equal(t, [][]byte{[]byte("v5"), []byte("v4"), []byte("v3")}, values)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("v5"), b.GetAt([]byte("k"), tx.ID()))
+		require.Equal(t, []byte("v4"), b.GetAt([]byte("k"), txids[3]))
+		require.Equal(t, []byte("v3"), b.GetAt([]byte("k"), txids[2]))
+		require.Nil(t, b.GetAt([]byte("k"), txids[1]))
+		require.Nil(t, b.GetAt([]byte("k"), txids[0]-1))
+
+		// The history is hidden.
+		n := 0
+		require.NoError(t, b.ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}))
+		require.Equal(t, 1, n)
+		require.Equal(t, 2, b.Options().MaxVersions)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Deleting makes a version, which is dropped once it is the oldest one.
+	deleted := updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+		return b.Delete([]byte("k"))
+	})
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Nil(t, b.GetAt([]byte("k"), deleted))
+		require.Equal(t, []byte("v5"), b.GetAt([]byte("k"), deleted-1))
+		return nil
+	})
+	require.NoError(t, err)
+	put("v6")
+	put("v7")
+	gotTxids, values = history(t, db.DB, "k")
+	require.Len(t, gotTxids, 2)
+	require.Equal(t, [][]byte{[]byte("v7"), []byte("v6")}, values)
+
+	db.MustClose()
+	db.MustReopen()
+	_, values = history(t, db.DB, "k")
+	require.Equal(t, [][]byte{[]byte("v7"), []byte("v6")}, values)
+	db.MustCheck()
+}
+
+// Ensure that the history of a key is found, and pruned, when the histories
+// of the keys before it fill the leaves it starts on.
+func TestBucket_History_SplitLeaves(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	opts := bolt.BucketOptions{MaxVersions: 2}
+	value := func(key string, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s%d", key, round)), 500)
+	}
+	var txids []int
+	for round := 0; round < 4; round++ {
+		txids = append(txids, updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+			for _, k := range []string{"a", "b", "c"} {
+				if err := b.Put([]byte(k), value(k, round)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	db.MustCheck()
+
+	for _, k := range []string{"a", "b", "c"} {
+		gotTxids, values := history(t, db.DB, k)
+		require.Equal(t, []int{txids[3], txids[2], txids[1]}, gotTxids, k)
+		require.Equal(t, [][]byte{value(k, 3), value(k, 2), value(k, 1)}, values, k)
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, k := range []string{"a", "b", "c"} {
+			require.Equal(t, value(k, 1), b.GetAt([]byte(k), txids[1]), k)
+			require.Nil(t, b.GetAt([]byte(k), txids[0]), k)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a bucket with VersionRetention keeps the previous versions of
+// its keys which were current within the retention window.
+func TestBucket_History_VersionRetention(t *testing.T) {
+	const retention = 300 * time.Millisecond
+	db := btesting.MustCreateDB(t)
+	opts := bolt.BucketOptions{VersionRetention: retention}
+	put := func(key, v string) int {
+		return updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+			return b.Put([]byte(key), []byte(v))
+		})
+	}
+	put("a", "a1")
+	put("b", "b1")
+	put("a", "a2")
+	put("b", "b2")
+	_, values := history(t, db.DB, "a")
+	require.Equal(t, [][]byte{[]byte("a2"), []byte("a1")}, values)
+
+	// The expired versions are left out, then pruned when the key is written.
+	time.Sleep(retention + 100*time.Millisecond)
+	_, values = history(t, db.DB, "a")
+	require.Equal(t, [][]byte{[]byte("a2")}, values)
+	keyN := func() int {
+		var n int
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte("widgets")).Stats().KeyN
+			return nil
+		}))
+		return n
+	}
+	before := keyN()
+	put("a", "a3")
+	require.Equal(t, before, keyN())
+	_, values = history(t, db.DB, "a")
+	require.Equal(t, [][]byte{[]byte("a3"), []byte("a2")}, values)
+	_, values = history(t, db.DB, "b")
+	require.Equal(t, [][]byte{[]byte("b2")}, values)
+	db.MustCheck()
+}
+
+// Ensure that the versions are recorded for all the ways of writing a key,
+// including by the transactions which do not hold the writer lock, and that
+// the history is released with its bucket.
+func TestBucket_History_Writers(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	opts := bolt.BucketOptions{MaxVersions: 10}
+	updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+		if err := b.Put([]byte("cursor"), []byte("v")); err != nil {
+			return err
+		}
+		return b.Put([]byte("handle"), []byte("v"))
+	})
+	updateVersioned(t, db.DB, opts, func(b *bolt.Bucket) error {
+		c := b.Cursor()
+		c.Seek([]byte("cursor"))
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		h, err := b.OpenValue([]byte("handle"))
+		if err != nil {
+			return err
+		}
+		_, err = h.Append([]byte("+"))
+		return err
+	})
+	_, values := history(t, db.DB, "cursor")
+	require.Equal(t, [][]byte{nil, []byte("v")}, values)
+	_, values = history(t, db.DB, "handle")
+	require.Equal(t, [][]byte{[]byte("v+"), []byte("v")}, values)
+
+	var optTxid, scopedTxid int
+	require.NoError(t, db.OptimisticUpdate(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("opt"), []byte("v"))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		optTxid = tx.ID()
+		return nil
+	}))
+	require.NoError(t, db.UpdateBuckets([][]byte{[]byte("widgets")}, func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("scoped"), []byte("v"))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		scopedTxid = tx.ID()
+		return nil
+	}))
+	txids, _ := history(t, db.DB, "opt")
+	require.Equal(t, []int{optTxid}, txids)
+	txids, _ = history(t, db.DB, "scoped")
+	require.Equal(t, []int{scopedTxid}, txids)
+	db.MustCheck()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte("widgets")).Put(make([]byte, bolt.MaxKeySize), []byte("v"))
+		require.ErrorIs(t, err, berrors.ErrKeyTooLarge)
+		return tx.DeleteBucket([]byte("widgets"))
+	})
+	require.NoError(t, err)
+	db.MustCheck()
+}
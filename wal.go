@@ -0,0 +1,518 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+
+	"go.etcd.io/bbolt/internal/common"
+)
+
+const (
+	// DefaultWALCheckpointInterval is the interval between two checkpoints
+	// when Options.WALCheckpointInterval is not set.
+	DefaultWALCheckpointInterval = time.Second
+
+	// DefaultWALCheckpointSize is the size of the write-ahead log above which
+	// a checkpoint is started when Options.WALCheckpointSize is not set.
+	DefaultWALCheckpointSize = 16 * 1024 * 1024
+)
+
+// walSuffix is appended to the path of a database to name its write-ahead log.
+const walSuffix = "-wal"
+
+const (
+	walMagic            uint32 = 0x57414C31
+	walRecordHeaderSize        = 32
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is the write-ahead log of a database opened in WAL mode.
+//
+// Every commit appends one record to the log, holding the dirty pages of the
+// transaction as they would be written to the data file, followed by its meta
+// page. The pages stay in memory until a checkpoint writes them to the data
+// file and truncates the log.
+//
+// A record starts with a header made of the magic number, the number of pages,
+// the size of the body, the transaction id and the CRC-32C of the body. The
+// body is a sequence of page id, page length and page content, followed by the
+// meta page. A record whose header or checksum is invalid ends the log.
+type wal struct {
+	file     *os.File // nil when the log is only read
+	size     int64    // offset of the next record
+	pageSize int
+
+	mu     sync.RWMutex
+	pages  map[common.Pgid][]byte      // latest version of the pages not checkpointed yet
+	within map[common.Pgid]common.Pgid // first page of the runs holding overflow pages
+	metas  [][]byte                    // meta pages of the last two records not checkpointed yet
+	meta   *common.Meta                // meta of the last record
+
+	staged []walPage // pages written by the current transaction
+
+	stop chan struct{}
+	full chan struct{}
+}
+
+type walPage struct {
+	id  common.Pgid
+	buf []byte
+}
+
+func newWAL(f *os.File, pageSize int) *wal {
+	return &wal{
+		file:     f,
+		pageSize: pageSize,
+		pages:    make(map[common.Pgid][]byte),
+		within:   make(map[common.Pgid]common.Pgid),
+		stop:     make(chan struct{}),
+		full:     make(chan struct{}, 1),
+	}
+}
+
+// load reads the records of the log into memory. It stops at the first
+// invalid record, which is the tail of a commit interrupted by a crash.
+func (w *wal) load(f *os.File) error {
+	pageSize := w.pageSize
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("read write-ahead log: %w", err)
+	}
+
+	var off int
+	for off+walRecordHeaderSize <= len(data) {
+		hdr := data[off : off+walRecordHeaderSize]
+		if binary.LittleEndian.Uint32(hdr[0:4]) != walMagic {
+			break
+		}
+		count := int(binary.LittleEndian.Uint32(hdr[4:8]))
+		size := binary.LittleEndian.Uint64(hdr[8:16])
+		if size < uint64(pageSize) || size > uint64(len(data)-off-walRecordHeaderSize) {
+			break
+		}
+		body := data[off+walRecordHeaderSize : off+walRecordHeaderSize+int(size)]
+		if crc32.Checksum(body, walCRCTable) != binary.LittleEndian.Uint32(hdr[24:28]) {
+			break
+		}
+
+		pages, metaBuf, ok := parseWALRecord(body, count, pageSize)
+		if !ok {
+			break
+		}
+		m := (*common.Page)(unsafe.Pointer(&metaBuf[0])).Meta()
+		if m.Validate() != nil || uint64(m.Txid()) != binary.LittleEndian.Uint64(hdr[16:24]) {
+			break
+		}
+		for _, p := range pages {
+			w.put(p.id, p.buf)
+		}
+		w.publishMeta(metaBuf)
+		off += walRecordHeaderSize + int(size)
+	}
+	w.size = int64(off)
+	return nil
+}
+
+// parseWALRecord splits the body of a record into its pages and meta page.
+func parseWALRecord(body []byte, count int, pageSize int) ([]walPage, []byte, bool) {
+	pages := make([]walPage, 0, count)
+	for i := 0; i < count; i++ {
+		if len(body) < 16 {
+			return nil, nil, false
+		}
+		id := common.Pgid(binary.LittleEndian.Uint64(body[0:8]))
+		n := binary.LittleEndian.Uint64(body[8:16])
+		body = body[16:]
+		if n == 0 || n%uint64(pageSize) != 0 || n > uint64(len(body)) || id <= 1 {
+			return nil, nil, false
+		}
+		pages = append(pages, walPage{id: id, buf: body[:n:n]})
+		body = body[n:]
+	}
+	if len(body) != pageSize {
+		return nil, nil, false
+	}
+	return pages, body, true
+}
+
+// empty returns true if the log holds no transaction.
+func (w *wal) empty() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.meta == nil
+}
+
+// page returns the latest version of a page committed to the log, or nil if
+// the page is not in the log.
+func (w *wal) page(id common.Pgid) []byte {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.pages[id]
+}
+
+// lastMeta returns the meta of the last transaction committed to the log, or
+// nil if the log is empty.
+func (w *wal) lastMeta() *common.Meta {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.meta
+}
+
+// begin starts the record of a transaction, dropping the pages staged by a
+// transaction that failed to commit.
+func (w *wal) begin() {
+	w.staged = w.staged[:0]
+}
+
+// stage adds a page, in the form written to the data file, to the record of
+// the current transaction. The page is visible to transactions reading it
+// right away, which is safe as it is only reachable from the new meta.
+func (w *wal) stage(id common.Pgid, buf []byte) {
+	buf = append([]byte(nil), buf...)
+	w.staged = append(w.staged, walPage{id: id, buf: buf})
+
+	w.mu.Lock()
+	w.put(id, buf)
+	w.mu.Unlock()
+}
+
+// put makes buf the latest version of the run of pages starting at id. The
+// runs it overlaps are dropped: they have been freed as a whole before any of
+// their pages could be reallocated, so no transaction reads them anymore, and
+// they would otherwise be checkpointed over the new run. The caller must hold
+// w.mu.
+func (w *wal) put(id common.Pgid, buf []byte) {
+	n := common.Pgid(len(buf) / w.pageSize)
+	for i := id; i < id+n; i++ {
+		if start, ok := w.within[i]; ok {
+			w.drop(start)
+		}
+		w.drop(i)
+	}
+	w.pages[id] = buf
+	for i := id + 1; i < id+n; i++ {
+		w.within[i] = id
+	}
+}
+
+// drop removes the run of pages starting at id. The caller must hold w.mu.
+func (w *wal) drop(id common.Pgid) {
+	buf, ok := w.pages[id]
+	if !ok {
+		return
+	}
+	delete(w.pages, id)
+	for i := id + 1; i < id+common.Pgid(len(buf)/w.pageSize); i++ {
+		delete(w.within, i)
+	}
+}
+
+// commit appends the record of the current transaction to the log with a
+// single sync, then makes its meta page current. It returns true if the log
+// has grown over the checkpoint size.
+func (w *wal) commit(metaBuf []byte, txid common.Txid, sync bool, checkpointSize int64) (bool, error) {
+	size := len(metaBuf)
+	for _, p := range w.staged {
+		size += 16 + len(p.buf)
+	}
+	rec := make([]byte, walRecordHeaderSize, walRecordHeaderSize+size)
+	for _, p := range w.staged {
+		rec = binary.LittleEndian.AppendUint64(rec, uint64(p.id))
+		rec = binary.LittleEndian.AppendUint64(rec, uint64(len(p.buf)))
+		rec = append(rec, p.buf...)
+	}
+	rec = append(rec, metaBuf...)
+
+	binary.LittleEndian.PutUint32(rec[0:4], walMagic)
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(len(w.staged)))
+	binary.LittleEndian.PutUint64(rec[8:16], uint64(size))
+	binary.LittleEndian.PutUint64(rec[16:24], uint64(txid))
+	binary.LittleEndian.PutUint32(rec[24:28], crc32.Checksum(rec[walRecordHeaderSize:], walCRCTable))
+
+	if _, err := w.file.WriteAt(rec, w.size); err != nil {
+		return false, fmt.Errorf("write-ahead log write: %w", err)
+	}
+	if sync {
+		if err := w.file.Sync(); err != nil {
+			return false, fmt.Errorf("write-ahead log sync: %w", err)
+		}
+	}
+	w.size += int64(len(rec))
+	w.staged = w.staged[:0]
+
+	w.mu.Lock()
+	w.publishMeta(metaBuf)
+	w.mu.Unlock()
+
+	return w.size >= checkpointSize, nil
+}
+
+// publishMeta makes a meta page current. The caller must hold w.mu.
+func (w *wal) publishMeta(buf []byte) {
+	if len(w.metas) == 2 {
+		w.metas = w.metas[1:]
+	}
+	w.metas = append(w.metas, buf)
+	w.meta = (*common.Page)(unsafe.Pointer(&buf[0])).Meta()
+}
+
+// snapshot returns the pages and meta pages not checkpointed yet, sorted by
+// page id and by transaction id respectively.
+func (w *wal) snapshot() ([]walPage, [][]byte) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	pages := make([]walPage, 0, len(w.pages))
+	for id, buf := range w.pages {
+		pages = append(pages, walPage{id: id, buf: buf})
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].id < pages[j].id })
+	return pages, append([][]byte(nil), w.metas...)
+}
+
+// reset drops the pages and meta pages once they are checkpointed.
+func (w *wal) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pages = make(map[common.Pgid][]byte)
+	w.within = make(map[common.Pgid]common.Pgid)
+	w.metas = nil
+	w.meta = nil
+}
+
+// truncate empties the log file.
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("write-ahead log truncate: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("write-ahead log sync: %w", err)
+	}
+	w.size = 0
+	return nil
+}
+
+// openWAL replays the write-ahead log left by a previous process, if any, and
+// opens it for appending if WAL mode is enabled. It is called before the data
+// file is mapped. A read-only database serves the logged transactions from
+// memory without touching the files. The log of a database that has just been
+// created is discarded, as it cannot belong to it.
+func (db *DB) openWAL(mode os.FileMode, options *Options, created bool) error {
+	path := db.path + walSuffix
+	enabled := options.WAL && !db.readOnly && !db.follower
+
+	flag := os.O_RDONLY
+	if !db.readOnly {
+		flag = os.O_RDWR
+	}
+	if enabled {
+		flag |= os.O_CREATE
+	}
+	f, err := db.openFile(path, flag, mode)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("open write-ahead log: %w", err)
+	}
+
+	w := newWAL(f, db.pageSize)
+	if !created {
+		if err := w.load(f); err != nil {
+			_ = f.Close()
+			return err
+		}
+	} else if info, err := f.Stat(); err == nil {
+		w.size = info.Size()
+	}
+
+	switch {
+	case db.readOnly:
+		_ = f.Close()
+		w.file = nil
+		if !w.empty() {
+			db.wal = w
+		}
+		return nil
+	case !w.empty():
+		// Fold the transactions committed before a crash into the data file.
+		db.wal = w
+		if err := db.checkpoint(); err != nil {
+			db.wal = nil
+			_ = f.Close()
+			return fmt.Errorf("replay write-ahead log: %w", err)
+		}
+	}
+
+	if enabled {
+		if w.size != 0 {
+			// Drop the torn tail of the log.
+			if err := w.truncate(); err != nil {
+				_ = f.Close()
+				return err
+			}
+		}
+		db.wal = w
+		db.walCheckpointSize = options.WALCheckpointSize
+		if db.walCheckpointSize <= 0 {
+			db.walCheckpointSize = DefaultWALCheckpointSize
+		}
+		return nil
+	}
+
+	db.wal = nil
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// runCheckpointer checkpoints the write-ahead log at the given interval, or
+// as soon as it has grown over the checkpoint size, until it is closed.
+func (db *DB) runCheckpointer(w *wal, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultWALCheckpointInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case <-w.full:
+		}
+
+		db.rwlock.Lock()
+		if db.wal == w {
+			if err := db.checkpoint(); err != nil {
+				db.Logger().Errorf("checkpointing write-ahead log of bbolt db (%s) failed: %v", db.path, err)
+			}
+		}
+		db.rwlock.Unlock()
+	}
+}
+
+// Checkpoint writes the transactions committed to the write-ahead log to the
+// data file and truncates the log. It is done periodically in the background,
+// and when the database is closed. It is a no-op if WAL mode is not enabled.
+func (db *DB) Checkpoint() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.wal == nil || db.wal.file == nil {
+		return nil
+	}
+	return db.checkpoint()
+}
+
+// checkpoint writes the pages of the write-ahead log and the last two meta
+// pages to the data file, then truncates the log. The caller must hold the
+// writer lock.
+//
+// Pages are written and synced before the meta pages, as when committing a
+// transaction, so that a crash leaves either meta page valid. The previous
+// meta page is written along with the last one, since the slot it belongs to
+// may still hold a meta page older than the log. A crash before the log is
+// truncated replays the same records on the next Open.
+func (db *DB) checkpoint() error {
+	pages, metas := db.wal.snapshot()
+	if len(metas) == 0 {
+		return nil
+	}
+
+	for _, p := range pages {
+		if _, err := db.ops.writeAt(p.buf, int64(p.id)*int64(db.pageSize)); err != nil {
+			return fmt.Errorf("checkpoint page %d: %w", p.id, err)
+		}
+	}
+	if err := fdatasync(db); err != nil {
+		return fmt.Errorf("checkpoint sync: %w", err)
+	}
+	for _, buf := range metas {
+		id := (*common.Page)(unsafe.Pointer(&buf[0])).Id()
+		if _, err := db.ops.writeAt(buf, int64(id)*int64(db.pageSize)); err != nil {
+			return fmt.Errorf("checkpoint meta page %d: %w", id, err)
+		}
+	}
+	if err := fdatasync(db); err != nil {
+		return fmt.Errorf("checkpoint sync: %w", err)
+	}
+
+	// The data file now holds the same pages as the log.
+	db.wal.reset()
+	return db.wal.truncate()
+}
+
+// closeWAL stops the checkpointer, checkpoints the write-ahead log and removes
+// it. The caller must hold the writer lock.
+func (db *DB) closeWAL() error {
+	w := db.wal
+	close(w.stop)
+
+	var err error
+	if w.file != nil {
+		err = db.checkpoint()
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Remove(db.path + walSuffix)
+		}
+	}
+	db.wal = nil
+	return err
+}
+
+// writeWALPagesTo copies the data pages seen by the transaction to w, taking
+// the pages not checkpointed yet from the write-ahead log and the other ones
+// from f.
+func (tx *Tx) writeWALPagesTo(w io.Writer, f io.ReaderAt) (int64, error) {
+	pageSize := int64(tx.db.pageSize)
+	hwm := int64(tx.meta.Pgid())
+	pages, _ := tx.db.wal.snapshot()
+
+	var n int64
+	copyFile := func(from, to int64) error {
+		if to <= from {
+			return nil
+		}
+		wn, err := io.Copy(w, io.NewSectionReader(f, from*pageSize, (to-from)*pageSize))
+		n += wn
+		return err
+	}
+
+	pos := int64(2)
+	for _, p := range pages {
+		id := int64(p.id)
+		if id >= hwm {
+			break
+		} else if id < pos {
+			continue
+		}
+		if err := copyFile(pos, id); err != nil {
+			return n, err
+		}
+		buf := p.buf
+		if max := (hwm - id) * pageSize; int64(len(buf)) > max {
+			buf = buf[:max]
+		}
+		nn, err := w.Write(buf)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+		pos = id + int64(len(buf))/pageSize
+	}
+	if err := copyFile(pos, hwm); err != nil {
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,153 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// walOptions returns options that enable WAL mode without background
+// checkpoints during the test.
+func walOptions() *bolt.Options {
+	return &bolt.Options{PageSize: 4096, WAL: true, WALCheckpointInterval: time.Hour}
+}
+
+// Ensure that the transactions committed in WAL mode are visible before and
+// after a checkpoint, and that closing the database removes the log.
+func TestDB_WAL(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%t", encrypted), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			opts := walOptions()
+			opts.PageChecksums = true
+			if encrypted {
+				opts.Cipher = mustCipher(t, "0123456789abcdef")
+			}
+			db, err := bolt.Open(path, 0600, opts)
+			require.NoError(t, err)
+
+			fillEncrypted(t, db)
+			verifyEncrypted(t, db)
+			info, err := os.Stat(path + "-wal")
+			require.NoError(t, err)
+			require.NotZero(t, info.Size())
+
+			require.NoError(t, db.Checkpoint())
+			info, err = os.Stat(path + "-wal")
+			require.NoError(t, err)
+			require.Zero(t, info.Size())
+			verifyEncrypted(t, db)
+
+			// Commit after the checkpoint, so that closing checkpoints again.
+			err = db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("after"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("after"), secret)
+			})
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+			_, err = os.Stat(path + "-wal")
+			require.ErrorIs(t, err, os.ErrNotExist)
+
+			db, err = bolt.Open(path, 0600, &bolt.Options{Cipher: opts.Cipher})
+			require.NoError(t, err)
+			defer db.Close()
+			verifyEncrypted(t, db)
+			err = db.View(func(tx *bolt.Tx) error {
+				require.Equal(t, secret, tx.Bucket([]byte("after")).Get([]byte("after")))
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+// Ensure that the log left by a crash is replayed by Open, in read-only mode
+// and with WAL mode disabled, and that its torn tail is ignored.
+func TestDB_WAL_Replay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	db, err := bolt.Open(path, 0600, walOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	fillEncrypted(t, db)
+
+	// Simulate a crash by copying the files while the database is open.
+	crashed := filepath.Join(dir, "crashed")
+	require.NoError(t, copyFile(path, crashed))
+	require.NoError(t, copyFile(path+"-wal", crashed+"-wal"))
+	f, err := os.OpenFile(crashed+"-wal", os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("torn record"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// A read-only database serves the log from memory.
+	ro, err := bolt.Open(crashed, 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	verifyEncrypted(t, ro)
+	require.NoError(t, ro.Close())
+	_, err = os.Stat(crashed + "-wal")
+	require.NoError(t, err)
+
+	rw, err := bolt.Open(crashed, 0600, nil)
+	require.NoError(t, err)
+	verifyEncrypted(t, rw)
+	_, err = os.Stat(crashed + "-wal")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, rw.Close())
+}
+
+// Ensure that a backup taken in WAL mode includes the pages that are not
+// checkpointed yet.
+func TestDB_WAL_CopyFile(t *testing.T) {
+	dir := t.TempDir()
+	db, err := bolt.Open(filepath.Join(dir, "db"), 0600, walOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	fillEncrypted(t, db)
+
+	backup := filepath.Join(dir, "backup")
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backup, 0600)
+	})
+	require.NoError(t, err)
+
+	bdb, err := bolt.Open(backup, 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer bdb.Close()
+	verifyEncrypted(t, bdb)
+}
+
+// Ensure that the background checkpointer folds the log into the data file
+// once it has grown over the checkpoint size.
+func TestDB_WAL_CheckpointSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	opts := walOptions()
+	opts.WALCheckpointSize = 1
+	db, err := bolt.Open(path, 0600, opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		info, err := os.Stat(path + "-wal")
+		return err == nil && info.Size() == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}